@@ -8,7 +8,9 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/keybase/kbfs/fsrpc"
 	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
 )
 
 const (
@@ -29,3 +31,22 @@ func byteCountStr(n int) string {
 func printError(prefix string, err error) {
 	fmt.Fprintf(os.Stderr, "%s: %s\n", prefix, err)
 }
+
+// getTlfFolderBranch returns the folder-branch of the top-level folder
+// with the given path.
+func getTlfFolderBranch(ctx context.Context, config libkbfs.Config,
+	tlfPathStr string) (libkbfs.FolderBranch, error) {
+	p, err := fsrpc.NewPath(tlfPathStr)
+	if err != nil {
+		return libkbfs.FolderBranch{}, err
+	}
+	if p.PathType != fsrpc.TLFPathType {
+		return libkbfs.FolderBranch{}, fmt.Errorf("%s is not a folder", p)
+	}
+
+	n, _, err := p.GetNode(ctx, config)
+	if err != nil {
+		return libkbfs.FolderBranch{}, err
+	}
+	return n.GetFolderBranch(), nil
+}
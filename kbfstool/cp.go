@@ -0,0 +1,109 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+func cpHelper(ctx context.Context, config libkbfs.Config, args []string) (err error) {
+	flags := flag.NewFlagSet("kbfs cp", flag.ContinueOnError)
+	verbose := flags.Bool("v", false, "Print extra status output.")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		return errExactlyTwoPaths
+	}
+
+	srcPathStr := flags.Arg(0)
+	dstPathStr := flags.Arg(1)
+
+	defer func() {
+		if err != nil {
+			if _, ok := err.(cannotWriteErr); !ok {
+				err = cannotWriteErr{dstPathStr, err}
+			}
+		}
+	}()
+
+	srcP, err := fsrpc.NewPath(srcPathStr)
+	if err != nil {
+		return err
+	}
+	if srcP.PathType != fsrpc.TLFPathType {
+		return fmt.Errorf("Cannot copy %s", srcP)
+	}
+
+	dstP, err := fsrpc.NewPath(dstPathStr)
+	if err != nil {
+		return err
+	}
+	if dstP.PathType != fsrpc.TLFPathType {
+		return cannotWriteErr{dstPathStr, nil}
+	}
+
+	if *verbose {
+		fmt.Fprintf(os.Stderr, "Looking up %s\n", srcP)
+	}
+
+	srcNode, err := srcP.GetFileNode(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	// If the destination is an existing directory, copy into it
+	// using the source's name.
+	var parentNode libkbfs.Node
+	var filename string
+	dstNode, de, err := dstP.GetNode(ctx, config)
+	switch err.(type) {
+	case nil:
+		if de.Type != libkbfs.Dir {
+			return libkbfs.NameExistsError{Name: dstP.String()}
+		}
+		parentNode = dstNode
+		_, filename, err = srcP.DirAndBasename()
+		if err != nil {
+			return err
+		}
+	case libkbfs.NoSuchNameError:
+		dir, basename, err := dstP.DirAndBasename()
+		if err != nil {
+			return err
+		}
+		if dir.PathType != fsrpc.TLFPathType {
+			return cannotWriteErr{dstPathStr, nil}
+		}
+		parentNode, err = dir.GetDirNode(ctx, config)
+		if err != nil {
+			return err
+		}
+		filename = basename
+	default:
+		return err
+	}
+
+	if *verbose {
+		fmt.Fprintf(os.Stderr, "Copying %s to %s\n", srcP, dstP)
+	}
+
+	_, _, err = config.KBFSOps().CopyFile(ctx, srcNode, parentNode, filename)
+	return err
+}
+
+func cp(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	err := cpHelper(ctx, config, args)
+	if err != nil {
+		printError("cp", err)
+		exitStatus = 1
+	}
+	return
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const crHistoryUsageStr = `Usage:
+  kbfstool cr history [-json] /keybase/[public|private]/user1,assertion2
+
+Resolutions are only recorded on the device that did them, and only
+if it runs with -conflict-history-root set.  They're kept for as long
+as -conflict-history-max-age says.
+
+`
+
+func printConflictHistoryEntry(entry libkbfs.ConflictHistoryEntry) {
+	fmt.Printf("%s: resolved unmerged head %s against merged head %s "+
+		"(policy %s)\n", entry.Time.Format(time.RFC3339),
+		entry.UnmergedHead, entry.MergedHead, entry.Policy)
+	for _, r := range entry.Renamed {
+		fmt.Printf("  renamed %s -> %s\n", r.From, r.To)
+	}
+	for _, a := range entry.Actions {
+		if a.Type == libkbfs.ConflictResolutionDrop {
+			fmt.Printf("  dropped %s: %s\n", a.Dir, a.Op)
+		}
+	}
+}
+
+func crHistory(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs cr history", flag.ContinueOnError)
+	printJSON := flags.Bool("json", false, "Print the history as JSON.")
+	flags.Parse(args)
+
+	inputs := flags.Args()
+	if len(inputs) != 1 {
+		fmt.Print(crHistoryUsageStr)
+		return 1
+	}
+
+	history := config.ConflictHistory()
+	if history == nil {
+		printError("cr history",
+			errors.New("the conflict history is disabled"))
+		return 1
+	}
+
+	fb, err := getTlfFolderBranch(ctx, config, inputs[0])
+	if err != nil {
+		printError("cr history", err)
+		return 1
+	}
+
+	entries, err := history.Get(ctx, fb.Tlf)
+	if err != nil {
+		printError("cr history", err)
+		return 1
+	}
+
+	if *printJSON {
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			printError("cr history", err)
+			return 1
+		}
+		fmt.Printf("%s\n", data)
+		return 0
+	}
+
+	if len(entries) == 0 {
+		fmt.Printf("No conflict resolutions recorded\n")
+		return 0
+	}
+	for _, entry := range entries {
+		printConflictHistoryEntry(entry)
+	}
+	return 0
+}
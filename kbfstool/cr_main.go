@@ -0,0 +1,41 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const crUsageStr = `Usage:
+  kbfstool cr [<subcommand>] [<args>]
+
+The possible subcommands are:
+  preview	Show what conflict resolution would do to unmerged changes
+  history	Show the conflict resolutions done on this device
+
+`
+
+func crMain(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	if len(args) < 1 {
+		fmt.Print(crUsageStr)
+		return 1
+	}
+
+	cmd := args[0]
+	args = args[1:]
+
+	switch cmd {
+	case "preview":
+		return crPreview(ctx, config, args)
+	case "history":
+		return crHistory(ctx, config, args)
+	default:
+		printError("cr", fmt.Errorf("unknown command '%s'", cmd))
+		return 1
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const crPreviewUsageStr = `Usage:
+  kbfstool cr preview [-json] /keybase/[public|private]/user1,assertion2
+
+Nothing is changed; resolution happens as usual once it's possible.
+
+`
+
+func printConflictResolutionPreview(
+	preview libkbfs.ConflictResolutionPreview) {
+	if !preview.Staged {
+		fmt.Printf("No unmerged changes\n")
+		return
+	}
+	fmt.Printf("Unmerged head: %s\n", preview.UnmergedHead)
+	if preview.MergedHead == libkbfs.MetadataRevisionUninitialized {
+		fmt.Printf("No merged changes to resolve against yet\n")
+		return
+	}
+	fmt.Printf("Merged head: %s\n", preview.MergedHead)
+	fmt.Printf("Conflict policy: %s\n", preview.Policy)
+	if len(preview.Actions) == 0 {
+		fmt.Printf("No conflicts; unmerged changes will be applied as-is\n")
+		return
+	}
+	for _, a := range preview.Actions {
+		switch {
+		case a.Op != "":
+			fmt.Printf("%s\t%s: %s\n", a.Type, a.Dir, a.Op)
+		case a.Target != "":
+			fmt.Printf("%s\t%s: %s -> %s (pointing to %s)\n",
+				a.Type, a.Dir, a.From, a.To, a.Target)
+		case a.To != "":
+			fmt.Printf("%s\t%s: %s -> %s\n", a.Type, a.Dir, a.From, a.To)
+		default:
+			fmt.Printf("%s\t%s: %s\n", a.Type, a.Dir, a.From)
+		}
+	}
+}
+
+func crPreview(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs cr preview", flag.ContinueOnError)
+	printJSON := flags.Bool("json", false, "Print the preview as JSON.")
+	flags.Parse(args)
+
+	inputs := flags.Args()
+	if len(inputs) != 1 {
+		fmt.Print(crPreviewUsageStr)
+		return 1
+	}
+
+	fb, err := getTlfFolderBranch(ctx, config, inputs[0])
+	if err != nil {
+		printError("cr preview", err)
+		return 1
+	}
+
+	preview, err := config.KBFSOps().PreviewConflictResolution(ctx, fb)
+	if err != nil {
+		printError("cr preview", err)
+		return 1
+	}
+
+	if *printJSON {
+		data, err := json.MarshalIndent(preview, "", "  ")
+		if err != nil {
+			printError("cr preview", err)
+			return 1
+		}
+		fmt.Printf("%s\n", data)
+		return 0
+	}
+
+	printConflictResolutionPreview(preview)
+	return 0
+}
@@ -11,6 +11,7 @@ import (
 
 var errExactlyOnePath = errors.New("exactly one path must be specified")
 var errAtLeastOnePath = errors.New("at least one path must be specified")
+var errExactlyTwoPaths = errors.New("exactly two paths must be specified")
 
 type cannotWriteErr struct {
 	pathStr string
@@ -0,0 +1,76 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const journalExportUsageStr = `Usage:
+  kbfstool journal export [-remove] /keybase/[public|private]/user1,assertion2 <archive>
+
+The archive can be flushed from anywhere by importing it with
+"kbfstool journal import".  The exported entries stay in the journal,
+which skips any of them that the archive has already flushed.  With
+-remove, they're removed from the journal instead, so they will only
+be flushed from the archive.
+
+`
+
+func journalExport(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs journal export", flag.ContinueOnError)
+	remove := flags.Bool("remove", false,
+		"Remove the exported entries from the journal.")
+	flags.Parse(args)
+
+	inputs := flags.Args()
+	if len(inputs) != 2 {
+		fmt.Print(journalExportUsageStr)
+		return 1
+	}
+
+	jServer, err := libkbfs.GetJournalServer(config)
+	if err != nil {
+		printError("journal export", err)
+		return 1
+	}
+
+	fb, err := getTlfFolderBranch(ctx, config, inputs[0])
+	if err != nil {
+		printError("journal export", err)
+		return 1
+	}
+
+	f, err := os.Create(inputs[1])
+	if err != nil {
+		printError("journal export", err)
+		return 1
+	}
+
+	err = jServer.ExportJournal(ctx, fb.Tlf, f, *remove)
+	// Once anything has been written, keep the archive even on
+	// error, since its entries may already have been removed from
+	// the journal.
+	written := false
+	if fi, statErr := f.Stat(); statErr == nil {
+		written = fi.Size() > 0
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if !written {
+			os.Remove(inputs[1])
+		}
+		printError("journal export", err)
+		return 1
+	}
+	return 0
+}
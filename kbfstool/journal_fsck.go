@@ -0,0 +1,86 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const journalFsckUsageStr = `Usage:
+  kbfstool -write-journal-root= journal fsck [-repair] <storage-root>
+
+Checks every folder journal under <storage-root>, which is the
+-write-journal-root of the KBFS instance that wrote them.  Neither
+KBFS nor this tool may be using the journals while they're checked,
+hence the empty -write-journal-root above.
+
+With -repair, each journal with problems is truncated to its last
+consistent entries.  Any unflushed writes after that point are lost.
+Journals whose bad entries can't be separated from the rest are
+reported as unrepairable and left alone.
+
+`
+
+func journalFsck(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs journal fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false,
+		"Truncate journals with problems to their last consistent entries.")
+	flags.Parse(args)
+
+	inputs := flags.Args()
+	if len(inputs) != 1 {
+		fmt.Print(journalFsckUsageStr)
+		return 1
+	}
+
+	root, err := filepath.Abs(inputs[0])
+	if err != nil {
+		printError("journal fsck", err)
+		return 1
+	}
+
+	if jServer, err := libkbfs.GetJournalServer(config); err == nil {
+		ourRoot, err := filepath.Abs(jServer.Status().RootDir)
+		if err == nil && ourRoot == filepath.Join(root, "v1") {
+			printError("journal fsck", fmt.Errorf(
+				"%s is in use by this tool; run it with an empty "+
+					"-write-journal-root", root))
+			return 1
+		}
+	}
+
+	results, err := libkbfs.FsckJournals(ctx, config, root, *repair)
+	if err != nil {
+		printError("journal fsck", err)
+		return 1
+	}
+
+	exitStatus = 0
+	for _, result := range results {
+		if len(result.Problems) == 0 {
+			fmt.Printf("%s (%s): OK\n", result.Dir, result.TlfID)
+			continue
+		}
+		fmt.Printf("%s (%s): %d problem(s)\n",
+			result.Dir, result.TlfID, len(result.Problems))
+		for _, p := range result.Problems {
+			fmt.Printf("  %s\n", p)
+		}
+		if result.Repaired {
+			fmt.Printf("  repaired\n")
+		} else {
+			if result.Unrepairable {
+				fmt.Printf("  can't be repaired\n")
+			}
+			exitStatus = 1
+		}
+	}
+	return exitStatus
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const journalImportUsageStr = `Usage:
+  kbfstool journal import [-apply] <archive>
+
+The archive's signatures and contents are checked first.  Then, by
+default, its entries are flushed straight to the servers.  With
+-apply, they're added to this device's journal for the folder
+instead, which only works for archives exported by this device.
+
+`
+
+func journalImport(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs journal import", flag.ContinueOnError)
+	apply := flags.Bool("apply", false,
+		"Add the entries to the local journal instead of flushing them.")
+	flags.Parse(args)
+
+	inputs := flags.Args()
+	if len(inputs) != 1 {
+		fmt.Print(journalImportUsageStr)
+		return 1
+	}
+
+	jServer, err := libkbfs.GetJournalServer(config)
+	if err != nil {
+		printError("journal import", err)
+		return 1
+	}
+
+	f, err := os.Open(inputs[0])
+	if err != nil {
+		printError("journal import", err)
+		return 1
+	}
+	defer f.Close()
+
+	tlfID, err := jServer.ImportJournal(ctx, f, *apply)
+	if err != nil {
+		printError("journal import", err)
+		return 1
+	}
+
+	if *apply {
+		fmt.Printf("Added the archived entries to the journal for %s\n",
+			tlfID)
+	} else {
+		fmt.Printf("Flushed the archived entries for %s\n", tlfID)
+	}
+	return 0
+}
@@ -0,0 +1,44 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const journalUsageStr = `Usage:
+  kbfstool journal [<subcommand>] [<args>]
+
+The possible subcommands are:
+  export	Write the unflushed entries of a folder's journal to an archive
+  import	Flush or apply an archive written by export
+  fsck		Check, and optionally repair, the journals in a directory
+
+`
+
+func journalMain(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	if len(args) < 1 {
+		fmt.Print(journalUsageStr)
+		return 1
+	}
+
+	cmd := args[0]
+	args = args[1:]
+
+	switch cmd {
+	case "export":
+		return journalExport(ctx, config, args)
+	case "import":
+		return journalImport(ctx, config, args)
+	case "fsck":
+		return journalFsck(ctx, config, args)
+	default:
+		printError("journal", fmt.Errorf("unknown command '%s'", cmd))
+		return 1
+	}
+}
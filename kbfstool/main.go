@@ -41,7 +41,11 @@ The possible commands are:
   mkdir		Make directories
   read		Dump file to stdout
   write		Write stdin to file
+  cp		Copy a file within a folder without re-uploading it
+  pin		Keep files and directories available offline (-u to undo)
   md            Operate on metadata objects
+  cr            Inspect conflict resolution
+  journal       Move unflushed journal entries between machines, or check them
 
 `
 
@@ -106,8 +110,16 @@ func realMain() (exitStatus int) {
 		return read(ctx, config, args)
 	case "write":
 		return write(ctx, config, args)
+	case "cp":
+		return cp(ctx, config, args)
+	case "pin":
+		return pin(ctx, config, args)
 	case "md":
 		return mdMain(ctx, config, args)
+	case "cr":
+		return crMain(ctx, config, args)
+	case "journal":
+		return journalMain(ctx, config, args)
 	default:
 		printError("kbfs", fmt.Errorf("unknown command '%s'", cmd))
 		return 1
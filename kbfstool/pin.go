@@ -0,0 +1,54 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+func pinNode(ctx context.Context, config libkbfs.Config, nodePathStr string,
+	pinned bool) error {
+	p, err := fsrpc.NewPath(nodePathStr)
+	if err != nil {
+		return err
+	}
+	if p.PathType != fsrpc.TLFPathType {
+		return fmt.Errorf("Cannot pin %s", p)
+	}
+
+	n, _, err := p.GetNode(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	return config.KBFSOps().SetSyncPolicy(ctx, n, pinned)
+}
+
+func pin(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs pin", flag.ContinueOnError)
+	unpin := flags.Bool("u", false, "Unpin the given paths instead.")
+	flags.Parse(args)
+
+	nodePaths := flags.Args()
+	if len(nodePaths) == 0 {
+		printError("pin", errAtLeastOnePath)
+		return 1
+	}
+
+	for _, nodePath := range nodePaths {
+		err := pinNode(ctx, config, nodePath, !*unpin)
+		if err != nil {
+			printError("pin", err)
+			return 1
+		}
+	}
+
+	return 0
+}
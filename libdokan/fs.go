@@ -274,12 +274,14 @@ func (f *FS) open(ctx context.Context, oc *openContext, ps []string) (dokan.File
 		return NewErrorFile(f), false, nil
 	case libfs.MetricsFileName == ps[psl-1]:
 		return NewMetricsFile(f), false, nil
-		// TODO: Make the two cases below available from any
+		// TODO: Make the three cases below available from any
 		// directory.
 	case libfs.ProfileListDirName == ps[0]:
 		return (ProfileList{fs: f}).open(ctx, oc, ps[1:])
 	case libfs.ResetCachesFileName == ps[0]:
 		return &ResetCachesFile{fs: f.root.private.fs}, false, nil
+	case libfs.JournalFlushLimitFileName == ps[0]:
+		return NewJournalFlushLimitFile(f), false, nil
 
 		// This section is equivalent to
 		// handleNonTLFSpecialFile in libfuse.
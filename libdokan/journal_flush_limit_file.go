@@ -0,0 +1,52 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"time"
+
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// JournalFlushLimitFile represents a file that shows the limit on
+// background journal flushing when read, and updates it with the
+// settings in each write.  It can only be reached from the top-level
+// FS mount.
+type JournalFlushLimitFile struct {
+	SpecialReadFile
+}
+
+// NewJournalFlushLimitFile returns a JournalFlushLimitFile.
+func NewJournalFlushLimitFile(fs *FS) *JournalFlushLimitFile {
+	return &JournalFlushLimitFile{SpecialReadFile{
+		read: func(ctx context.Context) ([]byte, time.Time, error) {
+			return libfs.GetEncodedJournalFlushLimit(ctx, fs.config)
+		},
+		fs: fs,
+	}}
+}
+
+// GetFileInformation does stats for dokan.  Unlike SpecialReadFile,
+// the file isn't read-only.
+func (f *JournalFlushLimitFile) GetFileInformation(
+	ctx context.Context, fi *dokan.FileInfo) (*dokan.Stat, error) {
+	a, err := f.SpecialReadFile.GetFileInformation(ctx, fi)
+	if err != nil {
+		return nil, err
+	}
+	a.FileAttributes &^= dokan.FileAttributeReadonly
+	return a, nil
+}
+
+// WriteFile implements writes for dokan.
+func (f *JournalFlushLimitFile) WriteFile(ctx context.Context,
+	fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	f.fs.logEnter(ctx, "JournalFlushLimitFile Write")
+	defer func() { f.fs.reportErr(ctx, libkbfs.WriteMode, err) }()
+	return libfs.SetJournalFlushLimit(ctx, f.fs.log, f.fs.config, bs)
+}
@@ -22,6 +22,12 @@ func handleTLFSpecialFile(name string, folder *Folder) dokan.File {
 	case libfs.EditHistoryName:
 		return NewTlfEditHistoryFile(folder)
 
+	case libfs.ConflictPreviewFileName:
+		return NewConflictPreviewFile(folder)
+
+	case libfs.ConflictHistoryFileName:
+		return NewConflictHistoryFile(folder)
+
 	case libfs.UnstageFileName:
 		return &UnstageFile{
 			folder: folder,
@@ -0,0 +1,30 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// GetEncodedConflictHistory returns serialized JSON containing the
+// conflict resolutions recorded for a folder on this device.
+func GetEncodedConflictHistory(ctx context.Context, config libkbfs.Config,
+	folderBranch libkbfs.FolderBranch) (
+	data []byte, t time.Time, err error) {
+	entries := []libkbfs.ConflictHistoryEntry{}
+	if history := config.ConflictHistory(); history != nil {
+		recorded, err := history.Get(ctx, folderBranch.Tlf)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		entries = append(entries, recorded...)
+	}
+
+	data, err = PrettyJSON(entries)
+	return data, time.Time{}, err
+}
@@ -0,0 +1,27 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// GetEncodedConflictPreview returns serialized JSON describing what
+// conflict resolution would do to the unmerged changes in a folder.
+func GetEncodedConflictPreview(ctx context.Context, config libkbfs.Config,
+	folderBranch libkbfs.FolderBranch) (
+	data []byte, t time.Time, err error) {
+	preview, err := config.KBFSOps().PreviewConflictResolution(
+		ctx, folderBranch)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	data, err = PrettyJSON(preview)
+	return data, time.Time{}, err
+}
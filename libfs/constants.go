@@ -61,9 +61,46 @@ const ResumeJournalBackgroundWorkFileName = ".kbfs_resume_journal_background_wor
 // file. It can be reached anywhere within a top-level folder.
 const DisableJournalFileName = ".kbfs_disable_journal"
 
+// JournalFlushLimitFileName is the name of the file that shows and
+// sets the limits on background journal flushing for all
+// folders. It can be reached from any KBFS directory.
+const JournalFlushLimitFileName = ".kbfs_journal_flush_limit"
+
 // EditHistoryName is the name of the KBFS TLF edit history file --
 // it can be reached anywhere within a top-level folder.
 const EditHistoryName = ".kbfs_edit_history"
 
+// ConflictPreviewFileName is the name of the KBFS conflict resolution
+// preview file -- it can be reached anywhere within a top-level
+// folder.
+const ConflictPreviewFileName = ".kbfs_conflict_preview"
+
+// ConflictHistoryFileName is the name of the KBFS conflict resolution
+// history file -- it can be reached anywhere within a top-level
+// folder.
+const ConflictHistoryFileName = ".kbfs_conflict_history"
+
 // FileInfoPrefix is the prefix of the per-file metadata files.
 const FileInfoPrefix = ".kbfs_fileinfo_"
+
+// ArchivedRevDirName is the name of the virtual directory, reachable
+// anywhere within a top-level folder, whose entries are read-only
+// views of the folder at the merged revision given by the entry name
+// (e.g., ".kbfs_archived/42").
+const ArchivedRevDirName = ".kbfs_archived"
+
+// ArchivedTimeDirName is the name of the virtual directory, reachable
+// anywhere within a top-level folder, whose entries are read-only
+// views of the folder as it was at the RFC3339 time given by the
+// entry name (e.g., ".kbfs_at/2017-01-02T15:04:05Z").
+const ArchivedTimeDirName = ".kbfs_at"
+
+// PinFileName is the name of the KBFS pin file, reachable from any
+// directory within a top-level folder.  Writing a path relative to
+// that directory (or nothing but whitespace, for the directory
+// itself) keeps the named subtree available offline.
+const PinFileName = ".kbfs_pin"
+
+// UnpinFileName is the name of the KBFS unpin file; it works like
+// PinFileName, but undoes a pin.
+const UnpinFileName = ".kbfs_unpin"
@@ -0,0 +1,45 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// GetEncodedJournalFlushLimit returns the current limit on background
+// journal flushing, in the format accepted by SetJournalFlushLimit.
+func GetEncodedJournalFlushLimit(ctx context.Context,
+	config libkbfs.Config) ([]byte, time.Time, error) {
+	jServer, err := libkbfs.GetJournalServer(config)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return []byte(jServer.FlushLimit().String() + "\n"), time.Time{}, nil
+}
+
+// SetJournalFlushLimit updates the limit on background journal
+// flushing with the settings in data, as parsed by
+// libkbfs.ParseJournalFlushLimit.  Settings that aren't in data are
+// left alone.
+func SetJournalFlushLimit(ctx context.Context, log logger.Logger,
+	config libkbfs.Config, data []byte) (int, error) {
+	log.CDebugf(ctx, "SetJournalFlushLimit(%q)", data)
+	jServer, err := libkbfs.GetJournalServer(config)
+	if err != nil {
+		return 0, err
+	}
+
+	limit, err := libkbfs.ParseJournalFlushLimit(
+		string(data), jServer.FlushLimit())
+	if err != nil {
+		return 0, err
+	}
+	jServer.SetFlushLimit(limit)
+	return len(data), nil
+}
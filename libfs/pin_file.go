@@ -0,0 +1,44 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"strings"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// SetSyncPolicy pins or unpins the subtree at the path given by
+// data, relative to dir, if the given data is non-empty.  If the
+// data is only whitespace, dir itself is pinned or unpinned.  If the
+// given data is empty, it does nothing.
+func SetSyncPolicy(ctx context.Context, log logger.Logger,
+	config libkbfs.Config, dir libkbfs.Node, data []byte,
+	pinned bool) (int, error) {
+	log.CDebugf(ctx, "SetSyncPolicy(%q, %t)", data, pinned)
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	node := dir
+	for _, name := range strings.Split(strings.TrimSpace(string(data)), "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		var err error
+		node, _, err = config.KBFSOps().Lookup(ctx, node, name)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err := config.KBFSOps().SetSyncPolicy(ctx, node, pinned)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
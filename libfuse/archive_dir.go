@@ -0,0 +1,92 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// ArchiveDir is a virtual directory within a TLF whose entries are
+// read-only views of that TLF at past revisions.  Entries are named
+// either by merged revision number or, if byTime is set, by an
+// RFC3339 timestamp.  Its listing is always empty; entries can only
+// be reached by looking them up directly.
+type ArchiveDir struct {
+	folder *Folder
+	byTime bool
+}
+
+var _ fs.Node = (*ArchiveDir)(nil)
+
+// Attr implements the fs.Node interface for ArchiveDir.
+func (ad *ArchiveDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0500
+	if ad.folder.list.public {
+		a.Mode |= 0055
+	}
+	return nil
+}
+
+func (ad *ArchiveDir) revisionForName(ctx context.Context, name string) (
+	libkbfs.MetadataRevision, error) {
+	if !ad.byTime {
+		rev, err := strconv.ParseInt(name, 10, 64)
+		if err != nil || rev < int64(libkbfs.MetadataRevisionInitial) {
+			return libkbfs.MetadataRevisionUninitialized, fuse.ENOENT
+		}
+		return libkbfs.MetadataRevision(rev), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, name)
+	if err != nil {
+		return libkbfs.MetadataRevisionUninitialized, fuse.ENOENT
+	}
+	return ad.folder.fs.config.KBFSOps().GetRevisionForTime(
+		ctx, ad.folder.getHandle(), t)
+}
+
+var _ fs.NodeRequestLookuper = (*ArchiveDir)(nil)
+
+// Lookup implements the fs.NodeRequestLookuper interface for ArchiveDir.
+func (ad *ArchiveDir) Lookup(ctx context.Context, req *fuse.LookupRequest,
+	resp *fuse.LookupResponse) (node fs.Node, err error) {
+	ad.folder.fs.log.CDebugf(ctx, "ArchiveDir Lookup %s", req.Name)
+	defer func() { ad.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	rev, err := ad.revisionForName(ctx, req.Name)
+	if err != nil {
+		if _, ok := err.(libkbfs.NoSuchMDError); ok {
+			return nil, fuse.ENOENT
+		}
+		return nil, err
+	}
+
+	root, err := ad.folder.getArchivedRoot(ctx, rev)
+	if err != nil {
+		if _, ok := err.(libkbfs.NoSuchMDError); ok {
+			return nil, fuse.ENOENT
+		}
+		return nil, err
+	}
+	return root, nil
+}
+
+var _ fs.Handle = (*ArchiveDir)(nil)
+
+var _ fs.HandleReadDirAller = (*ArchiveDir)(nil)
+
+// ReadDirAll implements the fs.HandleReadDirAller interface for
+// ArchiveDir.
+func (ad *ArchiveDir) ReadDirAll(ctx context.Context) (
+	res []fuse.Dirent, err error) {
+	return nil, nil
+}
@@ -0,0 +1,27 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/keybase/kbfs/libfs"
+)
+
+// NewConflictPreviewFile returns a special read file that contains a
+// text representation of what conflict resolution would do to the
+// unmerged changes in that TLF.
+func NewConflictPreviewFile(
+	folder *Folder, entryValid *time.Duration) *SpecialReadFile {
+	*entryValid = 0
+	return &SpecialReadFile{
+		read: func(ctx context.Context) ([]byte, time.Time, error) {
+			return libfs.GetEncodedConflictPreview(
+				ctx, folder.fs.config, folder.getFolderBranch())
+		},
+	}
+}
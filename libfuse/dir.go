@@ -50,6 +50,25 @@ type Folder struct {
 	// file system.  Sending a struct{}{} on this channel will unpause
 	// the updates.
 	updateChan chan<- struct{}
+
+	// archivedRev is set if this folder is a read-only view of the
+	// TLF at a past revision, in which case archiveParent is the
+	// live folder it was reached from.
+	archivedRev   libkbfs.MetadataRevision
+	archiveParent *Folder
+
+	// Protects the archived map.
+	archivedMu sync.Mutex
+	// archived maps past revisions to the read-only folders
+	// currently in use by the kernel for those revisions.
+	archived map[libkbfs.MetadataRevision]*archivedFolder
+}
+
+// archivedFolder tracks a read-only folder along with its root
+// directory.
+type archivedFolder struct {
+	folder *Folder
+	root   *Dir
 }
 
 func newFolder(fl *FolderList, h *libkbfs.TlfHandle) *Folder {
@@ -68,6 +87,82 @@ func (f *Folder) name() libkbfs.CanonicalTlfName {
 	return f.h.GetCanonicalName()
 }
 
+func (f *Folder) getHandle() *libkbfs.TlfHandle {
+	f.handleMu.RLock()
+	defer f.handleMu.RUnlock()
+	return f.h
+}
+
+// isArchived returns true if this folder is a read-only view of its
+// TLF at a past revision.
+func (f *Folder) isArchived() bool {
+	return f.archiveParent != nil
+}
+
+// getArchivedRoot returns the root directory of a read-only view of
+// this folder's TLF at the given merged revision, creating it if
+// necessary.
+func (f *Folder) getArchivedRoot(ctx context.Context,
+	rev libkbfs.MetadataRevision) (*Dir, error) {
+	if f.archiveParent != nil {
+		// Archived views are always rooted in the live folder.
+		return f.archiveParent.getArchivedRoot(ctx, rev)
+	}
+
+	f.archivedMu.Lock()
+	defer f.archivedMu.Unlock()
+	if af, ok := f.archived[rev]; ok {
+		// The view is shut down if its revision was squashed away
+		// in the journal, in which case make a new one.
+		_, err := f.fs.config.KBFSOps().Stat(ctx, af.root.node)
+		if err == nil {
+			return af.root, nil
+		}
+		f.fs.log.CDebugf(ctx, "Replacing archived view for revision %d: %v",
+			rev, err)
+		af.folder.unsetFolderBranch(ctx)
+		delete(f.archived, rev)
+	}
+
+	h := f.getHandle()
+	rootNode, _, err := f.fs.config.KBFSOps().GetArchivedRootNode(
+		ctx, h, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	af := &Folder{
+		fs:            f.fs,
+		list:          f.list,
+		h:             h,
+		nodes:         map[libkbfs.NodeID]fs.Node{},
+		archivedRev:   rev,
+		archiveParent: f,
+	}
+	err = af.setFolderBranch(rootNode.GetFolderBranch())
+	if err != nil {
+		return nil, err
+	}
+	root := newDir(af, rootNode)
+	af.nodes[rootNode.GetID()] = root
+
+	if f.archived == nil {
+		f.archived = make(map[libkbfs.MetadataRevision]*archivedFolder)
+	}
+	f.archived[rev] = &archivedFolder{af, root}
+	return root, nil
+}
+
+// forgetArchived forgets the given read-only view, unless it's
+// already been replaced.
+func (f *Folder) forgetArchived(af *Folder) {
+	f.archivedMu.Lock()
+	defer f.archivedMu.Unlock()
+	if a, ok := f.archived[af.archivedRev]; ok && a.folder == af {
+		delete(f.archived, af.archivedRev)
+	}
+}
+
 func (f *Folder) reportErr(ctx context.Context,
 	mode libkbfs.ErrorModeType, err error) {
 	if err == nil {
@@ -130,6 +225,10 @@ func (f *Folder) forgetNode(node libkbfs.Node) {
 		ctx := libkbfs.BackgroundContextWithCancellationDelayer()
 		defer libkbfs.CleanupCancellationDelayer(ctx)
 		f.unsetFolderBranch(ctx)
+		if f.isArchived() {
+			f.archiveParent.forgetArchived(f)
+			return
+		}
 		f.list.forgetFolder(string(f.name()))
 	}
 }
@@ -321,6 +420,7 @@ type DirInterface interface {
 	fs.NodeCreater
 	fs.NodeMkdirer
 	fs.NodeSymlinker
+	fs.NodeLinker
 	fs.NodeRenamer
 	fs.NodeRemover
 	fs.Handle
@@ -372,6 +472,9 @@ func (d *Dir) attr(ctx context.Context, a *fuse.Attr) (err error) {
 	fillAttr(&de, a)
 
 	a.Mode = os.ModeDir | 0700
+	if d.folder.isArchived() {
+		a.Mode = os.ModeDir | 0500
+	}
 	if d.folder.list.public {
 		a.Mode |= 0055
 	}
@@ -396,6 +499,14 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 		return specialNode, nil
 	}
 
+	switch req.Name {
+	case libfs.PinFileName, libfs.UnpinFileName:
+		return &PinFile{
+			dir:    d,
+			pinned: req.Name == libfs.PinFileName,
+		}, nil
+	}
+
 	// Check if this is a per-file metainformation file, if so
 	// return the corresponding SpecialReadFile.
 	if strings.HasPrefix(req.Name, libfs.FileInfoPrefix) {
@@ -556,6 +667,49 @@ func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (
 	return child, nil
 }
 
+// Link implements the fs.NodeLinker interface for Dir.
+func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest,
+	old fs.Node) (node fs.Node, err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Link %s", req.NewName)
+	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	target, ok := old.(*File)
+	if !ok {
+		// Only regular files can be hard-linked.
+		return nil, fuse.Errno(syscall.EPERM)
+	}
+	if target.folder != d.folder {
+		return nil, fuse.Errno(syscall.EXDEV)
+	}
+
+	// This fits in situation 1 as described in libkbfs/delayed_cancellation.go
+	err = libkbfs.EnableDelayedCancellationWithGracePeriod(
+		ctx, d.folder.fs.config.DelayedCancellationGracePeriod())
+	if err != nil {
+		return nil, err
+	}
+
+	newNode, ei, err := d.folder.fs.config.KBFSOps().CreateHardLink(
+		ctx, d.node, req.NewName, target.node)
+	if err != nil {
+		return nil, err
+	}
+
+	child := &File{
+		folder: d.folder,
+		node:   newNode,
+	}
+	// See the comment in Create.
+	if reqID, ok := ctx.Value(CtxIDKey).(string); ok {
+		child.eiCache.set(reqID, ei)
+	}
+
+	d.folder.nodesMu.Lock()
+	d.folder.nodes[newNode.GetID()] = child
+	d.folder.nodesMu.Unlock()
+	return child, nil
+}
+
 // Rename implements the fs.NodeRenamer interface for Dir.
 func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest,
 	newDir fs.Node) (err error) {
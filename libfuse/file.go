@@ -5,7 +5,11 @@
 package libfuse
 
 import (
+	"math"
+	"strconv"
 	"sync"
+	"syscall"
+	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
@@ -51,12 +55,22 @@ func (c *eiCacheHolder) set(reqID string, ei libkbfs.EntryInfo) {
 	}
 }
 
+// fileLockWaitInterval is how often a blocking lock request retries
+// a lock held by another owner.  The MD server doesn't queue lock
+// waiters, so nothing tells us when the lock is released.
+const fileLockWaitInterval = 1 * time.Second
+
 // File represents KBFS files.
 type File struct {
 	folder *Folder
 	node   libkbfs.Node
 
 	eiCache eiCacheHolder
+
+	locksMu sync.Mutex
+	// locks maps each lock owner to the byte ranges it has locked
+	// on this file through the kernel.
+	locks map[uint64]fileLockRanges
 }
 
 var _ fs.Node = (*File)(nil)
@@ -101,6 +115,9 @@ func (f *File) attr(ctx context.Context, a *fuse.Attr) (err error) {
 	}
 
 	fillAttrWithMode(&de, a)
+	if f.folder.isArchived() {
+		a.Mode &^= 0222
+	}
 	return nil
 }
 
@@ -167,6 +184,290 @@ func (f *File) Write(ctx context.Context, req *fuse.WriteRequest,
 	return nil
 }
 
+// Whence values for SEEK_DATA and SEEK_HOLE, which the syscall
+// package doesn't define.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+var _ fs.HandleLseeker = (*File)(nil)
+
+// Lseek implements the fs.HandleLseeker interface for File, finding
+// data and holes from the file's hole list.  The end of the file
+// counts as a hole.
+func (f *File) Lseek(ctx context.Context, req *fuse.LseekRequest,
+	resp *fuse.LseekResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Lseek off=%d whence=%d",
+		req.Offset, req.Whence)
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	if req.Whence != seekData && req.Whence != seekHole {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	kbfsOps := f.folder.fs.config.KBFSOps()
+	ei, err := kbfsOps.Stat(ctx, f.node)
+	if err != nil {
+		return err
+	}
+	if req.Offset < 0 || uint64(req.Offset) >= ei.Size {
+		return fuse.Errno(syscall.ENXIO)
+	}
+	holes, err := kbfsOps.GetFileHoles(ctx, f.node)
+	if err != nil {
+		return err
+	}
+
+	off := uint64(req.Offset)
+	for _, h := range holes {
+		if off >= h.Off+h.Len {
+			continue
+		}
+		inHole := off >= h.Off
+		switch {
+		case req.Whence == seekHole && inHole:
+			resp.Offset = req.Offset
+		case req.Whence == seekHole:
+			resp.Offset = int64(h.Off)
+		case inHole:
+			resp.Offset = int64(h.Off + h.Len)
+		default:
+			resp.Offset = req.Offset
+		}
+		return nil
+	}
+	if req.Whence == seekHole {
+		resp.Offset = int64(ei.Size)
+	} else {
+		resp.Offset = req.Offset
+	}
+	return nil
+}
+
+var _ fs.HandleFallocater = (*File)(nil)
+
+// Fallocate implements the fs.HandleFallocater interface for File.
+// KBFS doesn't reserve space ahead of time, so a plain preallocation
+// just extends the file if needed (with a hole), and one that keeps
+// the size does nothing.  Punching holes is also supported, but no
+// other modes are.
+func (f *File) Fallocate(ctx context.Context,
+	req *fuse.FallocateRequest) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Fallocate off=%d len=%d mode=%#x",
+		req.Offset, req.Length, req.Mode)
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	if req.Offset < 0 || req.Length <= 0 {
+		return fuse.Errno(syscall.EINVAL)
+	}
+
+	kbfsOps := f.folder.fs.config.KBFSOps()
+	switch req.Mode {
+	case 0:
+		end := uint64(req.Offset) + uint64(req.Length)
+		ei, err := kbfsOps.Stat(ctx, f.node)
+		if err != nil {
+			return err
+		}
+		if end <= ei.Size {
+			return nil
+		}
+		f.eiCache.destroy()
+		return kbfsOps.Truncate(ctx, f.node, end)
+	case fuse.FallocateKeepSize:
+		return nil
+	case fuse.FallocatePunchHole | fuse.FallocateKeepSize:
+		f.eiCache.destroy()
+		return kbfsOps.PunchHole(
+			ctx, f.node, uint64(req.Offset), uint64(req.Length))
+	default:
+		return fuse.ENOTSUP
+	}
+}
+
+var _ fs.HandleCopyFileRanger = (*File)(nil)
+
+// CopyFileRange implements the fs.HandleCopyFileRanger interface for
+// File.  Copying a whole file into an empty one within the same TLF
+// shares the existing data blocks instead of re-uploading them; for
+// anything else, the kernel falls back to reading and writing.
+func (f *File) CopyFileRange(ctx context.Context,
+	req *fuse.CopyFileRangeRequest, out fs.Handle,
+	resp *fuse.CopyFileRangeResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File CopyFileRange off=%d offOut=%d len=%d",
+		req.Offset, req.OffsetOut, req.Len)
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	dst, ok := out.(*File)
+	if !ok || req.Offset != 0 || req.OffsetOut != 0 || req.Flags != 0 {
+		return fuse.ENOTSUP
+	}
+
+	kbfsOps := f.folder.fs.config.KBFSOps()
+	ei, err := kbfsOps.Stat(ctx, f.node)
+	if err != nil {
+		return err
+	}
+	// The reply can only report up to 4GiB-1 copied bytes, and a
+	// partial copy can't be finished here, so leave bigger files to
+	// the kernel too.
+	if req.Len < ei.Size || ei.Size > math.MaxUint32 {
+		return fuse.ENOTSUP
+	}
+
+	dst.eiCache.destroy()
+	size, err := kbfsOps.CopyFileInto(ctx, f.node, dst.node)
+	if err != nil {
+		return err
+	}
+	resp.Size = int(size)
+	return nil
+}
+
+var _ fs.HandleLocker = (*File)(nil)
+
+func fileLockOwner(owner uint64) string {
+	return strconv.FormatUint(owner, 16)
+}
+
+func (f *File) heldRanges(owner uint64) fileLockRanges {
+	f.locksMu.Lock()
+	defer f.locksMu.Unlock()
+	return f.locks[owner]
+}
+
+// setHeldRange records that the given owner now has the given range
+// locked with the given type (or unlocked), and returns the owner's
+// new set of ranges.
+func (f *File) setHeldRange(owner uint64, lock fuse.FileLock) fileLockRanges {
+	f.locksMu.Lock()
+	defer f.locksMu.Unlock()
+	ranges := f.locks[owner].set(lock.Start, lock.End, lock.Type)
+	if len(ranges) == 0 {
+		delete(f.locks, owner)
+		return nil
+	}
+	if f.locks == nil {
+		f.locks = make(map[uint64]fileLockRanges)
+	}
+	f.locks[owner] = ranges
+	return ranges
+}
+
+// lockWhole takes, changes or releases the owner's whole-file KBFS
+// lock so that it has the given type, waiting for conflicting locks
+// to go away if wait is true.
+func (f *File) lockWhole(ctx context.Context, owner uint64,
+	t fuse.LockType, wait bool) (err error) {
+	kbfsOps := f.folder.fs.config.KBFSOps()
+	if t == fuse.LockUnlock {
+		return kbfsOps.UnlockFile(ctx, f.node, fileLockOwner(owner))
+	}
+	for {
+		err = kbfsOps.LockFile(
+			ctx, f.node, fileLockOwner(owner), t == fuse.LockWrite)
+		if _, ok := err.(libkbfs.FileLockConflictError); !ok || !wait {
+			return err
+		}
+		select {
+		case <-time.After(fileLockWaitInterval):
+		case <-ctx.Done():
+			return fuse.EINTR
+		}
+	}
+}
+
+// Lock implements the fs.HandleLocker interface for File.  KBFS
+// locks cover whole files, so each owner holds one KBFS lock for as
+// long as it has any byte range locked, which is exclusive if any of
+// its ranges are write-locked.  The ranges themselves are only
+// tracked locally, which means that the ranges locked by different
+// owners conflict even if they don't overlap.
+func (f *File) Lock(ctx context.Context, req *fuse.LockRequest) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Lock owner=%#x %v wait=%t",
+		req.LockOwner, req.Lock, req.Wait)
+	defer func() {
+		// A conflict is the expected answer to a non-blocking
+		// lock attempt, not a failure.
+		if _, ok := err.(libkbfs.FileLockConflictError); !ok {
+			f.folder.reportErr(ctx, libkbfs.WriteMode, err)
+		}
+	}()
+
+	switch req.Lock.Type {
+	case fuse.LockUnlock, fuse.LockRead, fuse.LockWrite:
+	default:
+		return fuse.Errno(syscall.EINVAL)
+	}
+
+	oldType := f.heldRanges(req.LockOwner).lockType()
+	newType := f.heldRanges(req.LockOwner).set(
+		req.Lock.Start, req.Lock.End, req.Lock.Type).lockType()
+	if newType != oldType {
+		err = f.lockWhole(ctx, req.LockOwner, newType, req.Wait)
+		if err != nil {
+			return err
+		}
+	}
+	f.setHeldRange(req.LockOwner, req.Lock)
+	return nil
+}
+
+// releaseLocks releases all the locks held by the given owner on this
+// file.
+func (f *File) releaseLocks(ctx context.Context, owner uint64) error {
+	f.locksMu.Lock()
+	_, ok := f.locks[owner]
+	delete(f.locks, owner)
+	f.locksMu.Unlock()
+	if !ok {
+		return nil
+	}
+	return f.lockWhole(ctx, owner, fuse.LockUnlock, false)
+}
+
+// QueryLock implements the fs.HandleLocker interface for File.  The
+// MD server can't say who holds a lock, so this probes for one by
+// briefly taking the queried lock under a separate owner name.
+func (f *File) QueryLock(ctx context.Context, req *fuse.QueryLockRequest,
+	resp *fuse.QueryLockResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File QueryLock owner=%#x %v",
+		req.LockOwner, req.Lock)
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	resp.Lock = fuse.FileLock{Type: fuse.LockUnlock}
+	held := f.heldRanges(req.LockOwner).lockType()
+	exclusive := req.Lock.Type == fuse.LockWrite
+	if req.Lock.Type == fuse.LockUnlock || held == fuse.LockWrite ||
+		(held == fuse.LockRead && !exclusive) {
+		// Nothing held by anyone else can conflict.
+		return nil
+	}
+
+	kbfsOps := f.folder.fs.config.KBFSOps()
+	probe := fileLockOwner(req.LockOwner) + ".query"
+	err = kbfsOps.LockFile(ctx, f.node, probe, exclusive)
+	switch err.(type) {
+	case nil:
+		return kbfsOps.UnlockFile(ctx, f.node, probe)
+	case libkbfs.FileLockConflictError:
+		resp.Lock = fuse.FileLock{
+			Start: 0,
+			End:   math.MaxInt64,
+			Type:  fuse.LockWrite,
+		}
+		if held == fuse.LockRead {
+			// While this owner holds a read lock, nobody can hold
+			// a write lock; the conflict is with a reader, which
+			// may be this owner itself.
+			resp.Lock.Type = fuse.LockRead
+		}
+		return nil
+	default:
+		return err
+	}
+}
+
 var _ fs.HandleFlusher = (*File)(nil)
 
 // Flush implements the fs.HandleFlusher interface for File.
@@ -183,7 +484,13 @@ func (f *File) Flush(ctx context.Context, req *fuse.FlushRequest) (err error) {
 		return err
 	}
 
-	return f.sync(ctx)
+	err = f.sync(ctx)
+	// POSIX locks are released when any of the owner's descriptors
+	// for the file is closed, which is when the kernel flushes.
+	if lockErr := f.releaseLocks(ctx, req.LockOwner); err == nil {
+		err = lockErr
+	}
+	return err
 }
 
 var _ fs.NodeSetattrer = (*File)(nil)
@@ -0,0 +1,59 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import "bazil.org/fuse"
+
+// fileLockRange is a byte range locked by a single lock owner.  As in
+// fuse.FileLock, end is inclusive.
+type fileLockRange struct {
+	start, end uint64
+	exclusive  bool
+}
+
+// fileLockRanges is the set of non-overlapping byte ranges locked by
+// a single lock owner on a file.
+type fileLockRanges []fileLockRange
+
+// set returns a copy of the ranges with [start, end] locked with the
+// given type, or unlocked, following POSIX semantics: the new lock
+// replaces any parts of the existing ranges that it overlaps.
+func (rs fileLockRanges) set(
+	start, end uint64, t fuse.LockType) fileLockRanges {
+	var newRanges fileLockRanges
+	for _, r := range rs {
+		if r.end < start || r.start > end {
+			newRanges = append(newRanges, r)
+			continue
+		}
+		// Keep the parts of r outside of [start, end].
+		if r.start < start {
+			newRanges = append(newRanges,
+				fileLockRange{r.start, start - 1, r.exclusive})
+		}
+		if r.end > end {
+			newRanges = append(newRanges,
+				fileLockRange{end + 1, r.end, r.exclusive})
+		}
+	}
+	if t != fuse.LockUnlock {
+		newRanges = append(newRanges,
+			fileLockRange{start, end, t == fuse.LockWrite})
+	}
+	return newRanges
+}
+
+// lockType returns the type of the whole-file lock needed to cover
+// the ranges.
+func (rs fileLockRanges) lockType() fuse.LockType {
+	t := fuse.LockUnlock
+	for _, r := range rs {
+		if r.exclusive {
+			return fuse.LockWrite
+		}
+		t = fuse.LockRead
+	}
+	return t
+}
@@ -0,0 +1,41 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"reflect"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+func TestFileLockRanges(t *testing.T) {
+	var rs fileLockRanges
+	rs = rs.set(0, 99, fuse.LockRead)
+	rs = rs.set(10, 19, fuse.LockWrite)
+	expected := fileLockRanges{
+		{0, 9, false},
+		{20, 99, false},
+		{10, 19, true},
+	}
+	if !reflect.DeepEqual(rs, expected) {
+		t.Fatalf("ranges %v, expected %v", rs, expected)
+	}
+	if rs.lockType() != fuse.LockWrite {
+		t.Fatalf("lock type %v, expected a write lock", rs.lockType())
+	}
+
+	// Like SQLite dropping its RESERVED lock, unlocking the
+	// write-locked bytes leaves the read lock in place.
+	rs = rs.set(10, 19, fuse.LockUnlock)
+	if rs.lockType() != fuse.LockRead {
+		t.Fatalf("lock type %v, expected a read lock", rs.lockType())
+	}
+
+	rs = rs.set(0, 99, fuse.LockUnlock)
+	if len(rs) != 0 || rs.lockType() != fuse.LockUnlock {
+		t.Fatalf("ranges %v left after unlocking everything", rs)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// JournalFlushLimitFile represents a file that shows the limit on
+// background journal flushing when read, and updates it with the
+// settings in each write.  It can be reached from any directory under
+// the FUSE mountpoint.
+type JournalFlushLimitFile struct {
+	fs *FS
+}
+
+var _ fs.Node = (*JournalFlushLimitFile)(nil)
+
+// Attr implements the fs.Node interface for JournalFlushLimitFile.
+func (f *JournalFlushLimitFile) Attr(
+	ctx context.Context, a *fuse.Attr) error {
+	data, _, err := libfs.GetEncodedJournalFlushLimit(ctx, f.fs.config)
+	if err != nil {
+		return err
+	}
+
+	// Keep the size up to date, as for SpecialReadFile.
+	a.Valid = 1 * time.Second
+	a.Size = uint64(len(data))
+	a.Mode = 0644
+	return nil
+}
+
+var _ fs.NodeOpener = (*JournalFlushLimitFile)(nil)
+
+// Open implements the fs.NodeOpener interface for
+// JournalFlushLimitFile.
+func (f *JournalFlushLimitFile) Open(ctx context.Context,
+	req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	resp.Flags |= fuse.OpenDirectIO
+	if !req.Flags.IsReadOnly() {
+		return f, nil
+	}
+
+	data, _, err := libfs.GetEncodedJournalFlushLimit(ctx, f.fs.config)
+	if err != nil {
+		return nil, err
+	}
+	return fs.DataHandle(data), nil
+}
+
+var _ fs.Handle = (*JournalFlushLimitFile)(nil)
+
+var _ fs.HandleWriter = (*JournalFlushLimitFile)(nil)
+
+// Write implements the fs.HandleWriter interface for
+// JournalFlushLimitFile.
+func (f *JournalFlushLimitFile) Write(ctx context.Context,
+	req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	f.fs.log.CDebugf(ctx, "JournalFlushLimitFile Write")
+	defer func() { f.fs.reportErr(ctx, libkbfs.WriteMode, err) }()
+	n, err := libfs.SetJournalFlushLimit(
+		ctx, f.fs.log, f.fs.config, req.Data)
+	if err != nil {
+		return err
+	}
+	resp.Size = n
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+func TestPunchHoleAndSeek(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	// Use the smallest possible block size, so the file is indirect.
+	bsplitter, err := libkbfs.NewBlockSplitterSimple(20, 8*1024,
+		config.Codec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.SetBlockSplitter(bsplitter)
+	mnt, _, cancelFn := makeFS(t, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	p := path.Join(mnt.Dir, PrivateName, "jdoe", "myfile")
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	const mode = 0x01 | 0x02 // FALLOC_FL_KEEP_SIZE | FALLOC_FL_PUNCH_HOLE
+	if err := syscall.Fallocate(int(f.Fd()), mode, 10, 60); err != nil {
+		t.Fatalf("fallocate error: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatalf("fsync error: %v", err)
+	}
+
+	expected := append([]byte(nil), data...)
+	for i := 10; i < 70; i++ {
+		expected[i] = 0
+	}
+	buf, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, expected) {
+		t.Fatalf("bad contents after punching a hole: %v", buf)
+	}
+
+	hole, err := f.Seek(0, seekHole)
+	if err != nil {
+		t.Fatalf("seek hole error: %v", err)
+	}
+	if hole < 10 || hole >= 70 {
+		t.Fatalf("hole at %d, not in the punched range", hole)
+	}
+	next, err := f.Seek(hole, seekData)
+	if err != nil {
+		t.Fatalf("seek data error: %v", err)
+	}
+	if next <= hole || next > 70 {
+		t.Fatalf("data after hole at %d, expected in (%d, 70]", next, hole)
+	}
+	_, err = f.Seek(int64(len(data)), seekData)
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.ENXIO {
+		t.Fatalf("expected ENXIO seeking past the end, got %v", err)
+	}
+}
+
+func TestFallocatePreallocate(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	mnt, _, cancelFn := makeFS(t, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	p := path.Join(mnt.Dir, PrivateName, "jdoe", "myfile")
+	data := []byte{1, 2, 3, 4}
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	const keepSize = 0x01 // FALLOC_FL_KEEP_SIZE
+	if err := syscall.Fallocate(int(f.Fd()), keepSize, 0, 100); err != nil {
+		t.Fatalf("fallocate keep size error: %v", err)
+	}
+	if err := syscall.Fallocate(int(f.Fd()), 0, 0, 2); err != nil {
+		t.Fatalf("fallocate within the file error: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(data)) {
+		t.Fatalf("size changed to %d", fi.Size())
+	}
+
+	if err := syscall.Fallocate(int(f.Fd()), 0, 2, 8); err != nil {
+		t.Fatalf("fallocate past the end error: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatalf("fsync error: %v", err)
+	}
+	buf, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(append([]byte(nil), data...), make([]byte, 6)...)
+	if !bytes.Equal(buf, expected) {
+		t.Fatalf("bad contents after preallocating: %v", buf)
+	}
+}
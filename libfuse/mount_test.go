@@ -1753,6 +1753,77 @@ func TestFsync(t *testing.T) {
 	}
 }
 
+func TestFileLock(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	mnt, _, cancelFn := makeFS(t, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	p := path.Join(mnt.Dir, PrivateName, "jdoe", "myfile")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	lk := syscall.Flock_t{Type: syscall.F_WRLCK}
+	if err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lk); err != nil {
+		t.Fatalf("lock error: %v", err)
+	}
+
+	// The lock is held in KBFS, where another owner can't take it.
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	root := libkbfs.GetRootNodeOrBust(t, config, "jdoe", false)
+	kbfsOps := config.KBFSOps()
+	n, _, err := kbfsOps.Lookup(ctx, root, "myfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kbfsOps.LockFile(ctx, n, "other", false)
+	if _, ok := err.(libkbfs.FileLockConflictError); !ok {
+		t.Fatalf("expected a lock conflict, got %v", err)
+	}
+
+	// Unlocking part of the file keeps the rest locked.
+	part := syscall.Flock_t{Type: syscall.F_UNLCK, Start: 0, Len: 10}
+	if err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &part); err != nil {
+		t.Fatalf("partial unlock error: %v", err)
+	}
+	err = kbfsOps.LockFile(ctx, n, "other", false)
+	if _, ok := err.(libkbfs.FileLockConflictError); !ok {
+		t.Fatalf("expected a lock conflict after a partial unlock, got %v",
+			err)
+	}
+
+	lk.Type = syscall.F_UNLCK
+	if err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lk); err != nil {
+		t.Fatalf("unlock error: %v", err)
+	}
+	if err := kbfsOps.LockFile(ctx, n, "other", false); err != nil {
+		t.Fatalf("lock after unlock error: %v", err)
+	}
+	if err := kbfsOps.UnlockFile(ctx, n, "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the file releases its locks.
+	lk.Type = syscall.F_WRLCK
+	if err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lk); err != nil {
+		t.Fatalf("relock error: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := kbfsOps.LockFile(ctx, n, "other", false); err != nil {
+		t.Fatalf("lock after close error: %v", err)
+	}
+	if err := kbfsOps.UnlockFile(ctx, n, "other"); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestReaddirMyPublic(t *testing.T) {
 	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
 	defer libkbfs.CheckConfigAndShutdown(t, config)
@@ -8,13 +8,19 @@ package libfuse
 
 import "bazil.org/fuse"
 
+// POSIX locks are only handed to KBFS when the MD server supports
+// file lock leases; otherwise the kernel keeps handling them locally.
+// The remote mdserver doesn't support them yet, so real mounts leave
+// locking to the kernel.
 func getPlatformSpecificMountOptions(dir string, platformParams PlatformParams) ([]fuse.MountOption, error) {
 	return []fuse.MountOption{}, nil
 }
 
-// GetPlatformSpecificMountOptionsForTest makes cross-platform tests work
+// GetPlatformSpecificMountOptionsForTest makes cross-platform tests
+// work.  The local MD servers used in tests support file lock
+// leases, so POSIX locks are handed to KBFS.
 func GetPlatformSpecificMountOptionsForTest() []fuse.MountOption {
-	return []fuse.MountOption{}
+	return []fuse.MountOption{fuse.LockingPOSIX()}
 }
 
 func translatePlatformSpecificError(err error, platformParams PlatformParams) error {
@@ -0,0 +1,50 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// PinFile represents a write-only file where any write of at least
+// one byte pins (or unpins) a subtree of the directory containing
+// it.  The data written is the path of the subtree, relative to that
+// directory; whitespace alone means the directory itself.
+type PinFile struct {
+	dir    *Dir
+	pinned bool
+}
+
+var _ fs.Node = (*PinFile)(nil)
+
+// Attr implements the fs.Node interface for PinFile.
+func (f *PinFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*PinFile)(nil)
+
+var _ fs.HandleWriter = (*PinFile)(nil)
+
+// Write implements the fs.HandleWriter interface for PinFile.
+func (f *PinFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	folder := f.dir.folder
+	folder.fs.log.CDebugf(ctx, "PinFile (pinned=%t) Write", f.pinned)
+	defer func() { folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	n, err := libfs.SetSyncPolicy(ctx, folder.fs.log, folder.fs.config,
+		f.dir.node, req.Data, f.pinned)
+	if err != nil {
+		return err
+	}
+	resp.Size = n
+	return nil
+}
@@ -25,6 +25,8 @@ func handleCommonSpecialFile(
 		return ProfileList{}
 	case libfs.ResetCachesFileName:
 		return &ResetCachesFile{fs}
+	case libfs.JournalFlushLimitFileName:
+		return &JournalFlushLimitFile{fs}
 	}
 
 	return nil
@@ -68,6 +70,12 @@ func handleTLFSpecialFile(
 	case libfs.EditHistoryName:
 		return NewTlfEditHistoryFile(folder, entryValid)
 
+	case libfs.ConflictPreviewFileName:
+		return NewConflictPreviewFile(folder, entryValid)
+
+	case libfs.ConflictHistoryFileName:
+		return NewConflictHistoryFile(folder, entryValid)
+
 	case libfs.UnstageFileName:
 		return &UnstageFile{
 			folder: folder,
@@ -132,6 +140,17 @@ func handleTLFSpecialFile(
 			folder: folder,
 			action: libfs.JournalDisable,
 		}
+
+	case libfs.ArchivedRevDirName:
+		return &ArchiveDir{
+			folder: folder,
+		}
+
+	case libfs.ArchivedTimeDirName:
+		return &ArchiveDir{
+			folder: folder,
+			byTime: true,
+		}
 	}
 	return nil
 }
@@ -195,6 +195,16 @@ func (tlf *TLF) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (
 	return dir.Symlink(ctx, req)
 }
 
+// Link implements the fs.NodeLinker interface for TLF.
+func (tlf *TLF) Link(ctx context.Context, req *fuse.LinkRequest,
+	old fs.Node) (fs.Node, error) {
+	dir, err := tlf.loadDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dir.Link(ctx, req, old)
+}
+
 // Rename implements the fs.NodeRenamer interface for TLF.
 func (tlf *TLF) Rename(ctx context.Context, req *fuse.RenameRequest,
 	newDir fs.Node) error {
@@ -0,0 +1,142 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// The xattr handlers below are shared by File and Dir, since KBFS
+// stores extended attributes in the parent directory's entry for
+// either kind of node.
+
+func getxattr(ctx context.Context, folder *Folder, node libkbfs.Node,
+	req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) (err error) {
+	folder.fs.log.CDebugf(ctx, "Getxattr %s", req.Name)
+	defer func() { folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	value, err := folder.fs.config.KBFSOps().GetXattr(ctx, node, req.Name)
+	if err != nil {
+		return err
+	}
+	resp.Xattr = value
+	return nil
+}
+
+func listxattr(ctx context.Context, folder *Folder, node libkbfs.Node,
+	req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) (err error) {
+	folder.fs.log.CDebugf(ctx, "Listxattr")
+	defer func() { folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	names, err := folder.fs.config.KBFSOps().ListXattr(ctx, node)
+	if err != nil {
+		return err
+	}
+	resp.Append(names...)
+	return nil
+}
+
+func setxattr(ctx context.Context, folder *Folder, node libkbfs.Node,
+	req *fuse.SetxattrRequest) (err error) {
+	folder.fs.log.CDebugf(ctx, "Setxattr %s", req.Name)
+	defer func() { folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	if req.Position != 0 {
+		// Only the OS X resource fork uses offsets, and we don't
+		// support partial writes of attributes.
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+
+	err = folder.fs.config.KBFSOps().SetXattr(
+		ctx, node, req.Name, req.Xattr)
+	if _, ok := err.(libkbfs.InvalidParentPathError); ok {
+		// The TLF root has no entry to hold attributes.
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+	return err
+}
+
+func removexattr(ctx context.Context, folder *Folder, node libkbfs.Node,
+	req *fuse.RemovexattrRequest) (err error) {
+	folder.fs.log.CDebugf(ctx, "Removexattr %s", req.Name)
+	defer func() { folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	err = folder.fs.config.KBFSOps().RemoveXattr(ctx, node, req.Name)
+	if _, ok := err.(libkbfs.InvalidParentPathError); ok {
+		return fuse.ErrNoXattr
+	}
+	return err
+}
+
+var _ fs.NodeGetxattrer = (*File)(nil)
+
+// Getxattr implements the fs.NodeGetxattrer interface for File.
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest,
+	resp *fuse.GetxattrResponse) error {
+	return getxattr(ctx, f.folder, f.node, req, resp)
+}
+
+var _ fs.NodeListxattrer = (*File)(nil)
+
+// Listxattr implements the fs.NodeListxattrer interface for File.
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest,
+	resp *fuse.ListxattrResponse) error {
+	return listxattr(ctx, f.folder, f.node, req, resp)
+}
+
+var _ fs.NodeSetxattrer = (*File)(nil)
+
+// Setxattr implements the fs.NodeSetxattrer interface for File.
+func (f *File) Setxattr(ctx context.Context,
+	req *fuse.SetxattrRequest) error {
+	f.eiCache.destroy()
+	return setxattr(ctx, f.folder, f.node, req)
+}
+
+var _ fs.NodeRemovexattrer = (*File)(nil)
+
+// Removexattr implements the fs.NodeRemovexattrer interface for File.
+func (f *File) Removexattr(ctx context.Context,
+	req *fuse.RemovexattrRequest) error {
+	f.eiCache.destroy()
+	return removexattr(ctx, f.folder, f.node, req)
+}
+
+var _ fs.NodeGetxattrer = (*Dir)(nil)
+
+// Getxattr implements the fs.NodeGetxattrer interface for Dir.
+func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest,
+	resp *fuse.GetxattrResponse) error {
+	return getxattr(ctx, d.folder, d.node, req, resp)
+}
+
+var _ fs.NodeListxattrer = (*Dir)(nil)
+
+// Listxattr implements the fs.NodeListxattrer interface for Dir.
+func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest,
+	resp *fuse.ListxattrResponse) error {
+	return listxattr(ctx, d.folder, d.node, req, resp)
+}
+
+var _ fs.NodeSetxattrer = (*Dir)(nil)
+
+// Setxattr implements the fs.NodeSetxattrer interface for Dir.
+func (d *Dir) Setxattr(ctx context.Context,
+	req *fuse.SetxattrRequest) error {
+	return setxattr(ctx, d.folder, d.node, req)
+}
+
+var _ fs.NodeRemovexattrer = (*Dir)(nil)
+
+// Removexattr implements the fs.NodeRemovexattrer interface for Dir.
+func (d *Dir) Removexattr(ctx context.Context,
+	req *fuse.RemovexattrRequest) error {
+	return removexattr(ctx, d.folder, d.node, req)
+}
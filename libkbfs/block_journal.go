@@ -6,7 +6,6 @@ package libkbfs
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -66,6 +65,7 @@ type blockJournal struct {
 	codec  kbfscodec.Codec
 	crypto cryptoPure
 	dir    string
+	files  journalFiles
 
 	log      logger.Logger
 	deferLog logger.Logger
@@ -80,6 +80,10 @@ type blockJournal struct {
 	// removeUnreferencedBlocks set to true can cause this count to
 	// deviate from the actual disk usage of the journal.
 	unflushedBytes int64
+	// Tracks the number of on-disk blocks counted in
+	// unflushedBytes, each of which is stored in its own set of
+	// files.  It's subject to the same caveats as unflushedBytes.
+	unflushedFiles int64
 }
 
 type blockOpType int
@@ -120,6 +124,10 @@ type blockJournalEntry struct {
 	Contexts map[BlockID][]BlockContext `codec:",omitempty"`
 	// Only used for mdRevMarkerOps.
 	Revision MetadataRevision `codec:",omitempty"`
+	// If true, the entry has been made moot by squashing the MD
+	// revisions it belongs to, and it will be skipped when
+	// flushing.
+	Ignore bool `codec:",omitempty"`
 
 	codec.UnknownFieldSetHandler
 }
@@ -150,30 +158,34 @@ func (e blockJournalEntry) getSingleContext() (
 }
 
 // makeBlockJournal returns a new blockJournal for the given
-// directory. Any existing journal entries are read.
+// directory, whose files are accessed through the given
+// journalFiles. Any existing journal entries are read.
 func makeBlockJournal(
 	ctx context.Context, codec kbfscodec.Codec, crypto cryptoPure,
-	dir string, log logger.Logger) (*blockJournal, error) {
+	dir string, files journalFiles, log logger.Logger) (
+	*blockJournal, error) {
 	journalPath := filepath.Join(dir, "block_journal")
 	deferLog := log.CloneWithAddedDepth(1)
 	j := makeDiskJournal(
-		codec, journalPath, reflect.TypeOf(blockJournalEntry{}))
+		codec, journalPath, files, reflect.TypeOf(blockJournalEntry{}))
 	journal := &blockJournal{
 		codec:    codec,
 		crypto:   crypto,
 		dir:      dir,
+		files:    files,
 		log:      log,
 		deferLog: deferLog,
 		j:        j,
 	}
 
-	refs, unflushedBytes, err := journal.readJournal(ctx)
+	refs, unflushedBytes, unflushedFiles, err := journal.readJournal(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	journal.refs = refs
 	journal.unflushedBytes = unflushedBytes
+	journal.unflushedFiles = unflushedFiles
 	return journal, nil
 }
 
@@ -216,116 +228,131 @@ func (j *blockJournal) readJournalEntry(ordinal journalOrdinal) (
 }
 
 // readJournal reads the journal and returns a map of all the block
-// references in the journal and the total number of bytes that need
-// flushing.
+// references in the journal, and the total number of bytes and
+// blocks that need flushing.
 func (j *blockJournal) readJournal(ctx context.Context) (
-	map[BlockID]blockRefMap, int64, error) {
+	map[BlockID]blockRefMap, int64, int64, error) {
 	refs := make(map[BlockID]blockRefMap)
 
 	first, err := j.j.readEarliestOrdinal()
 	if os.IsNotExist(err) {
-		return refs, 0, nil
+		return refs, 0, 0, nil
 	} else if err != nil {
-		return nil, 0, err
+		return nil, 0, 0, err
 	}
 	last, err := j.j.readLatestOrdinal()
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, 0, err
 	}
 
 	j.log.CDebugf(ctx, "Reading journal entries %d to %d", first, last)
 
-	var unflushedBytes int64
+	var unflushedBytes, unflushedFiles int64
 	for i := first; i <= last; i++ {
 		e, err := j.readJournalEntry(i)
 		if err != nil {
-			return nil, 0, err
+			return nil, 0, 0, err
 		}
 
-		// Handle single ops separately.
-		switch e.Op {
-		case blockPutOp, addRefOp:
-			id, context, err := e.getSingleContext()
+		err = addJournalEntryRefs(refs, e, i)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		// Only puts count as bytes, on the assumption that the
+		// refs won't have to upload any new bytes.  (This might
+		// be wrong if all references to a block were deleted
+		// since the addref entry was appended.)
+		if e.Op == blockPutOp && !e.Ignore {
+			id, _, err := e.getSingleContext()
 			if err != nil {
-				return nil, 0, err
+				return nil, 0, 0, err
 			}
-
-			blockRefs := refs[id]
-			if blockRefs == nil {
-				blockRefs = make(blockRefMap)
-				refs[id] = blockRefs
+			b, err := j.getDataSize(id)
+			// Ignore ENOENT errors, since users like
+			// BlockServerDisk can remove block data without
+			// deleting the corresponding addRef.
+			if err != nil && !os.IsNotExist(err) {
+				return nil, 0, 0, err
 			}
+			unflushedBytes += b
+			unflushedFiles++
+		}
+	}
+	j.log.CDebugf(ctx, "Found %d block bytes in the journal", unflushedBytes)
+	return refs, unflushedBytes, unflushedFiles, nil
+}
 
-			err = blockRefs.put(context, liveBlockRef, i)
-			if err != nil {
-				return nil, 0, err
-			}
+// addJournalEntryRefs applies the block reference changes made by
+// the journal entry with the given ordinal to refs.
+func addJournalEntryRefs(refs map[BlockID]blockRefMap,
+	e blockJournalEntry, i journalOrdinal) error {
+	if e.Ignore {
+		return nil
+	}
 
-			// Only puts count as bytes, on the assumption that the
-			// refs won't have to upload any new bytes.  (This might
-			// be wrong if all references to a block were deleted
-			// since the addref entry was appended.)
-			if e.Op == blockPutOp {
-				b, err := j.getDataSize(id)
-				// Ignore ENOENT errors, since users like
-				// BlockServerDisk can remove block data without
-				// deleting the corresponding addRef.
-				if err != nil && !os.IsNotExist(err) {
-					return nil, 0, err
-				}
-				unflushedBytes += b
-			}
+	// Handle single ops separately.
+	switch e.Op {
+	case blockPutOp, addRefOp:
+		id, context, err := e.getSingleContext()
+		if err != nil {
+			return err
+		}
 
-			continue
+		blockRefs := refs[id]
+		if blockRefs == nil {
+			blockRefs = make(blockRefMap)
+			refs[id] = blockRefs
 		}
 
-		for id, idContexts := range e.Contexts {
-			blockRefs := refs[id]
-
-			switch e.Op {
-			case removeRefsOp:
-				if blockRefs == nil {
-					// All refs are already gone,
-					// which is not an error.
-					continue
-				}
+		return blockRefs.put(context, liveBlockRef, i)
+	}
 
-				for _, context := range idContexts {
-					err := blockRefs.remove(context, nil)
-					if err != nil {
-						return nil, 0, err
-					}
-				}
+	for id, idContexts := range e.Contexts {
+		blockRefs := refs[id]
 
-				if len(blockRefs) == 0 {
-					delete(refs, id)
-				}
+		switch e.Op {
+		case removeRefsOp:
+			if blockRefs == nil {
+				// All refs are already gone,
+				// which is not an error.
+				continue
+			}
 
-			case archiveRefsOp:
-				if blockRefs == nil {
-					blockRefs = make(blockRefMap)
-					refs[id] = blockRefs
+			for _, context := range idContexts {
+				err := blockRefs.remove(context, nil)
+				if err != nil {
+					return err
 				}
+			}
 
-				for _, context := range idContexts {
-					err := blockRefs.put(
-						context, archivedBlockRef, i)
-					if err != nil {
-						return nil, 0, err
-					}
-				}
+			if len(blockRefs) == 0 {
+				delete(refs, id)
+			}
 
-			case mdRevMarkerOp:
-				// Ignore MD revision markers.
-				continue
+		case archiveRefsOp:
+			if blockRefs == nil {
+				blockRefs = make(blockRefMap)
+				refs[id] = blockRefs
+			}
 
-			default:
-				return nil, 0, fmt.Errorf("Unknown op %s", e.Op)
+			for _, context := range idContexts {
+				err := blockRefs.put(
+					context, archivedBlockRef, i)
+				if err != nil {
+					return err
+				}
 			}
+
+		case mdRevMarkerOp:
+			// Ignore MD revision markers.
+			continue
+
+		default:
+			return fmt.Errorf("Unknown op %s", e.Op)
 		}
 	}
-	j.log.CDebugf(ctx, "Found %d block bytes in the journal", unflushedBytes)
-	return refs, unflushedBytes, nil
+	return nil
 }
 
 func (j *blockJournal) appendJournalEntry(entry blockJournalEntry) (
@@ -391,16 +418,12 @@ func (j *blockJournal) putRefEntry(
 }
 
 func (j *blockJournal) getDataSize(id BlockID) (int64, error) {
-	fi, err := os.Stat(j.blockDataPath(id))
-	if err != nil {
-		return 0, err
-	}
-	return fi.Size(), nil
+	return j.files.dataSize(j.blockDataPath(id))
 }
 
 func (j *blockJournal) getData(id BlockID) (
 	[]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
-	data, err := ioutil.ReadFile(j.blockDataPath(id))
+	data, err := j.files.readFile(j.blockDataPath(id))
 	if os.IsNotExist(err) {
 		return nil, kbfscrypto.BlockCryptKeyServerHalf{},
 			blockNonExistentError{id}
@@ -409,7 +432,7 @@ func (j *blockJournal) getData(id BlockID) (
 	}
 
 	keyServerHalfPath := j.keyServerHalfPath(id)
-	buf, err := ioutil.ReadFile(keyServerHalfPath)
+	buf, err := j.files.readFile(keyServerHalfPath)
 	if os.IsNotExist(err) {
 		return nil, kbfscrypto.BlockCryptKeyServerHalf{},
 			blockNonExistentError{id}
@@ -529,11 +552,12 @@ func (j *blockJournal) putData(
 		return err
 	}
 
-	err = ioutil.WriteFile(j.blockDataPath(id), buf, 0600)
+	err = j.files.writeFile(j.blockDataPath(id), buf)
 	if err != nil {
 		return err
 	}
 	j.unflushedBytes += int64(len(buf))
+	j.unflushedFiles++
 
 	// TODO: Add integrity-checking for key server half?
 
@@ -541,8 +565,7 @@ func (j *blockJournal) putData(
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(
-		j.keyServerHalfPath(id), data, 0600)
+	err = j.files.writeFile(j.keyServerHalfPath(id), data)
 	if err != nil {
 		return err
 	}
@@ -648,7 +671,7 @@ func (j *blockJournal) removeBlockData(id BlockID) error {
 	}
 	path := j.blockPath(id)
 
-	err := os.RemoveAll(path)
+	err := j.files.removeAll(path)
 	if err != nil {
 		return err
 	}
@@ -751,6 +774,19 @@ func (be blockEntriesToFlush) flushNeeded() bool {
 	return be.length() > 0
 }
 
+// putBytes returns the number of bytes of block data that flushing
+// these entries will upload.
+func (be blockEntriesToFlush) putBytes() int64 {
+	if be.puts == nil {
+		return 0
+	}
+	var bytes int64
+	for _, bs := range be.puts.blockStates {
+		bytes += int64(bs.readyBlockData.GetEncodedSize())
+	}
+	return bytes
+}
+
 // Only entries with ordinals less than the given ordinal (assumed to
 // be <= latest ordinal + 1) are returned.  Also returns the maximum
 // MD revision that can be merged after the returned entries are
@@ -803,6 +839,13 @@ func (j *blockJournal) getNextEntriesToFlush(
 			return blockEntriesToFlush{}, MetadataRevisionUninitialized, err
 		}
 
+		if entry.Ignore {
+			// Still return the entry, so that it gets removed
+			// along with the rest of the batch.
+			entries.all = append(entries.all, entry)
+			continue
+		}
+
 		var data []byte
 		var serverHalf kbfscrypto.BlockCryptKeyServerHalf
 
@@ -821,7 +864,7 @@ func (j *blockJournal) getNextEntriesToFlush(
 			entries.puts.addNewBlock(
 				BlockPointer{ID: id, BlockContext: bctx},
 				nil, /* only used by folderBranchOps */
-				ReadyBlockData{data, serverHalf}, nil)
+				ReadyBlockData{buf: data, serverHalf: serverHalf}, nil)
 
 		case addRefOp:
 			id, bctx, err := entry.getSingleContext()
@@ -853,6 +896,45 @@ func (j *blockJournal) getNextEntriesToFlush(
 	return entries, maxMDRevToFlush, nil
 }
 
+// getNextEntriesToFlushBytes returns the number of bytes of block
+// data in the entries that getNextEntriesToFlush would return for the
+// given arguments, without reading the data.
+func (j *blockJournal) getNextEntriesToFlushBytes(
+	end journalOrdinal, maxToFlush int) (int64, error) {
+	first, err := j.j.readEarliestOrdinal()
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	loopEnd := end
+	if first+journalOrdinal(maxToFlush) < end {
+		loopEnd = first + journalOrdinal(maxToFlush)
+	}
+
+	var bytes int64
+	for ordinal := first; ordinal < loopEnd; ordinal++ {
+		entry, err := j.readJournalEntry(ordinal)
+		if err != nil {
+			return 0, err
+		}
+		if entry.Ignore || entry.Op != blockPutOp {
+			continue
+		}
+		id, _, err := entry.getSingleContext()
+		if err != nil {
+			return 0, err
+		}
+		size, err := j.getDataSize(id)
+		if err != nil {
+			return 0, err
+		}
+		bytes += size
+	}
+	return bytes, nil
+}
+
 // flushNonBPSBlockJournalEntry flushes journal entries that can't be
 // parallelized via a blockPutState.
 func flushNonBPSBlockJournalEntry(
@@ -937,8 +1019,10 @@ func flushBlockEntries(ctx context.Context, log logger.Logger,
 func (j *blockJournal) removeFlushedEntry(ctx context.Context,
 	ordinal journalOrdinal, entry blockJournalEntry) (
 	flushedBytes int64, err error) {
-	// Fix up the block byte count if we've finished a Put.
-	if entry.Op == blockPutOp {
+	// Fix up the block byte count if we've finished a Put.  Ignored
+	// entries were already taken out of the count when they were
+	// squashed.
+	if entry.Op == blockPutOp && !entry.Ignore {
 		id, _, err := entry.getSingleContext()
 		if err != nil {
 			return 0, err
@@ -954,6 +1038,7 @@ func (j *blockJournal) removeFlushedEntry(ctx context.Context,
 				flushedBytes, j.unflushedBytes)
 		}
 		j.unflushedBytes -= flushedBytes
+		j.unflushedFiles--
 	}
 
 	earliestOrdinal, err := j.j.readEarliestOrdinal()
@@ -971,6 +1056,11 @@ func (j *blockJournal) removeFlushedEntry(ctx context.Context,
 		return 0, err
 	}
 
+	if entry.Ignore {
+		// The entry's refs were already removed.
+		return 0, nil
+	}
+
 	// Remove any of the entry's refs that hasn't been modified by
 	// a subsequent block op (i.e., that has earliestOrdinal as a
 	// tag).
@@ -1024,7 +1114,7 @@ func (j *blockJournal) removeFlushedEntries(ctx context.Context,
 }
 
 func (j *blockJournal) checkInSync(ctx context.Context) error {
-	refs, _, err := j.readJournal(ctx)
+	refs, _, _, err := j.readJournal(ctx)
 	if err != nil {
 		return err
 	}
@@ -46,6 +46,7 @@ func makeFakeBlockJournalEntryFuture(t *testing.T) blockJournalEntryFuture {
 				},
 			},
 			MetadataRevisionInitial,
+			false,
 			codec.UnknownFieldSetHandler{},
 		},
 		makeExtraOrBust("blockJournalEntry", t),
@@ -82,7 +83,8 @@ func setupBlockJournalTest(t *testing.T) (
 		}
 	}()
 
-	j, err = makeBlockJournal(ctx, codec, crypto, tempdir, log)
+	j, err = makeBlockJournal(
+		ctx, codec, crypto, tempdir, journalFiles{}, log)
 	require.NoError(t, err)
 	require.Equal(t, 0, getBlockJournalLength(t, j))
 
@@ -166,7 +168,7 @@ func TestBlockJournalBasic(t *testing.T) {
 	// Shutdown and restart.
 	err := j.checkInSync(ctx)
 	require.NoError(t, err)
-	j, err = makeBlockJournal(ctx, j.codec, j.crypto, tempdir, j.log)
+	j, err = makeBlockJournal(ctx, j.codec, j.crypto, tempdir, j.files, j.log)
 	require.NoError(t, err)
 
 	require.Equal(t, 2, getBlockJournalLength(t, j))
@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"fmt"
 
+	"github.com/keybase/kbfs/kbfscrypto"
 	"golang.org/x/net/context"
 )
 
@@ -18,12 +19,26 @@ type BlockOpsStandard struct {
 
 var _ BlockOps = (*BlockOpsStandard)(nil)
 
-// Get implements the BlockOps interface for BlockOpsStandard.
-func (b *BlockOpsStandard) Get(ctx context.Context, kmd KeyMetadata,
-	blockPtr BlockPointer, block Block) error {
+// getEncrypted returns the verified, encrypted data and server half
+// for the given block, from the disk block cache if possible, and
+// otherwise from the block server (in which case the block is then
+// added to the disk block cache).
+func (b *BlockOpsStandard) getEncrypted(ctx context.Context, tlfID TlfID,
+	blockPtr BlockPointer) ([]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
+	crypto := b.config.Crypto()
+	dbc := b.config.DiskBlockCache()
+	if dbc != nil {
+		buf, blockServerHalf, err := dbc.Get(ctx, tlfID, blockPtr.ID)
+		if err == nil && crypto.VerifyBlockID(buf, blockPtr.ID) == nil {
+			return buf, blockServerHalf, nil
+		}
+		// On any failure, including a corrupted cache entry, just
+		// fall back to the block server.
+	}
+
 	bserv := b.config.BlockServer()
 	buf, blockServerHalf, err := bserv.Get(
-		ctx, kmd.TlfID(), blockPtr.ID, blockPtr.BlockContext)
+		ctx, tlfID, blockPtr.ID, blockPtr.BlockContext)
 	if err != nil {
 		// Temporary code to track down bad block
 		// requests. Remove when not needed anymore.
@@ -32,14 +47,31 @@ func (b *BlockOpsStandard) Get(ctx context.Context, kmd KeyMetadata,
 				err, blockPtr))
 		}
 
-		return err
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
 	}
 
-	crypto := b.config.Crypto()
 	if err := crypto.VerifyBlockID(buf, blockPtr.ID); err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+
+	if dbc != nil {
+		// The disk cache logs its own failures, and a block that
+		// can't be cached is still perfectly readable.
+		_ = dbc.Put(ctx, tlfID, blockPtr.ID, buf, blockServerHalf)
+	}
+	return buf, blockServerHalf, nil
+}
+
+// Get implements the BlockOps interface for BlockOpsStandard.
+func (b *BlockOpsStandard) Get(ctx context.Context, kmd KeyMetadata,
+	blockPtr BlockPointer, block Block) error {
+	buf, blockServerHalf, err := b.getEncrypted(ctx, kmd.TlfID(), blockPtr)
+	if err != nil {
 		return err
 	}
 
+	crypto := b.config.Crypto()
+
 	tlfCryptKey, err := b.config.KeyManager().
 		GetTLFCryptKeyForBlockDecryption(ctx, kmd, blockPtr)
 	if err != nil {
@@ -58,6 +90,12 @@ func (b *BlockOpsStandard) Get(ctx context.Context, kmd KeyMetadata,
 	if err != nil {
 		return err
 	}
+	// Compressed blocks must be marked as such in their pointers,
+	// so that older clients refuse to read them.
+	if encryptedBlock.Version == EncryptionSecretboxWithSnappy &&
+		blockPtr.DataVer < CompressedBlocksDataVer {
+		return UnknownEncryptionVer{encryptedBlock.Version}
+	}
 
 	// decrypt the block
 	err = crypto.DecryptBlock(encryptedBlock, blockCryptKey, block)
@@ -100,7 +138,13 @@ func (b *BlockOpsStandard) Ready(ctx context.Context, kmd KeyMetadata,
 		return
 	}
 
-	plainSize, encryptedBlock, err := crypto.EncryptBlock(block, blockKey)
+	var encryptedBlock EncryptedBlock
+	if b.config.DoBlockCompression() {
+		plainSize, encryptedBlock, err =
+			crypto.EncryptBlockCompressed(block, blockKey)
+	} else {
+		plainSize, encryptedBlock, err = crypto.EncryptBlock(block, blockKey)
+	}
 	if err != nil {
 		return
 	}
@@ -113,10 +157,14 @@ func (b *BlockOpsStandard) Ready(ctx context.Context, kmd KeyMetadata,
 	readyBlockData = ReadyBlockData{
 		buf:        buf,
 		serverHalf: serverHalf,
+		compressed: encryptedBlock.Version == EncryptionSecretboxWithSnappy,
 	}
 
 	encodedSize := readyBlockData.GetEncodedSize()
-	if encodedSize < plainSize {
+	// Compressed blocks can legitimately end up smaller than their
+	// plaintext.
+	if encodedSize < plainSize &&
+		encryptedBlock.Version != EncryptionSecretboxWithSnappy {
 		err = TooLowByteCountError{
 			ExpectedMinByteCount: plainSize,
 			ByteCount:            encodedSize,
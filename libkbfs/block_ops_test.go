@@ -265,6 +265,34 @@ func TestBlockOpsGetFailDecryptBlockData(t *testing.T) {
 	}
 }
 
+func TestBlockOpsGetFailCompressedOldDataVer(t *testing.T) {
+	mockCtrl, config, ctx := blockOpsInit(t)
+	defer blockOpsShutdown(mockCtrl, config)
+
+	kmd := makeKMD()
+	// A compressed block whose pointer doesn't have a new enough
+	// data version must not be decrypted.
+	id := fakeBlockID(1)
+	encData := []byte{1, 2, 3, 4}
+	blockPtr := BlockPointer{ID: id, DataVer: ContentDefinedChunksDataVer}
+	config.mockBserv.EXPECT().Get(ctx, kmd.TlfID(), id, blockPtr.BlockContext).Return(
+		encData, kbfscrypto.BlockCryptKeyServerHalf{}, nil)
+	config.mockCrypto.EXPECT().VerifyBlockID(encData, blockPtr.ID).Return(nil)
+	expectGetTLFCryptKeyForBlockDecryption(config, kmd, blockPtr)
+	config.mockCrypto.EXPECT().UnmaskBlockCryptKey(gomock.Any(), gomock.Any()).
+		Return(kbfscrypto.BlockCryptKey{}, nil)
+	config.mockCodec.EXPECT().Decode(encData, gomock.Any()).
+		Do(func(buf []byte, obj interface{}) {
+			obj.(*EncryptedBlock).Version = EncryptionSecretboxWithSnappy
+		}).Return(nil)
+
+	expectedErr := UnknownEncryptionVer{EncryptionSecretboxWithSnappy}
+	if err := config.BlockOps().Get(
+		ctx, kmd, blockPtr, nil); err != expectedErr {
+		t.Errorf("Got bad error: %v", err)
+	}
+}
+
 func TestBlockOpsReadySuccess(t *testing.T) {
 	mockCtrl, config, ctx := blockOpsInit(t)
 	defer blockOpsShutdown(mockCtrl, config)
@@ -138,8 +138,9 @@ func (fb FileBlock) DeepCopy(codec kbfscodec.Codec) (*FileBlock, error) {
 
 // DefaultNewBlockDataVersion returns the default data version for new blocks.
 func DefaultNewBlockDataVersion(c Config, holes bool) DataVer {
-	if holes {
-		return FilesWithHolesDataVer
+	dver := c.BlockSplitter().DataVersion()
+	if holes && dver < FilesWithHolesDataVer {
+		dver = FilesWithHolesDataVer
 	}
-	return FirstValidDataVer
+	return dver
 }
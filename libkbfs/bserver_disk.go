@@ -113,7 +113,8 @@ func (b *BlockServerDisk) getStorage(ctx context.Context, tlfID TlfID) (
 	}
 
 	path := filepath.Join(b.dirPath, tlfID.String())
-	journal, err := makeBlockJournal(ctx, b.codec, b.crypto, path, b.log)
+	journal, err := makeBlockJournal(
+		ctx, b.codec, b.crypto, path, journalFiles{}, b.log)
 	if err != nil {
 		return nil, err
 	}
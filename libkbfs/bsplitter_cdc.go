@@ -0,0 +1,212 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+
+	"github.com/keybase/kbfs/kbfscodec"
+)
+
+const (
+	// cdcWindowSize is the number of bytes that the rolling hash
+	// covers when looking for chunk boundaries.
+	cdcWindowSize = 64
+
+	// The default chunk sizes for BlockSplitterCDC.  Chunks average
+	// roughly cdcMinSizeDefault + cdcAvgSizeDefault bytes.
+	cdcMinSizeDefault = 64 << 10
+	cdcAvgSizeDefault = 256 << 10
+)
+
+// cdcHashTable maps each byte value to a pseudo-random 32-bit value
+// for the buzhash rolling hash.  It must never change, since two
+// clients can only share identical chunks if they split at the same
+// places.
+var cdcHashTable = func() (table [256]uint32) {
+	// splitmix64, with a fixed seed.
+	x := uint64(0x6b626673)
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		z ^= z >> 31
+		table[i] = uint32(z)
+	}
+	return table
+}()
+
+func rotl32(x uint32, n uint) uint32 {
+	n %= 32
+	return (x << n) | (x >> (32 - n))
+}
+
+// BlockSplitterCDC implements the BlockSplitter interface using
+// content-defined chunking: a block ends wherever a buzhash of the
+// trailing cdcWindowSize bytes matches a fixed bit pattern, subject
+// to minimum and maximum block sizes.  Since boundaries depend only
+// on nearby content, a small edit to a file only changes the blocks
+// around that edit, and identical runs of data in different files
+// (or different versions of a file) produce identical blocks, which
+// ReadyBlock can then dedup via BlockCache.CheckForKnownPtr.
+//
+// Files written with this splitter get ContentDefinedChunksDataVer,
+// so that older clients, which would re-split the file at fixed
+// offsets, refuse to touch them.
+type BlockSplitterCDC struct {
+	minSize                 int64
+	maxSize                 int64
+	mask                    uint32
+	blockChangeEmbedMaxSize uint64
+}
+
+var _ BlockSplitter = (*BlockSplitterCDC)(nil)
+
+// NewBlockSplitterCDC creates a new BlockSplitterCDC.  avgSize, which
+// must be a power of 2, is the expected number of bytes past minSize
+// before a boundary is found.  Like NewBlockSplitterSimple, it
+// adjusts maxSize to account for the overhead of encoding a file
+// block.
+func NewBlockSplitterCDC(minSize, avgSize, maxSize int64,
+	blockChangeEmbedMaxSize uint64, codec kbfscodec.Codec) (
+	*BlockSplitterCDC, error) {
+	if avgSize <= 0 || avgSize&(avgSize-1) != 0 {
+		return nil, fmt.Errorf("Average chunk size %d is not a power of 2",
+			avgSize)
+	}
+	if minSize <= cdcWindowSize || minSize >= maxSize {
+		return nil, fmt.Errorf("Invalid chunk sizes: min=%d, max=%d",
+			minSize, maxSize)
+	}
+
+	simple, err := NewBlockSplitterSimple(
+		maxSize, blockChangeEmbedMaxSize, codec)
+	if err != nil {
+		return nil, err
+	}
+	if simple.maxSize <= minSize {
+		return nil, fmt.Errorf("Max chunk size %d leaves no room over "+
+			"the min chunk size %d", simple.maxSize, minSize)
+	}
+
+	return &BlockSplitterCDC{
+		minSize:                 minSize,
+		maxSize:                 simple.maxSize,
+		mask:                    uint32(avgSize - 1),
+		blockChangeEmbedMaxSize: blockChangeEmbedMaxSize,
+	}, nil
+}
+
+// nextBoundary returns the smallest e in (from, len(contents)] such
+// that contents[:e] should end a block, or -1 if there is none.
+// Blocks never end before minSize bytes.
+func (b *BlockSplitterCDC) nextBoundary(contents []byte, from int64) int64 {
+	end := int64(len(contents))
+	if from < b.minSize-1 {
+		from = b.minSize - 1
+	}
+	if from >= end {
+		return -1
+	}
+
+	// Prime the hash with the window preceding the first candidate
+	// boundary.
+	start := from - cdcWindowSize
+	if start < 0 {
+		start = 0
+	}
+	var h uint32
+	for i := start; i < end; i++ {
+		h = rotl32(h, 1) ^ cdcHashTable[contents[i]]
+		if i-start >= cdcWindowSize {
+			h ^= rotl32(cdcHashTable[contents[i-cdcWindowSize]],
+				cdcWindowSize)
+		}
+		if i >= from && h&b.mask == 0 {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// CopyUntilSplit implements the BlockSplitter interface for
+// BlockSplitterCDC.
+func (b *BlockSplitterCDC) CopyUntilSplit(
+	block *FileBlock, lastBlock bool, data []byte, off int64) int64 {
+	currLen := int64(len(block.Contents))
+	end := off + int64(len(data))
+	if end > currLen {
+		if end > b.maxSize {
+			end = b.maxSize
+		}
+		if end <= currLen {
+			// The block is already full; only overwrite what's
+			// already there.
+			end = currLen
+		} else {
+			if off >= end {
+				return 0
+			}
+			// Grow the block, but only up to the first boundary
+			// among the new bytes.  Boundaries within the existing
+			// bytes are left for CheckSplit to deal with.
+			contents := make([]byte, end)
+			copy(contents, block.Contents)
+			copy(contents[off:], data[:end-off])
+			if boundary := b.nextBoundary(contents, currLen); boundary > 0 {
+				end = boundary
+			}
+			block.Contents = contents[:end]
+			if end <= off {
+				return 0
+			}
+			return end - off
+		}
+	}
+
+	if off >= end {
+		return 0
+	}
+	copy(block.Contents[off:end], data)
+	return end - off
+}
+
+// CheckSplit implements the BlockSplitter interface for
+// BlockSplitterCDC.
+func (b *BlockSplitterCDC) CheckSplit(block *FileBlock) int64 {
+	contents := block.Contents
+	if int64(len(contents)) > b.maxSize {
+		contents = contents[:b.maxSize]
+	}
+	boundary := b.nextBoundary(contents, 0)
+	switch {
+	case boundary > 0 && boundary < int64(len(block.Contents)):
+		return boundary
+	case boundary > 0:
+		return 0
+	case int64(len(block.Contents)) > b.maxSize:
+		return b.maxSize
+	case int64(len(block.Contents)) == b.maxSize:
+		return 0
+	default:
+		// No boundary yet, so this block should take bytes from
+		// the next one.
+		return -1
+	}
+}
+
+// ShouldEmbedBlockChanges implements the BlockSplitter interface for
+// BlockSplitterCDC.
+func (b *BlockSplitterCDC) ShouldEmbedBlockChanges(
+	bc *BlockChanges) bool {
+	return bc.SizeEstimate() <= b.blockChangeEmbedMaxSize
+}
+
+// DataVersion implements the BlockSplitter interface for
+// BlockSplitterCDC.
+func (b *BlockSplitterCDC) DataVersion() DataVer {
+	return ContentDefinedChunksDataVer
+}
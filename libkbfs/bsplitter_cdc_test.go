@@ -0,0 +1,172 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/keybase/kbfs/kbfscodec"
+)
+
+func makeCDCTestData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+// cdcSplitAll splits data into blocks the way a series of appends
+// to the end of a file would.
+func cdcSplitAll(t *testing.T, bsplit *BlockSplitterCDC,
+	data []byte) [][]byte {
+	var blocks [][]byte
+	for len(data) > 0 {
+		fblock := NewFileBlock().(*FileBlock)
+		n := bsplit.CopyUntilSplit(fblock, true, data, 0)
+		if n <= 0 {
+			t.Fatalf("Copied %d bytes into an empty block", n)
+		}
+		if splitAt := bsplit.CheckSplit(fblock); splitAt > 0 {
+			t.Errorf("Block of %d bytes should have been split at %d",
+				len(fblock.Contents), splitAt)
+		}
+		blocks = append(blocks, fblock.Contents)
+		data = data[n:]
+	}
+	return blocks
+}
+
+func TestBsplitterCDCBounds(t *testing.T) {
+	bsplit := &BlockSplitterCDC{100, 1000, 255, 10}
+	blocks := cdcSplitAll(t, bsplit, makeCDCTestData(50000))
+	for i, block := range blocks {
+		if len(block) > 1000 {
+			t.Errorf("Block %d is too big: %d", i, len(block))
+		}
+		if i < len(blocks)-1 && len(block) < 100 {
+			t.Errorf("Block %d is too small: %d", i, len(block))
+		}
+	}
+	if len(blocks) < 50000/1000 {
+		t.Errorf("Too few blocks: %d", len(blocks))
+	}
+}
+
+func TestBsplitterCDCInsertShiftsFewBlocks(t *testing.T) {
+	bsplit := &BlockSplitterCDC{100, 1000, 255, 10}
+	data := makeCDCTestData(50000)
+	blocks := cdcSplitAll(t, bsplit, data)
+
+	// Insert a byte at the very beginning; only the first few
+	// blocks should differ.
+	shifted := cdcSplitAll(t, bsplit, append([]byte{42}, data...))
+	seen := make(map[string]bool)
+	for _, block := range blocks {
+		seen[string(block)] = true
+	}
+	numNew := 0
+	for _, block := range shifted {
+		if !seen[string(block)] {
+			numNew++
+		}
+	}
+	if numNew*10 > len(shifted) {
+		t.Errorf("%d of %d blocks changed after a one-byte insert",
+			numNew, len(shifted))
+	}
+}
+
+func TestBsplitterCDCCheckSplit(t *testing.T) {
+	bsplit := &BlockSplitterCDC{100, 1000, 255, 10}
+	allData := makeCDCTestData(50000)
+	// Find a max-sized run of data with a boundary in it.
+	var data []byte
+	boundary := int64(-1)
+	for start := 0; boundary < 0; start += 1000 {
+		if start+1000 > len(allData) {
+			t.Fatalf("No boundaries found")
+		}
+		data = allData[start : start+1000]
+		boundary = bsplit.nextBoundary(data, 0)
+	}
+
+	fblock := NewFileBlock().(*FileBlock)
+	fblock.Contents = data[:boundary]
+	if splitAt := bsplit.CheckSplit(fblock); splitAt != 0 {
+		t.Errorf("Block ending at a boundary split at %d", splitAt)
+	}
+
+	fblock.Contents = data[:boundary+10]
+	if splitAt := bsplit.CheckSplit(fblock); splitAt != boundary {
+		t.Errorf("Block split at %d, not %d", splitAt, boundary)
+	}
+
+	fblock.Contents = data[:boundary-1]
+	if splitAt := bsplit.CheckSplit(fblock); splitAt != -1 {
+		t.Errorf("Short block split at %d, instead of asking for more",
+			splitAt)
+	}
+}
+
+func TestBsplitterCDCOverwriteMiddle(t *testing.T) {
+	bsplit := &BlockSplitterCDC{100, 1000, 255, 10}
+	fblock := NewFileBlock().(*FileBlock)
+	fblock.Contents = []byte{10, 9, 8, 7, 6}
+	data := []byte{1, 2}
+
+	if n := bsplit.CopyUntilSplit(fblock, false, data, 1); n != 2 {
+		t.Errorf("Did not copy expected number of bytes: %d", n)
+	} else if !bytes.Equal(fblock.Contents, []byte{10, 1, 2, 7, 6}) {
+		t.Errorf("Wrong file contents after copy: %v", fblock.Contents)
+	}
+}
+
+func TestBsplitterCDCNewValidatesSizes(t *testing.T) {
+	codec := kbfscodec.NewMsgpack()
+	if _, err := NewBlockSplitterCDC(1<<10, 3000, 1<<16, 10, codec); err == nil {
+		t.Errorf("Non-power-of-2 average size was accepted")
+	}
+	if _, err := NewBlockSplitterCDC(1<<16, 1<<12, 1<<10, 10, codec); err == nil {
+		t.Errorf("Min size bigger than max size was accepted")
+	}
+	bsplit, err := NewBlockSplitterCDC(1<<10, 1<<12, 1<<16, 10, codec)
+	if err != nil {
+		t.Fatalf("Couldn't make splitter: %v", err)
+	}
+	if bsplit.maxSize >= 1<<16 {
+		t.Errorf("Max size %d doesn't account for encoding overhead",
+			bsplit.maxSize)
+	}
+}
+
+func TestBsplitterCDCDataVersion(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	// Only files written with the CDC splitter are marked with
+	// its data version.
+	if dver := config.DataVersion(); dver != FirstValidDataVer {
+		t.Errorf("Unexpected data version with simple splitter: %d", dver)
+	}
+	if dver := DefaultNewBlockDataVersion(config, false); dver !=
+		FirstValidDataVer {
+		t.Errorf("Unexpected new block data version: %d", dver)
+	}
+
+	bsplit, err := NewBlockSplitterCDC(1<<10, 1<<12, 1<<16, 10,
+		config.Codec())
+	if err != nil {
+		t.Fatalf("Couldn't make splitter: %v", err)
+	}
+	config.SetBlockSplitter(bsplit)
+	if dver := config.DataVersion(); dver != ContentDefinedChunksDataVer {
+		t.Errorf("Unexpected data version with CDC splitter: %d", dver)
+	}
+	if dver := DefaultNewBlockDataVersion(config, false); dver !=
+		ContentDefinedChunksDataVer {
+		t.Errorf("Unexpected new block data version: %d", dver)
+	}
+}
@@ -130,3 +130,9 @@ func (b *BlockSplitterSimple) ShouldEmbedBlockChanges(
 	bc *BlockChanges) bool {
 	return bc.SizeEstimate() <= b.blockChangeEmbedMaxSize
 }
+
+// DataVersion implements the BlockSplitter interface for
+// BlockSplitterSimple.
+func (b *BlockSplitterSimple) DataVersion() DataVer {
+	return FirstValidDataVer
+}
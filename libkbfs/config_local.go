@@ -54,6 +54,9 @@ type ConfigLocal struct {
 	kcache      KeyCache
 	bcache      BlockCache
 	dirtyBcache DirtyBlockCache
+	diskBcache  DiskBlockCache
+	crHistory   ConflictHistory
+	prefetcher  Prefetcher
 	codec       kbfscodec.Codec
 	mdops       MDOps
 	kops        KeyOps
@@ -72,6 +75,7 @@ type ConfigLocal struct {
 	registry    metrics.Registry
 	loggerFn    func(prefix string) logger.Logger
 	noBGFlush   bool // logic opposite so the default value is the common setting
+	compress    bool
 	rwpWaitTime time.Duration
 
 	maxFileBytes uint64
@@ -333,6 +337,48 @@ func (c *ConfigLocal) SetDirtyBlockCache(d DirtyBlockCache) {
 	c.dirtyBcache = d
 }
 
+// DiskBlockCache implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) DiskBlockCache() DiskBlockCache {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.diskBcache
+}
+
+// SetDiskBlockCache implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetDiskBlockCache(d DiskBlockCache) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.diskBcache = d
+}
+
+// ConflictHistory implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) ConflictHistory() ConflictHistory {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.crHistory
+}
+
+// SetConflictHistory implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetConflictHistory(h ConflictHistory) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.crHistory = h
+}
+
+// Prefetcher implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) Prefetcher() Prefetcher {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.prefetcher
+}
+
+// SetPrefetcher implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetPrefetcher(p Prefetcher) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.prefetcher = p
+}
+
 // Crypto implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) Crypto() Crypto {
 	c.lock.RLock()
@@ -539,7 +585,7 @@ func (c *ConfigLocal) MetadataVersion() MetadataVer {
 
 // DataVersion implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) DataVersion() DataVer {
-	return FilesWithHolesDataVer
+	return DefaultNewBlockDataVersion(c, false)
 }
 
 // DoBackgroundFlushes implements the Config interface for ConfigLocal.
@@ -556,6 +602,21 @@ func (c *ConfigLocal) SetDoBackgroundFlushes(doBGFlush bool) {
 	c.noBGFlush = !doBGFlush
 }
 
+// DoBlockCompression implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) DoBlockCompression() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.compress
+}
+
+// SetDoBlockCompression implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetDoBlockCompression(compress bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.compress = compress
+}
+
 // RekeyWithPromptWaitTime implements the Config interface for
 // ConfigLocal.
 func (c *ConfigLocal) RekeyWithPromptWaitTime() time.Duration {
@@ -785,6 +846,9 @@ func (c *ConfigLocal) Shutdown() error {
 		errors = append(errors, err)
 		// Continue with shutdown regardless of err.
 	}
+	if p := c.Prefetcher(); p != nil {
+		p.Shutdown()
+	}
 	c.MDServer().Shutdown()
 	c.KeyServer().Shutdown()
 	c.KeybaseService().Shutdown()
@@ -795,6 +859,9 @@ func (c *ConfigLocal) Shutdown() error {
 	if err != nil {
 		errors = append(errors, err)
 	}
+	if dbc := c.DiskBlockCache(); dbc != nil {
+		dbc.Shutdown(context.Background())
+	}
 
 	if len(errors) == 1 {
 		return errors[0]
@@ -843,9 +910,11 @@ func (c *ConfigLocal) journalizeBcaches() error {
 	return nil
 }
 
-// EnableJournaling creates a JournalServer, but journaling must still
-// be enabled manually for individual folders.
-func (c *ConfigLocal) EnableJournaling(journalRoot string) {
+// EnableJournaling creates a JournalServer that keeps its files as
+// given by storage, but journaling must still be enabled manually for
+// individual folders.
+func (c *ConfigLocal) EnableJournaling(
+	journalRoot string, storage JournalStorageOptions) {
 	jServer, err := GetJournalServer(c)
 	if err == nil {
 		// Journaling shouldn't be enabled twice for the same
@@ -859,9 +928,10 @@ func (c *ConfigLocal) EnableJournaling(journalRoot string) {
 	log := c.MakeLogger("")
 	branchListener := c.KBFSOps().(branchChangeListener)
 	flushListener := c.KBFSOps().(mdFlushListener)
-	jServer = makeJournalServer(c, log, journalRoot, c.BlockCache(),
-		c.DirtyBlockCache(), c.BlockServer(), c.MDOps(), branchListener,
-		flushListener)
+	squashListener := c.KBFSOps().(mdSquashListener)
+	jServer = makeJournalServer(c, log, journalRoot, storage,
+		c.BlockCache(), c.DirtyBlockCache(), c.BlockServer(), c.MDOps(),
+		branchListener, flushListener, squashListener)
 	ctx := context.Background()
 	uid, key, err := getCurrentUIDAndVerifyingKey(ctx, c.KBPKI())
 	if err != nil {
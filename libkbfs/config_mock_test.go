@@ -107,6 +107,8 @@ func NewConfigMock(c *gomock.Controller, ctr *SafeTestReporter) *ConfigMock {
 	config.SetBlockServer(config.mockBserv)
 	config.mockBsplit = NewMockBlockSplitter(c)
 	config.SetBlockSplitter(config.mockBsplit)
+	config.mockBsplit.EXPECT().DataVersion().AnyTimes().
+		Return(DataVer(FirstValidDataVer))
 	config.mockNotifier = NewMockNotifier(c)
 	config.SetNotifier(config.mockNotifier)
 	config.mockClock = NewMockClock(c)
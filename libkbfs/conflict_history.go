@@ -0,0 +1,278 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// defaultConflictHistoryMaxAge is how long recorded conflict
+// resolutions are kept by default.
+const defaultConflictHistoryMaxAge = 30 * 24 * time.Hour
+
+// ConflictHistoryRename records that a conflicting entry was moved
+// out of the way during a conflict resolution.  Both paths start with
+// the canonical name of the folder.
+type ConflictHistoryRename struct {
+	From string
+	To   string
+}
+
+// ConflictHistoryEntry records one completed conflict resolution, in
+// a form suitable for encoding directly into JSON.
+type ConflictHistoryEntry struct {
+	Time time.Time
+	// UnmergedHead and MergedHead are the latest revisions of the
+	// two branches that were resolved.
+	UnmergedHead MetadataRevision
+	MergedHead   MetadataRevision
+	Policy       string
+	Actions      []ConflictResolutionAction
+	Renamed      []ConflictHistoryRename `json:",omitempty"`
+}
+
+// makeConflictHistoryRenames returns the renames done by the given
+// actions.
+func makeConflictHistoryRenames(
+	actions []ConflictResolutionAction) []ConflictHistoryRename {
+	var renames []ConflictHistoryRename
+	for _, a := range actions {
+		switch a.Type {
+		case ConflictResolutionRename, ConflictResolutionRenameMerged,
+			ConflictResolutionSymlink:
+		default:
+			continue
+		}
+		if a.To == "" || a.From == a.To {
+			continue
+		}
+		renames = append(renames, ConflictHistoryRename{
+			From: a.Dir + "/" + a.From,
+			To:   a.Dir + "/" + a.To,
+		})
+	}
+	return renames
+}
+
+// ConflictHistoryDisk is a ConflictHistory that keeps a log file for
+// each TLF in a local directory, with one JSON-encoded entry per
+// line.  New entries are appended to the log; entries older than the
+// configured maximum age are dropped whenever the log is read or
+// added to.
+type ConflictHistoryDisk struct {
+	config Config
+	root   string
+	// maxAge is how long entries are kept; zero means forever.
+	maxAge time.Duration
+
+	lock sync.Mutex
+}
+
+var _ ConflictHistory = (*ConflictHistoryDisk)(nil)
+
+// NewConflictHistoryDisk returns a new ConflictHistoryDisk that
+// keeps its logs in the given directory, for the given amount of
+// time.
+func NewConflictHistoryDisk(config Config, root string,
+	maxAge time.Duration) *ConflictHistoryDisk {
+	return &ConflictHistoryDisk{
+		config: config,
+		root:   root,
+		maxAge: maxAge,
+	}
+}
+
+func (h *ConflictHistoryDisk) logPath(tlfID TlfID) string {
+	return filepath.Join(h.root, tlfID.String())
+}
+
+func (h *ConflictHistoryDisk) isExpired(entry ConflictHistoryEntry,
+	now time.Time) bool {
+	return h.maxAge > 0 && now.Sub(entry.Time) > h.maxAge
+}
+
+// readLocked returns the unexpired entries for the given TLF, oldest
+// first, along with whether the log needs trimming because some
+// lines were expired or couldn't be parsed.  A line that can't be
+// parsed, such as one cut short by a crash, is skipped.
+func (h *ConflictHistoryDisk) readLocked(tlfID TlfID, now time.Time) (
+	entries []ConflictHistoryEntry, trim bool, err error) {
+	f, err := os.Open(h.logPath(tlfID))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, false, err
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			var entry ConflictHistoryEntry
+			if jsonErr := json.Unmarshal(line, &entry); jsonErr != nil {
+				trim = true
+			} else if h.isExpired(entry, now) {
+				trim = true
+			} else {
+				entries = append(entries, entry)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return entries, trim, nil
+}
+
+// writeLocked replaces the log for the given TLF with the given
+// entries.  The new log is written to a temporary file first, so a
+// crash can't leave it half-written.
+func (h *ConflictHistoryDisk) writeLocked(tlfID TlfID,
+	entries []ConflictHistoryEntry) (err error) {
+	err = os.MkdirAll(h.root, 0700)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(h.root, tlfID.String()+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	enc := json.NewEncoder(f)
+	for _, entry := range entries {
+		err = enc.Encode(entry)
+		if err != nil {
+			return err
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), h.logPath(tlfID))
+}
+
+// Add implements the ConflictHistory interface for
+// ConflictHistoryDisk.
+func (h *ConflictHistoryDisk) Add(ctx context.Context, tlfID TlfID,
+	entry ConflictHistoryEntry) (err error) {
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	entries, trim, err := h.readLocked(tlfID, h.config.Clock().Now())
+	if err != nil {
+		return err
+	}
+	if trim {
+		// Drop the expired entries while we're here, so the log
+		// doesn't grow forever when nobody reads it.
+		return h.writeLocked(tlfID, append(entries, entry))
+	}
+
+	err = os.MkdirAll(h.root, 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(h.logPath(tlfID),
+		os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	// If a crash cut the last line short, start a new line so this
+	// entry is still readable.
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() > 0 {
+		last := make([]byte, 1)
+		_, err = f.ReadAt(last, fi.Size()-1)
+		if err != nil {
+			return err
+		}
+		if last[0] != '\n' {
+			buf = append([]byte{'\n'}, buf...)
+		}
+	}
+	_, err = f.Write(buf)
+	return err
+}
+
+// Get implements the ConflictHistory interface for
+// ConflictHistoryDisk.
+func (h *ConflictHistoryDisk) Get(ctx context.Context, tlfID TlfID) (
+	[]ConflictHistoryEntry, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	entries, trim, err := h.readLocked(tlfID, h.config.Clock().Now())
+	if err != nil {
+		return nil, err
+	}
+	if trim {
+		// Trim the log while we're here.
+		err = h.writeLocked(tlfID, entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// recordResolution adds an entry for a completed resolution to the
+// conflict history, if there is one.  Failing to record it isn't
+// fatal, since the resolution itself is done.
+func (cr *ConflictResolver) recordResolution(ctx context.Context,
+	unmergedMDs, mergedMDs []ImmutableRootMetadata, policy ConflictPolicy,
+	actions []ConflictResolutionAction) {
+	history := cr.config.ConflictHistory()
+	if history == nil {
+		return
+	}
+	entry := ConflictHistoryEntry{
+		Time:         cr.config.Clock().Now(),
+		UnmergedHead: unmergedMDs[len(unmergedMDs)-1].Revision(),
+		MergedHead:   mergedMDs[len(mergedMDs)-1].Revision(),
+		Policy:       policy.Name(),
+		Actions:      actions,
+		Renamed:      makeConflictHistoryRenames(actions),
+	}
+	err := history.Add(ctx, cr.fbo.id(), entry)
+	if err != nil {
+		cr.log.CWarningf(ctx, "Couldn't record the resolution in the "+
+			"conflict history: %v", err)
+	}
+}
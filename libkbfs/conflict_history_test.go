@@ -0,0 +1,156 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestConflictHistoryDiskExpiry(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test")
+	defer CheckConfigAndShutdown(t, config)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	tempdir, err := ioutil.TempDir(os.TempDir(), "conflict_history")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	ctx := context.Background()
+	h := NewConflictHistoryDisk(config, tempdir, time.Hour)
+	tlfID := FakeTlfID(1, false)
+	otherTlfID := FakeTlfID(2, false)
+
+	entries, err := h.Get(ctx, tlfID)
+	require.NoError(t, err)
+	require.Len(t, entries, 0)
+
+	actions := []ConflictResolutionAction{{
+		Type: ConflictResolutionRename,
+		Dir:  "u1,u2/a",
+		From: "b",
+		To:   "b.conflict",
+	}}
+	first := ConflictHistoryEntry{
+		Time:         clock.Now(),
+		UnmergedHead: 3,
+		MergedHead:   4,
+		Policy:       KeepBothConflictPolicy{}.Name(),
+		Actions:      actions,
+		Renamed:      makeConflictHistoryRenames(actions),
+	}
+	require.Equal(t, []ConflictHistoryRename{{
+		From: "u1,u2/a/b",
+		To:   "u1,u2/a/b.conflict",
+	}}, first.Renamed)
+	err = h.Add(ctx, tlfID, first)
+	require.NoError(t, err)
+
+	clock.Add(45 * time.Minute)
+	second := first
+	second.Time = clock.Now()
+	second.UnmergedHead = 5
+	second.MergedHead = 6
+	err = h.Add(ctx, tlfID, second)
+	require.NoError(t, err)
+
+	entries, err = h.Get(ctx, tlfID)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.True(t, first.Time.Equal(entries[0].Time))
+	require.Equal(t, MetadataRevision(3), entries[0].UnmergedHead)
+	require.Equal(t, first.Renamed, entries[0].Renamed)
+	require.Equal(t, MetadataRevision(5), entries[1].UnmergedHead)
+
+	// Other TLFs have their own logs.
+	entries, err = h.Get(ctx, otherTlfID)
+	require.NoError(t, err)
+	require.Len(t, entries, 0)
+
+	// The first entry expires, and is dropped from the log by the
+	// next Add, even without a Get.
+	clock.Add(30 * time.Minute)
+	third := second
+	third.Time = clock.Now()
+	third.UnmergedHead = 7
+	third.MergedHead = 8
+	err = h.Add(ctx, tlfID, third)
+	require.NoError(t, err)
+	h.lock.Lock()
+	entries, trim, err := h.readLocked(tlfID, time.Time{})
+	h.lock.Unlock()
+	require.NoError(t, err)
+	require.False(t, trim)
+	require.Len(t, entries, 2)
+	require.Equal(t, MetadataRevision(5), entries[0].UnmergedHead)
+	require.Equal(t, MetadataRevision(7), entries[1].UnmergedHead)
+
+	// Get drops expired entries too.
+	clock.Add(45 * time.Minute)
+	entries, err = h.Get(ctx, tlfID)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, MetadataRevision(7), entries[0].UnmergedHead)
+
+	// The log survives a restart.
+	h = NewConflictHistoryDisk(config, tempdir, time.Hour)
+	entries, err = h.Get(ctx, tlfID)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestConflictHistoryDiskSkipsBadLines(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test")
+	defer CheckConfigAndShutdown(t, config)
+	tempdir, err := ioutil.TempDir(os.TempDir(), "conflict_history")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	ctx := context.Background()
+	h := NewConflictHistoryDisk(config, tempdir, 0)
+	tlfID := FakeTlfID(1, false)
+
+	entry := ConflictHistoryEntry{
+		Time:         config.Clock().Now(),
+		UnmergedHead: 3,
+		MergedHead:   4,
+		Policy:       KeepBothConflictPolicy{}.Name(),
+	}
+	err = h.Add(ctx, tlfID, entry)
+	require.NoError(t, err)
+
+	// Simulate a crash in the middle of appending an entry.
+	f, err := os.OpenFile(h.logPath(tlfID), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte(`{"Time":"20`))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	entry.UnmergedHead = 5
+	err = h.Add(ctx, tlfID, entry)
+	require.NoError(t, err)
+
+	entries, err := h.Get(ctx, tlfID)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, MetadataRevision(3), entries[0].UnmergedHead)
+	require.Equal(t, MetadataRevision(5), entries[1].UnmergedHead)
+
+	// Reading the log trimmed the bad line.
+	data, err := ioutil.ReadFile(h.logPath(tlfID))
+	require.NoError(t, err)
+	require.NotContains(t, string(data), `{"Time":"20`+"\n")
+}
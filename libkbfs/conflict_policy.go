@@ -0,0 +1,208 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ConflictPolicyFileName is the name of the file, at the root of a
+// top-level folder, that selects the ConflictPolicy used when
+// resolving conflicts in that folder.  It's a regular file, synced to
+// every device like any other; its contents are the name of one of
+// the built-in policies.  Without it, conflicting files are kept
+// side-by-side.
+const ConflictPolicyFileName = ".kbfs_conflict_policy"
+
+// maxConflictPolicyFileSize is the most that's read from a
+// ConflictPolicyFileName file; policy names are short.
+const maxConflictPolicyFileSize = 1024
+
+// KeepBothConflictPolicy keeps both versions of a conflicting file,
+// renaming the unmerged one.  It's the default policy.
+type KeepBothConflictPolicy struct{}
+
+// Name implements the ConflictPolicy interface for
+// KeepBothConflictPolicy.
+func (KeepBothConflictPolicy) Name() string {
+	return "keep-both"
+}
+
+// ChooseForFile implements the ConflictPolicy interface for
+// KeepBothConflictPolicy.
+func (KeepBothConflictPolicy) ChooseForFile(
+	unmerged, merged ConflictFileVersion) ConflictChoice {
+	return ConflictKeepBoth
+}
+
+// NewestMtimeWinsConflictPolicy keeps whichever version of a
+// conflicting file has the latest modification time.  If both have
+// the same mtime, it keeps both.
+type NewestMtimeWinsConflictPolicy struct{}
+
+// Name implements the ConflictPolicy interface for
+// NewestMtimeWinsConflictPolicy.
+func (NewestMtimeWinsConflictPolicy) Name() string {
+	return "newest-mtime-wins"
+}
+
+// ChooseForFile implements the ConflictPolicy interface for
+// NewestMtimeWinsConflictPolicy.
+func (NewestMtimeWinsConflictPolicy) ChooseForFile(
+	unmerged, merged ConflictFileVersion) ConflictChoice {
+	switch {
+	case unmerged.Mtime.After(merged.Mtime):
+		return ConflictKeepUnmerged
+	case merged.Mtime.After(unmerged.Mtime):
+		return ConflictKeepMerged
+	default:
+		return ConflictKeepBoth
+	}
+}
+
+// MergedWinsConflictPolicy always keeps the merged version of a
+// conflicting file, i.e. the one that reached the server first.
+type MergedWinsConflictPolicy struct{}
+
+// Name implements the ConflictPolicy interface for
+// MergedWinsConflictPolicy.
+func (MergedWinsConflictPolicy) Name() string {
+	return "merged-wins"
+}
+
+// ChooseForFile implements the ConflictPolicy interface for
+// MergedWinsConflictPolicy.
+func (MergedWinsConflictPolicy) ChooseForFile(
+	unmerged, merged ConflictFileVersion) ConflictChoice {
+	return ConflictKeepMerged
+}
+
+// UnmergedWinsConflictPolicy always keeps the unmerged version of a
+// conflicting file, i.e. the one being resolved by this device.
+type UnmergedWinsConflictPolicy struct{}
+
+// Name implements the ConflictPolicy interface for
+// UnmergedWinsConflictPolicy.
+func (UnmergedWinsConflictPolicy) Name() string {
+	return "unmerged-wins"
+}
+
+// ChooseForFile implements the ConflictPolicy interface for
+// UnmergedWinsConflictPolicy.
+func (UnmergedWinsConflictPolicy) ChooseForFile(
+	unmerged, merged ConflictFileVersion) ConflictChoice {
+	return ConflictKeepUnmerged
+}
+
+// MergeTextConflictPolicy merges conflicting writes to the same
+// text file line by line, using the version of the file from before
+// the branch as the common ancestor.  If the file isn't UTF-8 text,
+// doesn't fit in a single block, or both versions changed the same
+// lines, it keeps both versions instead. Files whose contents
+// weren't changed on both branches always keep both.
+type MergeTextConflictPolicy struct{}
+
+// Name implements the ConflictPolicy interface for
+// MergeTextConflictPolicy.
+func (MergeTextConflictPolicy) Name() string {
+	return "merge-text"
+}
+
+// ChooseForFile implements the ConflictPolicy interface for
+// MergeTextConflictPolicy.
+func (MergeTextConflictPolicy) ChooseForFile(
+	unmerged, merged ConflictFileVersion) ConflictChoice {
+	if unmerged.Written && merged.Written {
+		return ConflictMergeText
+	}
+	return ConflictKeepBoth
+}
+
+var builtinConflictPolicies = func() map[string]ConflictPolicy {
+	policies := make(map[string]ConflictPolicy)
+	for _, p := range []ConflictPolicy{
+		KeepBothConflictPolicy{},
+		NewestMtimeWinsConflictPolicy{},
+		MergedWinsConflictPolicy{},
+		UnmergedWinsConflictPolicy{},
+		MergeTextConflictPolicy{},
+	} {
+		policies[p.Name()] = p
+	}
+	return policies
+}()
+
+// ConflictPolicyByName returns the built-in ConflictPolicy with the
+// given name, if there is one.
+func ConflictPolicyByName(name string) (ConflictPolicy, bool) {
+	p, ok := builtinConflictPolicies[name]
+	return p, ok
+}
+
+// getConflictPolicy returns the policy selected by the
+// ConflictPolicyFileName file at the root of the given merged MD.  If
+// there's no such file, or it can't be read or doesn't name a known
+// policy, it returns KeepBothConflictPolicy, which never loses data.
+func (cr *ConflictResolver) getConflictPolicy(ctx context.Context,
+	lState *lockState, md ImmutableRootMetadata) ConflictPolicy {
+	rootPath := path{
+		FolderBranch: cr.fbo.folderBranch,
+		path: []pathNode{{
+			BlockPointer: md.data.Dir.BlockPointer,
+			Name:         string(md.GetTlfHandle().GetCanonicalName()),
+		}},
+	}
+	dblock, err := cr.fbo.blocks.GetDirBlockForReading(ctx, lState,
+		md.ReadOnly(), rootPath.tailPointer(), rootPath.Branch, rootPath)
+	if err != nil {
+		cr.log.CDebugf(ctx, "Couldn't read the root directory to find "+
+			"the conflict policy: %v", err)
+		return KeepBothConflictPolicy{}
+	}
+	de, ok := dblock.Children[ConflictPolicyFileName]
+	if !ok || (de.Type != File && de.Type != Exec) {
+		return KeepBothConflictPolicy{}
+	}
+
+	size := de.Size
+	if size > maxConflictPolicyFileSize {
+		size = maxConflictPolicyFileSize
+	}
+	buf := make([]byte, size)
+	n, err := cr.fbo.blocks.Read(ctx, lState, md.ReadOnly(),
+		rootPath.ChildPath(ConflictPolicyFileName, de.BlockPointer), buf, 0)
+	if err != nil {
+		cr.log.CDebugf(ctx, "Couldn't read the conflict policy: %v", err)
+		return KeepBothConflictPolicy{}
+	}
+	name := strings.TrimSpace(string(buf[:n]))
+	p, ok := ConflictPolicyByName(name)
+	if !ok {
+		cr.log.CWarningf(ctx, "Unknown conflict policy %q; keeping both "+
+			"versions of conflicting files", name)
+		return KeepBothConflictPolicy{}
+	}
+	return p
+}
+
+// getFileMtime returns the mtime of the file at the given path, as
+// of the given MD.
+func (cr *ConflictResolver) getFileMtime(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, file path) (time.Time, error) {
+	parent := file.parentPath()
+	dblock, err := cr.fbo.blocks.GetDirBlockForReading(ctx, lState, kmd,
+		parent.tailPointer(), parent.Branch, *parent)
+	if err != nil {
+		return time.Time{}, err
+	}
+	de, ok := dblock.Children[file.tailName()]
+	if !ok {
+		return time.Time{}, NoSuchNameError{file.tailName()}
+	}
+	return time.Unix(0, de.Mtime), nil
+}
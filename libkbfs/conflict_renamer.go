@@ -5,7 +5,10 @@
 package libkbfs
 
 import (
+	"bytes"
 	"fmt"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/keybase/client/go/protocol/keybase1"
@@ -38,6 +41,110 @@ func (WriterDeviceDateConflictRenamer) ConflictRenameHelper(t time.Time, user, d
 		base, user, device, date, ext)
 }
 
+// DefaultConflictRenameTemplate is the TemplateConflictRenamer
+// template that gives the same names as
+// WriterDeviceDateConflictRenamer.
+const DefaultConflictRenameTemplate = "{{.Base}}.conflicted " +
+	"({{.User}}'s {{.Device}} copy {{.Date}}){{.Ext}}"
+
+// ConflictRenameFields are the fields available to the template of a
+// TemplateConflictRenamer.
+type ConflictRenameFields struct {
+	// Base and Ext are the original name, split at its extension
+	// (which includes the dot).
+	Base string
+	Ext  string
+	// User and Device name the writer of the conflicting change.
+	User   string
+	Device string
+	// Date and Time are when the conflict was resolved, as
+	// 2006-01-02 and 15-04-05 respectively, in local time.
+	Date string
+	Time string
+	// Revision is the revision of the conflicting change.
+	Revision MetadataRevision
+}
+
+// TemplateConflictRenamer renames a file according to a text/template
+// executed on ConflictRenameFields.
+type TemplateConflictRenamer struct {
+	config Config
+	tmpl   *template.Template
+}
+
+var _ ConflictRenamer = (*TemplateConflictRenamer)(nil)
+
+// NewTemplateConflictRenamer returns a TemplateConflictRenamer using
+// the given template, or an error if the template can't be parsed or
+// doesn't make a valid new name.
+func NewTemplateConflictRenamer(config Config, text string) (
+	*TemplateConflictRenamer, error) {
+	tmpl, err := template.New("conflict rename").Option(
+		"missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	cr := &TemplateConflictRenamer{config, tmpl}
+	// Try it out, to catch bad fields and useless templates early.
+	_, err = cr.ConflictRenameHelper(time.Unix(0, 0), "user", "device",
+		MetadataRevisionInitial, "file.txt")
+	if err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// ConflictRename implements the ConflictRename interface for
+// TemplateConflictRenamer.  If the template fails for the given op,
+// it falls back to the WriterDeviceDateConflictRenamer format.
+func (cr *TemplateConflictRenamer) ConflictRename(
+	op op, original string) string {
+	now := cr.config.Clock().Now()
+	winfo := op.getWriterInfo()
+	name, err := cr.ConflictRenameHelper(now, string(winfo.name),
+		winfo.deviceName, winfo.revision, original)
+	if err != nil {
+		return WriterDeviceDateConflictRenamer{}.ConflictRenameHelper(
+			now, string(winfo.name), winfo.deviceName, original)
+	}
+	return name
+}
+
+// ConflictRenameHelper is a helper for ConflictRename especially
+// useful from tests.
+func (cr *TemplateConflictRenamer) ConflictRenameHelper(t time.Time,
+	user, device string, revision MetadataRevision, original string) (
+	string, error) {
+	if device == "" {
+		device = "unknown"
+	}
+	base, ext := splitExtension(original)
+	fields := ConflictRenameFields{
+		Base:     base,
+		Ext:      ext,
+		User:     user,
+		Device:   device,
+		Date:     t.Format("2006-01-02"),
+		Time:     t.Format("15-04-05"),
+		Revision: revision,
+	}
+	var buf bytes.Buffer
+	err := cr.tmpl.Execute(&buf, fields)
+	if err != nil {
+		return "", err
+	}
+	name := buf.String()
+	switch {
+	case name == "", name == ".", name == "..", name == original:
+		return "", fmt.Errorf("Conflict rename template gave %q for %q",
+			name, original)
+	case strings.ContainsAny(name, "/\\\x00"):
+		return "", fmt.Errorf("Conflict rename template gave %q, which "+
+			"isn't a single path component", name)
+	}
+	return name, nil
+}
+
 // splitExtension splits filename into a base name and the extension.
 func splitExtension(path string) (string, string) {
 	for i := len(path) - 1; i > 0; i-- {
@@ -5,7 +5,9 @@
 package libkbfs
 
 import (
+	"fmt"
 	"testing"
+	"time"
 )
 
 func testSplitExtension(t *testing.T, s, base, ext string) {
@@ -30,3 +32,69 @@ func TestSplitExtension(t *testing.T) {
 	testSplitExtension(t, "weird. is this?", "weird. is this?", "")
 	testSplitExtension(t, "", "", "")
 }
+
+func TestTemplateConflictRenamer(t *testing.T) {
+	now := time.Date(2016, 11, 2, 13, 14, 15, 0, time.UTC)
+	cre, err := NewTemplateConflictRenamer(nil, DefaultConflictRenameTemplate)
+	if err != nil {
+		t.Fatalf("Couldn't make the default renamer: %v", err)
+	}
+	name, err := cre.ConflictRenameHelper(now, "u1", "dev1", 5, "foo.tar.gz")
+	if err != nil {
+		t.Fatalf("Couldn't rename: %v", err)
+	}
+	expected := WriterDeviceDateConflictRenamer{}.ConflictRenameHelper(
+		now, "u1", "dev1", "foo.tar.gz")
+	if name != expected {
+		t.Errorf("Default template gave %q, expected %q", name, expected)
+	}
+
+	cre, err = NewTemplateConflictRenamer(nil,
+		"{{.Base}}-{{.User}}-{{.Device}}-{{.Date}}T{{.Time}}-r{{.Revision}}{{.Ext}}")
+	if err != nil {
+		t.Fatalf("Couldn't make the renamer: %v", err)
+	}
+	name, err = cre.ConflictRenameHelper(now, "u1", "", 5, "foo.txt")
+	if err != nil {
+		t.Fatalf("Couldn't rename: %v", err)
+	}
+	expected = "foo-u1-unknown-2016-11-02T13-14-15-r5.txt"
+	if name != expected {
+		t.Errorf("Template gave %q, expected %q", name, expected)
+	}
+
+	for _, bad := range []string{
+		"{{.Base",
+		"{{.NoSuchField}}",
+		"{{.Base}}{{.Ext}}",
+		"",
+		"{{.User}}/{{.Base}}",
+	} {
+		_, err := NewTemplateConflictRenamer(nil, bad)
+		if err == nil {
+			t.Errorf("Template %q was accepted", bad)
+		}
+	}
+}
+
+func TestUniquifyNameManyTaken(t *testing.T) {
+	block := NewDirBlock().(*DirBlock)
+	block.Children["a.txt"] = DirEntry{}
+	for i := 1; i <= 150; i++ {
+		block.Children[fmt.Sprintf("a (%d).txt", i)] = DirEntry{}
+	}
+	name, err := uniquifyName(block, "a.txt")
+	if err != nil {
+		t.Fatalf("Couldn't uniquify: %v", err)
+	}
+	if name != "a (151).txt" {
+		t.Errorf("Got %q, expected %q", name, "a (151).txt")
+	}
+	name, err = uniquifyName(block, "b.txt")
+	if err != nil {
+		t.Fatalf("Couldn't uniquify: %v", err)
+	}
+	if name != "b.txt" {
+		t.Errorf("Got %q, expected %q", name, "b.txt")
+	}
+}
@@ -984,10 +984,33 @@ func (cr *ConflictResolver) buildChainsAndPaths(
 		return nil, nil, nil, nil, nil, nil, nil, err
 	}
 
+	unmergedChains, mergedChains, unmergedPaths, mergedPaths, recreateOps,
+		err = cr.makeChainsAndPaths(ctx, lState, unmerged, merged)
+	if err != nil {
+		if mergedChains != nil {
+			// Return mergedChains in this error case, to allow the
+			// error handling code to unstage if necessary.
+			return nil, nil, nil, nil, nil, nil, merged, err
+		}
+		return nil, nil, nil, nil, nil, nil, nil, err
+	}
+
+	return unmergedChains, mergedChains, unmergedPaths, mergedPaths,
+		recreateOps, unmerged, merged, nil
+}
+
+// makeChainsAndPaths makes the chains for the given unmerged and
+// merged MDs, and resolves the paths of the unmerged changes in the
+// merged branch.  If resolving those paths fails, it returns the
+// merged chains along with the error.
+func (cr *ConflictResolver) makeChainsAndPaths(ctx context.Context,
+	lState *lockState, unmerged, merged []ImmutableRootMetadata) (
+	unmergedChains, mergedChains *crChains, unmergedPaths []path,
+	mergedPaths map[BlockPointer]path, recreateOps []*createOp, err error) {
 	// Make the chains
 	unmergedChains, mergedChains, err = cr.makeChains(ctx, unmerged, merged)
 	if err != nil {
-		return nil, nil, nil, nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
 	}
 
 	// TODO: if the root node didn't change in either chain, we can
@@ -1000,14 +1023,14 @@ func (cr *ConflictResolver) buildChainsAndPaths(
 	unmergedPaths, err = unmergedChains.getPaths(ctx, &cr.fbo.blocks,
 		cr.log, cr.fbo.nodeCache, false)
 	if err != nil {
-		return nil, nil, nil, nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
 	}
 
 	// Add in any directory paths that were created in both branches.
 	newUnmergedPaths, err := cr.findCreatedDirsToMerge(ctx, unmergedPaths,
 		unmergedChains, mergedChains)
 	if err != nil {
-		return nil, nil, nil, nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
 	}
 	unmergedPaths = append(unmergedPaths, newUnmergedPaths...)
 	if len(newUnmergedPaths) > 0 {
@@ -1020,9 +1043,7 @@ func (cr *ConflictResolver) buildChainsAndPaths(
 	mergedPaths, recreateOps, newUnmergedPaths, err = cr.resolveMergedPaths(
 		ctx, lState, unmergedPaths, unmergedChains, mergedChains)
 	if err != nil {
-		// Return mergedChains in this error case, to allow the error
-		// handling code to unstage if necessary.
-		return nil, nil, nil, nil, nil, nil, merged, err
+		return nil, mergedChains, nil, nil, nil, err
 	}
 	unmergedPaths = append(unmergedPaths, newUnmergedPaths...)
 	if len(newUnmergedPaths) > 0 {
@@ -1030,7 +1051,7 @@ func (cr *ConflictResolver) buildChainsAndPaths(
 	}
 
 	return unmergedChains, mergedChains, unmergedPaths, mergedPaths,
-		recreateOps, unmerged, merged, nil
+		recreateOps, nil
 }
 
 // addRecreateOpsToUnmergedChains inserts each recreateOp, into its
@@ -1629,9 +1650,11 @@ func (cr *ConflictResolver) addMergedRecreates(ctx context.Context,
 // getActionsToMerge returns the set of actions needed to merge each
 // unmerged chain of operations, in a map keyed by the tail pointer of
 // the corresponding merged path.
-func (cr *ConflictResolver) getActionsToMerge(unmergedChains *crChains,
-	mergedChains *crChains, mergedPaths map[BlockPointer]path) (
+func (cr *ConflictResolver) getActionsToMerge(ctx context.Context,
+	unmergedChains *crChains, mergedChains *crChains,
+	mergedPaths map[BlockPointer]path, policy ConflictPolicy) (
 	map[BlockPointer]crActionList, error) {
+	lState := makeFBOLockState()
 	actionMap := make(map[BlockPointer]crActionList)
 	for unmergedMostRecent, unmergedChain := range unmergedChains.byMostRecent {
 		original := unmergedChain.original
@@ -1650,8 +1673,27 @@ func (cr *ConflictResolver) getActionsToMerge(unmergedChains *crChains,
 			continue
 		}
 
+		getMtimes := func() (unmerged, merged time.Time, err error) {
+			unmerged, err = cr.getFileMtime(ctx, lState,
+				unmergedChains.mostRecentMD.ReadOnly(),
+				unmergedChain.ops[0].getFinalPath())
+			if err != nil {
+				return time.Time{}, time.Time{}, err
+			}
+			merged, err = cr.getFileMtime(ctx, lState,
+				mergedChains.mostRecentMD.ReadOnly(), mergedPath)
+			if err != nil {
+				return time.Time{}, time.Time{}, err
+			}
+			return unmerged, merged, nil
+		}
+		mergeText := func() (*FileBlock, error) {
+			return cr.makeTextMergeBlock(ctx, lState, unmergedChains,
+				mergedChains, unmergedChain, mergedChain)
+		}
 		actions, err := unmergedChain.getActionsToMerge(
-			cr.config.ConflictRenamer(), mergedPath, mergedChain)
+			cr.config.ConflictRenamer(), policy, getMtimes, mergeText,
+			mergedPath, mergedChain)
 		if err != nil {
 			return nil, err
 		}
@@ -1685,8 +1727,9 @@ func collapseActions(unmergedChains *crChains, unmergedPaths []path,
 			continue
 		}
 
-		// If this is a directory with setAttr(mtime)-related actions,
-		// just those action should be collapsed into the parent.
+		// If this is a directory with setAttr(mtime or xattr)-related
+		// actions, just those action should be collapsed into the
+		// parent.
 		if !chain.isFile() {
 			var parentActions crActionList
 			var otherDirActions crActionList
@@ -1694,7 +1737,9 @@ func collapseActions(unmergedChains *crChains, unmergedPaths []path,
 				moved := false
 				switch realAction := action.(type) {
 				case *copyUnmergedAttrAction:
-					if realAction.attr[0] == mtimeAttr && !realAction.moved {
+					isDirAttr := realAction.attr[0] == mtimeAttr ||
+						realAction.attr[0] == xattrAttr
+					if isDirAttr && !realAction.moved {
 						realAction.moved = true
 						parentActions = append(parentActions, realAction)
 						moved = true
@@ -1766,8 +1811,8 @@ func collapseActions(unmergedChains *crChains, unmergedPaths []path,
 
 func (cr *ConflictResolver) computeActions(ctx context.Context,
 	unmergedChains *crChains, mergedChains *crChains, unmergedPaths []path,
-	mergedPaths map[BlockPointer]path, recreateOps []*createOp) (
-	map[BlockPointer]crActionList, []path, error) {
+	mergedPaths map[BlockPointer]path, recreateOps []*createOp,
+	policy ConflictPolicy) (map[BlockPointer]crActionList, []path, error) {
 	// Process all the recreateOps, adding them to the appropriate
 	// unmerged chains.
 	newUnmergedPaths, err := cr.addRecreateOpsToUnmergedChains(
@@ -1793,7 +1838,8 @@ func (cr *ConflictResolver) computeActions(ctx context.Context,
 	}
 
 	actionMap, err :=
-		cr.getActionsToMerge(unmergedChains, mergedChains, mergedPaths)
+		cr.getActionsToMerge(
+			ctx, unmergedChains, mergedChains, mergedPaths, policy)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1855,10 +1901,14 @@ func (cr *ConflictResolver) makeFileBlockDeepCopy(ctx context.Context,
 		if err != nil {
 			return BlockPointer{}, err
 		}
+		dver := cr.config.DataVersion()
+		if fblock.DataVersion() > dver {
+			dver = fblock.DataVersion()
+		}
 		newPtr = BlockPointer{
 			ID:      newID,
 			KeyGen:  md.LatestKeyGeneration(),
-			DataVer: cr.config.DataVersion(),
+			DataVer: dver,
 			BlockContext: BlockContext{
 				Creator:  uid,
 				RefNonce: zeroBlockRefNonce,
@@ -2037,6 +2087,16 @@ func (cr *ConflictResolver) doActions(ctx context.Context,
 				if err != nil {
 					return err
 				}
+
+				// A text merge's block replaces the merged file's
+				// contents when the tree gets synced.
+				if mta, ok := action.(*mergeTextAction); ok {
+					dirPtr := mergedPath.tailPointer()
+					if _, ok := newFileBlocks[dirPtr]; !ok {
+						newFileBlocks[dirPtr] = make(map[string]*FileBlock)
+					}
+					newFileBlocks[dirPtr][mta.name] = mta.block
+				}
 			}
 		}
 
@@ -2293,6 +2353,38 @@ func (cr *ConflictResolver) createResolvedMD(ctx context.Context,
 	return newMD, nil
 }
 
+// resolveHardLinks merges the hard link groups of the unmerged
+// branch into those of the resolved MD, which start out as the
+// merged branch's groups.
+//
+// Concurrent writes to different links of the same file need no
+// special handling: each write is copied to the other links on its
+// own branch as a regular syncOp, so every link ends up with
+// conflicting syncOps on both branches.  As with any other file,
+// the merged contents win, and the unmerged contents are kept in a
+// renamed copy of each link.
+func (cr *ConflictResolver) resolveHardLinks(ctx context.Context,
+	md *RootMetadata, unmergedMDs []ImmutableRootMetadata) error {
+	if len(unmergedMDs) == 0 {
+		return nil
+	}
+	unmergedHead := unmergedMDs[len(unmergedMDs)-1]
+	if len(md.data.HardLinks) == 0 &&
+		len(unmergedHead.data.HardLinks) == 0 {
+		return nil
+	}
+
+	branchPoint, err := getSingleMD(ctx, cr.config, cr.fbo.id(),
+		NullBranchID, unmergedMDs[0].Revision()-1, Merged)
+	if err != nil {
+		return err
+	}
+	md.data.HardLinks = mergeHardLinks(branchPoint.data.HardLinks,
+		md.data.HardLinks, unmergedHead.data.HardLinks)
+	cr.log.CDebugf(ctx, "Resolved hard links: %v", md.data.HardLinks)
+	return nil
+}
+
 // crFixOpPointers takes in a slice of "reverted" ops (all referring
 // to the original BlockPointers) and a map of BlockPointer updates
 // (from original to the new most recent pointer), and corrects all
@@ -3241,6 +3333,11 @@ func (cr *ConflictResolver) completeResolution(ctx context.Context,
 		return err
 	}
 
+	err = cr.resolveHardLinks(ctx, md, unmergedMDs)
+	if err != nil {
+		return err
+	}
+
 	resolvedPaths, err := cr.makePostResolutionPaths(ctx, md, unmergedChains,
 		mergedChains, mergedPaths)
 	if err != nil {
@@ -3455,8 +3552,10 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	// actions contains the logic needed to manipulate the data into
 	// the final merged state, including the resolution of any
 	// conflicts that occurred between the two branches.
+	policy := cr.getConflictPolicy(ctx, lState, mergedChains.mostRecentMD)
+	cr.log.CDebugf(ctx, "Using conflict policy %s", policy.Name())
 	actionMap, newUnmergedPaths, err := cr.computeActions(ctx, unmergedChains,
-		mergedChains, unmergedPaths, mergedPaths, recOps)
+		mergedChains, unmergedPaths, mergedPaths, recOps, policy)
 	if err != nil {
 		return
 	}
@@ -3514,12 +3613,15 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	// Step 4: finish up by syncing all the blocks, computing and
 	// putting the final resolved MD, and issuing all the local
 	// notifications.
+	actions := makeConflictResolutionActions(actionMap, mergedPaths)
 	err = cr.completeResolution(ctx, lState, unmergedChains, mergedChains,
 		unmergedPaths, mergedPaths, lbc, newFileBlocks, unmergedMDs, doLock)
 	if err != nil {
 		return
 	}
 
+	cr.recordResolution(ctx, unmergedMDs, mergedMDs, policy, actions)
+
 	// TODO: If conflict resolution fails after some blocks were put,
 	// remember these and include them in the later resolution so they
 	// don't count against the quota forever.  (Though of course if we
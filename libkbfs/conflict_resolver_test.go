@@ -333,7 +333,7 @@ func testCRCheckPathsAndActions(t *testing.T, cr *ConflictResolver,
 
 	// Now for step 2 -- check the actions
 	actionMap, _, err := cr.computeActions(ctx, unmergedChains, mergedChains,
-		unmergedPaths, mergedPaths, recreateOps)
+		unmergedPaths, mergedPaths, recreateOps, KeepBothConflictPolicy{})
 	if err != nil {
 		t.Fatalf("Couldn't compute actions: %v", err)
 	}
@@ -435,7 +435,7 @@ func TestCRMergedChainsSimple(t *testing.T) {
 	mergedPaths[expectedUnmergedPath.tailPointer()] = mergedPath
 	expectedActions := map[BlockPointer]crActionList{
 		mergedPath.tailPointer(): {&copyUnmergedEntryAction{
-			"file2", "file2", "", false, false, DirEntry{}, nil}},
+			"file2", "file2", "", false, false, DirEntry{}, nil, nil}},
 	}
 	testCRCheckPathsAndActions(t, cr2, []path{expectedUnmergedPath},
 		mergedPaths, nil, expectedActions)
@@ -498,7 +498,7 @@ func TestCRMergedChainsDifferentDirectories(t *testing.T) {
 	mergedPaths[expectedUnmergedPath.tailPointer()] = mergedPath
 	expectedActions := map[BlockPointer]crActionList{
 		mergedPath.tailPointer(): {&copyUnmergedEntryAction{
-			"file2", "file2", "", false, false, DirEntry{}, nil}},
+			"file2", "file2", "", false, false, DirEntry{}, nil, nil}},
 	}
 	testCRCheckPathsAndActions(t, cr2, []path{expectedUnmergedPath},
 		mergedPaths, nil, expectedActions)
@@ -591,11 +591,11 @@ func TestCRMergedChainsDeletedDirectories(t *testing.T) {
 	dirAPtr1 := cr1.fbo.nodeCache.PathFromNode(dirA1).tailPointer()
 	expectedActions := map[BlockPointer]crActionList{
 		dirCPtr: {&copyUnmergedEntryAction{"file2", "file2", "",
-			false, false, DirEntry{}, nil}},
+			false, false, DirEntry{}, nil, nil}},
 		dirBPtr: {&copyUnmergedEntryAction{"dirC", "dirC", "", false, false,
-			DirEntry{}, nil}},
+			DirEntry{}, nil, nil}},
 		dirAPtr1: {&copyUnmergedEntryAction{"dirB", "dirB", "", false, false,
-			DirEntry{}, nil}},
+			DirEntry{}, nil, nil}},
 	}
 
 	testCRCheckPathsAndActions(t, cr2, []path{expectedUnmergedPath},
@@ -676,7 +676,7 @@ func TestCRMergedChainsRenamedDirectory(t *testing.T) {
 
 	expectedActions := map[BlockPointer]crActionList{
 		mergedPath.tailPointer(): {&copyUnmergedEntryAction{
-			"file2", "file2", "", false, false, DirEntry{}, nil}},
+			"file2", "file2", "", false, false, DirEntry{}, nil, nil}},
 	}
 
 	testCRCheckPathsAndActions(t, cr2, []path{expectedUnmergedPath},
@@ -852,13 +852,13 @@ func TestCRMergedChainsComplex(t *testing.T) {
 	mergedPathE := cr1.fbo.nodeCache.PathFromNode(dirE1)
 	expectedActions := map[BlockPointer]crActionList{
 		mergedPathA.tailPointer(): {&copyUnmergedEntryAction{
-			"dirJ", "dirJ", "", false, false, DirEntry{}, nil}},
+			"dirJ", "dirJ", "", false, false, DirEntry{}, nil, nil}},
 		mergedPathE.tailPointer(): {&copyUnmergedEntryAction{
-			"dirF", "dirF", "", false, false, DirEntry{}, nil}},
+			"dirF", "dirF", "", false, false, DirEntry{}, nil, nil}},
 		mergedPathF.tailPointer(): {&copyUnmergedEntryAction{
-			"file3", "file3", "", false, false, DirEntry{}, nil}},
+			"file3", "file3", "", false, false, DirEntry{}, nil, nil}},
 		mergedPathH.tailPointer(): {&copyUnmergedEntryAction{
-			"file4", "file4", "", false, false, DirEntry{}, nil}},
+			"file4", "file4", "", false, false, DirEntry{}, nil, nil}},
 		mergedPathB.tailPointer(): {&rmMergedEntryAction{"dirD"}},
 	}
 	// `rm file5` doesn't get an action because the parent directory
@@ -951,7 +951,7 @@ func TestCRMergedChainsRenameCycleSimple(t *testing.T) {
 	expectedActions := map[BlockPointer]crActionList{
 		mergedPathRoot.tailPointer(): {&dropUnmergedAction{ro}},
 		mergedPathB.tailPointer(): {&copyUnmergedEntryAction{
-			"dirA", "dirA", "./../", false, false, DirEntry{}, nil}},
+			"dirA", "dirA", "./../", false, false, DirEntry{}, nil, nil}},
 	}
 
 	testCRCheckPathsAndActions(t, cr2, []path{unmergedPathRoot, unmergedPathB},
@@ -1193,7 +1193,7 @@ func TestCRDoActionsSimple(t *testing.T) {
 	}
 
 	actionMap, _, err := cr2.computeActions(ctx, unmergedChains, mergedChains,
-		unmergedPaths, mergedPaths, recreateOps)
+		unmergedPaths, mergedPaths, recreateOps, KeepBothConflictPolicy{})
 	if err != nil {
 		t.Fatalf("Couldn't compute actions: %v", err)
 	}
@@ -1310,7 +1310,7 @@ func TestCRDoActionsWriteConflict(t *testing.T) {
 	}
 
 	actionMap, _, err := cr2.computeActions(ctx, unmergedChains, mergedChains,
-		unmergedPaths, mergedPaths, recreateOps)
+		unmergedPaths, mergedPaths, recreateOps, KeepBothConflictPolicy{})
 	if err != nil {
 		t.Fatalf("Couldn't compute actions: %v", err)
 	}
@@ -1346,3 +1346,107 @@ func TestCRDoActionsWriteConflict(t *testing.T) {
 	// NOTE: the action doesn't actually create the entry, so this
 	// test can only check that newFileBlocks looks correct.
 }
+
+// Tests that conflict policies pick a version for the whole file,
+// compare file mtimes, and unref the blocks of a replaced merged file.
+func TestCRConflictPolicyPerFile(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, uid1, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	_, uid2, err := config2.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	name := userName1.String() + "," + userName2.String()
+	configs := make(map[keybase1.UID]Config)
+	configs[uid1] = config1
+	configs[uid2] = config2
+	nodes := testCRSharedFolderForUsers(t, name, uid1, configs, []string{"dir"})
+	dir1 := nodes[uid1]
+	dir2 := nodes[uid2]
+	fb := dir1.GetFolderBranch()
+
+	file1, _, err := config1.KBFSOps().CreateFile(
+		ctx, dir1, "file", false, NoExcl)
+	require.NoError(t, err)
+	err = config2.KBFSOps().SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	file2, _, err := config2.KBFSOps().Lookup(ctx, dir2, "file")
+	require.NoError(t, err)
+
+	_, err = DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+	cr1 := testCRGetCROrBust(t, config1, fb)
+	cr2 := testCRGetCROrBust(t, config2, fb)
+	cr2.Shutdown()
+
+	// user1 writes the file first, but sets its mtime into the
+	// future.
+	err = config1.KBFSOps().Write(ctx, file1, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = config1.KBFSOps().Sync(ctx, file1)
+	require.NoError(t, err)
+	future := config1.Clock().Now().Add(time.Hour)
+	err = config1.KBFSOps().SetMtime(ctx, file1, &future)
+	require.NoError(t, err)
+	mergedFilePtr := cr1.fbo.nodeCache.PathFromNode(file1).tailPointer()
+
+	// user2 writes and chmods the file later.
+	err = config2.KBFSOps().Write(ctx, file2, []byte{4, 5, 6}, 0)
+	require.NoError(t, err)
+	err = config2.KBFSOps().Sync(ctx, file2)
+	require.NoError(t, err)
+	err = config2.KBFSOps().SetEx(ctx, file2, true)
+	require.NoError(t, err)
+	unmergedFilePtr := cr2.fbo.nodeCache.PathFromNode(file2).tailPointer()
+
+	lState := makeFBOLockState()
+	mergedDirPtr := cr1.fbo.nodeCache.PathFromNode(dir1).tailPointer()
+	computeActions := func(policy ConflictPolicy) (
+		*crChains, crActionList) {
+		unmergedChains, mergedChains, unmergedPaths, mergedPaths,
+			recreateOps, _, _, err := cr2.buildChainsAndPaths(
+			ctx, lState, false)
+		require.NoError(t, err)
+		actionMap, _, err := cr2.computeActions(ctx, unmergedChains,
+			mergedChains, unmergedPaths, mergedPaths, recreateOps, policy)
+		require.NoError(t, err)
+		return unmergedChains, actionMap[mergedDirPtr]
+	}
+
+	// The merged version has the newer mtime, so all of the
+	// unmerged changes to the file are dropped, even the chmod that
+	// doesn't conflict with anything.
+	_, actions := computeActions(NewestMtimeWinsConflictPolicy{})
+	drops := 0
+	for _, action := range actions {
+		switch action.(type) {
+		case *dropUnmergedAction:
+			drops++
+		case *renameUnmergedAction:
+			t.Fatalf("Unexpected rename action %s", action)
+		}
+	}
+	require.Equal(t, 2, drops)
+
+	// If the unmerged version wins, the merged file's blocks are
+	// unreferenced by the unmerged sync that replaces them.
+	unmergedChains, _ := computeActions(UnmergedWinsConflictPolicy{})
+	chain, ok := unmergedChains.byMostRecent[unmergedFilePtr]
+	require.True(t, ok)
+	found := false
+	for _, op := range chain.ops {
+		if _, ok := op.(*syncOp); !ok {
+			continue
+		}
+		for _, ptr := range op.Unrefs() {
+			if ptr == mergedFilePtr {
+				found = true
+			}
+		}
+	}
+	require.True(t, found)
+}
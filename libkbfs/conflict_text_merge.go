@@ -0,0 +1,265 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"unicode/utf8"
+
+	"golang.org/x/net/context"
+)
+
+// crTextMergeMaxEdits is the most line insertions plus deletions a
+// diff may need before a text merge is given up on.
+const crTextMergeMaxEdits = 4096
+
+// readTextForMerge returns the contents of the given file, if it's
+// UTF-8 text that fits in a single block.  Otherwise it returns
+// false.
+func (cr *ConflictResolver) readTextForMerge(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, ptr BlockPointer) (
+	[]byte, bool, error) {
+	file := path{
+		FolderBranch: cr.fbo.folderBranch,
+		path:         []pathNode{{BlockPointer: ptr}},
+	}
+	fblock, err := cr.fbo.blocks.GetFileBlockForReading(
+		ctx, lState, kmd, ptr, file.Branch, file)
+	if err != nil {
+		return nil, false, err
+	}
+	if fblock.IsInd {
+		cr.log.CDebugf(ctx, "%v is too big to merge as text", ptr)
+		return nil, false, nil
+	}
+	if !utf8.Valid(fblock.Contents) {
+		cr.log.CDebugf(ctx, "%v isn't UTF-8 text", ptr)
+		return nil, false, nil
+	}
+	return fblock.Contents, true, nil
+}
+
+// makeTextMergeBlock merges, line by line, the unmerged and merged
+// versions of a file that was written on both branches, using the
+// version from the branch point as the common ancestor.  It returns
+// a new file block holding the result, or nil if the file can't be
+// merged: because a version isn't text or doesn't fit in a single
+// block, or because both versions changed the same lines.
+func (cr *ConflictResolver) makeTextMergeBlock(ctx context.Context,
+	lState *lockState, unmergedChains *crChains, mergedChains *crChains,
+	unmergedChain *crChain, mergedChain *crChain) (*FileBlock, error) {
+	unmergedKmd := unmergedChains.mostRecentMD.ReadOnly()
+	ancestor, ok, err := cr.readTextForMerge(
+		ctx, lState, unmergedKmd, unmergedChain.original)
+	if !ok || err != nil {
+		return nil, err
+	}
+	unmerged, ok, err := cr.readTextForMerge(
+		ctx, lState, unmergedKmd, unmergedChain.mostRecent)
+	if !ok || err != nil {
+		return nil, err
+	}
+	merged, ok, err := cr.readTextForMerge(ctx, lState,
+		mergedChains.mostRecentMD.ReadOnly(), mergedChain.mostRecent)
+	if !ok || err != nil {
+		return nil, err
+	}
+
+	result, ok := mergeTextLines(ancestor, unmerged, merged)
+	if !ok {
+		cr.log.CDebugf(ctx, "Both versions of %v changed the same lines",
+			unmergedChain.original)
+		return nil, nil
+	}
+	fblock := NewFileBlock().(*FileBlock)
+	n := cr.config.BlockSplitter().CopyUntilSplit(fblock, true, result, 0)
+	if n < int64(len(result)) {
+		cr.log.CDebugf(ctx, "The merge of %v doesn't fit in one block",
+			unmergedChain.original)
+		return nil, nil
+	}
+	return fblock, nil
+}
+
+// splitLines splits the given text into lines, each of which keeps
+// its trailing newline (the last one might not have one).
+func splitLines(text []byte) []string {
+	var lines []string
+	for len(text) > 0 {
+		i := bytes.IndexByte(text, '\n')
+		if i < 0 {
+			lines = append(lines, string(text))
+			break
+		}
+		lines = append(lines, string(text[:i+1]))
+		text = text[i+1:]
+	}
+	return lines
+}
+
+// textHunk replaces the lines [start, end) of some original text
+// with new lines.
+type textHunk struct {
+	start, end int
+	lines      []string
+}
+
+func (h textHunk) equals(other textHunk) bool {
+	if h.start != other.start || h.end != other.end ||
+		len(h.lines) != len(other.lines) {
+		return false
+	}
+	for i, line := range h.lines {
+		if line != other.lines[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// overlaps returns whether the two hunks touch the same original
+// lines.  Hunks that are merely adjacent count too, since there's no
+// way to know the right order for their new lines.
+func (h textHunk) overlaps(other textHunk) bool {
+	return h.start <= other.end && other.start <= h.end
+}
+
+// diffLines returns, in order, the hunks that turn a into b, using
+// Myers' algorithm.  It returns false if the texts differ by more
+// than crTextMergeMaxEdits lines.
+func diffLines(a, b []string) ([]textHunk, bool) {
+	n, m := len(a), len(b)
+	max := n + m
+	if max > crTextMergeMaxEdits {
+		max = crTextMergeMaxEdits
+	}
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	// trace[d] holds v[-d..d] as it was before step d.
+	var trace [][]int
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		snapshot := make([]int, 2*d+1)
+		copy(snapshot, v[offset-d:offset+d+1])
+		trace = append(trace, snapshot)
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		return nil, false
+	}
+
+	// Walk back through the trace, collecting the matching lines.
+	type match struct{ a, b int }
+	var matches []match
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		prev := trace[d]
+		k := x - y
+		var prevK int
+		if d == 0 {
+			prevK = 0
+		} else if k == -d || (k != d && prev[k-1+d] < prev[k+1+d]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX, prevY := 0, 0
+		if d > 0 {
+			prevX = prev[prevK+d]
+			prevY = prevX - prevK
+		}
+		for x > prevX && y > prevY {
+			x--
+			y--
+			matches = append(matches, match{x, y})
+		}
+		x, y = prevX, prevY
+	}
+
+	// Turn the gaps between matches into hunks.
+	var hunks []textHunk
+	nextA, nextB := 0, 0
+	for i := len(matches) - 1; i >= -1; i-- {
+		ma, mb := n, m
+		if i >= 0 {
+			ma, mb = matches[i].a, matches[i].b
+		}
+		if ma > nextA || mb > nextB {
+			hunks = append(hunks, textHunk{nextA, ma, b[nextB:mb]})
+		}
+		nextA, nextB = ma+1, mb+1
+	}
+	return hunks, true
+}
+
+// mergeTextLines does a three-way merge, by line, of two texts that
+// were both changed from the given ancestor.  It returns false if
+// the two sets of changes overlap, and so can't be merged
+// automatically.
+func mergeTextLines(ancestor, unmerged, merged []byte) ([]byte, bool) {
+	base := splitLines(ancestor)
+	unmergedHunks, ok := diffLines(base, splitLines(unmerged))
+	if !ok {
+		return nil, false
+	}
+	mergedHunks, ok := diffLines(base, splitLines(merged))
+	if !ok {
+		return nil, false
+	}
+
+	var result bytes.Buffer
+	pos := 0
+	i, j := 0, 0
+	for i < len(unmergedHunks) || j < len(mergedHunks) {
+		var h textHunk
+		switch {
+		case i < len(unmergedHunks) && j < len(mergedHunks) &&
+			unmergedHunks[i].overlaps(mergedHunks[j]):
+			// The same change on both sides is fine.
+			if !unmergedHunks[i].equals(mergedHunks[j]) {
+				return nil, false
+			}
+			h = unmergedHunks[i]
+			i++
+			j++
+		case j >= len(mergedHunks) ||
+			(i < len(unmergedHunks) &&
+				unmergedHunks[i].start < mergedHunks[j].start):
+			h = unmergedHunks[i]
+			i++
+		default:
+			h = mergedHunks[j]
+			j++
+		}
+		for _, line := range base[pos:h.start] {
+			result.WriteString(line)
+		}
+		for _, line := range h.lines {
+			result.WriteString(line)
+		}
+		pos = h.end
+	}
+	for _, line := range base[pos:] {
+		result.WriteString(line)
+	}
+	return result.Bytes(), true
+}
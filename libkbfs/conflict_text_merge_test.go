@@ -0,0 +1,42 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeTextLines(t *testing.T) {
+	ancestor := "a\nb\nc\nd\ne\n"
+	tests := []struct {
+		unmerged, merged string
+		expected         string
+		ok               bool
+	}{
+		// Changes to different lines.
+		{"A\nb\nc\nd\ne\n", "a\nb\nc\nd\nE\n", "A\nb\nc\nd\nE\n", true},
+		// Insertions at both ends.
+		{"a\nb\nc\nd\ne\nf\n", "z\na\nb\nc\nd\ne\n",
+			"z\na\nb\nc\nd\ne\nf\n", true},
+		// A deletion and a change to the last line.
+		{"a\nc\nd\ne\n", "a\nb\nc\nd\ne", "a\nc\nd\ne", true},
+		// The same change on both sides.
+		{"a\nb\nX\nd\ne\n", "a\nb\nX\nd\ne\n", "a\nb\nX\nd\ne\n", true},
+		// Different changes to the same line.
+		{"a\nb\nX\nd\ne\n", "a\nb\nY\nd\ne\n", "", false},
+		// Changes to adjacent lines.
+		{"a\nB\nc\nd\ne\n", "a\nb\nC\nd\ne\n", "", false},
+	}
+	for _, test := range tests {
+		merged, ok := mergeTextLines([]byte(ancestor),
+			[]byte(test.unmerged), []byte(test.merged))
+		require.Equal(t, test.ok, ok, "%q vs %q", test.unmerged, test.merged)
+		if ok {
+			require.Equal(t, test.expected, string(merged))
+		}
+	}
+}
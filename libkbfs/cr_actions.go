@@ -27,6 +27,7 @@ type copyUnmergedEntryAction struct {
 	unique        bool
 	unmergedEntry DirEntry
 	attr          []attrChange
+	xattr         []string
 }
 
 func fixupNamesInOps(fromName string, toName string, ops []op,
@@ -101,6 +102,9 @@ func (cuea *copyUnmergedEntryAction) swapUnmergedBlock(
 			// attributes so we can re-apply them during do().
 			if sao, ok := op.(*setAttrOp); ok {
 				cuea.attr = append(cuea.attr, sao.Attr)
+				if sao.Attr == xattrAttr {
+					cuea.xattr = append(cuea.xattr, sao.XattrName)
+				}
 			} else {
 				return false, zeroPtr, nil
 			}
@@ -135,13 +139,18 @@ func (cuea *copyUnmergedEntryAction) swapUnmergedBlock(
 	return true, parentMostRecent, nil
 }
 
+// uniquifyName returns the given name if it's not already taken in
+// the given directory block, or else the name with the lowest number
+// inserted before its extension that isn't.  Since there are only so
+// many children, one of the first len(block.Children)+1 numbered
+// names must be free.
 func uniquifyName(block *DirBlock, name string) (string, error) {
 	if _, ok := block.Children[name]; !ok {
 		return name, nil
 	}
 
 	base, ext := splitExtension(name)
-	for i := 1; i <= 100; i++ {
+	for i := 1; i <= len(block.Children)+1; i++ {
 		newName := fmt.Sprintf("%s (%d)%s", base, i, ext)
 		if _, ok := block.Children[newName]; !ok {
 			return newName, nil
@@ -190,6 +199,8 @@ func (cuea *copyUnmergedEntryAction) do(ctx context.Context,
 				unmergedEntry.Type = cuea.unmergedEntry.Type
 			case mtimeAttr:
 				unmergedEntry.Mtime = cuea.unmergedEntry.Mtime
+			case xattrAttr:
+				unmergedEntry.copyXattrsFrom(cuea.unmergedEntry, cuea.xattr)
 			}
 		}
 	}
@@ -351,7 +362,8 @@ type copyUnmergedAttrAction struct {
 	fromName string
 	toName   string
 	attr     []attrChange
-	moved    bool // move this action to the parent at most one time
+	xattr    []string // the xattr keys to copy, if attr has xattrAttr
+	moved    bool     // move this action to the parent at most one time
 }
 
 func (cuaa *copyUnmergedAttrAction) swapUnmergedBlock(
@@ -383,6 +395,8 @@ func (cuaa *copyUnmergedAttrAction) do(ctx context.Context,
 			mergedEntry.Size = unmergedEntry.Size
 			mergedEntry.EncodedSize = unmergedEntry.EncodedSize
 			mergedEntry.BlockPointer = unmergedEntry.BlockPointer
+		case xattrAttr:
+			mergedEntry.copyXattrsFrom(unmergedEntry, cuaa.xattr)
 		}
 	}
 	mergedBlock.Children[cuaa.toName] = mergedEntry
@@ -805,6 +819,84 @@ func (rma *renameMergedAction) String() string {
 	return fmt.Sprintf("renameMerged: %s -> %s", rma.fromName, rma.toName)
 }
 
+// mergeTextAction says that the merged version of a file should be
+// replaced by a line-by-line merge of both versions, in place of any
+// unmerged writes.
+type mergeTextAction struct {
+	name string
+	// original is the original pointer of the file.
+	original BlockPointer
+	// block holds the merged text, and gets synced under the merged
+	// file's name.
+	block *FileBlock
+}
+
+func (mta *mergeTextAction) swapUnmergedBlock(
+	unmergedChains *crChains, mergedChains *crChains,
+	unmergedBlock *DirBlock) (bool, BlockPointer, error) {
+	return false, zeroPtr, nil
+}
+
+func (mta *mergeTextAction) do(ctx context.Context,
+	unmergedCopier fileBlockDeepCopier, mergedCopier fileBlockDeepCopier,
+	unmergedBlock *DirBlock, mergedBlock *DirBlock) error {
+	// The merged entry keeps its pointer, so that syncing the new
+	// block updates it like any other write to the merged file.
+	mergedEntry, ok := mergedBlock.Children[mta.name]
+	if !ok {
+		return NoSuchNameError{mta.name}
+	}
+	mergedEntry.Size = uint64(len(mta.block.Contents))
+	mergedBlock.Children[mta.name] = mergedEntry
+	return nil
+}
+
+func (mta *mergeTextAction) updateOps(unmergedMostRecent BlockPointer,
+	mergedMostRecent BlockPointer, unmergedBlock *DirBlock,
+	mergedBlock *DirBlock, unmergedChains *crChains,
+	mergedChains *crChains) error {
+	unmergedChain, ok := unmergedChains.byMostRecent[unmergedMostRecent]
+	if !ok {
+		return fmt.Errorf("Couldn't find unmerged chain for %v",
+			unmergedMostRecent)
+	}
+	// Only the file's own chain gets the new write.
+	if unmergedChain.original != mta.original {
+		return nil
+	}
+
+	// The unmerged writes have been dropped, so describe the merge
+	// as a single sync that rewrites the whole merged file.
+	size := uint64(len(mta.block.Contents))
+	so, err := newSyncOp(mergedMostRecent)
+	if err != nil {
+		return err
+	}
+	so.addWrite(0, size)
+	so.addTruncate(size)
+	so.AutoMerged = true
+	unmergedChain.ops = append(unmergedChain.ops, so)
+
+	// Play the same write locally, to invalidate any cached
+	// contents of either version.
+	localOp, err := newSyncOp(mergedMostRecent)
+	if err != nil {
+		return err
+	}
+	localOp.Writes = append([]WriteRange(nil), so.Writes...)
+	mergedChain, ok := mergedChains.byMostRecent[mergedMostRecent]
+	if !ok {
+		return fmt.Errorf("Couldn't find merged chain for %v",
+			mergedMostRecent)
+	}
+	mergedChain.ops = append(mergedChain.ops, localOp)
+	return nil
+}
+
+func (mta *mergeTextAction) String() string {
+	return fmt.Sprintf("mergeText: %s", mta.name)
+}
+
 // dropUnmergedAction says that the corresponding unmerged
 // operation should be dropped.
 type dropUnmergedAction struct {
@@ -929,6 +1021,18 @@ func (cal crActionList) collapse() crActionList {
 						topAction.attr = append(topAction.attr, a)
 					}
 				}
+				for _, x := range action.xattr {
+					found := false
+					for _, topX := range topAction.xattr {
+						if x == topX {
+							found = true
+							break
+						}
+					}
+					if !found {
+						topAction.xattr = append(topAction.xattr, x)
+					}
+				}
 				indicesToRemove[i] = true
 			default:
 				setTopAction(action, action.fromName, i, infoMap,
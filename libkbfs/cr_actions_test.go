@@ -12,12 +12,13 @@ import (
 func TestCRActionsCollapseNoChange(t *testing.T) {
 	al := crActionList{
 		&copyUnmergedEntryAction{"old1", "new1", "", false, false,
-			DirEntry{}, nil},
+			DirEntry{}, nil, nil},
 		&copyUnmergedEntryAction{"old2", "new2", "", false, false,
-			DirEntry{}, nil},
+			DirEntry{}, nil, nil},
 		&renameUnmergedAction{"old3", "new3", "", 0, false, zeroPtr, zeroPtr},
 		&renameMergedAction{"old4", "new4", ""},
-		&copyUnmergedAttrAction{"old5", "new5", []attrChange{mtimeAttr}, false},
+		&copyUnmergedAttrAction{"old5", "new5", []attrChange{mtimeAttr},
+			nil, false},
 	}
 
 	newList := al.collapse()
@@ -28,9 +29,10 @@ func TestCRActionsCollapseNoChange(t *testing.T) {
 
 func TestCRActionsCollapseEntry(t *testing.T) {
 	al := crActionList{
-		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, false},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr},
+			nil, false},
 		&copyUnmergedEntryAction{"old", "new", "", false, false,
-			DirEntry{}, nil},
+			DirEntry{}, nil, nil},
 		&renameUnmergedAction{"old", "new", "", 0, false, zeroPtr, zeroPtr},
 	}
 
@@ -65,14 +67,17 @@ func TestCRActionsCollapseEntry(t *testing.T) {
 }
 func TestCRActionsCollapseAttr(t *testing.T) {
 	al := crActionList{
-		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, false},
-		&copyUnmergedAttrAction{"old", "new", []attrChange{exAttr}, false},
-		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, false},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr},
+			nil, false},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{exAttr},
+			nil, false},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr},
+			nil, false},
 	}
 
 	expected := crActionList{
 		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr, exAttr},
-			false},
+			nil, false},
 	}
 
 	newList := al.collapse()
@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"fmt"
 	"sort"
+	"time"
 
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/kbfs/kbfscodec"
@@ -86,8 +87,66 @@ func (cc *crChain) getCollapsedWriteRange() []WriteRange {
 	return wr
 }
 
-func (cc *crChain) getActionsToMerge(renamer ConflictRenamer, mergedPath path,
-	mergedChain *crChain) (crActionList, error) {
+// liveSyncBlocks returns the blocks referenced by the syncs in this
+// file chain that are still referenced at the end of it, including
+// the file's most recent pointer if a sync changed it.
+func (cc *crChain) liveSyncBlocks() []BlockPointer {
+	live := make(map[BlockPointer]bool)
+	var ptrs []BlockPointer
+	ref := func(ptr BlockPointer) {
+		if ptr == zeroPtr || live[ptr] {
+			return
+		}
+		live[ptr] = true
+		ptrs = append(ptrs, ptr)
+	}
+	for _, op := range cc.ops {
+		so, ok := op.(*syncOp)
+		if !ok {
+			continue
+		}
+		for _, ptr := range so.Refs() {
+			ref(ptr)
+		}
+		for _, ptr := range so.Unrefs() {
+			delete(live, ptr)
+		}
+		if so.File.Unref != so.File.Ref {
+			delete(live, so.File.Unref)
+			ref(so.File.Ref)
+		}
+	}
+
+	livePtrs := make([]BlockPointer, 0, len(live))
+	for _, ptr := range ptrs {
+		if live[ptr] {
+			livePtrs = append(livePtrs, ptr)
+		}
+	}
+	return livePtrs
+}
+
+// hasSync returns whether any op in the chain, other than those in
+// toSkip, is a syncOp.
+func (cc *crChain) hasSync(toSkip map[int]bool) bool {
+	for i, op := range cc.ops {
+		if _, ok := op.(*syncOp); ok && !toSkip[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// getActionsToMerge returns the actions needed to merge the ops in
+// this unmerged chain into the corresponding merged chain, which may
+// be nil.  If this is a file with changes that conflict with the
+// merged ones, policy picks how to resolve them for the whole file,
+// using the mtimes of both versions returned by getMtimes.
+func (cc *crChain) getActionsToMerge(renamer ConflictRenamer,
+	policy ConflictPolicy,
+	getMtimes func() (unmerged, merged time.Time, err error),
+	mergeText func() (*FileBlock, error),
+	mergedPath path, mergedChain *crChain) (crActionList, error) {
 	var actions crActionList
 
 	// If this is a file, determine whether the unmerged chain
@@ -121,29 +180,119 @@ func (cc *crChain) getActionsToMerge(renamer ConflictRenamer, mergedPath path,
 	}
 
 	// Check each op against all ops in the corresponding merged
-	// chain, looking for conflicts.  If there is a conflict, return
-	// it as part of the action list.  If there are no conflicts for
-	// that op, return the op's default actions.
+	// chain, looking for conflicts.
+	conflictActions := make(map[int]crActionList)
+	// A conflicting change to a file's contents or attributes shows
+	// up as a rename of the unmerged copy.  Contents conflicts could
+	// be merged as text, into the merged file with the given name.
+	fileConflict := false
+	var textMergeName string
 	for i, unmergedOp := range cc.ops {
-		if toSkip[i] {
+		if toSkip[i] || mergedChain == nil {
 			continue
 		}
-		conflict := false
-		if mergedChain != nil {
-			for _, mergedOp := range mergedChain.ops {
-				action, err :=
-					unmergedOp.CheckConflict(renamer, mergedOp, cc.isFile())
-				if err != nil {
-					return nil, err
-				}
-				if action != nil {
-					conflict = true
-					actions = append(actions, action)
+		for _, mergedOp := range mergedChain.ops {
+			action, err :=
+				unmergedOp.CheckConflict(renamer, mergedOp, cc.isFile())
+			if err != nil {
+				return nil, err
+			}
+			if action == nil {
+				continue
+			}
+			if _, ok := action.(*renameUnmergedAction); ok && cc.isFile() {
+				fileConflict = true
+				_, unmergedSync := unmergedOp.(*syncOp)
+				_, mergedSync := mergedOp.(*syncOp)
+				if unmergedSync && mergedSync {
+					textMergeName = mergedOp.getFinalPath().tailName()
 				}
 			}
+			conflictActions[i] = append(conflictActions[i], action)
+		}
+	}
+
+	// The policy may pick one version of a conflicting file instead
+	// of keeping both.
+	choice := ConflictKeepBoth
+	if fileConflict {
+		unmergedMtime, mergedMtime, err := getMtimes()
+		if err != nil {
+			return nil, err
+		}
+		choice = policy.ChooseForFile(
+			ConflictFileVersion{unmergedMtime, cc.hasSync(toSkip)},
+			ConflictFileVersion{mergedMtime, mergedChain.hasSync(nil)})
+	}
+
+	switch choice {
+	case ConflictKeepMerged:
+		for i, unmergedOp := range cc.ops {
+			if !toSkip[i] {
+				actions = append(actions, &dropUnmergedAction{unmergedOp})
+			}
+		}
+		return actions, nil
+	case ConflictKeepUnmerged:
+		var lastSync *syncOp
+		for i, unmergedOp := range cc.ops {
+			if toSkip[i] {
+				continue
+			}
+			if so, ok := unmergedOp.(*syncOp); ok {
+				lastSync = so
+			}
+			actions = append(actions, unmergedOp.GetDefaultAction(mergedPath))
+		}
+		if lastSync != nil {
+			// The unmerged entry replaces the merged one, so the
+			// blocks written on the merged branch aren't referenced
+			// anymore.
+			for _, ptr := range mergedChain.liveSyncBlocks() {
+				lastSync.AddUnrefBlock(ptr)
+			}
+		}
+		return actions, nil
+	case ConflictMergeText:
+		if textMergeName == "" {
+			break
+		}
+		block, err := mergeText()
+		if err != nil {
+			return nil, err
+		}
+		if block == nil {
+			// Keep both versions.
+			break
+		}
+		// The merged text replaces the unmerged writes, but any
+		// other unmerged changes still apply to the merged file.
+		for i, unmergedOp := range cc.ops {
+			if toSkip[i] {
+				continue
+			}
+			if _, ok := unmergedOp.(*syncOp); ok {
+				actions = append(actions, &dropUnmergedAction{unmergedOp})
+			} else {
+				actions = append(actions,
+					unmergedOp.GetDefaultAction(mergedPath))
+			}
+		}
+		actions = append(actions, &mergeTextAction{
+			name:     textMergeName,
+			original: cc.original,
+			block:    block,
+		})
+		return actions, nil
+	}
+
+	for i, unmergedOp := range cc.ops {
+		if toSkip[i] {
+			continue
 		}
+		actions = append(actions, conflictActions[i]...)
 		// no conflicts!
-		if !conflict {
+		if len(conflictActions[i]) == 0 {
 			actions = append(actions, unmergedOp.GetDefaultAction(mergedPath))
 		}
 	}
@@ -176,12 +325,13 @@ func (cc *crChain) identifyType(ctx context.Context, fbo *folderBlockOps,
 			cc.file = true
 			return nil
 		case *setAttrOp:
-			if realOp.Attr != mtimeAttr {
+			if realOp.Attr != mtimeAttr && realOp.Attr != xattrAttr {
 				cc.file = true
 				return nil
 			}
-			// We can't tell the file type from an mtimeAttr, so we
-			// may have to actually fetch the block to figure it out.
+			// We can't tell the file type from an mtimeAttr or
+			// xattrAttr, so we may have to actually fetch the block
+			// to figure it out.
 			parentDir = realOp.Dir.Ref
 		default:
 			return nil
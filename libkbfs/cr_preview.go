@@ -0,0 +1,188 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+
+	"golang.org/x/net/context"
+)
+
+// ConflictResolutionActionType says what a conflict resolution action
+// will do to an entry in the merged branch.
+type ConflictResolutionActionType string
+
+const (
+	// ConflictResolutionCopy copies an unmerged entry into the
+	// merged directory.
+	ConflictResolutionCopy ConflictResolutionActionType = "copy"
+	// ConflictResolutionCopyAttrs copies the attributes of an
+	// unmerged entry onto the merged entry.
+	ConflictResolutionCopyAttrs ConflictResolutionActionType = "copyAttrs"
+	// ConflictResolutionRename keeps the unmerged version of a
+	// conflicting entry under a new name.
+	ConflictResolutionRename ConflictResolutionActionType = "rename"
+	// ConflictResolutionRenameMerged moves the merged version of a
+	// conflicting entry to a new name, so the unmerged version can
+	// take its place.
+	ConflictResolutionRenameMerged ConflictResolutionActionType = "renameMerged"
+	// ConflictResolutionSymlink replaces an entry with a symlink,
+	// to break a rename cycle between the two branches.
+	ConflictResolutionSymlink ConflictResolutionActionType = "symlink"
+	// ConflictResolutionRemove removes a merged entry.
+	ConflictResolutionRemove ConflictResolutionActionType = "remove"
+	// ConflictResolutionDrop drops an unmerged operation, because
+	// the merged branch already makes it moot.
+	ConflictResolutionDrop ConflictResolutionActionType = "drop"
+	// ConflictResolutionMergeText replaces the contents of a merged
+	// file with a line-by-line merge of both versions.
+	ConflictResolutionMergeText ConflictResolutionActionType = "mergeText"
+)
+
+// ConflictResolutionAction is one action that conflict resolution
+// takes, in a form suitable for encoding directly into JSON.
+type ConflictResolutionAction struct {
+	Type ConflictResolutionActionType
+	// Dir is the merged path of the directory the action applies to.
+	Dir  string
+	From string `json:",omitempty"`
+	To   string `json:",omitempty"`
+	// Target is the destination of a new symlink.
+	Target string `json:",omitempty"`
+	// Op describes a dropped unmerged operation.
+	Op string `json:",omitempty"`
+}
+
+// ConflictResolutionPreview describes what conflict resolution would
+// do to the unmerged changes of a folder-branch, in a form suitable
+// for encoding directly into JSON.
+type ConflictResolutionPreview struct {
+	// Staged is false if there are no unmerged changes.
+	Staged       bool
+	UnmergedHead MetadataRevision `json:",omitempty"`
+	MergedHead   MetadataRevision `json:",omitempty"`
+	Policy       string           `json:",omitempty"`
+	Actions      []ConflictResolutionAction
+}
+
+func makeConflictResolutionAction(
+	dir string, action crAction) ConflictResolutionAction {
+	a := ConflictResolutionAction{Dir: dir}
+	switch action := action.(type) {
+	case *copyUnmergedEntryAction:
+		a.Type, a.From, a.To = ConflictResolutionCopy,
+			action.fromName, action.toName
+		a.Target = action.symPath
+	case *copyUnmergedAttrAction:
+		a.Type, a.From, a.To = ConflictResolutionCopyAttrs,
+			action.fromName, action.toName
+	case *renameUnmergedAction:
+		a.Type, a.From, a.To = ConflictResolutionRename,
+			action.fromName, action.toName
+		a.Target = action.symPath
+	case *renameMergedAction:
+		a.Type, a.From, a.To = ConflictResolutionRenameMerged,
+			action.fromName, action.toName
+		a.Target = action.symPath
+	case *rmMergedEntryAction:
+		a.Type, a.From = ConflictResolutionRemove, action.name
+	case *dropUnmergedAction:
+		a.Type, a.Op = ConflictResolutionDrop, action.op.String()
+	case *mergeTextAction:
+		a.Type, a.From = ConflictResolutionMergeText, action.name
+	default:
+		a.Op = action.String()
+	}
+	if a.Target != "" {
+		a.Type = ConflictResolutionSymlink
+	}
+	return a
+}
+
+// makeConflictResolutionActions returns the actions in the given
+// map, grouped by the merged path of their directory.
+func makeConflictResolutionActions(actionMap map[BlockPointer]crActionList,
+	mergedPaths map[BlockPointer]path) []ConflictResolutionAction {
+	// Actions are keyed by the most recent merged pointer of their
+	// directory.
+	dirs := make(map[BlockPointer]string)
+	for _, p := range mergedPaths {
+		dirs[p.tailPointer()] = p.String()
+	}
+	var actions []ConflictResolutionAction
+	for ptr, dirActions := range actionMap {
+		dir, ok := dirs[ptr]
+		if !ok {
+			dir = ptr.String()
+		}
+		for _, action := range dirActions {
+			actions = append(actions,
+				makeConflictResolutionAction(dir, action))
+		}
+	}
+	// Keep the order of each directory's actions, but list the
+	// directories in a stable order.
+	sort.Stable(conflictResolutionActionsByDir(actions))
+	return actions
+}
+
+// Preview works out what conflict resolution would do to the current
+// unmerged changes, without applying anything: it builds the chains
+// and merged paths and computes the actions, but stops short of doing
+// them or syncing any blocks.  It doesn't take any locks beyond those
+// needed to read the MDs, so the unmerged branch may move on while
+// it runs, and a later resolution may differ.
+func (cr *ConflictResolver) Preview(ctx context.Context) (
+	preview ConflictResolutionPreview, err error) {
+	lState := makeFBOLockState()
+	unmerged, merged, err := cr.getMDs(ctx, lState, false)
+	if err != nil {
+		return ConflictResolutionPreview{}, err
+	}
+	if len(unmerged) == 0 {
+		return ConflictResolutionPreview{}, nil
+	}
+	preview.Staged = true
+	preview.UnmergedHead = unmerged[len(unmerged)-1].Revision()
+	if len(merged) == 0 {
+		// Nothing to resolve against yet.
+		return preview, nil
+	}
+	preview.MergedHead = merged[len(merged)-1].Revision()
+
+	unmergedChains, mergedChains, unmergedPaths, mergedPaths, recreateOps,
+		err := cr.makeChainsAndPaths(ctx, lState, unmerged, merged)
+	if err != nil {
+		return ConflictResolutionPreview{}, err
+	}
+	policy := cr.getConflictPolicy(ctx, lState, mergedChains.mostRecentMD)
+	preview.Policy = policy.Name()
+	if len(mergedPaths) == 0 {
+		return preview, nil
+	}
+
+	actionMap, _, err := cr.computeActions(ctx, unmergedChains, mergedChains,
+		unmergedPaths, mergedPaths, recreateOps, policy)
+	if err != nil {
+		return ConflictResolutionPreview{}, err
+	}
+
+	preview.Actions = makeConflictResolutionActions(actionMap, mergedPaths)
+	return preview, nil
+}
+
+type conflictResolutionActionsByDir []ConflictResolutionAction
+
+func (a conflictResolutionActionsByDir) Len() int {
+	return len(a)
+}
+
+func (a conflictResolutionActionsByDir) Less(i, j int) bool {
+	return a[i].Dir < a[j].Dir
+}
+
+func (a conflictResolutionActionsByDir) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
@@ -0,0 +1,87 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreviewConflictResolution(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	config2.SetClock(newTestClockNow())
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	fb := rootNode2.GetFolderBranch()
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+
+	// Nothing to preview before there are unmerged changes.
+	preview, err := kbfsOps2.PreviewConflictResolution(ctx, fb)
+	require.NoError(t, err)
+	require.False(t, preview.Staged)
+
+	c, err := DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, fb)
+	require.NoError(t, err)
+
+	// Both users write to the same file.
+	err = kbfsOps1.Write(ctx, fileNode1, []byte{1}, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+	err = kbfsOps2.Write(ctx, fileNode2, []byte{2}, 0)
+	require.NoError(t, err)
+	err = kbfsOps2.Sync(ctx, fileNode2)
+	require.NoError(t, err)
+
+	preview, err = kbfsOps2.PreviewConflictResolution(ctx, fb)
+	require.NoError(t, err)
+	require.True(t, preview.Staged)
+	require.Equal(t, KeepBothConflictPolicy{}.Name(), preview.Policy)
+	require.Len(t, preview.Actions, 1)
+	action := preview.Actions[0]
+	require.Equal(t, ConflictResolutionRename, action.Type)
+	require.Equal(t, name, action.Dir)
+	require.Equal(t, "a", action.From)
+	require.NotEqual(t, "a", action.To)
+
+	// The preview doesn't change anything.
+	entries, err := kbfsOps2.GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2, fb)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+
+	entries, err = kbfsOps2.GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Contains(t, entries, action.To)
+
+	preview, err = kbfsOps2.PreviewConflictResolution(ctx, fb)
+	require.NoError(t, err)
+	require.False(t, preview.Staged)
+}
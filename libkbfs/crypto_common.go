@@ -8,8 +8,10 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"fmt"
 	"io"
 
+	"github.com/golang/snappy"
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfscodec"
@@ -342,7 +344,13 @@ func (c CryptoCommon) decryptData(encryptedData encryptedData, key [32]byte) ([]
 	if encryptedData.Version != EncryptionSecretbox {
 		return nil, UnknownEncryptionVer{encryptedData.Version}
 	}
+	return c.openSecretbox(encryptedData, key)
+}
 
+// openSecretbox decrypts the given data without checking its
+// version, which callers must do themselves.
+func (c CryptoCommon) openSecretbox(
+	encryptedData encryptedData, key [32]byte) ([]byte, error) {
 	var nonce [24]byte
 	if len(encryptedData.Nonce) != len(nonce) {
 		return nil, InvalidNonceError{encryptedData.Nonce}
@@ -445,15 +453,30 @@ func (c CryptoCommon) depadBlock(paddedBlock []byte) ([]byte, error) {
 	return buf.Next(int(blockLen)), nil
 }
 
-// EncryptBlock implements the Crypto interface for CryptoCommon.
-func (c CryptoCommon) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (
+func (c CryptoCommon) encryptBlock(block Block, key kbfscrypto.BlockCryptKey,
+	compress bool) (
 	plainSize int, encryptedBlock EncryptedBlock, err error) {
 	encodedBlock, err := c.codec.Encode(block)
 	if err != nil {
 		return
 	}
 
-	paddedBlock, err := c.padBlock(encodedBlock)
+	version := EncryptionSecretbox
+	toPad := encodedBlock
+	// Blocks over the maximum size are never compressed, since
+	// DecryptBlock won't decompress them.
+	if compress && len(encodedBlock) <= MaxBlockSizeBytesDefault {
+		// Only keep the compressed version if it actually helps.
+		// It gets padded just the same, so the server still only
+		// learns the (rounded-up) size of what's stored.
+		compressedBlock := snappy.Encode(nil, encodedBlock)
+		if len(compressedBlock) < len(encodedBlock) {
+			version = EncryptionSecretboxWithSnappy
+			toPad = compressedBlock
+		}
+	}
+
+	paddedBlock, err := c.padBlock(toPad)
 	if err != nil {
 		return
 	}
@@ -462,17 +485,39 @@ func (c CryptoCommon) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (
 	if err != nil {
 		return
 	}
+	encryptedData.Version = version
 
 	plainSize = len(encodedBlock)
 	encryptedBlock = EncryptedBlock(encryptedData)
 	return
 }
 
+// EncryptBlock implements the Crypto interface for CryptoCommon.
+func (c CryptoCommon) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (
+	plainSize int, encryptedBlock EncryptedBlock, err error) {
+	return c.encryptBlock(block, key, false)
+}
+
+// EncryptBlockCompressed implements the Crypto interface for
+// CryptoCommon.
+func (c CryptoCommon) EncryptBlockCompressed(
+	block Block, key kbfscrypto.BlockCryptKey) (
+	plainSize int, encryptedBlock EncryptedBlock, err error) {
+	return c.encryptBlock(block, key, true)
+}
+
 // DecryptBlock implements the Crypto interface for CryptoCommon.
 func (c CryptoCommon) DecryptBlock(
 	encryptedBlock EncryptedBlock, key kbfscrypto.BlockCryptKey,
 	block Block) error {
-	paddedBlock, err := c.decryptData(encryptedData(encryptedBlock), key.Data())
+	switch encryptedBlock.Version {
+	case EncryptionSecretbox, EncryptionSecretboxWithSnappy:
+	default:
+		return UnknownEncryptionVer{encryptedBlock.Version}
+	}
+
+	paddedBlock, err := c.openSecretbox(
+		encryptedData(encryptedBlock), key.Data())
 	if err != nil {
 		return err
 	}
@@ -482,6 +527,24 @@ func (c CryptoCommon) DecryptBlock(
 		return err
 	}
 
+	if encryptedBlock.Version == EncryptionSecretboxWithSnappy {
+		// Check the decompressed size first, so that a bad block
+		// can't make us allocate an arbitrary amount of memory.
+		decodedLen, err := snappy.DecodedLen(encodedBlock)
+		if err != nil {
+			return BlockDecodeError{err}
+		}
+		if decodedLen > MaxBlockSizeBytesDefault {
+			return BlockDecodeError{fmt.Errorf(
+				"Decompressed block size %d is over the maximum of %d",
+				decodedLen, MaxBlockSizeBytesDefault)}
+		}
+		encodedBlock, err = snappy.Decode(nil, encodedBlock)
+		if err != nil {
+			return BlockDecodeError{err}
+		}
+	}
+
 	err = c.codec.Decode(encodedBlock, &block)
 	if err != nil {
 		return BlockDecodeError{err}
@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"bytes"
+	"encoding/binary"
 	"testing"
 	"testing/quick"
 
@@ -565,7 +566,7 @@ func checkDecryptionFailures(
 	// Wrong version.
 
 	encryptedDataWrongVersion := encryptedData
-	encryptedDataWrongVersion.Version++
+	encryptedDataWrongVersion.Version = EncryptionSecretboxWithSnappy + 1
 	expectedErr = UnknownEncryptionVer{encryptedDataWrongVersion.Version}
 	err = decryptFn(encryptedDataWrongVersion, key)
 	if err != expectedErr {
@@ -767,6 +768,128 @@ func TestDecryptBlockFailures(t *testing.T) {
 		})
 }
 
+// Test that crypto.EncryptBlockCompressed() compresses blocks that
+// shrink, and that crypto.DecryptBlock() can read them back.
+func TestEncryptDecryptBlockCompressed(t *testing.T) {
+	c := MakeCryptoCommon(kbfscodec.NewMsgpack())
+
+	cryptKey := makeFakeBlockCryptKey(t)
+
+	block := NewFileBlock().(*FileBlock)
+	block.Contents = bytes.Repeat([]byte("kbfs"), 10000)
+	expectedEncodedBlock, err := c.codec.Encode(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plainSize, encryptedBlock, err := c.EncryptBlockCompressed(block, cryptKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plainSize != len(expectedEncodedBlock) {
+		t.Errorf("Expected plain size %d, got %d",
+			len(expectedEncodedBlock), plainSize)
+	}
+	if encryptedBlock.Version != EncryptionSecretboxWithSnappy {
+		t.Errorf("Expected version %d, got %d",
+			EncryptionSecretboxWithSnappy, encryptedBlock.Version)
+	}
+	if len(encryptedBlock.EncryptedData) >= plainSize {
+		t.Errorf("Compressed block of size %d isn't smaller than %d",
+			len(encryptedBlock.EncryptedData), plainSize)
+	}
+
+	// The compressed data must still be padded.
+	secretboxData := encryptedData(encryptedBlock)
+	secretboxData.Version = EncryptionSecretbox
+	paddedBlock := checkSecretboxOpen(t, secretboxData, cryptKey.Data())
+	if _, err := c.depadBlock(paddedBlock); err != nil {
+		t.Fatal(err)
+	}
+
+	decryptedBlock := NewFileBlock().(*FileBlock)
+	err = c.DecryptBlock(encryptedBlock, cryptKey, decryptedBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decryptedBlock.Contents, block.Contents) {
+		t.Errorf("Decrypted block contents don't match")
+	}
+}
+
+// Test that crypto.EncryptBlockCompressed() leaves blocks that don't
+// compress alone.
+func TestEncryptBlockCompressedIncompressible(t *testing.T) {
+	c := MakeCryptoCommon(kbfscodec.NewMsgpack())
+
+	cryptKey := makeFakeBlockCryptKey(t)
+
+	block := NewFileBlock().(*FileBlock)
+	block.Contents = make([]byte, 10000)
+	if err := cryptoRandRead(block.Contents); err != nil {
+		t.Fatal(err)
+	}
+
+	_, encryptedBlock, err := c.EncryptBlockCompressed(block, cryptKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encryptedBlock.Version != EncryptionSecretbox {
+		t.Errorf("Expected version %d, got %d",
+			EncryptionSecretbox, encryptedBlock.Version)
+	}
+
+	decryptedBlock := NewFileBlock().(*FileBlock)
+	err = c.DecryptBlock(encryptedBlock, cryptKey, decryptedBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decryptedBlock.Contents, block.Contents) {
+		t.Errorf("Decrypted block contents don't match")
+	}
+}
+
+// Test that crypto.EncryptBlockCompressed() leaves blocks over the
+// maximum size uncompressed, and that crypto.DecryptBlock() refuses
+// to decompress them.
+func TestEncryptDecryptBlockCompressedTooBig(t *testing.T) {
+	c := MakeCryptoCommon(kbfscodec.NewMsgpack())
+
+	cryptKey := makeFakeBlockCryptKey(t)
+
+	block := NewFileBlock().(*FileBlock)
+	block.Contents = make([]byte, MaxBlockSizeBytesDefault)
+	_, encryptedBlock, err := c.EncryptBlockCompressed(block, cryptKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encryptedBlock.Version != EncryptionSecretbox {
+		t.Errorf("Expected version %d, got %d",
+			EncryptionSecretbox, encryptedBlock.Version)
+	}
+
+	// Just a snappy header, claiming a decompressed size that's
+	// too big.
+	header := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(header, MaxBlockSizeBytesDefault+1)
+	paddedBlock, err := c.padBlock(header[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedData, err := c.encryptData(paddedBlock, cryptKey.Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedData.Version = EncryptionSecretboxWithSnappy
+
+	decryptedBlock := NewFileBlock().(*FileBlock)
+	err = c.DecryptBlock(
+		EncryptedBlock(encryptedData), cryptKey, decryptedBlock)
+	if _, ok := err.(BlockDecodeError); !ok {
+		t.Errorf("Expected a BlockDecodeError, got %v", err)
+	}
+}
+
 // Test padding of blocks results in a larger block, with length
 // equal to power of 2 + 4.
 func TestBlockPadding(t *testing.T) {
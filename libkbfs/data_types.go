@@ -8,6 +8,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -66,6 +67,11 @@ const (
 	// EncryptionSecretbox is the encryption version that uses
 	// nacl/secretbox or nacl/box.
 	EncryptionSecretbox EncryptionVer = 1
+	// EncryptionSecretboxWithSnappy is the same as
+	// EncryptionSecretbox, except that the plaintext was
+	// compressed with snappy before being padded.  It's only used
+	// for blocks.
+	EncryptionSecretboxWithSnappy EncryptionVer = 2
 )
 
 // encryptedData is encrypted data with a nonce and a version.
@@ -153,6 +159,15 @@ const (
 	// FilesWithHolesDataVer is the data version for files
 	// with holes.
 	FilesWithHolesDataVer = 2
+	// ContentDefinedChunksDataVer is the data version for files
+	// whose blocks were split at content-defined boundaries, which
+	// older clients must not re-split at fixed offsets.
+	ContentDefinedChunksDataVer = 3
+	// CompressedBlocksDataVer is the data version for blocks that
+	// may have been compressed before being encrypted (see
+	// EncryptionSecretboxWithSnappy), which older clients can't
+	// decrypt.
+	CompressedBlocksDataVer = 4
 )
 
 // BlockRefNonce is a 64-bit unique sequence of bytes for identifying
@@ -326,6 +341,8 @@ type ReadyBlockData struct {
 	// These fields should not be used outside of BlockOps.Put().
 	buf        []byte
 	serverHalf kbfscrypto.BlockCryptKeyServerHalf
+
+	compressed bool
 }
 
 // GetEncodedSize returns the size of the encoded (and encrypted)
@@ -334,6 +351,13 @@ func (r ReadyBlockData) GetEncodedSize() int {
 	return len(r.buf)
 }
 
+// IsCompressed returns whether the block was compressed before it
+// was encrypted, in which case its pointer must be marked with
+// CompressedBlocksDataVer.
+func (r ReadyBlockData) IsCompressed() bool {
+	return r.compressed
+}
+
 // Favorite is a top-level favorited folder name.
 type Favorite struct {
 	Name   string
@@ -378,8 +402,39 @@ const (
 	// folder.  Set to the empty string so that the default will be
 	// the master branch.
 	MasterBranch BranchName = ""
+
+	// archivedRevBranchPrefix is the prefix of a branch name that
+	// represents a read-only view of a top-level folder, pinned at a
+	// particular merged revision.
+	archivedRevBranchPrefix = "rev="
 )
 
+// MakeRevBranchName returns a branch name specifying an archive
+// branch pinned to the given revision number.
+func MakeRevBranchName(rev MetadataRevision) BranchName {
+	return BranchName(archivedRevBranchPrefix + strconv.FormatInt(int64(rev), 10))
+}
+
+// IsArchived returns true if the branch specifies an archived revision.
+func (bn BranchName) IsArchived() bool {
+	return strings.HasPrefix(string(bn), archivedRevBranchPrefix)
+}
+
+// RevisionIfSpecified returns a valid revision number and true if
+// `bn` is a revision branch.
+func (bn BranchName) RevisionIfSpecified() (MetadataRevision, bool) {
+	if !bn.IsArchived() {
+		return MetadataRevisionUninitialized, false
+	}
+
+	i, err := strconv.ParseInt(string(bn[len(archivedRevBranchPrefix):]), 10, 64)
+	if err != nil {
+		return MetadataRevisionUninitialized, false
+	}
+
+	return MetadataRevision(i), true
+}
+
 // FolderBranch represents a unique pair of top-level folder and a
 // branch of that folder.
 type FolderBranch struct {
@@ -545,6 +600,18 @@ type EntryInfo struct {
 	Mtime int64
 	// Ctime is in unix nanoseconds
 	Ctime int64
+	// Nlink is the number of hard links to this entry, or 0 if it
+	// isn't hard-linked.  It isn't stored in the directory entry;
+	// instead it's filled in from PrivateMetadata.HardLinks when
+	// the entry is looked up.
+	Nlink uint32 `codec:"-"`
+}
+
+// FileHole is a range of a file that has no data blocks behind it,
+// and reads back as zeros.
+type FileHole struct {
+	Off uint64
+	Len uint64
 }
 
 // ReportedError represents an error reported by KBFS.
@@ -11,6 +11,21 @@ type DirEntry struct {
 	BlockInfo
 	EntryInfo
 
+	// Xattrs holds the extended attributes of this entry.  Like the
+	// rest of the entry, it is encrypted as part of the parent
+	// DirBlock.  It must be treated as immutable; any change must
+	// make a new map (see setXattr and removeXattr), since DirEntry
+	// values are copied freely between cached blocks.
+	Xattrs map[string][]byte `codec:"x,omitempty"`
+
+	// HardLink is the ID of the hard link group this entry belongs
+	// to, or empty if the entry isn't hard-linked.  The ID moves
+	// along with the entry when it is renamed, so it's the
+	// authoritative record of which entries are linked together;
+	// the paths in PrivateMetadata.HardLinks are just hints for
+	// finding them.
+	HardLink string `codec:"hl,omitempty"`
+
 	codec.UnknownFieldSetHandler
 }
 
@@ -18,3 +33,50 @@ type DirEntry struct {
 func (de *DirEntry) IsInitialized() bool {
 	return de.BlockPointer.IsInitialized()
 }
+
+// copyXattrs returns a copy of the entry's xattr map, with room for
+// at least one more entry.
+func (de *DirEntry) copyXattrs() map[string][]byte {
+	xattrs := make(map[string][]byte, len(de.Xattrs)+1)
+	for k, v := range de.Xattrs {
+		xattrs[k] = v
+	}
+	return xattrs
+}
+
+// setXattr sets the value of the given extended attribute, without
+// modifying the previous map.
+func (de *DirEntry) setXattr(name string, value []byte) {
+	xattrs := de.copyXattrs()
+	xattrs[name] = append([]byte(nil), value...)
+	de.Xattrs = xattrs
+}
+
+// removeXattr removes the given extended attribute, without
+// modifying the previous map.  It returns false if the attribute
+// didn't exist.
+func (de *DirEntry) removeXattr(name string) bool {
+	if _, ok := de.Xattrs[name]; !ok {
+		return false
+	}
+	xattrs := de.copyXattrs()
+	delete(xattrs, name)
+	if len(xattrs) == 0 {
+		xattrs = nil
+	}
+	de.Xattrs = xattrs
+	return true
+}
+
+// copyXattrsFrom copies the values of the given extended attribute
+// names from the other entry into this one, removing any that don't
+// exist in the other entry.
+func (de *DirEntry) copyXattrsFrom(other DirEntry, names []string) {
+	for _, name := range names {
+		if value, ok := other.Xattrs[name]; ok {
+			de.setXattr(name, value)
+		} else {
+			de.removeXattr(name)
+		}
+	}
+}
@@ -33,7 +33,10 @@ func makeFakeDirEntryFuture(t *testing.T) dirEntryFuture {
 				"fake sym path",
 				101,
 				102,
+				0,
 			},
+			map[string][]byte{"user.fake": []byte("fake value")},
+			"fake hard link",
 			codec.UnknownFieldSetHandler{},
 		},
 		makeExtraOrBust("dirEntry", t),
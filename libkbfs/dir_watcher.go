@@ -0,0 +1,361 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+// ChangeEventType indicates what kind of change a ChangeEvent
+// describes.
+type ChangeEventType int
+
+const (
+	// ChangeEventDelete means the entry at Path was removed.
+	ChangeEventDelete ChangeEventType = iota
+	// ChangeEventRename means the entry at OldPath was moved to
+	// Path.
+	ChangeEventRename
+	// ChangeEventCreate means a new entry was created at Path.
+	ChangeEventCreate
+	// ChangeEventModify means the contents or attributes of the
+	// entry at Path changed.
+	ChangeEventModify
+	// ChangeEventError means the watch failed with Err.  It's
+	// always the last event before the channel is closed.
+	ChangeEventError
+)
+
+func (t ChangeEventType) String() string {
+	switch t {
+	case ChangeEventDelete:
+		return "delete"
+	case ChangeEventRename:
+		return "rename"
+	case ChangeEventCreate:
+		return "create"
+	case ChangeEventModify:
+		return "modify"
+	case ChangeEventError:
+		return "error"
+	default:
+		return fmt.Sprintf("ChangeEventType(%d)", int(t))
+	}
+}
+
+// ChangeEvent describes a single change to an entry under a watched
+// directory.  Paths include the name of the top-level folder, e.g.
+// "alice,bob/dir/file".
+type ChangeEvent struct {
+	Type ChangeEventType
+	Path string
+	// OldPath is only set for ChangeEventRename.
+	OldPath string
+	// Revision is the revision of the folder that includes the
+	// change.  Passing it to KBFSOps.Watch resumes watching right
+	// after it.  For ChangeEventError, it's the last revision
+	// whose events were all delivered, except that for a
+	// RevisionsSquashedError it's the revision before the squash,
+	// and the revisions of all the events since then should be
+	// forgotten.
+	Revision MetadataRevision
+	// Err is only set for ChangeEventError.
+	Err error
+}
+
+// changeEvents sorts events by type, and then by path.
+type changeEvents []ChangeEvent
+
+func (e changeEvents) Len() int {
+	return len(e)
+}
+
+func (e changeEvents) Less(i, j int) bool {
+	if e[i].Type != e[j].Type {
+		return e[i].Type < e[j].Type
+	}
+	return e[i].Path < e[j].Path
+}
+
+func (e changeEvents) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+}
+
+// watchEventBufferSize is the number of events that can be queued
+// for a slow watcher before processing of new revisions stops.
+const watchEventBufferSize = 100
+
+// dirWatcher implements a single KBFSOps.Watch call.  It registers
+// as an Observer just to learn when new revisions have been applied,
+// and then turns the ops in those revisions into path-based events.
+//
+// Events are delivered through a bounded channel.  When the reader
+// falls behind, the watcher stops processing revisions until there's
+// room again; all the revisions that arrived in the meantime are
+// then processed together, so that repeated changes to the same
+// entry coalesce into a single event.
+type dirWatcher struct {
+	fbo       *folderBranchOps
+	log       logger.Logger
+	dirPath   string
+	recursive bool
+
+	// lastRev is the last revision that was turned into events.
+	// Only accessed by the run goroutine.
+	lastRev MetadataRevision
+	// squashCount is the number of squashes of the folder's MDs
+	// that the watcher has already checked lastRev against.  Only
+	// accessed by the run goroutine.
+	squashCount int
+
+	eventCh chan ChangeEvent
+	kickCh  chan struct{}
+}
+
+var _ Observer = (*dirWatcher)(nil)
+
+func newDirWatcher(fbo *folderBranchOps, dirPath string, recursive bool,
+	lastRev MetadataRevision, squashCount int) *dirWatcher {
+	return &dirWatcher{
+		fbo:         fbo,
+		log:         fbo.log,
+		dirPath:     dirPath,
+		recursive:   recursive,
+		lastRev:     lastRev,
+		squashCount: squashCount,
+		eventCh:     make(chan ChangeEvent, watchEventBufferSize),
+		kickCh:      make(chan struct{}, 1),
+	}
+}
+
+func (w *dirWatcher) kick() {
+	select {
+	case w.kickCh <- struct{}{}:
+	default:
+		// Already kicked.
+	}
+}
+
+// LocalChange implements the Observer interface for dirWatcher.
+func (w *dirWatcher) LocalChange(
+	ctx context.Context, node Node, write WriteRange) {
+	// Unsynced writes will show up in a revision once they're
+	// synced, so there's nothing to do yet.
+}
+
+// BatchChanges implements the Observer interface for dirWatcher.
+func (w *dirWatcher) BatchChanges(
+	ctx context.Context, changes []NodeChange) {
+	w.kick()
+}
+
+// TlfHandleChange implements the Observer interface for dirWatcher.
+func (w *dirWatcher) TlfHandleChange(
+	ctx context.Context, newHandle *TlfHandle) {
+}
+
+// run processes new revisions until ctx is canceled or an error
+// happens, and then closes the event channel.  An error is passed on
+// to the reader as a final ChangeEventError, so that it knows it
+// may have missed changes, and where to resume watching from.
+func (w *dirWatcher) run(ctx context.Context) {
+	defer close(w.eventCh)
+	for {
+		select {
+		case <-w.kickCh:
+		case <-ctx.Done():
+			return
+		}
+
+		events, err := w.getEvents(ctx)
+		if err != nil {
+			w.log.CDebugf(ctx, "Couldn't get events for watch on %s: %v",
+				w.dirPath, err)
+			select {
+			case w.eventCh <- ChangeEvent{
+				Type: ChangeEventError, Revision: w.lastRev, Err: err}:
+			case <-ctx.Done():
+			}
+			return
+		}
+		for _, event := range events {
+			select {
+			case w.eventCh <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// getEvents returns the events for all the merged revisions since
+// the last call, and advances lastRev.
+func (w *dirWatcher) getEvents(ctx context.Context) ([]ChangeEvent, error) {
+	lState := makeFBOLockState()
+	if !w.fbo.isMasterBranch(lState) {
+		// Wait until conflict resolution is done.
+		return nil, nil
+	}
+	squashes, squashCount := w.fbo.getSquashesSince(lState, w.squashCount)
+	w.squashCount = squashCount
+	if squash, ok := findSquash(squashes, w.lastRev); ok {
+		// The revisions of the events already delivered may be
+		// reused, so the reader has to start over from before the
+		// squash.
+		w.lastRev = squash.Start - 1
+		return nil, squash
+	}
+	head := w.fbo.getHead(lState)
+	if head == (ImmutableRootMetadata{}) || head.Revision() <= w.lastRev {
+		return nil, nil
+	}
+
+	rmds, err := getMDRange(ctx, w.fbo.config, w.fbo.id(), NullBranchID,
+		w.lastRev+1, head.Revision(), Merged)
+	if err != nil {
+		return nil, err
+	}
+	if len(rmds) == 0 {
+		return nil, nil
+	}
+
+	chains, err := newCRChains(
+		ctx, w.fbo.config, rmds, &w.fbo.blocks, false)
+	if err != nil {
+		return nil, err
+	}
+	_, err = chains.getPaths(
+		ctx, &w.fbo.blocks, w.log, w.fbo.nodeCache, true)
+	if err != nil {
+		return nil, err
+	}
+
+	rev := rmds[len(rmds)-1].Revision()
+	w.lastRev = rev
+	return w.eventsFromChains(chains, rev), nil
+}
+
+// chainPath returns the final path of the node whose original
+// pointer is given, or false if it's unknown.
+func (w *dirWatcher) chainPath(chains *crChains, original BlockPointer) (
+	path, bool) {
+	chain, ok := chains.byOriginal[original]
+	if !ok || len(chain.ops) == 0 {
+		return path{}, false
+	}
+	p := chain.ops[0].getFinalPath()
+	return p, p.isValid()
+}
+
+func (w *dirWatcher) eventsFromChains(
+	chains *crChains, rev MetadataRevision) []ChangeEvent {
+	seen := make(map[ChangeEvent]bool)
+	var events changeEvents
+	add := func(t ChangeEventType, p, oldPath string) {
+		event := ChangeEvent{t, p, oldPath, rev, nil}
+		if !w.matches(p) && (oldPath == "" || !w.matches(oldPath)) {
+			return
+		}
+		if seen[event] {
+			return
+		}
+		seen[event] = true
+		events = append(events, event)
+	}
+
+	// Renames are split across two chains, as an rmOp and a
+	// renamed createOp, so handle them separately.
+	type nameInDir struct {
+		dir  BlockPointer
+		name string
+	}
+	renamedFrom := make(map[nameInDir]bool)
+	for original, ri := range chains.renamedOriginals {
+		renamedFrom[nameInDir{ri.originalOldParent, ri.oldName}] = true
+		oldParent, oldOk := w.chainPath(chains, ri.originalOldParent)
+		if chains.isDeleted(original) {
+			// Renamed and then removed, so the rmOp under the
+			// new name is covered here.
+			renamedFrom[nameInDir{ri.originalNewParent, ri.newName}] = true
+			if oldOk && !chains.isCreated(original) {
+				add(ChangeEventDelete,
+					oldParent.ChildPathNoPtr(ri.oldName).String(), "")
+			}
+			continue
+		}
+		newParent, ok := w.chainPath(chains, ri.originalNewParent)
+		if !ok {
+			continue
+		}
+		newPath := newParent.ChildPathNoPtr(ri.newName).String()
+		if !oldOk || chains.isCreated(original) {
+			// Anything created and renamed within these revisions
+			// is just a create, as far as the watcher can tell.
+			add(ChangeEventCreate, newPath, "")
+			continue
+		}
+		add(ChangeEventRename, newPath,
+			oldParent.ChildPathNoPtr(ri.oldName).String())
+	}
+
+	for original, chain := range chains.byOriginal {
+		for _, op := range chain.ops {
+			p := op.getFinalPath()
+			if !p.isValid() {
+				continue
+			}
+			switch realOp := op.(type) {
+			case *createOp:
+				if realOp.renamed {
+					continue
+				}
+				add(ChangeEventCreate,
+					p.ChildPathNoPtr(realOp.NewName).String(), "")
+			case *rmOp:
+				if renamedFrom[nameInDir{original, realOp.OldName}] {
+					continue
+				}
+				add(ChangeEventDelete,
+					p.ChildPathNoPtr(realOp.OldName).String(), "")
+			case *syncOp:
+				add(ChangeEventModify, p.String(), "")
+			case *setAttrOp:
+				add(ChangeEventModify,
+					p.ChildPathNoPtr(realOp.Name).String(), "")
+			}
+		}
+	}
+
+	// A create already implies the new entry's contents.
+	created := make(map[string]bool)
+	for _, event := range events {
+		if event.Type == ChangeEventCreate {
+			created[event.Path] = true
+		}
+	}
+	coalesced := events[:0]
+	for _, event := range events {
+		if event.Type == ChangeEventModify && created[event.Path] {
+			continue
+		}
+		coalesced = append(coalesced, event)
+	}
+	sort.Sort(coalesced)
+	return coalesced
+}
+
+// matches returns whether an event at the given path should be
+// reported by this watcher.
+func (w *dirWatcher) matches(p string) bool {
+	if !strings.HasPrefix(p, w.dirPath+"/") {
+		return false
+	}
+	return w.recursive || !strings.Contains(p[len(w.dirPath)+1:], "/")
+}
@@ -0,0 +1,213 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestDirWatcherMatches(t *testing.T) {
+	w := &dirWatcher{dirPath: "u1,u2/a"}
+	require.True(t, w.matches("u1,u2/a/b"))
+	require.False(t, w.matches("u1,u2/a/b/c"))
+	require.False(t, w.matches("u1,u2/a"))
+	require.False(t, w.matches("u1,u2/ab"))
+	require.False(t, w.matches("u1,u2/b"))
+
+	w.recursive = true
+	require.True(t, w.matches("u1,u2/a/b"))
+	require.True(t, w.matches("u1,u2/a/b/c"))
+	require.False(t, w.matches("u1,u2/ab/c"))
+}
+
+func TestDirWatcherEventOrder(t *testing.T) {
+	events := changeEvents{
+		{Type: ChangeEventModify, Path: "u1/a"},
+		{Type: ChangeEventCreate, Path: "u1/c"},
+		{Type: ChangeEventCreate, Path: "u1/b"},
+		{Type: ChangeEventRename, Path: "u1/d", OldPath: "u1/e"},
+		{Type: ChangeEventDelete, Path: "u1/f"},
+	}
+	sort.Sort(events)
+	require.Equal(t, changeEvents{
+		{Type: ChangeEventDelete, Path: "u1/f"},
+		{Type: ChangeEventRename, Path: "u1/d", OldPath: "u1/e"},
+		{Type: ChangeEventCreate, Path: "u1/b"},
+		{Type: ChangeEventCreate, Path: "u1/c"},
+		{Type: ChangeEventModify, Path: "u1/a"},
+	}, events)
+}
+
+func readChangeEvent(t *testing.T, eventCh <-chan ChangeEvent) ChangeEvent {
+	select {
+	case event, ok := <-eventCh:
+		require.True(t, ok, "Event channel closed")
+		return event
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for an event")
+		return ChangeEvent{}
+	}
+}
+
+func TestDirWatcherEvents(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	kbfsOps := config.KBFSOps()
+	h := parseTlfHandleOrBust(t, config, "test_user", false)
+	rootNode, _, err := kbfsOps.GetOrCreateRootNode(ctx, h, MasterBranch)
+	require.NoError(t, err)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	eventCh, err := kbfsOps.Watch(
+		watchCtx, dirNode, false, MetadataRevisionUninitialized)
+	require.NoError(t, err)
+
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	event := readChangeEvent(t, eventCh)
+	require.Equal(t, ChangeEventCreate, event.Type)
+	require.Equal(t, "test_user/a/b", event.Path)
+	createRev := event.Revision
+
+	err = kbfsOps.Write(ctx, fileNode, []byte{1}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	event = readChangeEvent(t, eventCh)
+	require.Equal(t, ChangeEventModify, event.Type)
+	require.Equal(t, "test_user/a/b", event.Path)
+
+	// Changes outside of the watched directory aren't reported.
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "c", false, NoExcl)
+	require.NoError(t, err)
+
+	err = kbfsOps.Rename(ctx, dirNode, "b", dirNode, "d")
+	require.NoError(t, err)
+	event = readChangeEvent(t, eventCh)
+	require.Equal(t, ChangeEventRename, event.Type)
+	require.Equal(t, "test_user/a/d", event.Path)
+	require.Equal(t, "test_user/a/b", event.OldPath)
+
+	err = kbfsOps.RemoveEntry(ctx, dirNode, "d")
+	require.NoError(t, err)
+	event = readChangeEvent(t, eventCh)
+	require.Equal(t, ChangeEventDelete, event.Type)
+	require.Equal(t, "test_user/a/d", event.Path)
+
+	cancel()
+	for range eventCh {
+	}
+
+	// Resuming from the create coalesces everything since then.
+	watchCtx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	eventCh, err = kbfsOps.Watch(watchCtx, dirNode, false, createRev)
+	require.NoError(t, err)
+	event = readChangeEvent(t, eventCh)
+	require.Equal(t, ChangeEventDelete, event.Type)
+	require.Equal(t, "test_user/a/b", event.Path)
+}
+
+// failingGetRangeMDOps fails every fetch of a range of revisions.
+type failingGetRangeMDOps struct {
+	MDOps
+	err error
+}
+
+func (m failingGetRangeMDOps) GetRange(ctx context.Context, id TlfID,
+	start, stop MetadataRevision) ([]ImmutableRootMetadata, error) {
+	return nil, m.err
+}
+
+func TestDirWatcherError(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	kbfsOps := config.KBFSOps()
+	h := parseTlfHandleOrBust(t, config, "test_user", false)
+	rootNode, _, err := kbfsOps.GetOrCreateRootNode(ctx, h, MasterBranch)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	// Resuming needs revisions that are no longer cached, and
+	// fetching them fails.
+	mdOps := config.MDOps()
+	defer config.SetMDOps(mdOps)
+	expectedErr := errors.New("GetRange failed")
+	config.SetMDOps(failingGetRangeMDOps{mdOps, expectedErr})
+	config.SetMDCache(NewMDCacheStandard(100))
+
+	eventCh, err := kbfsOps.Watch(ctx, rootNode, false, MetadataRevisionInitial)
+	require.NoError(t, err)
+	event := readChangeEvent(t, eventCh)
+	require.Equal(t, ChangeEventError, event.Type)
+	require.Equal(t, expectedErr, event.Err)
+	require.Equal(t, MetadataRevisionInitial, event.Revision)
+	_, ok := <-eventCh
+	require.False(t, ok)
+}
+
+func TestDirWatcherSquashed(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	kbfsOps := config.KBFSOps()
+	h := parseTlfHandleOrBust(t, config, "test_user", false)
+	rootNode, _, err := kbfsOps.GetOrCreateRootNode(ctx, h, MasterBranch)
+	require.NoError(t, err)
+
+	eventCh, err := kbfsOps.Watch(
+		ctx, rootNode, false, MetadataRevisionUninitialized)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	event := readChangeEvent(t, eventCh)
+	require.Equal(t, ChangeEventCreate, event.Type)
+	createRev := event.Revision
+
+	// Pretend the journal squashed the create, so that its revision
+	// number gets reused.
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	squash := RevisionsSquashedError{
+		Tlf: ops.id(), Start: createRev, End: createRev}
+	lState := makeFBOLockState()
+	ops.headLock.Lock(lState)
+	ops.squashes = append(ops.squashes, squash)
+	ops.headLock.Unlock(lState)
+
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	event = readChangeEvent(t, eventCh)
+	require.Equal(t, ChangeEventError, event.Type)
+	require.Equal(t, squash, event.Err)
+	require.Equal(t, createRev-1, event.Revision)
+	_, ok := <-eventCh
+	require.False(t, ok)
+
+	// Resuming from a squashed revision fails too, but resuming
+	// from before the squash works.
+	_, err = kbfsOps.Watch(ctx, rootNode, false, createRev)
+	require.Equal(t, squash, err)
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	eventCh, err = kbfsOps.Watch(watchCtx, rootNode, false, createRev-1)
+	require.NoError(t, err)
+	event = readChangeEvent(t, eventCh)
+	require.Equal(t, ChangeEventCreate, event.Type)
+	require.Equal(t, "test_user/a", event.Path)
+}
@@ -0,0 +1,765 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"container/list"
+	"errors"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/go-codec/codec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"golang.org/x/net/context"
+)
+
+const (
+	diskBlockCacheBlocksDir = "blocks"
+	diskBlockCacheMetaDir   = "meta"
+	diskBlockCachePinsDir   = "pins"
+
+	// diskBlockCacheLRUFlushThreshold is the number of blocks whose
+	// LRU times can change in memory before they're written back to
+	// the metadata db in a single batch.
+	diskBlockCacheLRUFlushThreshold = 100
+)
+
+// diskBlockCacheKey identifies a cached block.  The same block ID
+// may be cached separately for different TLFs.
+type diskBlockCacheKey struct {
+	tlfID   TlfID
+	blockID BlockID
+}
+
+// bytes returns the db key for the cached block, which is the TLF ID
+// followed by the block ID.
+func (k diskBlockCacheKey) bytes() []byte {
+	return append(append([]byte(nil), k.tlfID.Bytes()...),
+		k.blockID.Bytes()...)
+}
+
+func parseDiskBlockCacheKey(buf []byte) (k diskBlockCacheKey, err error) {
+	if len(buf) < TlfIDByteLen {
+		return diskBlockCacheKey{}, errors.New("Disk block cache key too short")
+	}
+	err = k.tlfID.UnmarshalBinary(buf[:TlfIDByteLen])
+	if err != nil {
+		return diskBlockCacheKey{}, err
+	}
+	err = k.blockID.UnmarshalBinary(buf[TlfIDByteLen:])
+	if err != nil {
+		return diskBlockCacheKey{}, err
+	}
+	return k, nil
+}
+
+// diskBlockCacheEntry is the value stored in the blocks db for each
+// cached block.
+type diskBlockCacheEntry struct {
+	Buf        []byte
+	ServerHalf kbfscrypto.BlockCryptKeyServerHalf
+
+	codec.UnknownFieldSetHandler
+}
+
+// diskBlockCacheMetadata is the value stored in the metadata db for
+// each cached block.  It's kept separate from the block data so that
+// the LRU order can be rebuilt on startup, and updated as blocks are
+// used, without touching the (much larger) blocks.
+type diskBlockCacheMetadata struct {
+	// Size is the number of bytes of encoded block data.
+	Size uint32
+	// LRUTime is the last time the block was used, in Unix
+	// nanoseconds.
+	LRUTime int64
+	// Pinned blocks are never evicted.
+	Pinned bool `codec:",omitempty"`
+
+	codec.UnknownFieldSetHandler
+}
+
+type diskBlockCacheLRUEntry struct {
+	key     diskBlockCacheKey
+	size    uint64
+	lruTime int64
+	pinned  bool
+}
+
+// diskBlockCacheLRUEntries sorts entries from most to least recently
+// used.
+type diskBlockCacheLRUEntries []diskBlockCacheLRUEntry
+
+func (e diskBlockCacheLRUEntries) Len() int {
+	return len(e)
+}
+
+func (e diskBlockCacheLRUEntries) Less(i, j int) bool {
+	return e[i].lruTime > e[j].lruTime
+}
+
+func (e diskBlockCacheLRUEntries) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+}
+
+// DiskBlockCacheStandard implements the DiskBlockCache interface by
+// storing encrypted blocks in a local leveldb instance, indexed by a
+// second leveldb instance that tracks each block's size and last use
+// time.  When the total size of cached blocks exceeds maxBytes, the
+// least-recently-used unpinned blocks are evicted.  A third leveldb
+// instance records which paths are pinned in each TLF.
+//
+// The in-memory index is the source of truth while the cache is
+// running, and is only touched under the lock; the dbs are read and
+// written outside of it.  Racing operations on the same block can
+// therefore leave the dbs briefly out of sync with the index, but
+// that only ever results in a cache miss: a block that's indexed but
+// missing or unreadable is dropped when it's next read, and blocks
+// without metadata are dropped on the next startup.
+type DiskBlockCacheStandard struct {
+	config   Config
+	log      logger.Logger
+	maxBytes uint64
+
+	hitMeter   metrics.Meter
+	missMeter  metrics.Meter
+	evictMeter metrics.Meter
+
+	blockStorage storage.Storage
+	metaStorage  storage.Storage
+	pinsStorage  storage.Storage
+	blockDb      *leveldb.DB // diskBlockCacheKey -> diskBlockCacheEntry
+	metaDb       *leveldb.DB // diskBlockCacheKey -> diskBlockCacheMetadata
+	pinsDb       *leveldb.DB // TlfID -> []string
+
+	// lock protects everything below.
+	lock  sync.Mutex
+	lru   *list.List // of diskBlockCacheLRUEntry, most recent first
+	elems map[diskBlockCacheKey]*list.Element
+	// lruDirty holds the blocks whose LRU times haven't been
+	// written to the metadata db yet.
+	lruDirty map[diskBlockCacheKey]bool
+	numBytes uint64
+	shutdown bool
+}
+
+var _ DiskBlockCache = (*DiskBlockCacheStandard)(nil)
+
+func newDiskBlockCacheStandardFromStorage(config Config,
+	blockStorage, metaStorage, pinsStorage storage.Storage,
+	maxBytes uint64) (cache *DiskBlockCacheStandard, err error) {
+	blockDb, err := leveldb.Open(blockStorage, leveldbOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			blockDb.Close()
+		}
+	}()
+	metaDb, err := leveldb.Open(metaStorage, leveldbOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			metaDb.Close()
+		}
+	}()
+	pinsDb, err := leveldb.Open(pinsStorage, leveldbOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			pinsDb.Close()
+		}
+	}()
+
+	hitMeter := metrics.Meter(metrics.NilMeter{})
+	missMeter := metrics.Meter(metrics.NilMeter{})
+	evictMeter := metrics.Meter(metrics.NilMeter{})
+	if r := config.MetricsRegistry(); r != nil {
+		hitMeter = metrics.GetOrRegisterMeter("DiskBlockCache.HitCount", r)
+		missMeter = metrics.GetOrRegisterMeter("DiskBlockCache.MissCount", r)
+		evictMeter = metrics.GetOrRegisterMeter(
+			"DiskBlockCache.EvictCount", r)
+	}
+
+	cache = &DiskBlockCacheStandard{
+		config:       config,
+		log:          config.MakeLogger("DBC"),
+		maxBytes:     maxBytes,
+		hitMeter:     hitMeter,
+		missMeter:    missMeter,
+		evictMeter:   evictMeter,
+		blockStorage: blockStorage,
+		metaStorage:  metaStorage,
+		pinsStorage:  pinsStorage,
+		blockDb:      blockDb,
+		metaDb:       metaDb,
+		pinsDb:       pinsDb,
+		lru:          list.New(),
+		elems:        make(map[diskBlockCacheKey]*list.Element),
+		lruDirty:     make(map[diskBlockCacheKey]bool),
+	}
+	err = cache.load()
+	if err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+// NewDiskBlockCacheStandard constructs a new DiskBlockCacheStandard
+// that stores its data in the given directory, and holds at most
+// maxBytes of encoded block data.
+func NewDiskBlockCacheStandard(config Config, dirPath string,
+	maxBytes uint64) (cache *DiskBlockCacheStandard, err error) {
+	// leveldb doesn't close storage that it didn't open itself,
+	// so on success the cache closes these on shutdown.
+	var storages []storage.Storage
+	defer func() {
+		if err != nil {
+			for _, s := range storages {
+				s.Close()
+			}
+		}
+	}()
+	for _, dir := range []string{diskBlockCacheBlocksDir,
+		diskBlockCacheMetaDir, diskBlockCachePinsDir} {
+		s, err := storage.OpenFile(filepath.Join(dirPath, dir), false)
+		if err != nil {
+			return nil, err
+		}
+		storages = append(storages, s)
+	}
+	return newDiskBlockCacheStandardFromStorage(
+		config, storages[0], storages[1], storages[2], maxBytes)
+}
+
+// load rebuilds the in-memory LRU order from the metadata db, drops
+// any entries that can't be decoded and any blocks that have no
+// metadata (e.g., because of a crash in the middle of a put), and
+// then evicts down to maxBytes in case the limit has shrunk since
+// the last run.  It must only be called before the cache is shared.
+func (cache *DiskBlockCacheStandard) load() error {
+	var entries diskBlockCacheLRUEntries
+	var bad []diskBlockCacheKey
+	badBatch := &leveldb.Batch{}
+	iter := cache.metaDb.NewIterator(nil, nil)
+	for iter.Next() {
+		key, err := parseDiskBlockCacheKey(iter.Key())
+		if err != nil {
+			// Any block under this key is removed as an
+			// orphan below.
+			badBatch.Delete(append([]byte(nil), iter.Key()...))
+			continue
+		}
+		var md diskBlockCacheMetadata
+		err = cache.config.Codec().Decode(iter.Value(), &md)
+		if err != nil {
+			bad = append(bad, key)
+			continue
+		}
+		entries = append(entries, diskBlockCacheLRUEntry{
+			key, uint64(md.Size), md.LRUTime, md.Pinned})
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if badBatch.Len() > 0 || len(bad) > 0 {
+		cache.log.CDebugf(nil, "Removing %d unreadable metadata entries",
+			badBatch.Len()+len(bad))
+		if err := cache.metaDb.Write(badBatch, nil); err != nil {
+			return err
+		}
+		if err := cache.deleteFromDbs(bad); err != nil {
+			return err
+		}
+	}
+
+	sort.Sort(entries)
+	for _, e := range entries {
+		cache.elems[e.key] = cache.lru.PushBack(e)
+		cache.numBytes += e.size
+	}
+
+	batch := &leveldb.Batch{}
+	iter = cache.blockDb.NewIterator(nil, nil)
+	for iter.Next() {
+		key, err := parseDiskBlockCacheKey(iter.Key())
+		if err != nil || cache.elems[key] == nil {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if batch.Len() > 0 {
+		cache.log.CDebugf(nil, "Removing %d orphaned blocks", batch.Len())
+		if err := cache.blockDb.Write(batch, nil); err != nil {
+			return err
+		}
+	}
+
+	return cache.deleteFromDbs(cache.evictLocked(0))
+}
+
+func (cache *DiskBlockCacheStandard) checkShutdownLocked() error {
+	if cache.shutdown {
+		return errors.New("Disk block cache already shut down")
+	}
+	return nil
+}
+
+// touchLocked marks the given block as the most recently used one.
+// The new LRU time is only written to the metadata db once enough
+// blocks have been touched; if that's the case, it returns the
+// entries to pass to writeMetadata once the lock is released.
+func (cache *DiskBlockCacheStandard) touchLocked(
+	elem *list.Element) []diskBlockCacheLRUEntry {
+	entry := elem.Value.(diskBlockCacheLRUEntry)
+	entry.lruTime = cache.config.Clock().Now().UnixNano()
+	elem.Value = entry
+	cache.lru.MoveToFront(elem)
+	cache.lruDirty[entry.key] = true
+	if len(cache.lruDirty) < diskBlockCacheLRUFlushThreshold {
+		return nil
+	}
+	return cache.takeLRUDirtyLocked()
+}
+
+// takeLRUDirtyLocked returns the entries whose LRU times haven't
+// been written yet, and marks them as clean.
+func (cache *DiskBlockCacheStandard) takeLRUDirtyLocked() (
+	entries []diskBlockCacheLRUEntry) {
+	for key := range cache.lruDirty {
+		if elem, ok := cache.elems[key]; ok {
+			entries = append(entries, elem.Value.(diskBlockCacheLRUEntry))
+		}
+	}
+	cache.lruDirty = make(map[diskBlockCacheKey]bool)
+	return entries
+}
+
+// writeMetadata writes the metadata for the given entries in a
+// single batch.
+func (cache *DiskBlockCacheStandard) writeMetadata(
+	entries []diskBlockCacheLRUEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	batch := &leveldb.Batch{}
+	for _, entry := range entries {
+		md := diskBlockCacheMetadata{
+			Size:    uint32(entry.size),
+			LRUTime: entry.lruTime,
+			Pinned:  entry.pinned,
+		}
+		buf, err := cache.config.Codec().Encode(md)
+		if err != nil {
+			return err
+		}
+		batch.Put(entry.key.bytes(), buf)
+	}
+	return cache.metaDb.Write(batch, nil)
+}
+
+// evictLocked removes least-recently-used unpinned blocks from the
+// index until there's room for newBytes more bytes within maxBytes,
+// or until there's nothing left to evict.  It returns the evicted
+// keys, which the caller must pass to deleteFromDbs once the lock is
+// released.
+func (cache *DiskBlockCacheStandard) evictLocked(
+	newBytes uint64) []diskBlockCacheKey {
+	if cache.numBytes+newBytes <= cache.maxBytes {
+		return nil
+	}
+	var keys []diskBlockCacheKey
+	numBytes := cache.numBytes
+	for elem := cache.lru.Back(); elem != nil &&
+		numBytes+newBytes > cache.maxBytes; elem = elem.Prev() {
+		entry := elem.Value.(diskBlockCacheLRUEntry)
+		if entry.pinned {
+			continue
+		}
+		keys = append(keys, entry.key)
+		numBytes -= entry.size
+	}
+	cache.removeLocked(keys)
+	cache.evictMeter.Mark(int64(len(keys)))
+	return keys
+}
+
+// removeLocked removes the given blocks from the index.
+func (cache *DiskBlockCacheStandard) removeLocked(keys []diskBlockCacheKey) {
+	for _, key := range keys {
+		elem, ok := cache.elems[key]
+		if !ok {
+			continue
+		}
+		cache.numBytes -= elem.Value.(diskBlockCacheLRUEntry).size
+		cache.lru.Remove(elem)
+		delete(cache.elems, key)
+		delete(cache.lruDirty, key)
+	}
+}
+
+// deleteFromDbs removes the given blocks from the dbs.
+func (cache *DiskBlockCacheStandard) deleteFromDbs(
+	keys []diskBlockCacheKey) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	blockBatch := &leveldb.Batch{}
+	metaBatch := &leveldb.Batch{}
+	for _, key := range keys {
+		blockBatch.Delete(key.bytes())
+		metaBatch.Delete(key.bytes())
+	}
+	// Delete the metadata first, so that a crash in between leaves
+	// orphaned blocks, which get cleaned up on the next load, rather
+	// than metadata for missing blocks.
+	if err := cache.metaDb.Write(metaBatch, nil); err != nil {
+		return err
+	}
+	return cache.blockDb.Write(blockBatch, nil)
+}
+
+// drop removes a block that turned out to be missing or unreadable,
+// so that it gets fetched from the server again.
+func (cache *DiskBlockCacheStandard) drop(
+	ctx context.Context, key diskBlockCacheKey) {
+	cache.lock.Lock()
+	cache.removeLocked([]diskBlockCacheKey{key})
+	cache.lock.Unlock()
+	if err := cache.deleteFromDbs([]diskBlockCacheKey{key}); err != nil {
+		cache.log.CDebugf(ctx, "Couldn't remove %s from the disk cache: %v",
+			key.blockID, err)
+	}
+}
+
+// Get implements the DiskBlockCache interface for
+// DiskBlockCacheStandard.
+func (cache *DiskBlockCacheStandard) Get(ctx context.Context, tlfID TlfID,
+	blockID BlockID) ([]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
+	key := diskBlockCacheKey{tlfID, blockID}
+	cache.lock.Lock()
+	err := cache.checkShutdownLocked()
+	_, ok := cache.elems[key]
+	cache.lock.Unlock()
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	if !ok {
+		cache.missMeter.Mark(1)
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{},
+			NoSuchBlockError{blockID}
+	}
+
+	var entry diskBlockCacheEntry
+	buf, err := cache.blockDb.Get(key.bytes(), nil)
+	if err == nil {
+		err = cache.config.Codec().Decode(buf, &entry)
+		if err != nil {
+			// Drop the unreadable entry and let the caller
+			// fetch the block from the server.
+			cache.log.CWarningf(ctx, "Evicting undecodable block %s "+
+				"from disk cache: %v", blockID, err)
+		}
+	} else if err == leveldb.ErrNotFound {
+		// The index and the blocks db disagree; drop the entry
+		// and let the caller fetch the block from the server.
+		cache.log.CWarningf(ctx, "Block %s missing from disk cache", blockID)
+	} else {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	if err != nil {
+		cache.missMeter.Mark(1)
+		cache.drop(ctx, key)
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{},
+			NoSuchBlockError{blockID}
+	}
+
+	var toFlush []diskBlockCacheLRUEntry
+	cache.lock.Lock()
+	if elem, ok := cache.elems[key]; ok {
+		toFlush = cache.touchLocked(elem)
+	}
+	cache.lock.Unlock()
+	if err := cache.writeMetadata(toFlush); err != nil {
+		// Not fatal; blocks will just be evicted a bit early.
+		cache.log.CDebugf(ctx, "Couldn't update LRU times: %v", err)
+	}
+	cache.hitMeter.Mark(1)
+	return entry.Buf, entry.ServerHalf, nil
+}
+
+// Put implements the DiskBlockCache interface for
+// DiskBlockCacheStandard.
+func (cache *DiskBlockCacheStandard) Put(ctx context.Context, tlfID TlfID,
+	blockID BlockID, buf []byte,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf) (err error) {
+	defer func() {
+		if err != nil {
+			cache.log.CWarningf(ctx, "Couldn't cache block %s: %v",
+				blockID, err)
+		}
+	}()
+
+	key := diskBlockCacheKey{tlfID, blockID}
+	size := uint64(len(buf))
+	cache.lock.Lock()
+	err = cache.checkShutdownLocked()
+	if err != nil {
+		cache.lock.Unlock()
+		return err
+	}
+	if elem, ok := cache.elems[key]; ok {
+		// Blocks are immutable, so there's nothing to rewrite.
+		toFlush := cache.touchLocked(elem)
+		cache.lock.Unlock()
+		return cache.writeMetadata(toFlush)
+	}
+	cache.lock.Unlock()
+	if size > cache.maxBytes {
+		// It would never fit, so don't bother evicting anything.
+		return nil
+	}
+
+	// Write the block before indexing it or writing its metadata,
+	// so that it can be read as soon as it's indexed, and so that a
+	// crash in between leaves an orphaned block rather than a
+	// dangling metadata entry.
+	entryBuf, err := cache.config.Codec().Encode(
+		diskBlockCacheEntry{Buf: buf, ServerHalf: serverHalf})
+	if err != nil {
+		return err
+	}
+	err = cache.blockDb.Put(key.bytes(), entryBuf, nil)
+	if err != nil {
+		return err
+	}
+
+	cache.lock.Lock()
+	if elem, ok := cache.elems[key]; ok {
+		// Someone else cached it in the meantime.
+		toFlush := cache.touchLocked(elem)
+		cache.lock.Unlock()
+		return cache.writeMetadata(toFlush)
+	}
+	evicted := cache.evictLocked(size)
+	if cache.numBytes+size > cache.maxBytes {
+		cache.lock.Unlock()
+		cache.log.CDebugf(ctx, "Not caching block %s; the cache is "+
+			"full of pinned blocks", blockID)
+		if err := cache.deleteFromDbs(evicted); err != nil {
+			return err
+		}
+		return cache.blockDb.Delete(key.bytes(), nil)
+	}
+	entry := diskBlockCacheLRUEntry{
+		key, size, cache.config.Clock().Now().UnixNano(), false}
+	cache.elems[key] = cache.lru.PushFront(entry)
+	cache.numBytes += size
+	cache.lock.Unlock()
+
+	if err := cache.deleteFromDbs(evicted); err != nil {
+		return err
+	}
+	return cache.writeMetadata([]diskBlockCacheLRUEntry{entry})
+}
+
+// Delete implements the DiskBlockCache interface for
+// DiskBlockCacheStandard.
+func (cache *DiskBlockCacheStandard) Delete(
+	ctx context.Context, tlfID TlfID, blockIDs []BlockID) error {
+	keys := make([]diskBlockCacheKey, 0, len(blockIDs))
+	for _, id := range blockIDs {
+		keys = append(keys, diskBlockCacheKey{tlfID, id})
+	}
+	cache.lock.Lock()
+	if err := cache.checkShutdownLocked(); err != nil {
+		cache.lock.Unlock()
+		return err
+	}
+	cache.removeLocked(keys)
+	cache.lock.Unlock()
+	return cache.deleteFromDbs(keys)
+}
+
+// SetPinnedBlocks implements the DiskBlockCache interface for
+// DiskBlockCacheStandard.
+func (cache *DiskBlockCacheStandard) SetPinnedBlocks(ctx context.Context,
+	tlfID TlfID, blockIDs []BlockID) (numMissing int, err error) {
+	pinned := make(map[BlockID]bool, len(blockIDs))
+	for _, id := range blockIDs {
+		pinned[id] = true
+	}
+
+	cache.lock.Lock()
+	if err := cache.checkShutdownLocked(); err != nil {
+		cache.lock.Unlock()
+		return 0, err
+	}
+	for id := range pinned {
+		if _, ok := cache.elems[diskBlockCacheKey{tlfID, id}]; !ok {
+			numMissing++
+		}
+	}
+	var changed []diskBlockCacheLRUEntry
+	for elem := cache.lru.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(diskBlockCacheLRUEntry)
+		if entry.key.tlfID != tlfID ||
+			entry.pinned == pinned[entry.key.blockID] {
+			continue
+		}
+		entry.pinned = pinned[entry.key.blockID]
+		elem.Value = entry
+		delete(cache.lruDirty, entry.key)
+		changed = append(changed, entry)
+	}
+	// Unpinning may have left the cache over its limit, if it had
+	// filled up with pinned blocks.
+	evicted := cache.evictLocked(0)
+	cache.lock.Unlock()
+
+	if err := cache.writeMetadata(changed); err != nil {
+		return 0, err
+	}
+	if err := cache.deleteFromDbs(evicted); err != nil {
+		return 0, err
+	}
+	return numMissing, nil
+}
+
+// UpdatePinnedBlocks implements the DiskBlockCache interface for
+// DiskBlockCacheStandard.
+func (cache *DiskBlockCacheStandard) UpdatePinnedBlocks(
+	ctx context.Context, tlfID TlfID, pin, unpin []BlockID) (
+	numMissing int, err error) {
+	cache.lock.Lock()
+	if err := cache.checkShutdownLocked(); err != nil {
+		cache.lock.Unlock()
+		return 0, err
+	}
+	var changed []diskBlockCacheLRUEntry
+	setPinned := func(id BlockID, pinned bool) bool {
+		elem, ok := cache.elems[diskBlockCacheKey{tlfID, id}]
+		if !ok {
+			return false
+		}
+		entry := elem.Value.(diskBlockCacheLRUEntry)
+		if entry.pinned != pinned {
+			entry.pinned = pinned
+			elem.Value = entry
+			delete(cache.lruDirty, entry.key)
+			changed = append(changed, entry)
+		}
+		return true
+	}
+	for _, id := range unpin {
+		setPinned(id, false)
+	}
+	for _, id := range pin {
+		if !setPinned(id, true) {
+			numMissing++
+		}
+	}
+	evicted := cache.evictLocked(0)
+	cache.lock.Unlock()
+
+	if err := cache.writeMetadata(changed); err != nil {
+		return 0, err
+	}
+	if err := cache.deleteFromDbs(evicted); err != nil {
+		return 0, err
+	}
+	return numMissing, nil
+}
+
+// GetPinnedPaths implements the DiskBlockCache interface for
+// DiskBlockCacheStandard.
+func (cache *DiskBlockCacheStandard) GetPinnedPaths(
+	ctx context.Context, tlfID TlfID) ([]string, error) {
+	cache.lock.Lock()
+	err := cache.checkShutdownLocked()
+	cache.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := cache.pinsDb.Get(tlfID.Bytes(), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var paths []string
+	err = cache.config.Codec().Decode(buf, &paths)
+	if err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// SetPinnedPaths implements the DiskBlockCache interface for
+// DiskBlockCacheStandard.
+func (cache *DiskBlockCacheStandard) SetPinnedPaths(
+	ctx context.Context, tlfID TlfID, paths []string) error {
+	cache.lock.Lock()
+	err := cache.checkShutdownLocked()
+	cache.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if len(paths) == 0 {
+		return cache.pinsDb.Delete(tlfID.Bytes(), nil)
+	}
+	buf, err := cache.config.Codec().Encode(paths)
+	if err != nil {
+		return err
+	}
+	return cache.pinsDb.Put(tlfID.Bytes(), buf, nil)
+}
+
+// Shutdown implements the DiskBlockCache interface for
+// DiskBlockCacheStandard.
+func (cache *DiskBlockCacheStandard) Shutdown(ctx context.Context) {
+	cache.lock.Lock()
+	if cache.shutdown {
+		cache.lock.Unlock()
+		return
+	}
+	cache.shutdown = true
+	toFlush := cache.takeLRUDirtyLocked()
+	cache.lock.Unlock()
+
+	if err := cache.writeMetadata(toFlush); err != nil {
+		cache.log.CWarningf(ctx, "Error writing LRU times: %v", err)
+	}
+	if err := cache.blockDb.Close(); err != nil {
+		cache.log.CWarningf(ctx, "Error closing blocks db: %v", err)
+	}
+	if err := cache.metaDb.Close(); err != nil {
+		cache.log.CWarningf(ctx, "Error closing metadata db: %v", err)
+	}
+	if err := cache.pinsDb.Close(); err != nil {
+		cache.log.CWarningf(ctx, "Error closing pins db: %v", err)
+	}
+	for _, s := range []storage.Storage{
+		cache.blockStorage, cache.metaStorage, cache.pinsStorage} {
+		if err := s.Close(); err != nil {
+			cache.log.CWarningf(ctx, "Error closing storage: %v", err)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/kbfscrypto"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+	"golang.org/x/net/context"
+)
+
+func diskBlockCacheTestInit(t *testing.T) (
+	config *ConfigLocal, clock *TestClock, tempdir string) {
+	config = MakeTestConfigOrBust(t, "test")
+	clock = newTestClockNow()
+	config.SetClock(clock)
+	config.SetMetricsRegistry(metrics.NewRegistry())
+	tempdir, err := ioutil.TempDir(os.TempDir(), "disk_block_cache")
+	require.NoError(t, err)
+	return config, clock, tempdir
+}
+
+func diskBlockCacheTestShutdown(t *testing.T, config Config,
+	tempdir string) {
+	CheckConfigAndShutdown(t, config)
+	err := os.RemoveAll(tempdir)
+	require.NoError(t, err)
+}
+
+func diskBlockCacheTestBlock(b byte, size int) (
+	BlockID, []byte, kbfscrypto.BlockCryptKeyServerHalf) {
+	buf := make([]byte, size)
+	for i := range buf {
+		buf[i] = b
+	}
+	return fakeBlockID(b), buf,
+		kbfscrypto.MakeBlockCryptKeyServerHalf([32]byte{b})
+}
+
+func TestDiskBlockCachePutGet(t *testing.T) {
+	config, _, tempdir := diskBlockCacheTestInit(t)
+	defer diskBlockCacheTestShutdown(t, config, tempdir)
+	ctx := context.Background()
+
+	cache, err := NewDiskBlockCacheStandard(config, tempdir, 1024)
+	require.NoError(t, err)
+	defer cache.Shutdown(ctx)
+
+	tlfID := FakeTlfID(1, false)
+	id, buf, serverHalf := diskBlockCacheTestBlock(1, 100)
+	_, _, err = cache.Get(ctx, tlfID, id)
+	require.Equal(t, NoSuchBlockError{id}, err)
+
+	err = cache.Put(ctx, tlfID, id, buf, serverHalf)
+	require.NoError(t, err)
+	gotBuf, gotServerHalf, err := cache.Get(ctx, tlfID, id)
+	require.NoError(t, err)
+	require.Equal(t, buf, gotBuf)
+	require.Equal(t, serverHalf, gotServerHalf)
+
+	r := config.MetricsRegistry()
+	require.Equal(t, int64(1),
+		metrics.GetOrRegisterMeter("DiskBlockCache.HitCount", r).Count())
+	require.Equal(t, int64(1),
+		metrics.GetOrRegisterMeter("DiskBlockCache.MissCount", r).Count())
+
+	err = cache.Delete(ctx, tlfID, []BlockID{id})
+	require.NoError(t, err)
+	_, _, err = cache.Get(ctx, tlfID, id)
+	require.Equal(t, NoSuchBlockError{id}, err)
+}
+
+func TestDiskBlockCacheEvictLRU(t *testing.T) {
+	config, clock, tempdir := diskBlockCacheTestInit(t)
+	defer diskBlockCacheTestShutdown(t, config, tempdir)
+	ctx := context.Background()
+
+	// Room for exactly three blocks.
+	cache, err := NewDiskBlockCacheStandard(config, tempdir, 300)
+	require.NoError(t, err)
+	defer cache.Shutdown(ctx)
+
+	tlfID := FakeTlfID(1, false)
+	for i := byte(1); i <= 3; i++ {
+		id, buf, serverHalf := diskBlockCacheTestBlock(i, 100)
+		err = cache.Put(ctx, tlfID, id, buf, serverHalf)
+		require.NoError(t, err)
+		clock.Add(time.Second)
+	}
+
+	// Use block 1, so that block 2 becomes the oldest.
+	_, _, err = cache.Get(ctx, tlfID, fakeBlockID(1))
+	require.NoError(t, err)
+	clock.Add(time.Second)
+
+	id4, buf4, serverHalf4 := diskBlockCacheTestBlock(4, 100)
+	err = cache.Put(ctx, tlfID, id4, buf4, serverHalf4)
+	require.NoError(t, err)
+
+	_, _, err = cache.Get(ctx, tlfID, fakeBlockID(2))
+	require.Equal(t, NoSuchBlockError{fakeBlockID(2)}, err)
+	for _, i := range []byte{1, 3, 4} {
+		_, _, err = cache.Get(ctx, tlfID, fakeBlockID(i))
+		require.NoError(t, err)
+	}
+
+	// A block bigger than the whole cache is silently skipped,
+	// without evicting anything.
+	id5, buf5, serverHalf5 := diskBlockCacheTestBlock(5, 301)
+	err = cache.Put(ctx, tlfID, id5, buf5, serverHalf5)
+	require.NoError(t, err)
+	_, _, err = cache.Get(ctx, tlfID, id5)
+	require.Equal(t, NoSuchBlockError{id5}, err)
+	_, _, err = cache.Get(ctx, tlfID, fakeBlockID(1))
+	require.NoError(t, err)
+}
+
+func TestDiskBlockCacheRestart(t *testing.T) {
+	config, clock, tempdir := diskBlockCacheTestInit(t)
+	defer diskBlockCacheTestShutdown(t, config, tempdir)
+	ctx := context.Background()
+
+	cache, err := NewDiskBlockCacheStandard(config, tempdir, 300)
+	require.NoError(t, err)
+
+	tlfID := FakeTlfID(1, false)
+	for i := byte(1); i <= 3; i++ {
+		id, buf, serverHalf := diskBlockCacheTestBlock(i, 100)
+		err = cache.Put(ctx, tlfID, id, buf, serverHalf)
+		require.NoError(t, err)
+		clock.Add(time.Second)
+	}
+	cache.Shutdown(ctx)
+
+	// Reopen with a smaller limit; the least-recently-used block
+	// should be evicted, and the rest should survive.
+	cache, err = NewDiskBlockCacheStandard(config, tempdir, 200)
+	require.NoError(t, err)
+	defer cache.Shutdown(ctx)
+
+	_, _, err = cache.Get(ctx, tlfID, fakeBlockID(1))
+	require.Equal(t, NoSuchBlockError{fakeBlockID(1)}, err)
+	for _, i := range []byte{2, 3} {
+		id, buf, serverHalf := diskBlockCacheTestBlock(i, 100)
+		gotBuf, gotServerHalf, err := cache.Get(ctx, tlfID, id)
+		require.NoError(t, err)
+		require.Equal(t, buf, gotBuf)
+		require.Equal(t, serverHalf, gotServerHalf)
+	}
+}
+
+func TestDiskBlockCachePinned(t *testing.T) {
+	config, clock, tempdir := diskBlockCacheTestInit(t)
+	defer diskBlockCacheTestShutdown(t, config, tempdir)
+	ctx := context.Background()
+
+	cache, err := NewDiskBlockCacheStandard(config, tempdir, 300)
+	require.NoError(t, err)
+
+	tlfID := FakeTlfID(1, false)
+	for i := byte(1); i <= 3; i++ {
+		id, buf, serverHalf := diskBlockCacheTestBlock(i, 100)
+		err = cache.Put(ctx, tlfID, id, buf, serverHalf)
+		require.NoError(t, err)
+		clock.Add(time.Second)
+	}
+
+	// Pin the two oldest blocks, plus one that isn't cached.
+	numMissing, err := cache.SetPinnedBlocks(ctx, tlfID,
+		[]BlockID{fakeBlockID(1), fakeBlockID(2), fakeBlockID(5)})
+	require.NoError(t, err)
+	require.Equal(t, 1, numMissing)
+
+	// Block 3 is the only one that can be evicted.
+	id4, buf4, serverHalf4 := diskBlockCacheTestBlock(4, 100)
+	err = cache.Put(ctx, tlfID, id4, buf4, serverHalf4)
+	require.NoError(t, err)
+	_, _, err = cache.Get(ctx, tlfID, fakeBlockID(3))
+	require.Equal(t, NoSuchBlockError{fakeBlockID(3)}, err)
+	for _, i := range []byte{1, 2, 4} {
+		_, _, err = cache.Get(ctx, tlfID, fakeBlockID(i))
+		require.NoError(t, err)
+	}
+
+	err = cache.SetPinnedPaths(ctx, tlfID, []string{"a/b", ""})
+	require.NoError(t, err)
+
+	// Pins survive a restart, even with a smaller limit.
+	cache.Shutdown(ctx)
+	cache, err = NewDiskBlockCacheStandard(config, tempdir, 200)
+	require.NoError(t, err)
+	defer cache.Shutdown(ctx)
+
+	_, _, err = cache.Get(ctx, tlfID, id4)
+	require.Equal(t, NoSuchBlockError{id4}, err)
+	for _, i := range []byte{1, 2} {
+		_, _, err = cache.Get(ctx, tlfID, fakeBlockID(i))
+		require.NoError(t, err)
+	}
+	paths, err := cache.GetPinnedPaths(ctx, tlfID)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/b", ""}, paths)
+
+	// Unpinning makes the blocks evictable again.
+	_, err = cache.SetPinnedBlocks(ctx, tlfID, []BlockID{fakeBlockID(2)})
+	require.NoError(t, err)
+	id6, buf6, serverHalf6 := diskBlockCacheTestBlock(6, 100)
+	err = cache.Put(ctx, tlfID, id6, buf6, serverHalf6)
+	require.NoError(t, err)
+	_, _, err = cache.Get(ctx, tlfID, fakeBlockID(1))
+	require.Equal(t, NoSuchBlockError{fakeBlockID(1)}, err)
+
+	err = cache.SetPinnedPaths(ctx, tlfID, nil)
+	require.NoError(t, err)
+	paths, err = cache.GetPinnedPaths(ctx, tlfID)
+	require.NoError(t, err)
+	require.Len(t, paths, 0)
+}
+
+func TestDiskBlockCachePerTlf(t *testing.T) {
+	config, _, tempdir := diskBlockCacheTestInit(t)
+	defer diskBlockCacheTestShutdown(t, config, tempdir)
+	ctx := context.Background()
+
+	cache, err := NewDiskBlockCacheStandard(config, tempdir, 1024)
+	require.NoError(t, err)
+	defer cache.Shutdown(ctx)
+
+	// The same block can be cached separately by two TLFs.
+	tlfID1 := FakeTlfID(1, false)
+	tlfID2 := FakeTlfID(2, false)
+	id, buf, serverHalf := diskBlockCacheTestBlock(1, 100)
+	err = cache.Put(ctx, tlfID1, id, buf, serverHalf)
+	require.NoError(t, err)
+	_, _, err = cache.Get(ctx, tlfID2, id)
+	require.Equal(t, NoSuchBlockError{id}, err)
+
+	err = cache.Put(ctx, tlfID2, id, buf, serverHalf)
+	require.NoError(t, err)
+	err = cache.Delete(ctx, tlfID2, []BlockID{id})
+	require.NoError(t, err)
+	_, _, err = cache.Get(ctx, tlfID2, id)
+	require.Equal(t, NoSuchBlockError{id}, err)
+	gotBuf, _, err := cache.Get(ctx, tlfID1, id)
+	require.NoError(t, err)
+	require.Equal(t, buf, gotBuf)
+}
+
+func TestDiskBlockCacheEvictUndecodable(t *testing.T) {
+	config, clock, tempdir := diskBlockCacheTestInit(t)
+	defer diskBlockCacheTestShutdown(t, config, tempdir)
+	ctx := context.Background()
+
+	cache, err := NewDiskBlockCacheStandard(config, tempdir, 1024)
+	require.NoError(t, err)
+	defer func() {
+		cache.Shutdown(ctx)
+	}()
+
+	tlfID := FakeTlfID(1, false)
+	for i := byte(1); i <= 2; i++ {
+		id, buf, serverHalf := diskBlockCacheTestBlock(i, 100)
+		err = cache.Put(ctx, tlfID, id, buf, serverHalf)
+		require.NoError(t, err)
+	}
+
+	// Hits only update LRU times in memory until they're flushed.
+	key := diskBlockCacheKey{tlfID, fakeBlockID(2)}
+	mdBuf, err := cache.metaDb.Get(key.bytes(), nil)
+	require.NoError(t, err)
+	clock.Add(time.Second)
+	_, _, err = cache.Get(ctx, tlfID, fakeBlockID(2))
+	require.NoError(t, err)
+	newMdBuf, err := cache.metaDb.Get(key.bytes(), nil)
+	require.NoError(t, err)
+	require.Equal(t, mdBuf, newMdBuf)
+
+	// A corrupted block is evicted rather than returned.
+	key = diskBlockCacheKey{tlfID, fakeBlockID(1)}
+	err = cache.blockDb.Put(key.bytes(), []byte{0xc1}, nil)
+	require.NoError(t, err)
+	_, _, err = cache.Get(ctx, tlfID, fakeBlockID(1))
+	require.Equal(t, NoSuchBlockError{fakeBlockID(1)}, err)
+	_, err = cache.metaDb.Get(key.bytes(), nil)
+	require.Equal(t, leveldb.ErrNotFound, err)
+
+	// So is corrupted metadata, on the next startup.
+	key = diskBlockCacheKey{tlfID, fakeBlockID(2)}
+	cache.Shutdown(ctx)
+	cache, err = NewDiskBlockCacheStandard(config, tempdir, 1024)
+	require.NoError(t, err)
+	newMdBuf, err = cache.metaDb.Get(key.bytes(), nil)
+	require.NoError(t, err)
+	require.NotEqual(t, mdBuf, newMdBuf)
+	err = cache.metaDb.Put(key.bytes(), []byte{0xc1}, nil)
+	require.NoError(t, err)
+	cache.Shutdown(ctx)
+	cache, err = NewDiskBlockCacheStandard(config, tempdir, 1024)
+	require.NoError(t, err)
+	_, _, err = cache.Get(ctx, tlfID, fakeBlockID(2))
+	require.Equal(t, NoSuchBlockError{fakeBlockID(2)}, err)
+	_, err = cache.blockDb.Get(key.bytes(), nil)
+	require.Equal(t, leveldb.ErrNotFound, err)
+}
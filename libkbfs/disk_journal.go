@@ -6,7 +6,6 @@ package libkbfs
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -39,15 +38,18 @@ import (
 type diskJournal struct {
 	codec     kbfscodec.Codec
 	dir       string
+	files     journalFiles
 	entryType reflect.Type
 }
 
-// makeDiskJournal returns a new diskJournal for the given directory.
-func makeDiskJournal(
-	codec kbfscodec.Codec, dir string, entryType reflect.Type) diskJournal {
+// makeDiskJournal returns a new diskJournal for the given directory,
+// whose files are accessed through the given journalFiles.
+func makeDiskJournal(codec kbfscodec.Codec, dir string, files journalFiles,
+	entryType reflect.Type) diskJournal {
 	return diskJournal{
 		codec:     codec,
 		dir:       dir,
+		files:     files,
 		entryType: entryType,
 	}
 }
@@ -89,7 +91,7 @@ func (j diskJournal) journalEntryPath(o journalOrdinal) string {
 
 func (j diskJournal) readOrdinal(path string) (
 	journalOrdinal, error) {
-	buf, err := ioutil.ReadFile(path)
+	buf, err := j.files.readFile(path)
 	if err != nil {
 		return 0, err
 	}
@@ -98,7 +100,7 @@ func (j diskJournal) readOrdinal(path string) (
 
 func (j diskJournal) writeOrdinal(
 	path string, o journalOrdinal) error {
-	return ioutil.WriteFile(path, []byte(o.String()), 0600)
+	return j.files.writeFile(path, []byte(o.String()))
 }
 
 func (j diskJournal) readEarliestOrdinal() (
@@ -128,11 +130,11 @@ func (j diskJournal) clearOrdinals() error {
 		return err
 	}
 
-	err = os.Remove(j.earliestPath())
+	err = j.files.remove(j.earliestPath())
 	if err != nil {
 		return err
 	}
-	err = os.Remove(j.latestPath())
+	err = j.files.remove(j.latestPath())
 	if err != nil {
 		return err
 	}
@@ -141,7 +143,7 @@ func (j diskJournal) clearOrdinals() error {
 	// sweeper to clean up entries left behind if we crash right here.
 	for ordinal := earliestOrdinal; ordinal <= latestOrdinal; ordinal++ {
 		p := j.journalEntryPath(ordinal)
-		err = os.Remove(p)
+		err = j.files.remove(p)
 		if err != nil {
 			return err
 		}
@@ -176,7 +178,7 @@ func (j diskJournal) removeEarliest() (empty bool, err error) {
 	// Garbage-collect the old entry.  TODO: we'll eventually need a
 	// sweeper to clean up entries left behind if we crash right here.
 	p := j.journalEntryPath(earliestOrdinal)
-	err = os.Remove(p)
+	err = j.files.remove(p)
 	if err != nil {
 		return false, err
 	}
@@ -184,11 +186,47 @@ func (j diskJournal) removeEarliest() (empty bool, err error) {
 	return false, nil
 }
 
+// removeLatestAfter removes all the entries after the given ordinal,
+// which must be in the journal.
+func (j diskJournal) removeLatestAfter(o journalOrdinal) error {
+	earliestOrdinal, err := j.readEarliestOrdinal()
+	if err != nil {
+		return err
+	}
+
+	latestOrdinal, err := j.readLatestOrdinal()
+	if err != nil {
+		return err
+	}
+
+	if o < earliestOrdinal || o > latestOrdinal {
+		return fmt.Errorf("Ordinal %d is not in the journal [%d, %d]",
+			o, earliestOrdinal, latestOrdinal)
+	}
+
+	err = j.writeLatestOrdinal(o)
+	if err != nil {
+		return err
+	}
+
+	// Garbage-collect the old entries.  TODO: we'll eventually need
+	// a sweeper to clean up entries left behind if we crash right
+	// here.
+	for i := o + 1; i <= latestOrdinal; i++ {
+		err = j.files.remove(j.journalEntryPath(i))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // The functions below are for reading and writing journal entries.
 
 func (j diskJournal) readJournalEntry(o journalOrdinal) (interface{}, error) {
 	p := j.journalEntryPath(o)
-	buf, err := ioutil.ReadFile(p)
+	buf, err := j.files.readFile(p)
 	if err != nil {
 		return nil, err
 	}
@@ -222,7 +260,7 @@ func (j diskJournal) writeJournalEntry(
 		return err
 	}
 
-	return ioutil.WriteFile(p, buf, 0600)
+	return j.files.writeFile(p, buf)
 }
 
 // appendJournalEntry appends the given entry to the journal. If o is
@@ -141,6 +141,59 @@ func (e RenameAcrossDirsError) Error() string {
 	return fmt.Sprintf("Cannot rename across directories")
 }
 
+// CopyAcrossTlfsError indicates that the user tried to copy a file
+// into a different top-level folder, where its blocks can't be
+// shared.
+type CopyAcrossTlfsError struct {
+}
+
+// Error implements the error interface for CopyAcrossTlfsError
+func (e CopyAcrossTlfsError) Error() string {
+	return "Cannot copy files across top-level folders"
+}
+
+// CopyIntoNonEmptyFileError indicates that the user tried to copy a
+// file's contents into a file that already has contents of its own.
+type CopyIntoNonEmptyFileError struct {
+	Name string
+}
+
+// Error implements the error interface for CopyIntoNonEmptyFileError
+func (e CopyIntoNonEmptyFileError) Error() string {
+	return fmt.Sprintf("Cannot copy into %s, which is not empty", e.Name)
+}
+
+// HardLinkAcrossTlfsError indicates that the user tried to make a
+// hard link to a file in a different top-level folder.
+type HardLinkAcrossTlfsError struct {
+}
+
+// Error implements the error interface for HardLinkAcrossTlfsError
+func (e HardLinkAcrossTlfsError) Error() string {
+	return "Cannot make hard links across top-level folders"
+}
+
+// FileLockConflictError indicates that another owner, possibly on
+// another device, holds a conflicting lock on a file.
+type FileLockConflictError struct {
+	LockID string
+}
+
+// Error implements the error interface for FileLockConflictError
+func (e FileLockConflictError) Error() string {
+	return fmt.Sprintf("File %s is locked by another owner", e.LockID)
+}
+
+// FileLocksUnsupportedError indicates that the MD server doesn't
+// support file lock leases.
+type FileLocksUnsupportedError struct {
+}
+
+// Error implements the error interface for FileLocksUnsupportedError
+func (e FileLocksUnsupportedError) Error() string {
+	return "File locks are not supported by this server"
+}
+
 // ErrorFileAccessError indicates that the user tried to perform an
 // operation on the ErrorFile that is not allowed.
 type ErrorFileAccessError struct {
@@ -192,6 +245,18 @@ func (e WriteUnsupportedError) Error() string {
 	return fmt.Sprintf("Writing to %s is unsupported", e.Filename)
 }
 
+// WriteToReadonlyNodeError indicates an error when trying to write a
+// node that's marked as read-only, such as a node in an archived
+// view of a top-level folder.
+type WriteToReadonlyNodeError struct {
+	Filename string
+}
+
+// Error implements the error interface for WriteToReadonlyNodeError
+func (e WriteToReadonlyNodeError) Error() string {
+	return fmt.Sprintf("%s is read-only", e.Filename)
+}
+
 // NewReadAccessError constructs a ReadAccessError for the given
 // directory and user.
 func NewReadAccessError(h *TlfHandle, username libkb.NormalizedUsername) error {
@@ -896,6 +961,32 @@ func (e DirTooBigError) Error() string {
 		e.size, e.maxAllowedBytes)
 }
 
+// NoSuchXattrError indicates that the requested extended attribute
+// doesn't exist on the given node.
+type NoSuchXattrError struct {
+	Name string
+}
+
+// Error implements the error interface for NoSuchXattrError.
+func (e NoSuchXattrError) Error() string {
+	return fmt.Sprintf("No extended attribute named %s", e.Name)
+}
+
+// XattrTooBigError indicates that the user tried to set an extended
+// attribute value that is bigger than KBFS's supported size.
+type XattrTooBigError struct {
+	name            string
+	size            int
+	maxAllowedBytes int
+}
+
+// Error implements the error interface for XattrTooBigError.
+func (e XattrTooBigError) Error() string {
+	return fmt.Sprintf("Extended attribute %s has a value of %d bytes, "+
+		"which is over the supported limit of %d bytes", e.name, e.size,
+		e.maxAllowedBytes)
+}
+
 // TlfNameNotCanonical indicates that a name isn't a canonical, and
 // that another (not necessarily canonical) name should be tried.
 type TlfNameNotCanonical struct {
@@ -1084,6 +1175,54 @@ func (e ExclOnUnmergedError) Error() string {
 	return "an operation with O_EXCL set is called but fbo is on an unmerged local version"
 }
 
+// BatchInProgressError indicates that a batch can't be started
+// because another one is already open for the same folder.
+type BatchInProgressError struct {
+}
+
+// Error implements the error interface for BatchInProgressError.
+func (e BatchInProgressError) Error() string {
+	return "A batch is already open for this folder"
+}
+
+// BatchNotOpenError indicates that a batch that has already been
+// committed or aborted was used again.
+type BatchNotOpenError struct {
+}
+
+// Error implements the error interface for BatchNotOpenError.
+func (e BatchNotOpenError) Error() string {
+	return "The batch is no longer open"
+}
+
+// BatchExpiredError indicates that a batch was aborted automatically,
+// discarding its writes, because it stayed open for too long.
+type BatchExpiredError struct {
+	Tlf TlfID
+}
+
+// Error implements the error interface for BatchExpiredError.
+func (e BatchExpiredError) Error() string {
+	return fmt.Sprintf("The batch for %s was open for too long, and "+
+		"its writes were discarded", e.Tlf)
+}
+
+// BatchCommitError indicates that the changes made in a batch
+// couldn't be resolved into a merged revision.  They remain on this
+// device's unmerged branch, invisible to other devices, until a
+// later conflict resolution attempt succeeds or the batch is
+// aborted.
+type BatchCommitError struct {
+	Tlf         TlfID
+	UnmergedRev MetadataRevision
+}
+
+// Error implements the error interface for BatchCommitError.
+func (e BatchCommitError) Error() string {
+	return fmt.Sprintf("Couldn't commit the batch for %s; its changes "+
+		"are still unmerged as of revision %d", e.Tlf, e.UnmergedRev)
+}
+
 // OverQuotaWarning indicates that the user is over their quota, and
 // is being slowed down by the server.
 type OverQuotaWarning struct {
@@ -1186,3 +1325,52 @@ func (e TLFCryptKeyNotPerDeviceEncrypted) Error() string {
 	return fmt.Sprintf("TLF crypt key for %s at generation %d is not per-device encrypted",
 		e.tlf, e.keyGen)
 }
+
+// OfflineUnavailableError is returned when the mdserver can't be
+// reached and there's no locally-known revision of the TLF to serve
+// instead.
+type OfflineUnavailableError struct {
+	tlf TlfID
+}
+
+// Error implements the error interface for OfflineUnavailableError.
+func (e OfflineUnavailableError) Error() string {
+	return fmt.Sprintf("Offline, and no cached revision of %s is available",
+		e.tlf)
+}
+
+// JournalFullError is returned when a write can't proceed because
+// the unflushed data in the write journals has reached one of the
+// configured JournalLimits.
+type JournalFullError struct {
+	tlf   TlfID
+	desc  string
+	usage int64
+	limit int64
+}
+
+// Error implements the error interface for JournalFullError.
+func (e JournalFullError) Error() string {
+	return fmt.Sprintf("Write journal for %s is full: %d unflushed %s "+
+		"would exceed the limit of %d; wait for it to flush", e.tlf,
+		e.usage, e.desc, e.limit)
+}
+
+// RevisionsSquashedError is returned for a revision of a TLF that
+// was squashed, along with the unflushed revisions up to End, into
+// the single revision Start.  Those revision numbers no longer mean
+// what they did, and the ones after Start get reused, so anything
+// that depended on them has to start over from the revision before
+// Start.
+type RevisionsSquashedError struct {
+	Tlf   TlfID
+	Start MetadataRevision
+	End   MetadataRevision
+}
+
+// Error implements the error interface for RevisionsSquashedError.
+func (e RevisionsSquashedError) Error() string {
+	return fmt.Sprintf("Revisions %d to %d of %s were squashed into "+
+		"revision %d; start over from revision %d", e.Start, e.End,
+		e.Tlf, e.Start, e.Start-1)
+}
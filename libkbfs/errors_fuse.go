@@ -52,6 +52,14 @@ func (e WriteUnsupportedError) Errno() fuse.Errno {
 	return fuse.Errno(syscall.ENOENT)
 }
 
+var _ fuse.ErrorNumber = WriteToReadonlyNodeError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// WriteToReadonlyNodeError.
+func (e WriteToReadonlyNodeError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EROFS)
+}
+
 var _ fuse.ErrorNumber = NeedSelfRekeyError{}
 
 // Errno implements the fuse.ErrorNumber interface for
@@ -132,3 +140,68 @@ var _ fuse.ErrorNumber = NoSuchFolderListError{}
 func (e NoSuchFolderListError) Errno() fuse.Errno {
 	return fuse.Errno(syscall.ENOENT)
 }
+
+var _ fuse.ErrorNumber = NoSuchXattrError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NoSuchXattrError
+func (e NoSuchXattrError) Errno() fuse.Errno {
+	return fuse.ErrNoXattr
+}
+
+var _ fuse.ErrorNumber = XattrTooBigError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// XattrTooBigError
+func (e XattrTooBigError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.E2BIG)
+}
+
+var _ fuse.ErrorNumber = CopyAcrossTlfsError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// CopyAcrossTlfsError
+func (e CopyAcrossTlfsError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EXDEV)
+}
+
+var _ fuse.ErrorNumber = CopyIntoNonEmptyFileError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// CopyIntoNonEmptyFileError.  This makes copy_file_range fall back to
+// copying the data normally.
+func (e CopyIntoNonEmptyFileError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EOPNOTSUPP)
+}
+
+var _ fuse.ErrorNumber = HardLinkAcrossTlfsError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// HardLinkAcrossTlfsError
+func (e HardLinkAcrossTlfsError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EXDEV)
+}
+
+var _ fuse.ErrorNumber = FileLockConflictError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// FileLockConflictError
+func (e FileLockConflictError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EAGAIN)
+}
+
+var _ fuse.ErrorNumber = FileLocksUnsupportedError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// FileLocksUnsupportedError
+func (e FileLocksUnsupportedError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ENOLCK)
+}
+
+var _ fuse.ErrorNumber = JournalFullError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// JournalFullError
+func (e JournalFullError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ENOSPC)
+}
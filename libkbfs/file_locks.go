@@ -0,0 +1,313 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+// fileLockRenewRetryDelay is how long to wait before retrying a lease
+// renewal that failed for a reason other than a lock conflict.
+const fileLockRenewRetryDelay = 5 * time.Second
+
+// fileLockID returns the ID used by the MD server for locks on the
+// file with the given path and directory entry.  All the links to a
+// hard-linked file share the ID of their group.  Other files have no
+// ID that's stable across devices except their path: block pointers
+// change with every write, which would let another device take the
+// lock as soon as the holder writes.  Once a file is locked, though,
+// its locks on this device stay under the same ID until they're all
+// released, even if the file is renamed (see folderFileLocker).
+func fileLockID(p path, de DirEntry) string {
+	if de.HardLink != "" {
+		return "link:" + de.HardLink
+	}
+	return hardLinkPath(p)
+}
+
+type fileLockKey struct {
+	lockID string
+	owner  string
+}
+
+type heldFileLock struct {
+	exclusive bool
+	renewAt   time.Time
+	// gen changes every time the lock is taken, so that a renewal
+	// that raced with a new lock call can tell that its result is
+	// stale.
+	gen uint64
+}
+
+// folderFileLocker holds the advisory file lock leases taken by this
+// device within a single TLF.  The leases themselves live on the MD
+// server, which makes sure that conflicting locks from other devices
+// (or other owners on this device) are refused.  A lease expires on
+// the server unless it's renewed, so that the locks of a device that
+// goes away are eventually released; the locker renews each lease in
+// the background when half of its lifetime has passed.
+//
+// Locks are tracked per node, so that all the locks on a file stay
+// under the lock ID it had when it was first locked, however it's
+// renamed while they're held.
+//
+// `lock` only protects the local state; it's never held across an MD
+// server RPC.
+type folderFileLocker struct {
+	config       Config
+	folderBranch FolderBranch
+	log          logger.Logger
+
+	lock sync.Mutex
+	held map[fileLockKey]heldFileLock
+	// nodeLockIDs maps each node with held locks to their lock ID.
+	nodeLockIDs map[NodeID]string
+	gen         uint64
+
+	kickCh     chan struct{}
+	shutdownCh chan struct{}
+	doneCh     chan struct{}
+}
+
+func newFolderFileLocker(config Config, fb FolderBranch,
+	log logger.Logger) *folderFileLocker {
+	fl := &folderFileLocker{
+		config:       config,
+		folderBranch: fb,
+		log:          log,
+		held:         make(map[fileLockKey]heldFileLock),
+		nodeLockIDs:  make(map[NodeID]string),
+		kickCh:       make(chan struct{}, 1),
+		shutdownCh:   make(chan struct{}),
+		doneCh:       make(chan struct{}),
+	}
+	go fl.loop()
+	return fl
+}
+
+// nextRenewal returns how long to wait before the next lease needs to
+// be renewed, and whether any leases are held at all.
+func (fl *folderFileLocker) nextRenewal() (time.Duration, bool) {
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+	if len(fl.held) == 0 {
+		return 0, false
+	}
+	var next time.Time
+	for _, h := range fl.held {
+		if next.IsZero() || h.renewAt.Before(next) {
+			next = h.renewAt
+		}
+	}
+	return next.Sub(fl.config.Clock().Now()), true
+}
+
+func (fl *folderFileLocker) loop() {
+	defer close(fl.doneCh)
+	ctx, cancel := context.WithCancel(ctxWithRandomIDReplayable(
+		context.Background(), CtxFBOIDKey, CtxFBOOpID, fl.log))
+	defer cancel()
+	go func() {
+		select {
+		case <-fl.shutdownCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		var timer *time.Timer
+		var renewCh <-chan time.Time
+		if d, ok := fl.nextRenewal(); ok {
+			timer = time.NewTimer(d)
+			renewCh = timer.C
+		}
+
+		select {
+		case <-renewCh:
+			fl.renew(ctx)
+		case <-fl.kickCh:
+			// The set of held locks changed; recompute the timer.
+		case <-fl.shutdownCh:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-fl.shutdownCh:
+			return
+		default:
+		}
+	}
+}
+
+func (fl *folderFileLocker) kick() {
+	select {
+	case fl.kickCh <- struct{}{}:
+	default:
+		// A kick is already pending.
+	}
+}
+
+// renew renews every lease that's due.  A lease that can't be renewed
+// because of a conflict has already expired on the server, and some
+// other owner has taken the lock, so it's dropped.
+func (fl *folderFileLocker) renew(ctx context.Context) {
+	type dueLock struct {
+		key fileLockKey
+		h   heldFileLock
+	}
+	var due []dueLock
+	func() {
+		fl.lock.Lock()
+		defer fl.lock.Unlock()
+		now := fl.config.Clock().Now()
+		for key, h := range fl.held {
+			if !now.Before(h.renewAt) {
+				due = append(due, dueLock{key, h})
+			}
+		}
+	}()
+
+	for _, d := range due {
+		ttl, err := fl.config.MDServer().LockFile(ctx, fl.folderBranch.Tlf,
+			d.key.lockID, d.key.owner, d.h.exclusive)
+		fl.renewDone(ctx, d.key, d.h.gen, ttl, err)
+	}
+}
+
+// renewDone records the result of renewing the given lease, unless
+// the lock was retaken or released while the renewal was in flight.
+func (fl *folderFileLocker) renewDone(ctx context.Context, key fileLockKey,
+	gen uint64, ttl time.Duration, err error) {
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+	h, ok := fl.held[key]
+	if !ok || h.gen != gen {
+		return
+	}
+	now := fl.config.Clock().Now()
+	switch err.(type) {
+	case nil:
+		h.renewAt = now.Add(ttl / 2)
+	case FileLockConflictError:
+		fl.log.CWarningf(ctx, "Lost the lock on %s for %s: %v",
+			key.lockID, key.owner, err)
+		delete(fl.held, key)
+		fl.forgetLockIDLocked(key.lockID)
+		return
+	default:
+		fl.log.CDebugf(ctx, "Couldn't renew the lock on %s for %s: %v",
+			key.lockID, key.owner, err)
+		h.renewAt = now.Add(fileLockRenewRetryDelay)
+	}
+	fl.held[key] = h
+}
+
+// lockFile takes, or changes the type of, the given owner's lock on
+// the given node.  lockID is only used if there are no locks held on
+// the node yet.
+func (fl *folderFileLocker) lockFile(ctx context.Context, node NodeID,
+	lockID string, owner string, exclusive bool) error {
+	func() {
+		fl.lock.Lock()
+		defer fl.lock.Unlock()
+		if id, ok := fl.nodeLockIDs[node]; ok {
+			lockID = id
+		}
+	}()
+
+	ttl, err := fl.config.MDServer().LockFile(ctx, fl.folderBranch.Tlf,
+		lockID, owner, exclusive)
+	if err != nil {
+		return err
+	}
+
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+	fl.gen++
+	fl.held[fileLockKey{lockID, owner}] = heldFileLock{
+		exclusive: exclusive,
+		renewAt:   fl.config.Clock().Now().Add(ttl / 2),
+		gen:       fl.gen,
+	}
+	fl.nodeLockIDs[node] = lockID
+	fl.kick()
+	return nil
+}
+
+// unlockFile releases the given owner's lock on the given node, if
+// it holds one.  The lock is forgotten, and no longer renewed, even
+// if the MD server can't be told about it; the lease then just
+// expires on its own.
+func (fl *folderFileLocker) unlockFile(
+	ctx context.Context, node NodeID, owner string) error {
+	lockID, ok := func() (string, bool) {
+		fl.lock.Lock()
+		defer fl.lock.Unlock()
+		lockID, ok := fl.nodeLockIDs[node]
+		if !ok {
+			return "", false
+		}
+		key := fileLockKey{lockID, owner}
+		_, held := fl.held[key]
+		delete(fl.held, key)
+		fl.forgetLockIDLocked(lockID)
+		return lockID, held
+	}()
+	if !ok {
+		return nil
+	}
+
+	return fl.config.MDServer().UnlockFile(ctx, fl.folderBranch.Tlf,
+		lockID, owner)
+}
+
+// forgetLockIDLocked forgets which nodes are locked under the given
+// lock ID, once no owner holds a lock under it anymore.
+func (fl *folderFileLocker) forgetLockIDLocked(lockID string) {
+	for key := range fl.held {
+		if key.lockID == lockID {
+			return
+		}
+	}
+	for node, id := range fl.nodeLockIDs {
+		if id == lockID {
+			delete(fl.nodeLockIDs, node)
+		}
+	}
+}
+
+// shutdown stops renewing leases, and makes a best effort to release
+// all the locks still held, so that other devices don't have to wait
+// for them to expire.
+func (fl *folderFileLocker) shutdown() {
+	close(fl.shutdownCh)
+	<-fl.doneCh
+
+	fl.lock.Lock()
+	held := fl.held
+	fl.held = make(map[fileLockKey]heldFileLock)
+	fl.nodeLockIDs = make(map[NodeID]string)
+	fl.lock.Unlock()
+	if len(held) == 0 {
+		return
+	}
+
+	ctx := ctxWithRandomIDReplayable(
+		context.Background(), CtxFBOIDKey, CtxFBOOpID, fl.log)
+	for key := range held {
+		err := fl.config.MDServer().UnlockFile(ctx, fl.folderBranch.Tlf,
+			key.lockID, key.owner)
+		if err != nil {
+			fl.log.CDebugf(ctx, "Couldn't release the lock on %s for %s: %v",
+				key.lockID, key.owner, err)
+		}
+	}
+}
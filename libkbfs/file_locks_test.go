@@ -0,0 +1,97 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type blockingLockMDServer struct {
+	MDServer
+	// Signalled on each LockFile call.
+	onLockCh chan struct{}
+	// LockFile hangs until this is closed.
+	releaseCh chan struct{}
+}
+
+func (md blockingLockMDServer) LockFile(ctx context.Context, id TlfID,
+	lockID string, owner string, exclusive bool) (time.Duration, error) {
+	select {
+	case md.onLockCh <- struct{}{}:
+	default:
+	}
+	<-md.releaseCh
+	return md.MDServer.LockFile(ctx, id, lockID, owner, exclusive)
+}
+
+func TestFolderFileLockerNoLockDuringRPC(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	ctx := context.Background()
+
+	mdserver := blockingLockMDServer{
+		config.MDServer(), make(chan struct{}, 1), make(chan struct{})}
+	config.SetMDServer(mdserver)
+	defer config.SetMDServer(mdserver.MDServer)
+	fb := FolderBranch{FakeTlfID(1, false), MasterBranch}
+	fl := newFolderFileLocker(config, fb, config.MakeLogger(""))
+	defer fl.shutdown()
+
+	nodeA, nodeB := &nodeCore{}, &nodeCore{}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fl.lockFile(ctx, nodeA, "a", "o1", true)
+	}()
+	<-mdserver.onLockCh
+
+	// The locker's state is still accessible while the RPC is in
+	// flight.
+	_, ok := fl.nextRenewal()
+	require.False(t, ok)
+	require.NoError(t, fl.unlockFile(ctx, nodeB, "o1"))
+
+	close(mdserver.releaseCh)
+	require.NoError(t, <-errCh)
+	_, ok = fl.nextRenewal()
+	require.True(t, ok)
+
+	err := fl.lockFile(ctx, nodeB, "a", "o2", false)
+	require.Equal(t, FileLockConflictError{"a"}, err)
+
+	// A renewal that raced with retaking the lock doesn't clobber
+	// the new lease.
+	key := fileLockKey{"a", "o1"}
+	fl.lock.Lock()
+	oldGen := fl.held[key].gen
+	fl.lock.Unlock()
+	require.NoError(t, fl.lockFile(ctx, nodeA, "a", "o1", false))
+	fl.renewDone(ctx, key, oldGen, 0, FileLockConflictError{"a"})
+	fl.lock.Lock()
+	h, ok := fl.held[key]
+	fl.lock.Unlock()
+	require.True(t, ok)
+	require.False(t, h.exclusive)
+
+	// Once a node is locked, its locks stay under the same lock ID,
+	// e.g. after the file is renamed.
+	require.NoError(t, fl.lockFile(ctx, nodeA, "renamed", "o3", false))
+	fl.lock.Lock()
+	_, ok = fl.held[fileLockKey{"a", "o3"}]
+	fl.lock.Unlock()
+	require.True(t, ok)
+
+	// Once all the locks are released, nothing is renewed anymore.
+	require.NoError(t, fl.unlockFile(ctx, nodeA, "o1"))
+	require.NoError(t, fl.unlockFile(ctx, nodeA, "o3"))
+	_, ok = fl.nextRenewal()
+	require.False(t, ok)
+	fl.lock.Lock()
+	require.Empty(t, fl.nodeLockIDs)
+	fl.lock.Unlock()
+}
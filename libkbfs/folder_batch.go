@@ -0,0 +1,384 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// defaultMaxBatchDuration is how long a batch may stay open
+	// before it's aborted automatically, so that a caller that never
+	// closes its batch can't hold up the folder's other writers
+	// forever.
+	defaultMaxBatchDuration = 2 * time.Minute
+	// batchExpireRetryDelay is how long to wait before trying again
+	// to abort an expired batch that couldn't be aborted yet.
+	batchExpireRetryDelay = 1 * time.Second
+)
+
+type ctxBatchKeyType int
+
+// ctxBatchKey tags the contexts of the caller that owns a batch; its
+// value is the *folderBatch.
+const ctxBatchKey ctxBatchKeyType = iota
+
+// A batch groups the writes made to a folder by its caller, while
+// it's open, into a single merged revision.
+//
+// While a batch is open, every MD write made with a context returned
+// by its Context method adds its ops to one pending successor of the
+// head the batch started from.  That pending MD becomes the local
+// head, so later writes in the batch see the earlier ones, but
+// nothing is put to the server, and MD writes from other callers
+// wait until the batch is closed.  Committing the batch puts the
+// pending MD as a single new revision with the combined ops list; if
+// other devices changed the folder in the meantime, that revision
+// goes through conflict resolution like any other out-of-date write.
+// Aborting it undoes the pending ops locally instead.  A batch that
+// stays open for longer than fbo.maxBatchDuration is aborted
+// automatically.
+type folderBatch struct {
+	fbo *folderBranchOps
+	// branchPoint is the latest merged revision when the batch began.
+	branchPoint MetadataRevision
+	// doneCh is closed, while holding fbo.mdWriterLock, when the
+	// batch is closed.
+	doneCh chan struct{}
+	// expireTimer aborts the batch once its deadline passes.
+	expireTimer *time.Timer
+
+	// The rest are protected by fbo.mdWriterLock.
+
+	// base is the head that the batch's writes are built on, as of
+	// its first write.
+	base ImmutableRootMetadata
+	// md holds the ops of all the batch's writes so far, as a
+	// successor of base.  It's nil until the first write.
+	md *RootMetadata
+	// bps holds the blocks put for the batch's writes, so they can
+	// be cleaned up if the batch is aborted.
+	bps *blockPutState
+	// committing is set once Commit has started putting md.
+	committing bool
+	// commitFailed is set if the batch was closed by Commit but its
+	// changes couldn't be resolved.
+	commitFailed bool
+	// expired is set if the batch was aborted because its deadline
+	// passed.
+	expired bool
+}
+
+var _ Batch = (*folderBatch)(nil)
+
+// Context implements the Batch interface for folderBatch.
+func (b *folderBatch) Context(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxBatchKey, b)
+}
+
+// includes returns whether ctx belongs to the caller that owns b.
+func (b *folderBatch) includes(ctx context.Context) bool {
+	owner, ok := ctx.Value(ctxBatchKey).(*folderBatch)
+	return ok && owner == b
+}
+
+// closeLocked closes the batch, letting any MD writes from other
+// callers through.
+func (b *folderBatch) closeLocked(lState *lockState) {
+	b.fbo.mdWriterLock.AssertLocked(lState)
+	if b.fbo.batch == b {
+		b.fbo.batch = nil
+		b.expireTimer.Stop()
+		close(b.doneCh)
+	}
+}
+
+// isPendingLocked returns whether the batch holds writes that
+// haven't been put yet.
+func (b *folderBatch) isPendingLocked(lState *lockState) bool {
+	b.fbo.mdWriterLock.AssertLocked(lState)
+	return b.fbo.batch == b && b.md != nil && !b.committing
+}
+
+// addLocked makes md, which holds all the batch's ops so far, the
+// new pending head of the folder, and sends out notifications for
+// the ops that the latest write added to it.
+func (b *folderBatch) addLocked(ctx context.Context, lState *lockState,
+	md *RootMetadata, bps *blockPutState) error {
+	fbo := b.fbo
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	err := fbo.finalizeBlocks(bps)
+	if err != nil {
+		return err
+	}
+
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	numOldOps := 0
+	if b.md == nil {
+		b.base = fbo.head
+		b.bps = newBlockPutState(len(bps.blockStates))
+	} else {
+		numOldOps = len(b.md.data.Changes.Ops)
+	}
+	b.md = md
+	b.bps.mergeOtherBps(bps)
+
+	// The pending head doesn't have an MD ID until it's put, so set
+	// it directly rather than through setHeadSuccessorLocked.
+	fbo.log.CDebugf(ctx, "Setting pending batch head revision to %d",
+		md.Revision())
+	fbo.head = ImmutableRootMetadata{
+		md.ReadOnly(), MdID{}, fbo.config.Clock().Now()}
+	fbo.status.setRootMetadata(fbo.head)
+	for _, op := range md.data.Changes.Ops[numOldOps:] {
+		fbo.notifyOneOpLocked(ctx, lState, op, fbo.head)
+	}
+	return nil
+}
+
+// setHeadLocked swaps md in as the head without any checks, for
+// moving between the pending head and the one it's built on.
+func (b *folderBatch) setHeadLocked(
+	lState *lockState, md ImmutableRootMetadata) {
+	b.fbo.headLock.Lock(lState)
+	defer b.fbo.headLock.Unlock(lState)
+	b.fbo.head = md
+	b.fbo.status.setRootMetadata(md)
+}
+
+// commitLocked puts the batch's pending MD as a single revision on
+// top of base.
+func (b *folderBatch) commitLocked(
+	ctx context.Context, lState *lockState) (err error) {
+	fbo := b.fbo
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Put a copy, so that the pending head stays intact if the put
+	// fails.
+	md, err := b.md.deepCopy(fbo.config.Codec(), true)
+	if err != nil {
+		return err
+	}
+	pending := fbo.getHead(lState)
+	b.setHeadLocked(lState, b.base)
+	b.committing = true
+	defer func() {
+		if err != nil {
+			b.committing = false
+			b.setHeadLocked(lState, pending)
+		}
+	}()
+
+	bps := newBlockPutState(1)
+	err = fbo.unembedBlockChangesIfNeeded(ctx, bps, md, uid)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			fbo.fbm.cleanUpBlockState(
+				md.ReadOnly(), bps, blockDeleteOnMDFail)
+		}
+	}()
+	_, err = doBlockPuts(ctx, fbo.config.BlockServer(),
+		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, md.TlfID(),
+		md.GetTlfHandle().GetCanonicalName(), *bps)
+	if err != nil {
+		return err
+	}
+	return fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl)
+}
+
+// undoLocked discards the batch's pending writes, and goes back to
+// the head they were built on.
+func (b *folderBatch) undoLocked(ctx context.Context, lState *lockState) {
+	fbo := b.fbo
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	b.setHeadLocked(lState, b.base)
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	ops := b.md.data.Changes.Ops
+	for i := len(ops) - 1; i >= 0; i-- {
+		io, err := invertOpForLocalNotifications(ops[i])
+		if err != nil {
+			fbo.log.CWarningf(ctx,
+				"got error %v when invert op %v; skipping", err, ops[i])
+			continue
+		}
+		fbo.notifyOneOpLocked(ctx, lState, io, b.base)
+	}
+	// Nothing references the batch's blocks anymore.  Forget them
+	// too, so they can't be used to dedup later writes.
+	bcache := fbo.config.BlockCache()
+	for _, bs := range b.bps.blockStates {
+		if fblock, ok := bs.block.(*FileBlock); ok {
+			_ = bcache.DeleteKnownPtr(fbo.id(), fblock)
+		}
+		_ = bcache.DeleteTransient(bs.blockPtr, fbo.id())
+	}
+	fbo.fbm.cleanUpBlockState(b.md.ReadOnly(), b.bps, blockDeleteAlways)
+	b.md = nil
+	b.bps = nil
+}
+
+// Commit implements the Batch interface for folderBatch.
+func (b *folderBatch) Commit(ctx context.Context) (err error) {
+	fbo := b.fbo
+	fbo.log.CDebugf(ctx, "Commit batch (branch point %d)", b.branchPoint)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	var unmergedRev MetadataRevision
+	err = fbo.doMDWriteWithRetryUnlessCanceled(b.Context(ctx),
+		func(lState *lockState) error {
+			if fbo.batch != b || b.committing {
+				return BatchNotOpenError{}
+			}
+			// Any unsynced writes stay dirty, and are synced
+			// outside of the batch.
+			if b.md == nil {
+				// Nothing was written during the batch.
+				b.closeLocked(lState)
+				return nil
+			}
+			err := b.commitLocked(ctx, lState)
+			if err != nil {
+				return err
+			}
+			if fbo.isMasterBranchLocked(lState) {
+				b.closeLocked(lState)
+				return nil
+			}
+			unmergedRev = fbo.getCurrMDRevision(lState)
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	if unmergedRev == MetadataRevisionUninitialized {
+		fbo.log.CDebugf(ctx, "Batch committed as merged revision %d",
+			fbo.getCurrMDRevision(makeFBOLockState()))
+		return nil
+	}
+
+	// Other devices changed the folder during the batch, so wait
+	// for conflict resolution to merge the batch's revision.  The
+	// batch stays open until then, so that writes from other callers
+	// can't end up in the same revision.
+	err = fbo.cr.Wait(ctx)
+	lState := makeFBOLockState()
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	b.closeLocked(lState)
+	if !fbo.isMasterBranchLocked(lState) {
+		b.commitFailed = true
+	}
+	if err != nil {
+		return err
+	}
+	if b.commitFailed {
+		return BatchCommitError{fbo.id(), unmergedRev}
+	}
+	fbo.log.CDebugf(ctx, "Batch committed as merged revision %d",
+		fbo.getLatestMergedRevision(lState))
+	return nil
+}
+
+func (b *folderBatch) abort(ctx context.Context, expired bool) error {
+	fbo := b.fbo
+
+	// Undo using a fresh context, like UnstageForTesting, so that
+	// upper layers don't ignore the resulting notifications.
+	freshCtx, cancel := fbo.newCtxWithFBOID()
+	defer cancel()
+	return fbo.doMDWriteWithRetryUnlessCanceled(b.Context(ctx),
+		func(lState *lockState) error {
+			// A failed commit leaves the batch's changes on the
+			// unmerged branch; aborting still discards them.
+			if b.committing && !b.commitFailed {
+				return BatchNotOpenError{}
+			}
+			if fbo.batch != b && !(b.commitFailed && fbo.batch == nil) {
+				return BatchNotOpenError{}
+			}
+			if fbo.blocks.GetState(lState) != cleanState {
+				return NotPermittedWhileDirtyError{}
+			}
+			if b.md != nil && !b.commitFailed {
+				b.undoLocked(freshCtx, lState)
+			}
+			b.closeLocked(lState)
+			b.expired = expired
+			if fbo.isMasterBranchLocked(lState) {
+				return nil
+			}
+			return fbo.unstageLocked(freshCtx, lState)
+		})
+}
+
+// Abort implements the Batch interface for folderBatch.
+func (b *folderBatch) Abort(ctx context.Context) (err error) {
+	fbo := b.fbo
+	fbo.log.CDebugf(ctx, "Abort batch (branch point %d)", b.branchPoint)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+	return b.abort(ctx, false)
+}
+
+// expire aborts the batch when its deadline passes, if it's still
+// open.  Any unsynced writes are first synced into the batch, so
+// that they're discarded along with it.
+func (b *folderBatch) expire() {
+	fbo := b.fbo
+	ctx, cancel := fbo.newCtxWithFBOID()
+	defer cancel()
+
+	lState := makeFBOLockState()
+	isOpen := func() bool {
+		fbo.mdWriterLock.Lock(lState)
+		defer fbo.mdWriterLock.Unlock(lState)
+		return fbo.batch == b && !b.committing
+	}()
+	if !isOpen {
+		return
+	}
+	select {
+	case <-fbo.shutdownChan:
+		return
+	default:
+	}
+
+	fbo.log.CDebugf(ctx, "Batch (branch point %d) expired; aborting it",
+		b.branchPoint)
+	bctx := b.Context(ctx)
+	for _, ref := range fbo.blocks.GetDirtyRefs(lState) {
+		node := fbo.nodeCache.Get(ref)
+		if node == nil {
+			continue
+		}
+		if err := fbo.Sync(bctx, node); err != nil {
+			fbo.log.CDebugf(ctx, "Couldn't sync %v into the expired "+
+				"batch: %v", ref, err)
+		}
+	}
+
+	err := b.abort(ctx, true)
+	switch err.(type) {
+	case nil, BatchNotOpenError:
+	case NotPermittedWhileDirtyError:
+		// More writes came in; try again shortly.
+		b.expireTimer.Reset(batchExpireRetryDelay)
+	default:
+		fbo.log.CWarningf(ctx, "Couldn't abort the expired batch: %v", err)
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchCommitSingleRevision(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	fb := rootNode1.GetFolderBranch()
+
+	kbfsOps1 := config1.KBFSOps()
+	kbfsOps2 := config2.KBFSOps()
+	_, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	ops1 := getOps(config1, fb.Tlf)
+	lState := makeFBOLockState()
+	startRev := ops1.getLatestMergedRevision(lState)
+
+	batch, err := kbfsOps1.BeginBatch(ctx, fb)
+	require.NoError(t, err)
+	_, err = kbfsOps1.BeginBatch(ctx, fb)
+	require.Equal(t, BatchInProgressError{}, err)
+
+	bctx := batch.Context(ctx)
+	fileNodeB, _, err := kbfsOps1.CreateFile(bctx, rootNode1, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(bctx, fileNodeB, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(bctx, fileNodeB)
+	require.NoError(t, err)
+	dirNode, _, err := kbfsOps1.CreateDir(bctx, rootNode1, "d")
+	require.NoError(t, err)
+	err = kbfsOps1.Rename(bctx, rootNode1, "a", dirNode, "a")
+	require.NoError(t, err)
+
+	// Nothing is visible to other devices until the commit.
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	entries, err := kbfsOps2.GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Contains(t, entries, "a")
+	// The writes are only pending locally, not on a branch.
+	require.True(t, ops1.isMasterBranch(lState))
+
+	err = batch.Commit(ctx)
+	require.NoError(t, err)
+	require.Equal(t, startRev+1, ops1.getLatestMergedRevision(lState))
+	err = batch.Commit(ctx)
+	require.Equal(t, BatchNotOpenError{}, err)
+
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	entries, err = kbfsOps2.GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Contains(t, entries, "b")
+	require.Contains(t, entries, "d")
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "d")
+	require.NoError(t, err)
+	_, _, err = kbfsOps2.Lookup(ctx, dirNode2, "a")
+	require.NoError(t, err)
+}
+
+func TestBatchCommitAfterConcurrentWrite(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	fb := rootNode1.GetFolderBranch()
+
+	kbfsOps1 := config1.KBFSOps()
+	kbfsOps2 := config2.KBFSOps()
+	batch, err := kbfsOps1.BeginBatch(ctx, fb)
+	require.NoError(t, err)
+	bctx := batch.Context(ctx)
+	_, _, err = kbfsOps1.CreateFile(bctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.CreateFile(bctx, rootNode1, "b", false, NoExcl)
+	require.NoError(t, err)
+
+	// Another device writes while the batch is open.
+	_, _, err = kbfsOps2.CreateFile(ctx, rootNode2, "c", false, NoExcl)
+	require.NoError(t, err)
+	ops2 := getOps(config2, fb.Tlf)
+	lState := makeFBOLockState()
+	concurrentRev := ops2.getLatestMergedRevision(lState)
+
+	// The commit goes through conflict resolution, but still lands
+	// as a single revision.
+	err = batch.Commit(ctx)
+	require.NoError(t, err)
+
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, concurrentRev+1, ops2.getLatestMergedRevision(lState))
+	entries, err := kbfsOps2.GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+}
+
+func TestBatchAbort(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	fb := rootNode1.GetFolderBranch()
+
+	kbfsOps1 := config1.KBFSOps()
+	_, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	batch, err := kbfsOps1.BeginBatch(ctx, fb)
+	require.NoError(t, err)
+	bctx := batch.Context(ctx)
+	_, _, err = kbfsOps1.CreateFile(bctx, rootNode1, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.RemoveEntry(bctx, rootNode1, "a")
+	require.NoError(t, err)
+
+	err = batch.Abort(ctx)
+	require.NoError(t, err)
+	err = batch.Commit(ctx)
+	require.Equal(t, BatchNotOpenError{}, err)
+
+	entries, err := kbfsOps1.GetDirChildren(ctx, rootNode1)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Contains(t, entries, "a")
+
+	// A new batch can be started once the old one is done.
+	batch, err = kbfsOps1.BeginBatch(ctx, fb)
+	require.NoError(t, err)
+	err = batch.Commit(ctx)
+	require.NoError(t, err)
+}
+
+func TestBatchScopedToCaller(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, fb.Tlf)
+	lState := makeFBOLockState()
+	startRev := ops.getLatestMergedRevision(lState)
+
+	batch, err := kbfsOps.BeginBatch(ctx, fb)
+	require.NoError(t, err)
+	bctx := batch.Context(ctx)
+	_, _, err = kbfsOps.CreateFile(bctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	// A write from another caller waits for the batch to close.
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		t.Fatalf("Write outside the batch finished early: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	_, _, err = kbfsOps.CreateFile(bctx, rootNode, "c", false, NoExcl)
+	require.NoError(t, err)
+
+	// With no other devices writing, the commit squashes the
+	// branch into one revision, and the other write lands after
+	// it.
+	err = batch.Commit(ctx)
+	require.NoError(t, err)
+	require.NoError(t, <-errCh)
+	require.Equal(t, startRev+2, ops.getLatestMergedRevision(lState))
+	entries, err := kbfsOps.GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+}
+
+func TestBatchExpires(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, fb.Tlf)
+	ops.maxBatchDuration = 100 * time.Millisecond
+
+	batch, err := kbfsOps.BeginBatch(ctx, fb)
+	require.NoError(t, err)
+	bctx := batch.Context(ctx)
+	_, _, err = kbfsOps.CreateFile(bctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	// A write from another caller gets through once the batch
+	// expires, without the batch's changes.
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	entries, err := kbfsOps.GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Contains(t, entries, "b")
+
+	expiredErr := BatchExpiredError{fb.Tlf}
+	_, _, err = kbfsOps.CreateFile(bctx, rootNode, "c", false, NoExcl)
+	require.Equal(t, expiredErr, err)
+	err = batch.Commit(ctx)
+	require.Equal(t, expiredErr, err)
+	err = batch.Abort(ctx)
+	require.Equal(t, expiredErr, err)
+}
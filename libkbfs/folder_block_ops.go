@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"time"
 
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfscodec"
@@ -208,6 +209,12 @@ type folderBlockOps struct {
 	// call PathFromNode() only under blockLock (see nodeCache
 	// comments in folder_branch_ops.go).
 	nodeCache NodeCache
+
+	// readEnds tracks, for recently-read files, the offset at
+	// which the last read ended, to detect sequential reads.  It
+	// maps a file's top BlockPointer to an int64, and is
+	// goroutine-safe itself.
+	readEnds *lru.Cache
 }
 
 // Only exported methods of folderBlockOps should be used outside of this
@@ -689,10 +696,12 @@ func (fbo *folderBlockOps) getDirtyDirLocked(ctx context.Context,
 }
 
 // GetDirtyDirChildren returns a map of EntryInfos for the (possibly
-// dirty) children entries of the given directory.
+// dirty) children entries of the given directory, with their link
+// counts filled in from md.
 func (fbo *folderBlockOps) GetDirtyDirChildren(
-	ctx context.Context, lState *lockState, kmd KeyMetadata, dir path) (
-	map[string]EntryInfo, error) {
+	ctx context.Context, lState *lockState, md ReadOnlyRootMetadata,
+	dir path) (map[string]EntryInfo, error) {
+	kmd := md
 	dblock, err := func() (*DirBlock, error) {
 		fbo.blockLock.RLock(lState)
 		defer fbo.blockLock.RUnlock(lState)
@@ -707,9 +716,15 @@ func (fbo *folderBlockOps) GetDirtyDirChildren(
 		return nil, err
 	}
 
+	if prefetcher := fbo.config.Prefetcher(); prefetcher != nil {
+		prefetcher.PrefetchDirChildren(dblock, kmd)
+	}
+
 	children := make(map[string]EntryInfo)
 	for k, de := range dblock.Children {
-		children[k] = de.EntryInfo
+		ei := de.EntryInfo
+		ei.Nlink = md.data.hardLinkCount(de.HardLink)
+		children[k] = ei
 	}
 	return children, nil
 }
@@ -1066,11 +1081,13 @@ func (fbo *folderBlockOps) Read(
 
 	nRead := int64(0)
 	n := int64(len(dest))
+	var lastParent *FileBlock
+	lastIndex := 0
 
 	for nRead < n {
 		nextByte := nRead + off
 		toRead := n - nRead
-		_, _, _, block, nextBlockOff, startOff, err := fbo.getFileBlockAtOffsetLocked(
+		_, parent, index, block, nextBlockOff, startOff, err := fbo.getFileBlockAtOffsetLocked(
 			ctx, lState, kmd, file, fblock, nextByte, blockRead)
 		if err != nil {
 			// If we hit a timeout while reading then return the bytes already read
@@ -1104,6 +1121,8 @@ func (fbo *folderBlockOps) Read(
 				nRead += fill
 				continue
 			}
+			fbo.maybePrefetchAfterReadLocked(
+				lState, kmd, file, off, nRead, lastParent, lastIndex)
 			return nRead, nil
 		} else if toRead > lastByteInBlock-nextByte {
 			toRead = lastByteInBlock - nextByte
@@ -1113,11 +1132,41 @@ func (fbo *folderBlockOps) Read(
 		copy(dest[nRead:nRead+toRead],
 			block.Contents[firstByteToRead:toRead+firstByteToRead])
 		nRead += toRead
+		lastParent, lastIndex = parent, index
 	}
 
+	fbo.maybePrefetchAfterReadLocked(
+		lState, kmd, file, off, n, lastParent, lastIndex)
 	return n, nil
 }
 
+// maybePrefetchAfterReadLocked records where a read of the given
+// file ended.  If the read started where the previous read of that
+// file ended, it asks the prefetcher to fetch the child blocks that
+// follow the last one read, in the given parent block.
+func (fbo *folderBlockOps) maybePrefetchAfterReadLocked(lState *lockState,
+	kmd KeyMetadata, file path, off, nRead int64, parent *FileBlock,
+	index int) {
+	fbo.blockLock.AssertAnyLocked(lState)
+	prefetcher := fbo.config.Prefetcher()
+	if prefetcher == nil || fbo.readEnds == nil {
+		return
+	}
+
+	ptr := file.tailPointer()
+	lastEnd, ok := fbo.readEnds.Get(ptr)
+	fbo.readEnds.Add(ptr, off+nRead)
+	if !ok || lastEnd.(int64) != off || parent == nil {
+		return
+	}
+	// Dirty files may point to blocks that aren't on the server
+	// yet, so leave them alone.
+	if _, ok := fbo.dirtyFiles[ptr]; ok {
+		return
+	}
+	prefetcher.PrefetchAfterRead(parent, index, kmd)
+}
+
 func (fbo *folderBlockOps) maybeWaitOnDeferredWrites(
 	ctx context.Context, lState *lockState, file Node,
 	c DirtyPermChan) error {
@@ -1370,6 +1419,9 @@ func (fbo *folderBlockOps) writeDataLocked(
 			// And push the indirect pointers to right
 			newb := fblock.IPtrs[len(fblock.IPtrs)-1]
 			copy(fblock.IPtrs[indexInParent+2:], fblock.IPtrs[indexInParent+1:])
+			// The new block only fills the start of the hole, so
+			// there may still be a hole after it.
+			newb.Holes = true
 			fblock.IPtrs[indexInParent+1] = newb
 			if oldSizeWithoutHoles == de.Size {
 				// For the purposes of calculating the newly-dirtied
@@ -1752,9 +1804,11 @@ func (fbo *folderBlockOps) Truncate(
 	//
 	// Assume the whole remaining file will be dirty after this
 	// truncate.  TODO: try to figure out how many bytes actually will
-	// be dirtied ahead of time?
-	c, err := fbo.config.DirtyBlockCache().RequestPermissionToDirty(ctx,
-		fbo.id(), int64(size))
+	// be dirtied ahead of time?  Since that overestimates the new
+	// data by a lot, don't let it count against the journal's hard
+	// limits.
+	c, err := fbo.config.DirtyBlockCache().RequestPermissionToDirty(
+		journalNoNewDataContext(ctx), fbo.id(), int64(size))
 	if err != nil {
 		return err
 	}
@@ -1815,6 +1869,310 @@ func (fbo *folderBlockOps) Truncate(
 	return nil
 }
 
+// GetFileHoles returns the holes in the given file, in order of
+// offset.  A hole is a range of the file between the end of one
+// child block's contents and the start of the next child block; it
+// has no blocks backing it, and reads back as zeros.  Only the child
+// blocks whose indirect pointers are marked as possibly being
+// followed by a hole are fetched.
+func (fbo *folderBlockOps) GetFileHoles(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file path) ([]FileHole, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	// getFileLocked already checks read permissions
+	fblock, err := fbo.getFileLocked(ctx, lState, kmd, file, blockRead)
+	if err != nil {
+		return nil, err
+	}
+	if !fblock.IsInd || fblock.DataVersion() < FilesWithHolesDataVer {
+		// Only a file with the hole marker on its indirect
+		// pointers can have holes.
+		return nil, nil
+	}
+
+	var holes []FileHole
+	for i, iptr := range fblock.IPtrs {
+		if i == len(fblock.IPtrs)-1 {
+			// Reads past the end of the last block hit EOF, so
+			// there's never a hole after it.
+			break
+		}
+		if !iptr.Holes {
+			continue
+		}
+		block, err := fbo.getFileBlockLocked(
+			ctx, lState, kmd, iptr.BlockPointer, file, blockRead)
+		if err != nil {
+			return nil, err
+		}
+		end := uint64(iptr.Off) + uint64(len(block.Contents))
+		next := uint64(fblock.IPtrs[i+1].Off)
+		if end >= next {
+			continue
+		}
+		if n := len(holes); n > 0 && holes[n-1].Off+holes[n-1].Len == end {
+			// An empty block between two holes.
+			holes[n-1].Len += next - end
+			continue
+		}
+		holes = append(holes, FileHole{Off: end, Len: next - end})
+	}
+	return holes, nil
+}
+
+// punchHoleLocked turns the given range of the file into zeros, and
+// drops as much of the block data behind the range as it can, leaving
+// holes in its place.  The first child block always starts at offset
+// 0, and the last one always ends at the end of the file, so those
+// can't be shifted or removed; any part of the range that can't be
+// turned into a hole is overwritten with zeros instead.  Returns the
+// set of newly-ID'd blocks created during this operation that might
+// need to be cleaned up if it is deferred.
+func (fbo *folderBlockOps) punchHoleLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file path, off, length uint64) (*WriteRange, []BlockPointer, int64, error) {
+	if jServer, err := GetJournalServer(fbo.config); err == nil {
+		jServer.dirtyOpStart(fbo.id())
+		defer jServer.dirtyOpEnd(fbo.id())
+	}
+
+	fblock, _, err := fbo.writeGetFileLocked(ctx, lState, kmd, file)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, file)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	end := off + length
+	if end > de.Size || end < off {
+		end = de.Size
+	}
+	if off >= end {
+		return nil, nil, 0, nil
+	}
+
+	var dirtyPtrs []BlockPointer
+	var newlyDirtiedChildBytes int64
+	type zeroRange struct {
+		off, len uint64
+	}
+	var zeros []zeroRange
+	if !fblock.IsInd {
+		zeros = append(zeros, zeroRange{off, end - off})
+	} else {
+		si, err := fbo.getOrCreateSyncInfoLocked(lState, de)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		df := fbo.getOrCreateDirtyFileLocked(lState, file)
+		dirtyBcache := fbo.config.DirtyBlockCache()
+
+		newIPtrs := make([]IndirectFilePtr, 0, len(fblock.IPtrs))
+		for i, iptr := range fblock.IPtrs {
+			if uint64(iptr.Off) >= end || (i < len(fblock.IPtrs)-1 &&
+				uint64(fblock.IPtrs[i+1].Off) <= off) {
+				// Avoid fetching blocks that can't overlap the range.
+				newIPtrs = append(newIPtrs, iptr)
+				continue
+			}
+			block, err := fbo.getFileBlockLocked(
+				ctx, lState, kmd, iptr.BlockPointer, file, blockWrite)
+			if err != nil {
+				return nil, dirtyPtrs, newlyDirtiedChildBytes, err
+			}
+			start := uint64(iptr.Off)
+			blockEnd := start + uint64(len(block.Contents))
+			ovStart, ovEnd := start, blockEnd
+			if off > ovStart {
+				ovStart = off
+			}
+			if end < ovEnd {
+				ovEnd = end
+			}
+			if ovStart >= ovEnd {
+				newIPtrs = append(newIPtrs, iptr)
+				continue
+			}
+
+			oldLen := len(block.Contents)
+			wasDirty := dirtyBcache.IsDirty(fbo.id(), iptr.BlockPointer,
+				file.Branch)
+			switch {
+			case i == len(fblock.IPtrs)-1:
+				zeros = append(zeros, zeroRange{ovStart, ovEnd - ovStart})
+				newIPtrs = append(newIPtrs, iptr)
+				continue
+			case i > 0 && ovStart == start && ovEnd == blockEnd:
+				// The whole block is in the range, so drop it.  Like
+				// the blocks a truncate drops, its dirty bytes will
+				// never be synced.
+				if wasDirty {
+					newlyDirtiedChildBytes -= int64(oldLen)
+					if df.isBlockSyncing(iptr.BlockPointer) {
+						// The ongoing sync still needs it; redo the
+						// hole punch once it's done.
+						fbo.doDeferWrite = true
+					} else if err := dirtyBcache.Delete(fbo.id(),
+						iptr.BlockPointer, file.Branch); err != nil {
+						return nil, dirtyPtrs, newlyDirtiedChildBytes, err
+					}
+				}
+				// A dirty block's old version was already unref'd
+				// when it was first dirtied, and a block that has
+				// never been put has nothing to unref.
+				if iptr.EncodedSize > 0 {
+					si.unrefs = append(si.unrefs, iptr.BlockInfo)
+				}
+				continue
+			case ovEnd == blockEnd:
+				// The end of the block is in the range.
+				block.Contents = append(
+					[]byte(nil), block.Contents[:ovStart-start]...)
+			case i > 0 && ovStart == start:
+				// The start of the block is in the range.
+				block.Contents = append(
+					[]byte(nil), block.Contents[ovEnd-start:]...)
+				iptr.Off = int64(ovEnd)
+			default:
+				zeros = append(zeros, zeroRange{ovStart, ovEnd - ovStart})
+				newIPtrs = append(newIPtrs, iptr)
+				continue
+			}
+
+			newlyDirtiedChildBytes += int64(len(block.Contents))
+			if wasDirty {
+				newlyDirtiedChildBytes -= int64(oldLen)
+			}
+			si.unrefs = append(si.unrefs, iptr.BlockInfo)
+			iptr.EncodedSize = 0
+			// Keep the old block ID while it's dirty.
+			if err = fbo.cacheBlockIfNotYetDirtyLocked(lState,
+				iptr.BlockPointer, file, block); err != nil {
+				return nil, dirtyPtrs, newlyDirtiedChildBytes, err
+			}
+			dirtyPtrs = append(dirtyPtrs, iptr.BlockPointer)
+			newIPtrs = append(newIPtrs, iptr)
+		}
+		df.updateNotYetSyncingBytes(newlyDirtiedChildBytes)
+
+		// Mark every block that may now be followed by a hole, so
+		// that GetFileHoles knows which blocks to look at.
+		for i := 0; i < len(newIPtrs)-1; i++ {
+			if uint64(newIPtrs[i+1].Off) > off &&
+				uint64(newIPtrs[i].Off) < end {
+				newIPtrs[i].Holes = true
+			}
+		}
+		fblock.IPtrs = newIPtrs
+		// Always make the top block dirty, so we will sync its
+		// indirect blocks.
+		if err = fbo.cacheBlockIfNotYetDirtyLocked(lState,
+			file.tailPointer(), file, fblock); err != nil {
+			return nil, dirtyPtrs, newlyDirtiedChildBytes, err
+		}
+		dirtyPtrs = append(dirtyPtrs, file.tailPointer())
+
+		de.EncodedSize = 0
+		fbo.deCache[file.tailPointer().ref()] = de
+	}
+
+	for _, z := range zeros {
+		_, ptrs, bytes, err := fbo.writeDataLocked(
+			ctx, lState, kmd, file, make([]byte, z.len), int64(z.off))
+		dirtyPtrs = append(dirtyPtrs, ptrs...)
+		newlyDirtiedChildBytes += bytes
+		if err != nil {
+			return nil, dirtyPtrs, newlyDirtiedChildBytes, err
+		}
+	}
+
+	si, err := fbo.getOrCreateSyncInfoLocked(lState, de)
+	if err != nil {
+		return nil, dirtyPtrs, newlyDirtiedChildBytes, err
+	}
+	// To everyone else, punching a hole looks just like writing
+	// zeros over the range.
+	latestWrite := si.op.addWrite(off, end-off)
+	return &latestWrite, dirtyPtrs, newlyDirtiedChildBytes, nil
+}
+
+// PunchHole turns the given range of the given file into a hole,
+// which reads back as zeros and releases the blocks behind it where
+// possible.  The file size doesn't change, and the range is clamped
+// to the end of the file.  May block if there is too much unflushed
+// data; in that case, it will be unblocked by a future sync.
+func (fbo *folderBlockOps) PunchHole(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file Node, off, length uint64) error {
+	// The only bytes dirtied are the ones overwritten with zeros,
+	// which is at most the whole range.  Holes don't add new data to
+	// the journal, so don't let them count against its hard limits.
+	c, err := fbo.config.DirtyBlockCache().RequestPermissionToDirty(
+		journalNoNewDataContext(ctx), fbo.id(), int64(length))
+	if err != nil {
+		return err
+	}
+	defer fbo.config.DirtyBlockCache().UpdateUnsyncedBytes(fbo.id(),
+		-int64(length), false)
+	err = fbo.maybeWaitOnDeferredWrites(ctx, lState, file, c)
+	if err != nil {
+		return err
+	}
+
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	filePath, err := fbo.pathFromNodeForBlockWriteLocked(lState, file)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		fbo.doDeferWrite = false
+	}()
+
+	latestWrite, dirtyPtrs, newlyDirtiedChildBytes, err := fbo.punchHoleLocked(
+		ctx, lState, kmd, filePath, off, length)
+	if err != nil {
+		return err
+	}
+
+	if latestWrite != nil {
+		fbo.observers.localChange(ctx, file, *latestWrite)
+	}
+
+	if fbo.doDeferWrite {
+		// There's an ongoing sync, and this hole punch altered
+		// dirty blocks that are in the process of syncing.  So, we
+		// have to redo it once the sync is complete, using the new
+		// file path.
+		fbo.log.CDebugf(ctx, "Deferring a hole punch to file %v",
+			filePath.tailPointer())
+		fbo.deferredDirtyDeletes = append(fbo.deferredDirtyDeletes,
+			dirtyPtrs...)
+		fbo.deferredWrites = append(fbo.deferredWrites,
+			func(ctx context.Context, lState *lockState, kmd KeyMetadata, f path) error {
+				// We are about to re-dirty these bytes, so mark that
+				// they will no longer be synced via the old file.
+				df := fbo.getOrCreateDirtyFileLocked(lState, filePath)
+				df.updateNotYetSyncingBytes(-newlyDirtiedChildBytes)
+
+				// Punch the hole again.  We know this won't be
+				// deferred, so no need to check the new ptrs.
+				_, _, _, err := fbo.punchHoleLocked(
+					ctx, lState, kmd, f, off, length)
+				return err
+			})
+		fbo.deferredWaitBytes += newlyDirtiedChildBytes
+	}
+
+	return nil
+}
+
 // IsDirty returns whether the given file is dirty; if false is
 // returned, then the file doesn't need to be synced.
 func (fbo *folderBlockOps) IsDirty(lState *lockState, file path) bool {
@@ -1930,10 +2288,24 @@ func (fbo *folderBlockOps) ReadyBlock(ctx context.Context, kmd KeyMetadata,
 		}
 		ptr.SetWriter(uid)
 	} else {
+		dver := block.DataVersion()
+		if _, ok := block.(*FileBlock); ok {
+			// Files written with a newer splitter need a newer
+			// data version, even if the block itself doesn't.
+			if splitDver := DefaultNewBlockDataVersion(
+				fbo.config, false); splitDver > dver {
+				dver = splitDver
+			}
+		}
+		// Only blocks that were actually compressed are kept from
+		// older clients.
+		if readyBlockData.IsCompressed() && dver < CompressedBlocksDataVer {
+			dver = CompressedBlocksDataVer
+		}
 		ptr = BlockPointer{
 			ID:      id,
 			KeyGen:  kmd.LatestKeyGeneration(),
-			DataVer: block.DataVersion(),
+			DataVer: dver,
 			BlockContext: BlockContext{
 				Creator:  uid,
 				RefNonce: zeroBlockRefNonce,
@@ -2863,6 +3235,8 @@ func (fbo *folderBlockOps) setCachedAttr(
 		fileEntry.Type = realEntry.Type
 	case mtimeAttr:
 		fileEntry.Mtime = realEntry.Mtime
+	case xattrAttr:
+		fileEntry.copyXattrsFrom(*realEntry, []string{op.XattrName})
 	}
 	fileEntry.Ctime = realEntry.Ctime
 	fbo.deCache[ref] = fileEntry
@@ -9,10 +9,12 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/keybase/backoff"
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
@@ -78,6 +80,12 @@ const (
 	dirtyBytesThreshold = maxParallelBlockPuts * MaxBlockSizeBytesDefault
 	// The timeout for any background task.
 	backgroundTaskTimeout = 1 * time.Minute
+	// The maximum size of a single extended attribute value, to
+	// match Linux's XATTR_SIZE_MAX.
+	maxXattrValueBytes = 64 << 10
+	// How many files to track read offsets for, in order to detect
+	// sequential reads.
+	numReadAheadFilesToTrack = 100
 )
 
 type fboMutexLevel mutexLevel
@@ -219,11 +227,15 @@ type folderBranchOps struct {
 	// should only be taken in the following order to avoid deadlock:
 	mdWriterLock leveledMutex // taken by any method making MD modifications
 
-	// protects access to head and latestMergedRevision.
+	// protects access to head, latestMergedRevision, and squashes.
 	headLock leveledRWMutex
 	head     ImmutableRootMetadata
 	// latestMergedRevision tracks the latest heard merged revision on server
 	latestMergedRevision MetadataRevision
+	// squashes lists every squash of the unflushed MDs in the
+	// journal, oldest first, so that anything holding on to a
+	// squashed revision number can tell that it's been reused.
+	squashes []RevisionsSquashedError
 
 	blocks folderBlockOps
 
@@ -259,6 +271,16 @@ type folderBranchOps struct {
 	// The current status summary for this folder
 	status *folderBranchStatusKeeper
 
+	// offlineLock serializes switches in and out of offline mode,
+	// and protects the fields below it.  enabledJournalForOffline
+	// is set while the journal that was turned on just for offline
+	// mode is still enabled, and disablingOfflineJournal while a
+	// goroutine is waiting to turn it back off.
+	offlineLock              sync.Mutex
+	pausedJournalForOffline  bool
+	enabledJournalForOffline bool
+	disablingOfflineJournal  bool
+
 	// How to log
 	log      logger.Logger
 	deferLog logger.Logger
@@ -283,6 +305,24 @@ type folderBranchOps struct {
 	// Helper class for archiving and cleaning up the blocks for this TLF
 	fbm *folderBlockManager
 
+	// Keeps the blocks of pinned subtrees in the disk block cache
+	pinner *folderPinner
+
+	// Holds and renews the advisory file lock leases for this TLF
+	locker *folderFileLocker
+
+	// The currently-open batch, if any.  Protected by mdWriterLock.
+	batch *folderBatch
+
+	// The results of background scans for the links of hard link
+	// groups with stale hints, keyed by group ID; a nil entry means
+	// the scan is still running.  See findHardLinksLocked.
+	hardLinkRepairsLock sync.Mutex
+	hardLinkRepairs     map[string][]string
+	// How long a batch may stay open before it's aborted.  Only
+	// changed by tests.
+	maxBatchDuration time.Duration
+
 	// rekeyWithPromptTimer tracks a timed function that will try to
 	// rekey with a paper key prompt, if enough time has passed.
 	// Protected by mdWriterLock
@@ -298,6 +338,8 @@ var _ KBFSOps = (*folderBranchOps)(nil)
 
 var _ fbmHelper = (*folderBranchOps)(nil)
 
+var _ folderPinnerHelper = (*folderBranchOps)(nil)
+
 // newFolderBranchOps constructs a new folderBranchOps object.
 func newFolderBranchOps(config Config, fb FolderBranch,
 	bType branchType) *folderBranchOps {
@@ -324,6 +366,10 @@ func newFolderBranchOps(config Config, fb FolderBranch,
 
 	forceSyncChan := make(chan struct{})
 
+	// lru.New only fails for a non-positive size, and a nil cache
+	// just disables read-ahead.
+	readEnds, _ := lru.New(numReadAheadFilesToTrack)
+
 	fbo := &folderBranchOps{
 		config:       config,
 		folderBranch: fb,
@@ -346,16 +392,20 @@ func newFolderBranchOps(config Config, fb FolderBranch,
 			unrefCache: make(map[blockRef]*syncInfo),
 			deCache:    make(map[blockRef]DirEntry),
 			nodeCache:  nodeCache,
+			readEnds:   readEnds,
 		},
-		nodeCache:       nodeCache,
-		log:             log,
-		deferLog:        log.CloneWithAddedDepth(1),
-		shutdownChan:    make(chan struct{}),
-		updatePauseChan: make(chan (<-chan struct{})),
-		forceSyncChan:   forceSyncChan,
+		nodeCache:        nodeCache,
+		log:              log,
+		deferLog:         log.CloneWithAddedDepth(1),
+		shutdownChan:     make(chan struct{}),
+		updatePauseChan:  make(chan (<-chan struct{})),
+		forceSyncChan:    forceSyncChan,
+		maxBatchDuration: defaultMaxBatchDuration,
 	}
 	fbo.cr = NewConflictResolver(config, fbo)
 	fbo.fbm = newFolderBlockManager(config, fb, fbo)
+	fbo.pinner = newFolderPinner(config, fb, fbo, log)
+	fbo.locker = newFolderFileLocker(config, fb, log)
 	fbo.editHistory = NewTlfEditHistory(config, fbo, log)
 	if config.DoBackgroundFlushes() {
 		go fbo.backgroundFlusher(secondsBetweenBackgroundFlushes * time.Second)
@@ -384,6 +434,8 @@ func (fbo *folderBranchOps) Shutdown() error {
 
 		if fbo.blocks.GetState(lState) == dirtyState {
 			fbo.log.CDebugf(ctx, "Skipping state-checking due to dirty state")
+		} else if fbo.isArchived() {
+			fbo.log.CDebugf(ctx, "Skipping state-checking for archived view")
 		} else if !fbo.isMasterBranch(lState) {
 			fbo.log.CDebugf(ctx, "Skipping state-checking due to being staged")
 		} else {
@@ -403,6 +455,8 @@ func (fbo *folderBranchOps) Shutdown() error {
 	close(fbo.shutdownChan)
 	fbo.cr.Shutdown()
 	fbo.fbm.shutdown()
+	fbo.pinner.shutdown()
+	fbo.locker.shutdown()
 	fbo.editHistory.Shutdown()
 	// Wait for the update goroutine to finish, so that we don't have
 	// any races with logging during test reporting.
@@ -420,6 +474,20 @@ func (fbo *folderBranchOps) branch() BranchName {
 	return fbo.folderBranch.Branch
 }
 
+// isArchived returns true if this folder-branch is a read-only view
+// of the TLF pinned at a past revision.
+func (fbo *folderBranchOps) isArchived() bool {
+	return fbo.bType == archive
+}
+
+// isIdle returns true if none of the Nodes handed out by this
+// folder-branch are still in use, so that it can be shut down
+// without invalidating anything the caller holds onto.
+func (fbo *folderBranchOps) isIdle() bool {
+	ncs, ok := fbo.nodeCache.(*nodeCacheStandard)
+	return ok && ncs.isEmpty()
+}
+
 func (fbo *folderBranchOps) GetFavorites(ctx context.Context) (
 	[]Favorite, error) {
 	return nil, errors.New("GetFavorites is not supported by folderBranchOps")
@@ -512,7 +580,7 @@ func (fbo *folderBranchOps) checkDataVersion(p path, ptr BlockPointer) error {
 		return InvalidDataVersionError{ptr.DataVer}
 	}
 	// TODO: migrate back to fbo.config.DataVersion
-	if ptr.DataVer > FilesWithHolesDataVer {
+	if ptr.DataVer > CompressedBlocksDataVer {
 		return NewDataVersionError{p, ptr.DataVer}
 	}
 	return nil
@@ -581,6 +649,9 @@ func (fbo *folderBranchOps) setHeadLocked(
 		if fbo.branch() == MasterBranch {
 			fbo.updateDoneChan = make(chan struct{})
 			go fbo.registerAndWaitForUpdates()
+			// Catch up on any paths that were pinned in a
+			// previous run.
+			fbo.pinner.kick()
 		}
 	}
 	if !wasReadable && md.IsReadable() {
@@ -755,6 +826,27 @@ func (fbo *folderBranchOps) setHeadConflictResolvedLocked(ctx context.Context,
 	return fbo.setHeadLocked(ctx, lState, md)
 }
 
+// setHeadSquashedLocked is for when the unflushed MDs in the journal
+// have been squashed into the given one, which replaces the head.
+func (fbo *folderBranchOps) setHeadSquashedLocked(ctx context.Context,
+	lState *lockState, md ImmutableRootMetadata) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+	fbo.headLock.AssertLocked(lState)
+	if fbo.head == (ImmutableRootMetadata{}) {
+		return errors.New("Unexpected nil head in setHeadSquashedLocked")
+	}
+	if fbo.head.MergedStatus() != Merged || md.MergedStatus() != Merged {
+		return errors.New("Unexpected unmerged MD in setHeadSquashedLocked")
+	}
+	if md.Revision() > fbo.head.Revision() {
+		return fmt.Errorf("setHeadSquashedLocked unexpectedly called with "+
+			"revision %d after head revision %d", md.Revision(),
+			fbo.head.Revision())
+	}
+
+	return fbo.setHeadLocked(ctx, lState, md)
+}
+
 func (fbo *folderBranchOps) identifyOnce(
 	ctx context.Context, md ReadOnlyRootMetadata) error {
 	fbo.identifyLock.Lock()
@@ -811,6 +903,23 @@ func (fbo *folderBranchOps) getMDLocked(
 
 	fbo.mdWriterLock.AssertLocked(lState)
 
+	if fbo.isArchived() {
+		// An archived view is pinned to the revision it was
+		// created with, so never fall back to the current head.
+		return ImmutableRootMetadata{}, fmt.Errorf(
+			"Archived view %s has no revision set", fbo.folderBranch)
+	}
+
+	if fbo.isOffline() {
+		// The server can't be reached, so the best we can do is
+		// the latest revision in our journal, if any.
+		md, err = fbo.getOfflineMDLocked(ctx, lState)
+		if err != nil {
+			return ImmutableRootMetadata{}, err
+		}
+		return md, nil
+	}
+
 	// Not in cache, fetch from server and add to cache.  First, see
 	// if this device has any unmerged commits -- take the latest one.
 	mdops := fbo.config.MDOps()
@@ -858,6 +967,171 @@ func (fbo *folderBranchOps) getMDLocked(
 	return md, nil
 }
 
+// getOfflineMDLocked sets the head to the latest revision in this
+// TLF's journal, for use while offline.  Without a journal head, it
+// falls back to the last merged revision we heard about, if it's
+// still in the MD cache.
+func (fbo *folderBranchOps) getOfflineMDLocked(
+	ctx context.Context, lState *lockState) (ImmutableRootMetadata, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	md, err := fbo.getOfflineJournalMD(ctx)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+	if md != (ImmutableRootMetadata{}) {
+		fbo.log.CDebugf(ctx, "Offline; using revision %d from the journal",
+			md.Revision())
+	} else {
+		rev := fbo.getLatestMergedRevision(lState)
+		if rev == MetadataRevisionUninitialized {
+			return ImmutableRootMetadata{}, OfflineUnavailableError{fbo.id()}
+		}
+		md, err = fbo.config.MDCache().Get(fbo.id(), rev, NullBranchID)
+		if err != nil {
+			fbo.log.CDebugf(ctx, "Revision %d isn't cached: %v", rev, err)
+			return ImmutableRootMetadata{}, OfflineUnavailableError{fbo.id()}
+		}
+		fbo.log.CDebugf(ctx, "Offline; using cached revision %d", rev)
+	}
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	err = fbo.setInitialHeadTrustedLocked(ctx, lState, md)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+	return md, nil
+}
+
+// getOfflineJournalMD returns the latest revision in this TLF's
+// journal, preferring this device's unmerged branch like when online.
+// It returns an empty MD if there's no journal or it has no MDs.
+func (fbo *folderBranchOps) getOfflineJournalMD(ctx context.Context) (
+	ImmutableRootMetadata, error) {
+	jServer, err := GetJournalServer(fbo.config)
+	if err != nil {
+		return ImmutableRootMetadata{}, nil
+	}
+	md, err := jServer.mdOps().getHeadFromJournal(
+		ctx, fbo.id(), NullBranchID, Unmerged, nil)
+	if err != nil || md != (ImmutableRootMetadata{}) {
+		return md, err
+	}
+	return jServer.mdOps().getHeadFromJournal(
+		ctx, fbo.id(), NullBranchID, Merged, nil)
+}
+
+// isOffline returns whether the mdserver is currently unreachable.
+func (fbo *folderBranchOps) isOffline() bool {
+	return fbo.status.isOffline()
+}
+
+// setOffline switches this folder-branch in or out of offline mode.
+// While offline, reads are served from the last known head and from
+// cached or journaled blocks, and writes go to the journal (if
+// journaling is available) with flushing paused until the mdserver
+// comes back.
+func (fbo *folderBranchOps) setOffline(ctx context.Context, offline bool) {
+	fbo.offlineLock.Lock()
+	defer fbo.offlineLock.Unlock()
+
+	if !fbo.status.setOffline(offline) {
+		return
+	}
+	fbo.log.CDebugf(ctx, "Offline mode: %t", offline)
+
+	if fbo.isArchived() {
+		return
+	}
+	jServer, err := GetJournalServer(fbo.config)
+	if err != nil {
+		if offline {
+			fbo.log.CDebugf(ctx, "No journal server; writes will fail "+
+				"until the mdserver is reachable")
+		}
+		return
+	}
+
+	if !offline {
+		if fbo.pausedJournalForOffline {
+			jServer.ResumeBackgroundWork(ctx, fbo.id())
+			fbo.pausedJournalForOffline = false
+		}
+		if fbo.enabledJournalForOffline && !fbo.disablingOfflineJournal {
+			fbo.disablingOfflineJournal = true
+			go fbo.disableOfflineJournal(jServer)
+		}
+		return
+	}
+
+	if _, err := jServer.JournalStatus(fbo.id()); err == nil {
+		jServer.PauseBackgroundWork(ctx, fbo.id())
+	} else {
+		err := jServer.Enable(
+			ctx, fbo.id(), TLFJournalBackgroundWorkPaused)
+		if err != nil {
+			fbo.log.CWarningf(ctx, "Couldn't enable the journal while "+
+				"offline: %v", err)
+			return
+		}
+		fbo.enabledJournalForOffline = true
+	}
+	fbo.pausedJournalForOffline = true
+}
+
+// offlineJournalDisableRetry is how long to wait before trying again
+// to turn off a journal that was enabled just for offline mode, when
+// it still has dirty data.
+const offlineJournalDisableRetry = 1 * time.Second
+
+// disableOfflineJournal waits for the journal that was enabled just
+// for offline mode to flush, and then turns it back off.  It gives up
+// if the mdserver becomes unreachable again in the meantime; the next
+// reconnection tries again.
+func (fbo *folderBranchOps) disableOfflineJournal(jServer *JournalServer) {
+	err := fbo.runUnlessShutdown(func(ctx context.Context) error {
+		for {
+			err := jServer.Wait(ctx, fbo.id())
+			if err != nil {
+				return err
+			}
+
+			done, err := func() (bool, error) {
+				fbo.offlineLock.Lock()
+				defer fbo.offlineLock.Unlock()
+				if fbo.isOffline() {
+					return true, nil
+				}
+				_, err := jServer.Disable(ctx, fbo.id())
+				if err != nil {
+					return false, err
+				}
+				fbo.enabledJournalForOffline = false
+				return true, nil
+			}()
+			if done {
+				return nil
+			}
+			fbo.log.CDebugf(ctx, "Couldn't turn off the offline journal "+
+				"yet: %v", err)
+
+			select {
+			case <-time.After(offlineJournalDisableRetry):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+	if err != nil {
+		fbo.log.CDebugf(context.Background(),
+			"Gave up on turning off the offline journal: %v", err)
+	}
+
+	fbo.offlineLock.Lock()
+	defer fbo.offlineLock.Unlock()
+	fbo.disablingOfflineJournal = false
+}
+
 func (fbo *folderBranchOps) getMDForReadHelper(
 	ctx context.Context, lState *lockState, rtype mdReqType) (ImmutableRootMetadata, error) {
 	md, err := fbo.getMDLocked(ctx, lState, rtype)
@@ -949,6 +1223,10 @@ func (fbo *folderBranchOps) getMDForWriteLockedForFilename(
 	ctx context.Context, lState *lockState, filename string) (*RootMetadata, error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
+	if fbo.isArchived() {
+		return nil, WriteToReadonlyNodeError{filename}
+	}
+
 	md, err := fbo.getMDLocked(ctx, lState, mdWrite)
 	if err != nil {
 		return nil, err
@@ -962,6 +1240,12 @@ func (fbo *folderBranchOps) getMDForWriteLockedForFilename(
 		return nil, NewWriteAccessError(md.GetTlfHandle(), username, filename)
 	}
 
+	if fbo.batch != nil && fbo.batch.isPendingLocked(lState) {
+		// Writes in a batch keep adding to its pending MD, which
+		// has no MD ID to make a successor from yet.
+		return fbo.batch.md.deepCopy(fbo.config.Codec(), true)
+	}
+
 	// Make a new successor of the current MD to hold the coming
 	// writes.  The caller must pass this into
 	// syncBlockAndCheckEmbedLocked or the changes will be lost.
@@ -1176,6 +1460,18 @@ func (fbo *folderBranchOps) GetRootNode(
 	return nil, EntryInfo{}, errors.New("GetRootNode is not supported by folderBranchOps")
 }
 
+func (fbo *folderBranchOps) GetArchivedRootNode(
+	ctx context.Context, h *TlfHandle, rev MetadataRevision) (
+	node Node, ei EntryInfo, err error) {
+	return nil, EntryInfo{}, errors.New("GetArchivedRootNode is not supported by folderBranchOps")
+}
+
+func (fbo *folderBranchOps) GetRevisionForTime(
+	ctx context.Context, h *TlfHandle, t time.Time) (
+	MetadataRevision, error) {
+	return MetadataRevisionUninitialized, errors.New("GetRevisionForTime is not supported by folderBranchOps")
+}
+
 func (fbo *folderBranchOps) checkNode(node Node) error {
 	fb := node.GetFolderBranch()
 	if fb != fbo.folderBranch {
@@ -1213,6 +1509,12 @@ func (fbo *folderBranchOps) SetInitialHeadFromServer(
 
 	return runUnlessCanceled(ctx, func() error {
 		fb := FolderBranch{md.TlfID(), MasterBranch}
+		if fbo.isArchived() {
+			if md.MergedStatus() != Merged {
+				return errors.New("Can't archive an unmerged revision")
+			}
+			fb.Branch = MakeRevBranchName(md.Revision())
+		}
 		if fb != fbo.folderBranch {
 			return WrongOpsError{fbo.folderBranch, fb}
 		}
@@ -1466,6 +1768,7 @@ func (fbo *folderBranchOps) Lookup(ctx context.Context, dir Node, name string) (
 		if err != nil {
 			return err
 		}
+		de.Nlink = md.data.hardLinkCount(de.HardLink)
 
 		if de.Type == Sym {
 			node = nil
@@ -1522,7 +1825,7 @@ func (fbo *folderBranchOps) statEntry(ctx context.Context, node Node) (
 		if err != nil {
 			return DirEntry{}, err
 		}
-
+		de.Nlink = md.data.hardLinkCount(de.HardLink)
 	} else {
 		// nodePath is just the root.
 		de = md.data.Dir
@@ -1547,6 +1850,12 @@ func (fbo *folderBranchOps) Stat(ctx context.Context, node Node) (
 
 	var de DirEntry
 	err = runUnlessCanceled(ctx, func() error {
+		// Include the group's unsynced writes, if the node is
+		// hard-linked.
+		node, err := fbo.hardLinkTarget(ctx, makeFBOLockState(), node)
+		if err != nil {
+			return err
+		}
 		de, err = fbo.statEntry(ctx, node)
 		return err
 	})
@@ -1629,6 +1938,15 @@ func (fbo *folderBranchOps) readyBlockMultiple(ctx context.Context,
 	return
 }
 
+// readiedBlock is a block that has already been readied by
+// readyBlockMultiple, and which syncBlock should use as is, rather
+// than readying it again.
+type readiedBlock struct {
+	Block
+	info      BlockInfo
+	plainSize int
+}
+
 func (fbo *folderBranchOps) unembedBlockChanges(
 	ctx context.Context, bps *blockPutState, md *RootMetadata,
 	changes *BlockChanges, uid keybase1.UID) (err error) {
@@ -1661,7 +1979,8 @@ type localBcache map[BlockPointer]*DirBlock
 // previous syncBlock calls or the FS calls themselves.  It returns
 // the updated path to the changed directory, the new or updated
 // directory entry created as part of the call, and a summary of all
-// the blocks that now must be put to the block server.
+// the blocks that now must be put to the block server.  If newBlock
+// is a readiedBlock, its existing block info is used.
 //
 // This function is safe to use unlocked, but may modify MD to have
 // the same revision number as another one. All functions in this file
@@ -1692,10 +2011,17 @@ func (fbo *folderBranchOps) syncBlock(
 	doSetTime := true
 	now := fbo.nowUnixNano()
 	for len(newPath.path) < len(dir.path)+1 {
-		info, plainSize, err := fbo.readyBlockMultiple(
-			ctx, md.ReadOnly(), currBlock, uid, bps)
-		if err != nil {
-			return path{}, DirEntry{}, nil, err
+		var info BlockInfo
+		var plainSize int
+		var err error
+		if rb, ok := currBlock.(readiedBlock); ok {
+			info, plainSize = rb.info, rb.plainSize
+		} else {
+			info, plainSize, err = fbo.readyBlockMultiple(
+				ctx, md.ReadOnly(), currBlock, uid, bps)
+			if err != nil {
+				return path{}, DirEntry{}, nil, err
+			}
 		}
 
 		// prepend to path and setup next one
@@ -1874,19 +2200,32 @@ func (fbo *folderBranchOps) syncBlockAndCheckEmbedLocked(ctx context.Context,
 	// Do the block changes need their own blocks?  Unembed only if
 	// this is the final call to this function with this MD.
 	if stopAt == zeroPtr {
-		bsplit := fbo.config.BlockSplitter()
-		if !bsplit.ShouldEmbedBlockChanges(&md.data.Changes) {
-			err = fbo.unembedBlockChanges(ctx, bps, md, &md.data.Changes,
-				uid)
-			if err != nil {
-				return path{}, DirEntry{}, nil, err
-			}
+		err = fbo.unembedBlockChangesIfNeeded(ctx, bps, md, uid)
+		if err != nil {
+			return path{}, DirEntry{}, nil, err
 		}
 	}
 
 	return newPath, newDe, bps, nil
 }
 
+// unembedBlockChangesIfNeeded moves the block changes of md into
+// their own block, if they're too big to be embedded.  It must only
+// be called once all the changes have been added to md.  The changes
+// of an open batch are only unembedded when it's committed.
+func (fbo *folderBranchOps) unembedBlockChangesIfNeeded(
+	ctx context.Context, bps *blockPutState, md *RootMetadata,
+	uid keybase1.UID) error {
+	if fbo.batch != nil && !fbo.batch.committing {
+		return nil
+	}
+	bsplit := fbo.config.BlockSplitter()
+	if bsplit.ShouldEmbedBlockChanges(&md.data.Changes) {
+		return nil
+	}
+	return fbo.unembedBlockChanges(ctx, bps, md, &md.data.Changes, uid)
+}
+
 // Returns whether the given error is one that shouldn't block the
 // removal of a file or directory.
 //
@@ -1982,6 +2321,18 @@ func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
 	// have already succeeded. Returning EINTR makes application thinks the file
 	// is not created successfully.
 
+	if fbo.batch != nil && !fbo.batch.committing {
+		// Writes in an open batch only become part of its pending
+		// MD, which is put as a single revision when the batch is
+		// committed.  Exclusive creates can't be checked against
+		// the server until then.
+		if excl == WithExcl {
+			fbo.log.CDebugf(ctx, "Exclusive create status is being "+
+				"discarded in a batch.")
+		}
+		return fbo.batch.addLocked(ctx, lState, md, bps)
+	}
+
 	if fbo.isMasterBranchLocked(lState) {
 		// only do a normal Put if we're not already staged.
 		mdID, err = mdops.Put(ctx, md)
@@ -2063,6 +2414,12 @@ func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
 		fbo.fbm.archiveUnrefBlocks(irmd.ReadOnly())
 	}
 
+	if fbo.batch != nil {
+		// The ops of a committed batch were already sent out as
+		// they were made.
+		fbo.editHistory.UpdateHistory(ctx, []ImmutableRootMetadata{irmd})
+		return nil
+	}
 	fbo.notifyBatchLocked(ctx, lState, irmd)
 	return nil
 }
@@ -2236,6 +2593,10 @@ func (fbo *folderBranchOps) syncBlockAndFinalizeLocked(ctx context.Context,
 }
 
 func checkDisallowedPrefixes(name string) error {
+	if name == ConflictPolicyFileName {
+		// Users pick the conflict policy by writing this file.
+		return nil
+	}
 	for _, prefix := range disallowedPrefixes {
 		if strings.HasPrefix(name, prefix) {
 			return DisallowedPrefixError{name, prefix}
@@ -2364,6 +2725,37 @@ func (fbo *folderBranchOps) createEntryLocked(
 	return node, de, nil
 }
 
+// lockMDWriterOutsideBatch takes mdWriterLock for an MD write made
+// with the given context.  If a batch is open and ctx doesn't belong
+// to it, it first waits for the batch to close, so that only the
+// batch's own caller writes into it.  That wait is bounded, since a
+// batch is aborted once it's been open for fbo.maxBatchDuration.
+// Writes made with the context of an expired batch fail with
+// BatchExpiredError rather than landing outside of it.
+func (fbo *folderBranchOps) lockMDWriterOutsideBatch(ctx context.Context,
+	lState *lockState) error {
+	for {
+		fbo.mdWriterLock.Lock(lState)
+		owner, ok := ctx.Value(ctxBatchKey).(*folderBatch)
+		if ok && owner.fbo == fbo && owner.expired {
+			fbo.mdWriterLock.Unlock(lState)
+			return BatchExpiredError{fbo.id()}
+		}
+		batch := fbo.batch
+		if batch == nil || batch.includes(ctx) {
+			return nil
+		}
+		fbo.mdWriterLock.Unlock(lState)
+
+		fbo.log.CDebugf(ctx, "Waiting for the open batch to close")
+		select {
+		case <-batch.doneCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
 func (fbo *folderBranchOps) doMDWriteWithRetry(ctx context.Context,
 	lState *lockState, fn func(lState *lockState) error) error {
 	doUnlock := false
@@ -2374,7 +2766,10 @@ func (fbo *folderBranchOps) doMDWriteWithRetry(ctx context.Context,
 	}()
 
 	for i := 0; ; i++ {
-		fbo.mdWriterLock.Lock(lState)
+		err := fbo.lockMDWriterOutsideBatch(ctx, lState)
+		if err != nil {
+			return err
+		}
 		doUnlock = true
 
 		// Make sure we haven't been canceled before doing anything
@@ -2385,7 +2780,7 @@ func (fbo *folderBranchOps) doMDWriteWithRetry(ctx context.Context,
 		default:
 		}
 
-		err := fn(lState)
+		err = fn(lState)
 		if isRetriableError(err, i) {
 			fbo.log.CDebugf(ctx, "Trying again after retriable error: %v", err)
 			// Release the lock to give someone else a chance
@@ -2623,86 +3018,629 @@ func (fbo *folderBranchOps) CreateLink(
 	return retEntryInfo, nil
 }
 
-// unrefEntry modifies md to unreference all relevant blocks for the
-// given entry.
-func (fbo *folderBranchOps) unrefEntry(ctx context.Context,
-	lState *lockState, md *RootMetadata, dir path, de DirEntry,
-	name string) error {
-	md.AddUnrefBlock(de.BlockInfo)
-	// construct a path for the child so we can unlink with it.
-	childPath := dir.ChildPath(name, de.BlockPointer)
+// copyFileChildBlocksLocked returns a copy of the top block of the
+// file at srcPath, along with a blockPutState containing new
+// references to all of its child blocks.  Unless journaling is
+// enabled, the children are shared with the source file by giving
+// them new reference nonces, rather than being re-uploaded.  The top
+// block itself still needs to be readied by the caller.
+func (fbo *folderBranchOps) copyFileChildBlocksLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, uid keybase1.UID, srcPath path) (
+	*FileBlock, *blockPutState, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
 
-	// If this is an indirect block, we need to delete all of its
-	// children as well. NOTE: non-empty directories can't be
-	// removed, so no need to check for indirect directory blocks
-	// here.
-	if de.Type == File || de.Type == Exec {
-		blockInfos, err := fbo.blocks.GetIndirectFileBlockInfos(
-			ctx, lState, md.ReadOnly(), childPath)
-		if isRecoverableBlockErrorForRemoval(err) {
-			msg := fmt.Sprintf("Recoverable block error encountered for unrefEntry(%v); continuing", childPath)
-			fbo.log.CWarningf(ctx, "%s", msg)
-			fbo.log.CDebugf(ctx, "%s (err=%v)", msg, err)
-		} else if err != nil {
-			return err
-		}
-		for _, blockInfo := range blockInfos {
-			md.AddUnrefBlock(blockInfo)
-		}
+	fblock, err := fbo.blocks.GetFileBlockForReading(ctx, lState,
+		md.ReadOnly(), srcPath.tailPointer(), srcPath.Branch, srcPath)
+	if err != nil {
+		return nil, nil, err
 	}
-	return nil
+	fblock, err = fblock.DeepCopy(fbo.config.Codec())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bps := newBlockPutState(len(fblock.IPtrs) + 1)
+	err = fbo.refFileChildBlocksLocked(
+		ctx, lState, md, uid, srcPath, fblock, nil, bps)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fblock, bps, nil
 }
 
-func (fbo *folderBranchOps) removeEntryLocked(ctx context.Context,
-	lState *lockState, md *RootMetadata, dir path, name string) error {
+// refFileChildBlocksLocked makes new references to all of the child
+// blocks of fblock, a copy of the top block of srcPath, and points
+// fblock at them.  Children found in newBlocks haven't been put yet,
+// and so are readied again as new blocks instead.
+func (fbo *folderBranchOps) refFileChildBlocksLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, uid keybase1.UID, srcPath path,
+	fblock *FileBlock, newBlocks map[BlockPointer]Block,
+	bps *blockPutState) error {
 	fbo.mdWriterLock.AssertLocked(lState)
 
-	pblock, err := fbo.blocks.GetDir(
-		ctx, lState, md.ReadOnly(), dir, blockWrite)
-	if err != nil {
-		return err
+	if !fblock.IsInd {
+		return nil
 	}
+	journalEnabled := TLFJournalEnabled(fbo.config, fbo.id())
+	for i, iptr := range fblock.IPtrs {
+		childBlock, isNew := newBlocks[iptr.BlockPointer]
+		// If journaling is enabled, new references aren't
+		// supported.  We have to fetch each block and ready
+		// it.  TODO: remove this when KBFS-1149 is fixed.
+		if journalEnabled || isNew {
+			if !isNew {
+				var err error
+				childBlock, err = fbo.blocks.GetFileBlockForReading(
+					ctx, lState, md.ReadOnly(), iptr.BlockPointer,
+					srcPath.Branch, srcPath)
+				if err != nil {
+					return err
+				}
+			}
+			info, _, err := fbo.readyBlockMultiple(
+				ctx, md.ReadOnly(), childBlock, uid, bps)
+			if err != nil {
+				return err
+			}
+			fblock.IPtrs[i].BlockInfo = info
+			md.AddRefBlock(info)
+			continue
+		}
 
-	// make sure the entry exists
-	de, ok := pblock.Children[name]
-	if !ok {
-		return NoSuchNameError{name}
+		var err error
+		iptr.RefNonce, err = fbo.config.Crypto().MakeBlockRefNonce()
+		if err != nil {
+			return err
+		}
+		iptr.SetWriter(uid)
+		fblock.IPtrs[i] = iptr
+		bps.addNewBlock(iptr.BlockPointer, nil, ReadyBlockData{}, nil)
+		md.AddRefBlock(iptr.BlockInfo)
 	}
+	return nil
+}
 
-	ro, err := newRmOp(name, dir.tailPointer())
-	if err != nil {
-		return err
-	}
-	md.AddOp(ro)
-	err = fbo.unrefEntry(ctx, lState, md, dir, de, name)
+// copyFileBlocksLocked makes new references to all of the blocks of
+// the file at srcPath, whose top block is srcInfo, and returns the
+// info for the new top block.  A direct top block is shared with the
+// source like the children are, while an indirect one points at new
+// references and so has to be readied again.
+func (fbo *folderBranchOps) copyFileBlocksLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, uid keybase1.UID, srcPath path,
+	srcInfo BlockInfo) (BlockInfo, *blockPutState, error) {
+	fblock, bps, err := fbo.copyFileChildBlocksLocked(
+		ctx, lState, md, uid, srcPath)
 	if err != nil {
-		return err
+		return BlockInfo{}, nil, err
 	}
 
-	// the actual unlink
-	delete(pblock.Children, name)
+	// If journaling is enabled, new references aren't supported,
+	// so the block has to be readied again.  TODO: remove this when
+	// KBFS-1149 is fixed.
+	if !fblock.IsInd && !TLFJournalEnabled(fbo.config, fbo.id()) {
+		info := srcInfo
+		info.RefNonce, err = fbo.config.Crypto().MakeBlockRefNonce()
+		if err != nil {
+			return BlockInfo{}, nil, err
+		}
+		info.SetWriter(uid)
+		bps.addNewBlock(info.BlockPointer, nil, ReadyBlockData{}, nil)
+		md.AddRefBlock(info)
+		return info, bps, nil
+	}
 
-	// sync the parent directory
-	_, err = fbo.syncBlockAndFinalizeLocked(
-		ctx, lState, md, pblock, *dir.parentPath(), dir.tailName(),
-		Dir, true, true, zeroPtr, NoExcl)
+	// The indirect top block is small, so just ready it again.
+	info, _, err := fbo.readyBlockMultiple(
+		ctx, md.ReadOnly(), fblock, uid, bps)
 	if err != nil {
-		return err
+		return BlockInfo{}, nil, err
 	}
-	return nil
+	md.AddRefBlock(info)
+	return info, bps, nil
 }
 
-func (fbo *folderBranchOps) removeDirLocked(ctx context.Context,
-	lState *lockState, dir Node, dirName string) (err error) {
+// syncForCopyLocked syncs any outstanding writes to the given file
+// node, so that they make it into a copy, and returns its path.
+func (fbo *folderBranchOps) syncForCopyLocked(
+	ctx context.Context, lState *lockState, node Node) (path, error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
-	// verify we have permission to write
-	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	p, err := fbo.pathFromNodeForMDWriteLocked(lState, node)
 	if err != nil {
-		return err
+		return path{}, err
+	}
+	if !fbo.blocks.IsDirty(lState, p) {
+		return p, nil
 	}
 
-	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	stillDirty, err := fbo.syncLocked(ctx, lState, p)
+	if err != nil {
+		return path{}, err
+	}
+	if !stillDirty {
+		fbo.status.rmDirtyNode(node)
+	}
+	return fbo.pathFromNodeForMDWriteLocked(lState, node)
+}
+
+// copyFileLocked makes a new file named name in dstDir, sharing all
+// of the blocks of src.  If hardLink is true, the new file is also
+// added to the hard link group of src, so that future writes to
+// either one are reflected in the other.
+func (fbo *folderBranchOps) copyFileLocked(
+	ctx context.Context, lState *lockState, src Node, dstDir Node,
+	name string, hardLink bool) (Node, DirEntry, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if err := checkDisallowedPrefixes(name); err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	if uint32(len(name)) > fbo.config.MaxNameBytes() {
+		return nil, DirEntry{},
+			NameTooLongError{name, fbo.config.MaxNameBytes()}
+	}
+
+	srcPath, err := fbo.syncForCopyLocked(ctx, lState, src)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	filename, err := fbo.canonicalPath(ctx, dstDir, name)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, filename)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	srcEntry, err := fbo.blocks.GetDirtyEntry(
+		ctx, lState, md.ReadOnly(), srcPath)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	if srcEntry.Type != File && srcEntry.Type != Exec {
+		return nil, DirEntry{}, NotFileError{srcPath}
+	}
+
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dstDir)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), dirPath, blockWrite)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	// does name already exist?
+	if _, ok := dblock.Children[name]; ok {
+		return nil, DirEntry{}, NameExistsError{name}
+	}
+
+	if err := fbo.checkNewDirSize(
+		ctx, lState, md.ReadOnly(), dirPath, name); err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	co, err := newCreateOp(name, dirPath.tailPointer(), srcEntry.Type)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	md.AddOp(co)
+
+	info, fileBps, err := fbo.copyFileBlocksLocked(
+		ctx, lState, md, uid, srcPath, srcEntry.BlockInfo)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	now := fbo.nowUnixNano()
+	de := DirEntry{
+		BlockInfo: info,
+		EntryInfo: EntryInfo{
+			Type:  srcEntry.Type,
+			Size:  srcEntry.Size,
+			Mtime: now,
+			Ctime: now,
+		},
+		// The map is never modified in place, so it can be shared.
+		Xattrs: srcEntry.Xattrs,
+	}
+	lbc := localBcache{dirPath.tailPointer(): dblock}
+	var srcDirs []path
+	if hardLink {
+		// All links share a single mtime.
+		de.Mtime = srcEntry.Mtime
+		id := srcEntry.HardLink
+		if id == "" {
+			// Tag the source entry with the new group ID, in
+			// this same revision.
+			id = md.data.newHardLinkGroupID(srcEntry.ID.String())
+			srcDir := *srcPath.parentPath()
+			sblock, err := fbo.getDirForHardLinksLocked(
+				ctx, lState, md, srcDir, lbc, blockWrite)
+			if err != nil {
+				return nil, DirEntry{}, err
+			}
+			sde, ok := sblock.Children[srcPath.tailName()]
+			if !ok {
+				return nil, DirEntry{}, NoSuchNameError{srcPath.tailName()}
+			}
+			sde.HardLink = id
+			sblock.Children[srcPath.tailName()] = sde
+			srcDirs = append(srcDirs, srcDir)
+		}
+		if md.data.hardLinkCount(id) == 0 {
+			md.data.addHardLink(id, hardLinkPath(srcPath))
+		}
+		md.data.addHardLink(id, hardLinkPath(dirPath.ChildPathNoPtr(name)))
+		de.HardLink = id
+	}
+	dblock.Children[name] = de
+
+	err = fbo.readyHardLinkDirsLocked(
+		ctx, lState, md, uid, dirPath, srcDirs, lbc, fileBps)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	_, _, bps, err := fbo.syncBlockAndCheckEmbedLocked(
+		ctx, lState, md, dblock, *dirPath.parentPath(), dirPath.tailName(),
+		Dir, true, true, zeroPtr, lbc)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	bps.mergeOtherBps(fileBps)
+
+	defer func() {
+		if err != nil {
+			fbo.fbm.cleanUpBlockState(
+				md.ReadOnly(), bps, blockDeleteOnMDFail)
+		}
+	}()
+
+	_, err = doBlockPuts(ctx, fbo.config.BlockServer(),
+		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, md.TlfID(),
+		md.GetTlfHandle().GetCanonicalName(), *bps)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	err = fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	node, err := fbo.nodeCache.GetOrCreate(de.BlockPointer, name, dstDir)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	de.Nlink = md.data.hardLinkCount(de.HardLink)
+	return node, de, nil
+}
+
+func (fbo *folderBranchOps) CopyFile(
+	ctx context.Context, src Node, dstDir Node, name string) (
+	n Node, ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "CopyFile %p -> %p %s",
+		src.GetID(), dstDir.GetID(), name)
+	defer func() {
+		if err != nil {
+			fbo.deferLog.CDebugf(ctx, "Error: %v", err)
+		} else {
+			fbo.deferLog.CDebugf(ctx, "Done: %p", n.GetID())
+		}
+	}()
+
+	err = fbo.checkNode(src)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	err = fbo.checkNode(dstDir)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	var retNode Node
+	var retEntryInfo EntryInfo
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			// Don't set node and ei directly, as that can cause a
+			// race when the copy is canceled.
+			node, de, err := fbo.copyFileLocked(
+				ctx, lState, src, dstDir, name, false)
+			if err != nil {
+				return err
+			}
+			retNode = node
+			retEntryInfo = de.EntryInfo
+			return nil
+		})
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return retNode, retEntryInfo, nil
+}
+
+// copyFileIntoLocked replaces the contents of the empty file dst
+// with the contents of src, sharing all of the blocks of src.
+func (fbo *folderBranchOps) copyFileIntoLocked(
+	ctx context.Context, lState *lockState, src Node, dst Node) (
+	size uint64, err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	srcPath, err := fbo.syncForCopyLocked(ctx, lState, src)
+	if err != nil {
+		return 0, err
+	}
+	dstPath, err := fbo.syncForCopyLocked(ctx, lState, dst)
+	if err != nil {
+		return 0, err
+	}
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLockedForFilename(
+		ctx, lState, dstPath.tailName())
+	if err != nil {
+		return 0, err
+	}
+
+	srcEntry, err := fbo.blocks.GetDirtyEntry(
+		ctx, lState, md.ReadOnly(), srcPath)
+	if err != nil {
+		return 0, err
+	}
+	if srcEntry.Type != File && srcEntry.Type != Exec {
+		return 0, NotFileError{srcPath}
+	}
+	dstEntry, err := fbo.blocks.GetDirtyEntry(
+		ctx, lState, md.ReadOnly(), dstPath)
+	if err != nil {
+		return 0, err
+	}
+	if dstEntry.Type != File && dstEntry.Type != Exec {
+		return 0, NotFileError{dstPath}
+	}
+	if dstEntry.Size != 0 {
+		return 0, CopyIntoNonEmptyFileError{dstPath.tailName()}
+	}
+	dstBlock, err := fbo.blocks.GetFileBlockForReading(ctx, lState,
+		md.ReadOnly(), dstPath.tailPointer(), dstPath.Branch, dstPath)
+	if err != nil {
+		return 0, err
+	}
+	if dstBlock.IsInd {
+		// An indirect file truncated to nothing still has
+		// children that would need to be unreferenced.
+		return 0, CopyIntoNonEmptyFileError{dstPath.tailName()}
+	}
+
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	so, err := newSyncOp(dstPath.tailPointer())
+	if err != nil {
+		return 0, err
+	}
+	so.addWrite(0, srcEntry.Size)
+	md.AddOp(so)
+
+	fblock, fileBps, err := fbo.copyFileChildBlocksLocked(
+		ctx, lState, md, uid, srcPath)
+	if err != nil {
+		return 0, err
+	}
+
+	// syncBlock readies the new top block and swaps it into the
+	// parent's entry for dst, which also updates the sync op.  Set
+	// the new size in the parent block it will use.
+	dirPath := *dstPath.parentPath()
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), dirPath, blockWrite)
+	if err != nil {
+		return 0, err
+	}
+	de := dblock.Children[dstPath.tailName()]
+	de.Size = srcEntry.Size
+	dblock.Children[dstPath.tailName()] = de
+	lbc := localBcache{dirPath.tailPointer(): dblock}
+
+	_, _, bps, err := fbo.syncBlockAndCheckEmbedLocked(
+		ctx, lState, md, fblock, dirPath, dstPath.tailName(),
+		dstEntry.Type, true, true, zeroPtr, lbc)
+	if err != nil {
+		return 0, err
+	}
+	bps.mergeOtherBps(fileBps)
+
+	defer func() {
+		if err != nil {
+			fbo.fbm.cleanUpBlockState(
+				md.ReadOnly(), bps, blockDeleteOnMDFail)
+		}
+	}()
+
+	_, err = doBlockPuts(ctx, fbo.config.BlockServer(),
+		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, md.TlfID(),
+		md.GetTlfHandle().GetCanonicalName(), *bps)
+	if err != nil {
+		return 0, err
+	}
+	err = fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl)
+	if err != nil {
+		return 0, err
+	}
+	return srcEntry.Size, nil
+}
+
+func (fbo *folderBranchOps) CopyFileInto(
+	ctx context.Context, src Node, dst Node) (size uint64, err error) {
+	fbo.log.CDebugf(ctx, "CopyFileInto %p -> %p", src.GetID(), dst.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %d %v", size, err) }()
+
+	err = fbo.checkNode(src)
+	if err != nil {
+		return 0, err
+	}
+	err = fbo.checkNode(dst)
+	if err != nil {
+		return 0, err
+	}
+
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			// Don't set size directly, as that can cause a race
+			// when the copy is canceled.
+			copied, err := fbo.copyFileIntoLocked(ctx, lState, src, dst)
+			if err != nil {
+				return err
+			}
+			size = copied
+			return nil
+		})
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func (fbo *folderBranchOps) CreateHardLink(
+	ctx context.Context, dir Node, name string, target Node) (
+	n Node, ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "CreateHardLink %p %s -> %p",
+		dir.GetID(), name, target.GetID())
+	defer func() {
+		if err != nil {
+			fbo.deferLog.CDebugf(ctx, "Error: %v", err)
+		} else {
+			fbo.deferLog.CDebugf(ctx, "Done: %p", n.GetID())
+		}
+	}()
+
+	err = fbo.checkNode(dir)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	err = fbo.checkNode(target)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	var retNode Node
+	var retEntryInfo EntryInfo
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			node, de, err := fbo.copyFileLocked(
+				ctx, lState, target, dir, name, true)
+			if err != nil {
+				return err
+			}
+			retNode = node
+			retEntryInfo = de.EntryInfo
+			return nil
+		})
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return retNode, retEntryInfo, nil
+}
+
+// unrefEntry modifies md to unreference all relevant blocks for the
+// given entry.
+func (fbo *folderBranchOps) unrefEntry(ctx context.Context,
+	lState *lockState, md *RootMetadata, dir path, de DirEntry,
+	name string) error {
+	md.AddUnrefBlock(de.BlockInfo)
+	// construct a path for the child so we can unlink with it.
+	childPath := dir.ChildPath(name, de.BlockPointer)
+
+	// If this is an indirect block, we need to delete all of its
+	// children as well. NOTE: non-empty directories can't be
+	// removed, so no need to check for indirect directory blocks
+	// here.
+	if de.Type == File || de.Type == Exec {
+		blockInfos, err := fbo.blocks.GetIndirectFileBlockInfos(
+			ctx, lState, md.ReadOnly(), childPath)
+		if isRecoverableBlockErrorForRemoval(err) {
+			msg := fmt.Sprintf("Recoverable block error encountered for unrefEntry(%v); continuing", childPath)
+			fbo.log.CWarningf(ctx, "%s", msg)
+			fbo.log.CDebugf(ctx, "%s (err=%v)", msg, err)
+		} else if err != nil {
+			return err
+		}
+		for _, blockInfo := range blockInfos {
+			md.AddUnrefBlock(blockInfo)
+		}
+	}
+	return nil
+}
+
+func (fbo *folderBranchOps) removeEntryLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, dir path, name string) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	pblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), dir, blockWrite)
+	if err != nil {
+		return err
+	}
+
+	// make sure the entry exists
+	de, ok := pblock.Children[name]
+	if !ok {
+		return NoSuchNameError{name}
+	}
+
+	ro, err := newRmOp(name, dir.tailPointer())
+	if err != nil {
+		return err
+	}
+	md.AddOp(ro)
+	// Every hard link has its own block references, so they can
+	// all be unreferenced here.
+	err = fbo.unrefEntry(ctx, lState, md, dir, de, name)
+	if err != nil {
+		return err
+	}
+	err = fbo.removeHardLinkLocked(ctx, lState, md, dir, name, de)
+	if err != nil {
+		return err
+	}
+
+	// the actual unlink
+	delete(pblock.Children, name)
+
+	// sync the parent directory
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, pblock, *dir.parentPath(), dir.tailName(),
+		Dir, true, true, zeroPtr, NoExcl)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (fbo *folderBranchOps) removeDirLocked(ctx context.Context,
+	lState *lockState, dir Node, dirName string) (err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
 	if err != nil {
 		return err
 	}
@@ -2822,7 +3760,14 @@ func (fbo *folderBranchOps) renameLocked(
 		if err != nil {
 			return err
 		}
+		err = fbo.removeHardLinkLocked(
+			ctx, lState, md, newParent, newName, de)
+		if err != nil {
+			return err
+		}
 	}
+	md.data.renameHardLinks(hardLinkPath(oldParent.ChildPathNoPtr(oldName)),
+		hardLinkPath(newParent.ChildPathNoPtr(newName)))
 
 	// only the ctime changes
 	newDe.Ctime = fbo.nowUnixNano()
@@ -2963,6 +3908,12 @@ func (fbo *folderBranchOps) Read(
 		return 0, err
 	}
 
+	// Read the group's unsynced writes, if the file is hard-linked.
+	file, err = fbo.hardLinkTarget(ctx, makeFBOLockState(), file)
+	if err != nil {
+		return 0, err
+	}
+
 	filePath, err := fbo.pathFromNodeForRead(file)
 	if err != nil {
 		return 0, err
@@ -3023,9 +3974,20 @@ func (fbo *folderBranchOps) Write(
 		return err
 	}
 
+	if fbo.isArchived() {
+		return WriteToReadonlyNodeError{file.GetBasename()}
+	}
+
 	return runUnlessCanceled(ctx, func() error {
 		lState := makeFBOLockState()
 
+		// Go through the link with the group's unsynced writes,
+		// if the file is hard-linked.
+		file, err := fbo.hardLinkTarget(ctx, lState, file)
+		if err != nil {
+			return err
+		}
+
 		// Get the MD for reading.  We won't modify it; we'll track the
 		// unref changes on the side, and put them into the MD during the
 		// sync.
@@ -3055,9 +4017,20 @@ func (fbo *folderBranchOps) Truncate(
 		return err
 	}
 
+	if fbo.isArchived() {
+		return WriteToReadonlyNodeError{file.GetBasename()}
+	}
+
 	return runUnlessCanceled(ctx, func() error {
 		lState := makeFBOLockState()
 
+		// Go through the link with the group's unsynced writes,
+		// if the file is hard-linked.
+		file, err := fbo.hardLinkTarget(ctx, lState, file)
+		if err != nil {
+			return err
+		}
+
 		// Get the MD for reading.  We won't modify it; we'll track the
 		// unref changes on the side, and put them into the MD during the
 		// sync.
@@ -3077,6 +4050,85 @@ func (fbo *folderBranchOps) Truncate(
 	})
 }
 
+// GetFileHoles implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) GetFileHoles(
+	ctx context.Context, file Node) (holes []FileHole, err error) {
+	fbo.log.CDebugf(ctx, "GetFileHoles %p", file.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return nil, err
+	}
+
+	filePath, err := fbo.pathFromNodeForRead(file)
+	if err != nil {
+		return nil, err
+	}
+
+	err = runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		// verify we have permission to read
+		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+		if err != nil {
+			return err
+		}
+
+		holes, err = fbo.blocks.GetFileHoles(
+			ctx, lState, md.ReadOnly(), filePath)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return holes, nil
+}
+
+// PunchHole implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) PunchHole(
+	ctx context.Context, file Node, off, length uint64) (err error) {
+	fbo.log.CDebugf(ctx, "PunchHole %p %d %d", file.GetID(), off, length)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return err
+	}
+
+	if fbo.isArchived() {
+		return WriteToReadonlyNodeError{file.GetBasename()}
+	}
+
+	return runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		// Go through the link with the group's unsynced writes,
+		// if the file is hard-linked.
+		file, err := fbo.hardLinkTarget(ctx, lState, file)
+		if err != nil {
+			return err
+		}
+
+		// Get the MD for reading.  We won't modify it; we'll track the
+		// unref changes on the side, and put them into the MD during the
+		// sync.
+		md, err := fbo.getMDLocked(ctx, lState, mdReadNeedIdentify)
+		if err != nil {
+			return err
+		}
+
+		err = fbo.blocks.PunchHole(
+			ctx, lState, md.ReadOnly(), file, off, length)
+		if err != nil {
+			return err
+		}
+
+		fbo.status.addDirtyNode(file)
+		return nil
+	})
+}
+
 func (fbo *folderBranchOps) setExLocked(
 	ctx context.Context, lState *lockState, file path,
 	ex bool) (err error) {
@@ -3136,6 +4188,10 @@ func (fbo *folderBranchOps) setExLocked(
 	md.AddOp(sao)
 
 	dblock.Children[file.tailName()] = de
+	if de.HardLink != "" {
+		return fbo.syncHardLinkAttrsLocked(
+			ctx, lState, md, sao, *parentPath, dblock, de)
+	}
 	_, err = fbo.syncBlockAndFinalizeLocked(
 		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
 		Dir, false, false, zeroPtr, NoExcl)
@@ -3202,39 +4258,194 @@ func (fbo *folderBranchOps) setMtimeLocked(
 		return nil
 	}
 
-	md.AddOp(sao)
+	md.AddOp(sao)
+
+	dblock.Children[file.tailName()] = de
+	if de.HardLink != "" {
+		return fbo.syncHardLinkAttrsLocked(
+			ctx, lState, md, sao, *parentPath, dblock, de)
+	}
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
+		Dir, false, false, zeroPtr, NoExcl)
+	return err
+}
+
+func (fbo *folderBranchOps) SetMtime(
+	ctx context.Context, file Node, mtime *time.Time) (err error) {
+	fbo.log.CDebugf(ctx, "SetMtime %p %v", file.GetID(), mtime)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if mtime == nil {
+		// Can happen on some OSes (e.g. OSX) when trying to set the atime only
+		return nil
+	}
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+			if err != nil {
+				return err
+			}
+
+			return fbo.setMtimeLocked(ctx, lState, filePath, mtime)
+		})
+}
+
+func (fbo *folderBranchOps) setXattrLocked(
+	ctx context.Context, lState *lockState, file path, name string,
+	value []byte, remove bool) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	dblock, de, err := fbo.blocks.GetDirtyParentAndEntry(
+		ctx, lState, md.ReadOnly(), file)
+	if err != nil {
+		return err
+	}
+
+	if remove {
+		if !de.removeXattr(name) {
+			return NoSuchXattrError{name}
+		}
+	} else {
+		de.setXattr(name, value)
+	}
+	// changing an xattr counts as changing the file MD, so must set
+	// ctime too
+	de.Ctime = fbo.nowUnixNano()
+
+	parentPath := file.parentPath()
+	sao, err := newSetAttrOp(file.tailName(), parentPath.tailPointer(),
+		xattrAttr, file.tailPointer())
+	if err != nil {
+		return err
+	}
+	sao.XattrName = name
+
+	// If the MD doesn't match the MD expected by the path, that
+	// implies we are using a cached path, which implies the node has
+	// been unlinked.  In that case, we can safely ignore this
+	// setxattr.
+	if md.data.Dir.BlockPointer != file.path[0].BlockPointer {
+		fbo.log.CDebugf(ctx, "Skipping setxattr for a removed file %v",
+			file.tailPointer())
+		fbo.blocks.UpdateCachedEntryAttributesOnRemovedFile(
+			ctx, lState, sao, de)
+		return nil
+	}
+
+	md.AddOp(sao)
+
+	dblock.Children[file.tailName()] = de
+	if de.HardLink != "" {
+		return fbo.syncHardLinkAttrsLocked(
+			ctx, lState, md, sao, *parentPath, dblock, de)
+	}
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
+		Dir, false, false, zeroPtr, NoExcl)
+	return err
+}
+
+func (fbo *folderBranchOps) doXattrWrite(
+	ctx context.Context, node Node, name string, value []byte,
+	remove bool) error {
+	err := fbo.checkNode(node)
+	if err != nil {
+		return err
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			nodePath, err := fbo.pathFromNodeForMDWriteLocked(lState, node)
+			if err != nil {
+				return err
+			}
+			if !nodePath.hasValidParent() {
+				return InvalidParentPathError{nodePath}
+			}
+
+			return fbo.setXattrLocked(
+				ctx, lState, nodePath, name, value, remove)
+		})
+}
+
+func (fbo *folderBranchOps) SetXattr(
+	ctx context.Context, node Node, name string, value []byte) (err error) {
+	fbo.log.CDebugf(ctx, "SetXattr %p %s (%d bytes)",
+		node.GetID(), name, len(value))
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if uint32(len(name)) > fbo.config.MaxNameBytes() {
+		return NameTooLongError{name, fbo.config.MaxNameBytes()}
+	}
+	if len(value) > maxXattrValueBytes {
+		return XattrTooBigError{name, len(value), maxXattrValueBytes}
+	}
+
+	return fbo.doXattrWrite(ctx, node, name, value, false)
+}
+
+func (fbo *folderBranchOps) RemoveXattr(
+	ctx context.Context, node Node, name string) (err error) {
+	fbo.log.CDebugf(ctx, "RemoveXattr %p %s", node.GetID(), name)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	dblock.Children[file.tailName()] = de
-	_, err = fbo.syncBlockAndFinalizeLocked(
-		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
-		Dir, false, false, zeroPtr, NoExcl)
-	return err
+	return fbo.doXattrWrite(ctx, node, name, nil, true)
 }
 
-func (fbo *folderBranchOps) SetMtime(
-	ctx context.Context, file Node, mtime *time.Time) (err error) {
-	fbo.log.CDebugf(ctx, "SetMtime %p %v", file.GetID(), mtime)
+func (fbo *folderBranchOps) GetXattr(
+	ctx context.Context, node Node, name string) (value []byte, err error) {
+	fbo.log.CDebugf(ctx, "GetXattr %p %s", node.GetID(), name)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	if mtime == nil {
-		// Can happen on some OSes (e.g. OSX) when trying to set the atime only
-		return nil
+	var de DirEntry
+	err = runUnlessCanceled(ctx, func() error {
+		de, err = fbo.statEntry(ctx, node)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	err = fbo.checkNode(file)
-	if err != nil {
-		return
+	value, ok := de.Xattrs[name]
+	if !ok {
+		return nil, NoSuchXattrError{name}
 	}
+	return append([]byte(nil), value...), nil
+}
 
-	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
-		func(lState *lockState) error {
-			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
-			if err != nil {
-				return err
-			}
+func (fbo *folderBranchOps) ListXattr(
+	ctx context.Context, node Node) (names []string, err error) {
+	fbo.log.CDebugf(ctx, "ListXattr %p", node.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-			return fbo.setMtimeLocked(ctx, lState, filePath, mtime)
-		})
+	var de DirEntry
+	err = runUnlessCanceled(ctx, func() error {
+		de, err = fbo.statEntry(ctx, node)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	names = make([]string, 0, len(de.Xattrs))
+	for name := range de.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
 }
 
 func (fbo *folderBranchOps) syncLocked(ctx context.Context,
@@ -3290,14 +4501,23 @@ func (fbo *folderBranchOps) syncLocked(ctx context.Context,
 		return true, err
 	}
 
+	linkBps := newBlockPutState(0)
+	linkRefBps := newBlockPutState(0)
+	top, linked, err := fbo.syncHardLinksLocked(ctx, lState, md, uid, file,
+		fblock, syncState.si.op, bps, lbc, linkBps, linkRefBps)
+	if err != nil {
+		return true, err
+	}
+
 	newPath, _, newBps, err :=
 		fbo.syncBlockAndCheckEmbedLocked(
-			ctx, lState, md, fblock, *file.parentPath(),
-			file.tailName(), File, true, true, zeroPtr, lbc)
+			ctx, lState, md, top, *file.parentPath(),
+			file.tailName(), File, !linked, !linked, zeroPtr, lbc)
 	if err != nil {
 		return true, err
 	}
 
+	bps.mergeOtherBps(linkBps)
 	bps.mergeOtherBps(newBps)
 
 	// Note: We explicitly don't call fbo.fbm.cleanUpBlockState here
@@ -3312,6 +4532,17 @@ func (fbo *folderBranchOps) syncLocked(ctx context.Context,
 	if err != nil {
 		return true, err
 	}
+	// New references to the blocks shared by hard links can only be
+	// added once the blocks themselves have been put.
+	if len(linkRefBps.blockStates) > 0 {
+		_, err = doBlockPuts(ctx, fbo.config.BlockServer(),
+			fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log,
+			md.TlfID(), md.GetTlfHandle().GetCanonicalName(), *linkRefBps)
+		if err != nil {
+			return true, err
+		}
+		bps.mergeOtherBps(linkRefBps)
+	}
 
 	err = fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl)
 	if err != nil {
@@ -3342,6 +4573,13 @@ func (fbo *folderBranchOps) Sync(ctx context.Context, file Node) (err error) {
 		return
 	}
 
+	// Sync the group's unsynced writes, if the file is
+	// hard-linked, which copies them into file as well.
+	file, err = fbo.hardLinkTarget(ctx, makeFBOLockState(), file)
+	if err != nil {
+		return err
+	}
+
 	var stillDirty bool
 	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
@@ -3364,6 +4602,178 @@ func (fbo *folderBranchOps) Sync(ctx context.Context, file Node) (err error) {
 	return nil
 }
 
+// SetSyncPolicy implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) SetSyncPolicy(
+	ctx context.Context, node Node, pinned bool) (err error) {
+	fbo.log.CDebugf(ctx, "SetSyncPolicy %p %t", node.GetID(), pinned)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(node)
+	if err != nil {
+		return err
+	}
+	// Pins are tracked per TLF, and always follow the master branch.
+	if fbo.branch() != MasterBranch {
+		return WriteToReadonlyNodeError{node.GetBasename()}
+	}
+
+	p := fbo.nodeCache.PathFromNode(node)
+	if !p.isValid() {
+		return InvalidPathError{p}
+	}
+	names := make([]string, 0, len(p.path)-1)
+	for _, pn := range p.path[1:] {
+		names = append(names, pn.Name)
+	}
+
+	return runUnlessCanceled(ctx, func() error {
+		return fbo.pinner.setPinned(ctx, strings.Join(names, "/"), pinned)
+	})
+}
+
+// LockFile implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) LockFile(ctx context.Context, file Node,
+	owner string, exclusive bool) (err error) {
+	fbo.log.CDebugf(ctx, "LockFile %p owner=%s exclusive=%t",
+		file.GetID(), owner, exclusive)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return err
+	}
+
+	p := fbo.nodeCache.PathFromNode(file)
+	if !p.isValid() {
+		return InvalidPathError{p}
+	}
+	de, err := fbo.statEntry(ctx, file)
+	if err != nil {
+		return err
+	}
+
+	return runUnlessCanceled(ctx, func() error {
+		return fbo.locker.lockFile(
+			ctx, file.GetID(), fileLockID(p, de), owner, exclusive)
+	})
+}
+
+// UnlockFile implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) UnlockFile(
+	ctx context.Context, file Node, owner string) (err error) {
+	fbo.log.CDebugf(ctx, "UnlockFile %p owner=%s", file.GetID(), owner)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return err
+	}
+
+	return runUnlessCanceled(ctx, func() error {
+		return fbo.locker.unlockFile(ctx, file.GetID(), owner)
+	})
+}
+
+// BeginBatch implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) BeginBatch(
+	ctx context.Context, folderBranch FolderBranch) (b Batch, err error) {
+	fbo.log.CDebugf(ctx, "BeginBatch")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return nil, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	// Give any pending conflict resolution a chance to finish.
+	if err := fbo.cr.Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	// Take the lock directly rather than through
+	// doMDWriteWithRetry, which would wait out an open batch instead
+	// of reporting it.
+	lState := makeFBOLockState()
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	if fbo.batch != nil {
+		return nil, BatchInProgressError{}
+	}
+	if !fbo.isMasterBranchLocked(lState) {
+		return nil, UnmergedError{}
+	}
+
+	// Verify we have permission to write, which also makes sure the
+	// head is initialized.
+	_, err = fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := &folderBatch{
+		fbo:         fbo,
+		branchPoint: fbo.getCurrMDRevision(lState),
+		doneCh:      make(chan struct{}),
+	}
+	batch.expireTimer = time.AfterFunc(fbo.maxBatchDuration, batch.expire)
+	fbo.batch = batch
+	return batch, nil
+}
+
+// Watch implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) Watch(ctx context.Context, dir Node,
+	recursive bool, fromRev MetadataRevision) (
+	eventCh <-chan ChangeEvent, err error) {
+	fbo.log.CDebugf(ctx, "Watch %p recursive=%t fromRev=%d",
+		dir.GetID(), recursive, fromRev)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	de, err := fbo.statEntry(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	p := fbo.nodeCache.PathFromNode(dir)
+	if de.Type != Dir {
+		return nil, NotDirError{p}
+	}
+
+	lState := makeFBOLockState()
+	squashes, squashCount := fbo.getSquashesSince(lState, 0)
+	lastRev := fromRev
+	if lastRev == MetadataRevisionUninitialized {
+		lastRev = fbo.getHead(lState).Revision()
+	} else if squash, ok := findSquash(squashes, fromRev); ok {
+		// There's no telling whether fromRev is from before or
+		// after the squash, so the caller has to start over.
+		return nil, squash
+	}
+	w := newDirWatcher(fbo, p.String(), recursive, lastRev, squashCount)
+	err = fbo.config.Notifier().RegisterForChanges(
+		[]FolderBranch{fbo.folderBranch}, w)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		w.run(ctx)
+		err := fbo.config.Notifier().UnregisterFromChanges(
+			[]FolderBranch{fbo.folderBranch}, w)
+		if err != nil {
+			fbo.log.CDebugf(ctx, "Couldn't unregister watcher: %v", err)
+		}
+	}()
+	if fromRev != MetadataRevisionUninitialized {
+		// Catch up on anything since fromRev right away.
+		w.kick()
+	}
+	return w.eventCh, nil
+}
+
+// getMDForPinning implements the folderPinnerHelper interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) getMDForPinning(ctx context.Context) (
+	ImmutableRootMetadata, error) {
+	return fbo.getHead(makeFBOLockState()), nil
+}
+
 func (fbo *folderBranchOps) FolderStatus(
 	ctx context.Context, folderBranch FolderBranch) (
 	fbs FolderBranchStatus, updateChan <-chan StatusUpdate, err error) {
@@ -3400,14 +4810,14 @@ func (fbo *folderBranchOps) UnregisterFromChanges(obs Observer) error {
 	return nil
 }
 
-// notifyBatchLocked sends out a notification for the most recent op
-// in md.
+// notifyBatchLocked sends out a notification for each op in md.
 func (fbo *folderBranchOps) notifyBatchLocked(
 	ctx context.Context, lState *lockState, md ImmutableRootMetadata) {
 	fbo.headLock.AssertLocked(lState)
 
-	lastOp := md.data.Changes.Ops[len(md.data.Changes.Ops)-1]
-	fbo.notifyOneOpLocked(ctx, lState, lastOp, md)
+	for _, op := range md.data.Changes.Ops {
+		fbo.notifyOneOpLocked(ctx, lState, op, md)
+	}
 	fbo.editHistory.UpdateHistory(ctx, []ImmutableRootMetadata{md})
 }
 
@@ -3711,6 +5121,15 @@ func (fbo *folderBranchOps) applyMDUpdatesLocked(ctx context.Context,
 	fbo.headLock.Lock(lState)
 	defer fbo.headLock.Unlock(lState)
 
+	// An open batch's pending head can't take updates; committing
+	// it will resolve them, like any other out-of-date write.
+	if fbo.batch != nil && fbo.batch.isPendingLocked(lState) {
+		if len(rmds) > 0 {
+			fbo.setLatestMergedRevisionLocked(ctx, lState, rmds[len(rmds)-1].Revision(), false)
+		}
+		return errors.New("Ignoring MD updates while a batch is pending")
+	}
+
 	// if we have staged changes, ignore all updates until conflict
 	// resolution kicks in.  TODO: cache these for future use.
 	if !fbo.isMasterBranchLocked(lState) {
@@ -4523,6 +5942,7 @@ func (fbo *folderBranchOps) waitForAndProcessUpdates(
 					"updates: %v", err)
 				return err
 			}
+			fbo.pinner.kick()
 			return nil
 		case unpause := <-fbo.updatePauseChan:
 			fbo.log.CInfof(ctx, "Updates paused")
@@ -4875,6 +6295,197 @@ func (fbo *folderBranchOps) onMDFlush(bid BranchID, rev MetadataRevision) {
 	}()
 }
 
+// getSquashableMDs returns the longest run of MDs at the end of the
+// given ones that can be squashed together into a single MD, if
+// there are at least two of them.
+func getSquashableMDs(
+	rmds []ImmutableRootMetadata) []ImmutableRootMetadata {
+	head := rmds[len(rmds)-1]
+	i := len(rmds)
+	for i > 0 && isSquashableMD(rmds[i-1], head.LatestKeyGeneration()) {
+		i--
+	}
+	if len(rmds)-i < 2 {
+		return nil
+	}
+	return rmds[i:]
+}
+
+// handleMDSquash squashes as many of the unflushed MDs in the journal
+// as it can into a single MD, and makes that the new head.  If it
+// squashes anything, it calls onSquashed (if non-nil) with the
+// revision of the new MD; that revision and the ones after it may
+// have been seen before, and are reused from then on.
+func (fbo *folderBranchOps) handleMDSquash(ctx context.Context,
+	onSquashed func(start MetadataRevision)) error {
+	jServer, err := GetJournalServer(fbo.config)
+	if err != nil {
+		return err
+	}
+	tlfJournal, ok := jServer.getTLFJournal(fbo.id())
+	if !ok {
+		return nil
+	}
+
+	lState := makeFBOLockState()
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+
+	if !fbo.isMasterBranchLocked(lState) {
+		fbo.log.CDebugf(ctx, "Not squashing MDs on a branch")
+		return nil
+	}
+	head := fbo.getHead(lState)
+	if head == (ImmutableRootMetadata{}) {
+		// Nothing has been read from this folder yet, so there's
+		// nothing to squash.
+		return nil
+	}
+
+	status, err := tlfJournal.getJournalStatus()
+	if err != nil {
+		return err
+	}
+	if status.RevisionEnd != head.Revision() {
+		fbo.log.CDebugf(ctx, "Not squashing MDs, since the journal head "+
+			"%d doesn't match our head %d", status.RevisionEnd,
+			head.Revision())
+		return nil
+	}
+
+	rmds, err := getMDRange(ctx, fbo.config, fbo.id(), NullBranchID,
+		status.RevisionStart, status.RevisionEnd, Merged)
+	if err != nil {
+		return err
+	}
+	if len(rmds) == 0 || rmds[len(rmds)-1].mdID != head.mdID {
+		return nil
+	}
+	rmds = getSquashableMDs(rmds)
+	if len(rmds) == 0 {
+		fbo.log.CDebugf(ctx, "No MDs to squash")
+		return nil
+	}
+
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	squash := makeMDSquash(rmds)
+	start := rmds[0].Revision()
+	fbo.log.CDebugf(ctx, "Squashing MD revisions %d to %d", start,
+		head.Revision())
+	var newMD *RootMetadata
+	var dropped map[BlockPointer]int64
+	mdID, err := tlfJournal.squashMDs(ctx, start, head.mdID,
+		squash.candidates, func(d map[BlockPointer]int64) (
+			*RootMetadata, *blockPutState, error) {
+			md, err := squash.makeMD(fbo.config.Codec(), d)
+			if err != nil {
+				return nil, nil, err
+			}
+			// The ops of all the MDs together may be too big to
+			// embed, even if each MD's own weren't.
+			bps := newBlockPutState(1)
+			if !fbo.config.BlockSplitter().ShouldEmbedBlockChanges(
+				&md.data.Changes) {
+				err = fbo.unembedBlockChanges(
+					ctx, bps, md, &md.data.Changes, uid)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+			newMD, dropped = md, d
+			return md, bps, nil
+		})
+	if err != nil {
+		return err
+	}
+	newMD.swapCachedBlockChanges()
+	fbo.log.CDebugf(ctx, "Squashed %d MDs into revision %d, dropping %d "+
+		"blocks", len(rmds), start, len(dropped))
+
+	// Forget the dropped blocks, so they can't be used to dedup
+	// later writes.
+	bcache := fbo.config.BlockCache()
+	for ptr := range dropped {
+		if block, err := bcache.Get(ptr); err == nil {
+			if fblock, ok := block.(*FileBlock); ok {
+				_ = bcache.DeleteKnownPtr(fbo.id(), fblock)
+			}
+		}
+		_ = bcache.DeleteTransient(ptr, fbo.id())
+	}
+
+	err = func() error {
+		fbo.headLock.Lock(lState)
+		defer fbo.headLock.Unlock(lState)
+		irmd := MakeImmutableRootMetadata(
+			newMD, mdID, fbo.config.Clock().Now())
+		err := fbo.setHeadSquashedLocked(ctx, lState, irmd)
+		if err != nil {
+			return err
+		}
+		fbo.squashes = append(fbo.squashes, RevisionsSquashedError{
+			Tlf: fbo.id(), Start: start, End: head.Revision()})
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+	for rev := start; rev <= head.Revision(); rev++ {
+		fbo.config.MDCache().Delete(fbo.id(), rev, NullBranchID)
+	}
+	// The edit history may have come from the squashed revisions,
+	// so have it recalculated from the new ones.
+	fbo.editHistory.reset()
+	if onSquashed != nil {
+		onSquashed(start)
+	}
+	return nil
+}
+
+// getSquashesSince returns the squashes after the first n, and the
+// total number of squashes.
+func (fbo *folderBranchOps) getSquashesSince(lState *lockState, n int) (
+	[]RevisionsSquashedError, int) {
+	fbo.headLock.RLock(lState)
+	defer fbo.headLock.RUnlock(lState)
+	return fbo.squashes[n:], len(fbo.squashes)
+}
+
+// findSquash returns the first of the given squashes that squashed
+// away the given revision, if any.
+func findSquash(squashes []RevisionsSquashedError, rev MetadataRevision) (
+	RevisionsSquashedError, bool) {
+	for _, squash := range squashes {
+		if rev >= squash.Start && rev <= squash.End {
+			return squash, true
+		}
+	}
+	return RevisionsSquashedError{}, false
+}
+
+func (fbo *folderBranchOps) onMDSquash(doneCh chan<- struct{},
+	onSquashed func(start MetadataRevision)) {
+	// Squashes are part of flushing, so track them along with
+	// the flushes.
+	fbo.mdFlushes.Add(1)
+
+	go func() {
+		defer fbo.mdFlushes.Done()
+		defer close(doneCh)
+		ctx, cancelFunc := fbo.newCtxWithFBOID()
+		defer cancelFunc()
+
+		err := fbo.handleMDSquash(ctx, onSquashed)
+		if err != nil {
+			fbo.log.CWarningf(ctx, "Couldn't squash MDs: %v", err)
+		}
+	}()
+}
+
 // GetUpdateHistory implements the KBFSOps interface for folderBranchOps
 func (fbo *folderBranchOps) GetUpdateHistory(ctx context.Context,
 	folderBranch FolderBranch) (history TLFUpdateHistory, err error) {
@@ -4958,6 +6569,25 @@ func (fbo *folderBranchOps) GetEditHistory(ctx context.Context,
 	return fbo.editHistory.GetComplete(ctx, head)
 }
 
+// PreviewConflictResolution implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) PreviewConflictResolution(ctx context.Context,
+	folderBranch FolderBranch) (preview ConflictResolutionPreview, err error) {
+	fbo.log.CDebugf(ctx, "PreviewConflictResolution")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return ConflictResolutionPreview{},
+			WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	lState := makeFBOLockState()
+	if fbo.isMasterBranch(lState) {
+		return ConflictResolutionPreview{}, nil
+	}
+	return fbo.cr.Preview(ctx)
+}
+
 // PushConnectionStatusChange pushes human readable connection status changes.
 func (fbo *folderBranchOps) PushConnectionStatusChange(service string, newStatus error) {
 	fbo.config.KBFSOps().PushConnectionStatusChange(service, newStatus)
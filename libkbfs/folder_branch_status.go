@@ -5,6 +5,7 @@
 package libkbfs
 
 import (
+	"fmt"
 	"reflect"
 	"sync"
 
@@ -36,6 +37,10 @@ type FolderBranchStatus struct {
 	Merged   []*crChainSummary
 
 	Journal *TLFJournalStatus `json:",omitempty"`
+
+	// Offline is set while the mdserver is unreachable, and says
+	// which revision is being served in the meantime.
+	Offline string `json:",omitempty"`
 }
 
 // KBFSStatus represents the content of the top-level status file. It is
@@ -64,6 +69,7 @@ type folderBranchStatusKeeper struct {
 	dirtyNodes map[NodeID]Node
 	unmerged   []*crChainSummary
 	merged     []*crChainSummary
+	offline    bool
 	dataMutex  sync.Mutex
 
 	updateChan  chan StatusUpdate
@@ -100,6 +106,26 @@ func (fbsk *folderBranchStatusKeeper) setRootMetadata(md ImmutableRootMetadata)
 	fbsk.signalChangeLocked()
 }
 
+// setOffline records whether the folder-branch is serving reads
+// from its last known head because the mdserver is unreachable.  It
+// returns false if that was already the case.
+func (fbsk *folderBranchStatusKeeper) setOffline(offline bool) bool {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	if fbsk.offline == offline {
+		return false
+	}
+	fbsk.offline = offline
+	fbsk.signalChangeLocked()
+	return true
+}
+
+func (fbsk *folderBranchStatusKeeper) isOffline() bool {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	return fbsk.offline
+}
+
 func (fbsk *folderBranchStatusKeeper) setCRSummary(unmerged []*crChainSummary,
 	merged []*crChainSummary) {
 	fbsk.dataMutex.Lock()
@@ -145,6 +171,18 @@ func (fbsk *folderBranchStatusKeeper) rmDirtyNode(n Node) {
 	fbsk.rmNode(fbsk.dirtyNodes, n)
 }
 
+// getDirtyNodes returns the nodes that currently have unsynced
+// writes.
+func (fbsk *folderBranchStatusKeeper) getDirtyNodes() []Node {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	nodes := make([]Node, 0, len(fbsk.dirtyNodes))
+	for _, n := range fbsk.dirtyNodes {
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
 // dataMutex should be taken by the caller
 func (fbsk *folderBranchStatusKeeper) convertNodesToPathsLocked(
 	m map[NodeID]Node) []string {
@@ -205,6 +243,14 @@ func (fbsk *folderBranchStatusKeeper) getStatus(ctx context.Context,
 		}
 	}
 
+	if fbsk.offline {
+		fbs.Offline = "offline"
+		if fbsk.md != (ImmutableRootMetadata{}) {
+			fbs.Offline = fmt.Sprintf("offline, serving revision %d",
+				fbsk.md.Revision())
+		}
+	}
+
 	fbs.DirtyPaths = fbsk.convertNodesToPathsLocked(fbsk.dirtyNodes)
 
 	fbs.Unmerged = fbsk.unmerged
@@ -69,6 +69,54 @@ func TestFBStatusSignal(t *testing.T) {
 	}
 }
 
+func TestFBStatusOffline(t *testing.T) {
+	mockCtrl, config, fbsk, _ := fbStatusTestInit(t)
+	defer fbStatusTestShutdown(mockCtrl, config)
+	ctx := context.Background()
+
+	id := FakeTlfID(1, false)
+	h := parseTlfHandleOrBust(t, config, "alice", false)
+	md := newRootMetadataOrBust(t, id, h)
+	md.SetRevision(MetadataRevision(5))
+	md.SetLastModifyingWriter(h.FirstResolvedWriter())
+	fbsk.setRootMetadata(MakeImmutableRootMetadata(md, fakeMdID(1),
+		time.Now()))
+
+	config.mockRekeyQueue.EXPECT().IsRekeyPending(id).AnyTimes()
+	status, c, err := fbsk.getStatus(ctx, nil)
+	if err != nil {
+		t.Fatalf("Couldn't get status: %v", err)
+	}
+	if status.Offline != "" {
+		t.Errorf("Unexpected offline status: %s", status.Offline)
+	}
+
+	if !fbsk.setOffline(true) {
+		t.Fatalf("Setting offline didn't change anything")
+	}
+	<-c
+	if fbsk.setOffline(true) {
+		t.Errorf("Setting offline twice changed something")
+	}
+
+	status, _, err = fbsk.getStatus(ctx, nil)
+	if err != nil {
+		t.Fatalf("Couldn't get status: %v", err)
+	}
+	if status.Offline != "offline, serving revision 5" {
+		t.Errorf("Unexpected offline status: %s", status.Offline)
+	}
+
+	fbsk.setOffline(false)
+	status, _, err = fbsk.getStatus(ctx, nil)
+	if err != nil {
+		t.Fatalf("Couldn't get status: %v", err)
+	}
+	if status.Offline != "" {
+		t.Errorf("Unexpected offline status: %s", status.Offline)
+	}
+}
+
 // mockNodeMatcher is needed to compare mock nodes -- for some reason
 // the default equality comparison doesn't work in gomock.
 type mockNodeMatcher struct {
@@ -0,0 +1,480 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+// folderPinnerHelper is the part of folderBranchOps that a
+// folderPinner needs.
+type folderPinnerHelper interface {
+	// getMDForPinning returns the current head, or an empty MD if
+	// the folder hasn't been initialized yet.
+	getMDForPinning(ctx context.Context) (ImmutableRootMetadata, error)
+}
+
+// errPinningNeedsDiskCache is returned when trying to pin something
+// while the disk block cache is disabled.
+var errPinningNeedsDiskCache = errors.New(
+	"Keeping files available offline requires the disk block cache")
+
+// pinnedNode is a file or directory within a pinned subtree, as of
+// the last sync.  Blocks are immutable, so a node is identified by
+// the ID of its top block, and a node that's still referenced in a
+// new revision never needs to be fetched again.
+type pinnedNode struct {
+	// refs counts the pinned paths and parent directories that
+	// point to this node.
+	refs int
+	// blocks holds the IDs of the node's own blocks, including any
+	// indirect ones.
+	blocks []BlockID
+	// children holds the top block IDs of a directory's files and
+	// subdirectories.
+	children []BlockID
+}
+
+// folderPinner keeps every block of the pinned subtrees of a single
+// TLF in the disk block cache, exempt from eviction.  The pinned
+// paths themselves are persisted by the disk block cache.  Each sync
+// looks up the pinned paths in the current head, and then only
+// fetches the nodes that weren't already pinned as of the previous
+// sync.  Blocks that are no longer referenced by a pinned subtree
+// are unpinned, and so become evictable again.
+type folderPinner struct {
+	config       Config
+	folderBranch FolderBranch
+	helper       folderPinnerHelper
+	log          logger.Logger
+
+	// syncLock serializes syncs, so that a sync requested by
+	// setPinned always sees the new set of pinned paths.  It also
+	// protects the fields below, which describe the state of the
+	// last successful sync.
+	syncLock sync.Mutex
+	// synced is false until the first successful sync, and after
+	// any failed one; the next sync then rebuilds the whole pinned
+	// block set.
+	synced bool
+	rev    MetadataRevision
+	paths  []string
+	// pathBlocks holds the IDs of the directory blocks that lead to
+	// each pinned path, and roots the top block IDs of the pinned
+	// subtrees themselves.
+	pathBlocks []BlockID
+	roots      []BlockID
+	nodes      map[BlockID]*pinnedNode
+	// blockRefs counts the references to each pinned block, from
+	// pathBlocks and from the nodes.
+	blockRefs map[BlockID]int
+
+	syncCh     chan struct{}
+	shutdownCh chan struct{}
+	doneCh     chan struct{}
+}
+
+func newFolderPinner(config Config, fb FolderBranch,
+	helper folderPinnerHelper, log logger.Logger) *folderPinner {
+	fp := &folderPinner{
+		config:       config,
+		folderBranch: fb,
+		helper:       helper,
+		log:          log,
+		syncCh:       make(chan struct{}, 1),
+		shutdownCh:   make(chan struct{}),
+		doneCh:       make(chan struct{}),
+	}
+	go fp.loop()
+	return fp
+}
+
+func (fp *folderPinner) loop() {
+	defer close(fp.doneCh)
+	ctx, cancel := context.WithCancel(ctxWithRandomIDReplayable(
+		context.Background(), CtxFBOIDKey, CtxFBOOpID, fp.log))
+	defer cancel()
+	go func() {
+		select {
+		case <-fp.shutdownCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		select {
+		case <-fp.syncCh:
+			if err := fp.sync(ctx); err != nil {
+				fp.log.CDebugf(ctx, "Couldn't sync pinned paths: %v", err)
+			}
+		case <-fp.shutdownCh:
+			return
+		}
+	}
+}
+
+// kick asks for the pinned subtrees to be re-synced in the
+// background, e.g. because a new revision has arrived.
+func (fp *folderPinner) kick() {
+	select {
+	case fp.syncCh <- struct{}{}:
+	default:
+		// A sync is already pending.
+	}
+}
+
+func (fp *folderPinner) shutdown() {
+	close(fp.shutdownCh)
+	<-fp.doneCh
+}
+
+// setPinned pins or unpins the given path, relative to the TLF root,
+// and then syncs the pinned subtrees.
+func (fp *folderPinner) setPinned(
+	ctx context.Context, p string, pinned bool) error {
+	dbc := fp.config.DiskBlockCache()
+	if dbc == nil {
+		return errPinningNeedsDiskCache
+	}
+
+	fp.syncLock.Lock()
+	defer fp.syncLock.Unlock()
+
+	paths, err := dbc.GetPinnedPaths(ctx, fp.folderBranch.Tlf)
+	if err != nil {
+		return err
+	}
+	var newPaths []string
+	for _, oldPath := range paths {
+		if oldPath != p {
+			newPaths = append(newPaths, oldPath)
+		}
+	}
+	if pinned {
+		newPaths = append(newPaths, p)
+	}
+	err = dbc.SetPinnedPaths(ctx, fp.folderBranch.Tlf, newPaths)
+	if err != nil {
+		return err
+	}
+	return fp.syncLocked(ctx, dbc)
+}
+
+func (fp *folderPinner) sync(ctx context.Context) error {
+	dbc := fp.config.DiskBlockCache()
+	if dbc == nil {
+		return nil
+	}
+
+	fp.syncLock.Lock()
+	defer fp.syncLock.Unlock()
+	return fp.syncLocked(ctx, dbc)
+}
+
+func (fp *folderPinner) resetLocked() {
+	fp.synced = false
+	fp.rev = MetadataRevisionUninitialized
+	fp.paths = nil
+	fp.pathBlocks = nil
+	fp.roots = nil
+	fp.nodes = make(map[BlockID]*pinnedNode)
+	fp.blockRefs = make(map[BlockID]int)
+}
+
+func (fp *folderPinner) pathsUnchangedLocked(paths []string) bool {
+	if len(paths) != len(fp.paths) {
+		return false
+	}
+	for i, p := range paths {
+		if p != fp.paths[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (fp *folderPinner) syncLocked(
+	ctx context.Context, dbc DiskBlockCache) (err error) {
+	paths, err := dbc.GetPinnedPaths(ctx, fp.folderBranch.Tlf)
+	if err != nil {
+		return err
+	}
+
+	rev := MetadataRevisionUninitialized
+	var md ImmutableRootMetadata
+	if len(paths) > 0 {
+		md, err = fp.helper.getMDForPinning(ctx)
+		if err != nil {
+			return err
+		}
+		if md == (ImmutableRootMetadata{}) {
+			// Nothing to fetch yet; we'll get kicked again once
+			// there's a head.
+			return nil
+		}
+		rev = md.Revision()
+	}
+	if fp.synced && rev == fp.rev && fp.pathsUnchangedLocked(paths) {
+		return nil
+	}
+
+	fullSync := !fp.synced
+	if fullSync {
+		fp.resetLocked()
+	}
+	defer func() {
+		if err != nil {
+			// Start from scratch next time, rather than trying
+			// to undo a partial sync.
+			fp.resetLocked()
+		}
+	}()
+
+	fp.log.CDebugf(ctx, "Syncing %d pinned paths at revision %d",
+		len(paths), rev)
+	wasPinned := make(map[BlockID]bool)
+	var pathBlocks, roots []BlockID
+	for _, p := range paths {
+		blocks, de, err := fp.lookupPath(ctx, md, p)
+		if err != nil {
+			return err
+		}
+		for _, id := range blocks {
+			fp.refBlock(id, wasPinned)
+		}
+		pathBlocks = append(pathBlocks, blocks...)
+		ok, err := fp.refNode(ctx, md, de, wasPinned)
+		if err != nil {
+			return err
+		}
+		if ok {
+			roots = append(roots, de.ID)
+		}
+	}
+
+	// Only now drop the previous sync's references, so that
+	// subtrees that haven't changed stay pinned throughout.
+	for _, id := range fp.pathBlocks {
+		fp.unrefBlock(id, wasPinned)
+	}
+	for _, id := range fp.roots {
+		fp.unrefNode(id, wasPinned)
+	}
+
+	var numMissing, numPinned int
+	if fullSync {
+		blockIDs := make([]BlockID, 0, len(fp.blockRefs))
+		for id := range fp.blockRefs {
+			blockIDs = append(blockIDs, id)
+		}
+		numPinned = len(blockIDs)
+		numMissing, err = dbc.SetPinnedBlocks(
+			ctx, fp.folderBranch.Tlf, blockIDs)
+	} else {
+		var pin, unpin []BlockID
+		for id, was := range wasPinned {
+			is := fp.blockRefs[id] > 0
+			if is && !was {
+				pin = append(pin, id)
+			} else if was && !is {
+				unpin = append(unpin, id)
+			}
+		}
+		fp.log.CDebugf(ctx, "Pinning %d new blocks and unpinning %d",
+			len(pin), len(unpin))
+		numPinned = len(pin)
+		if len(pin) > 0 || len(unpin) > 0 {
+			numMissing, err = dbc.UpdatePinnedBlocks(
+				ctx, fp.folderBranch.Tlf, pin, unpin)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if numMissing > 0 {
+		fp.log.CWarningf(ctx, "%d of %d pinned blocks didn't fit in "+
+			"the disk block cache", numMissing, numPinned)
+	}
+
+	fp.synced = true
+	fp.rev = rev
+	fp.paths = paths
+	fp.pathBlocks = pathBlocks
+	fp.roots = roots
+	return nil
+}
+
+// refBlock adds a reference to the given block, first recording in
+// wasPinned whether it was pinned before the current sync.
+func (fp *folderPinner) refBlock(id BlockID, wasPinned map[BlockID]bool) {
+	if _, ok := wasPinned[id]; !ok {
+		wasPinned[id] = fp.blockRefs[id] > 0
+	}
+	fp.blockRefs[id]++
+}
+
+// unrefBlock drops a reference to the given block, first recording
+// in wasPinned whether it was pinned before the current sync.
+func (fp *folderPinner) unrefBlock(id BlockID, wasPinned map[BlockID]bool) {
+	if _, ok := wasPinned[id]; !ok {
+		wasPinned[id] = fp.blockRefs[id] > 0
+	}
+	fp.blockRefs[id]--
+	if fp.blockRefs[id] <= 0 {
+		delete(fp.blockRefs, id)
+	}
+}
+
+// lookupPath returns the IDs of the directory blocks needed to reach
+// the given path, along with the path's entry.  A path that no
+// longer exists returns an empty entry, but stays pinned in case
+// it's re-created.
+func (fp *folderPinner) lookupPath(
+	ctx context.Context, md ImmutableRootMetadata, p string) (
+	blocks []BlockID, de DirEntry, err error) {
+	de = md.data.Dir
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+		if de.Type != Dir {
+			fp.log.CDebugf(ctx, "Pinned path %s no longer exists", p)
+			return blocks, DirEntry{}, nil
+		}
+		dblock := NewDirBlock().(*DirBlock)
+		err := fp.config.BlockOps().Get(ctx, md, de.BlockPointer, dblock)
+		if err != nil {
+			return nil, DirEntry{}, err
+		}
+		blocks = append(blocks, de.ID)
+		child, ok := dblock.Children[name]
+		if !ok {
+			fp.log.CDebugf(ctx, "Pinned path %s no longer exists", p)
+			return blocks, DirEntry{}, nil
+		}
+		de = child
+	}
+	return blocks, de, nil
+}
+
+// refNode adds a reference to the node for the given entry, fetching
+// it and its children only if it isn't already pinned.  It returns
+// false if the entry has no blocks of its own, as for a symlink.
+func (fp *folderPinner) refNode(ctx context.Context, kmd KeyMetadata,
+	de DirEntry, wasPinned map[BlockID]bool) (bool, error) {
+	if !de.IsValid() {
+		return false, nil
+	}
+	if n, ok := fp.nodes[de.ID]; ok {
+		n.refs++
+		return true, nil
+	}
+
+	n := &pinnedNode{refs: 1}
+	switch de.Type {
+	case Dir:
+		children, err := fp.getDirBlocks(ctx, kmd, de.BlockPointer, n)
+		if err != nil {
+			return false, err
+		}
+		for _, child := range children {
+			ok, err := fp.refNode(ctx, kmd, child, wasPinned)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				n.children = append(n.children, child.ID)
+			}
+		}
+	case File, Exec:
+		err := fp.getFileBlocks(ctx, kmd, de.BlockPointer, n)
+		if err != nil {
+			return false, err
+		}
+	default:
+		return false, nil
+	}
+	fp.nodes[de.ID] = n
+	for _, id := range n.blocks {
+		fp.refBlock(id, wasPinned)
+	}
+	return true, nil
+}
+
+// unrefNode drops a reference to the given node, and once nothing
+// references it, to its blocks and children.
+func (fp *folderPinner) unrefNode(id BlockID, wasPinned map[BlockID]bool) {
+	n, ok := fp.nodes[id]
+	if !ok {
+		return
+	}
+	n.refs--
+	if n.refs > 0 {
+		return
+	}
+	delete(fp.nodes, id)
+	for _, blockID := range n.blocks {
+		fp.unrefBlock(blockID, wasPinned)
+	}
+	for _, childID := range n.children {
+		fp.unrefNode(childID, wasPinned)
+	}
+}
+
+// getDirBlocks fetches the given directory block and any indirect
+// blocks under it, records their IDs in n, and returns the
+// directory's entries.
+func (fp *folderPinner) getDirBlocks(ctx context.Context, kmd KeyMetadata,
+	ptr BlockPointer, n *pinnedNode) ([]DirEntry, error) {
+	dblock := NewDirBlock().(*DirBlock)
+	err := fp.config.BlockOps().Get(ctx, kmd, ptr, dblock)
+	if err != nil {
+		return nil, err
+	}
+	n.blocks = append(n.blocks, ptr.ID)
+	children := make([]DirEntry, 0, len(dblock.Children))
+	for _, de := range dblock.Children {
+		children = append(children, de)
+	}
+	for _, iptr := range dblock.IPtrs {
+		if !iptr.IsValid() {
+			continue
+		}
+		more, err := fp.getDirBlocks(ctx, kmd, iptr.BlockPointer, n)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, more...)
+	}
+	return children, nil
+}
+
+// getFileBlocks fetches the given file block and any indirect blocks
+// under it, and records their IDs in n.
+func (fp *folderPinner) getFileBlocks(ctx context.Context, kmd KeyMetadata,
+	ptr BlockPointer, n *pinnedNode) error {
+	fblock := NewFileBlock().(*FileBlock)
+	err := fp.config.BlockOps().Get(ctx, kmd, ptr, fblock)
+	if err != nil {
+		return err
+	}
+	n.blocks = append(n.blocks, ptr.ID)
+	for _, iptr := range fblock.IPtrs {
+		if !iptr.IsValid() {
+			continue
+		}
+		err := fp.getFileBlocks(ctx, kmd, iptr.BlockPointer, n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
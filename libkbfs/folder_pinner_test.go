@@ -0,0 +1,146 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// countingBlockOps counts the block fetches made through it.
+type countingBlockOps struct {
+	BlockOps
+	lock sync.Mutex
+	gets int
+}
+
+func (cbo *countingBlockOps) Get(ctx context.Context, kmd KeyMetadata,
+	blockPtr BlockPointer, block Block) error {
+	cbo.lock.Lock()
+	cbo.gets++
+	cbo.lock.Unlock()
+	return cbo.BlockOps.Get(ctx, kmd, blockPtr, block)
+}
+
+func (cbo *countingBlockOps) takeGets() int {
+	cbo.lock.Lock()
+	defer cbo.lock.Unlock()
+	gets := cbo.gets
+	cbo.gets = 0
+	return gets
+}
+
+func isDiskBlockPinned(cache *DiskBlockCacheStandard, tlfID TlfID,
+	id BlockID) bool {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	elem, ok := cache.elems[diskBlockCacheKey{tlfID, id}]
+	return ok && elem.Value.(diskBlockCacheLRUEntry).pinned
+}
+
+func TestFolderPinnerIncrementalSync(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	tempdir, err := ioutil.TempDir(os.TempDir(), "folder_pinner")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	defer CheckConfigAndShutdown(t, config)
+
+	cache, err := NewDiskBlockCacheStandard(config, tempdir, 1<<20)
+	require.NoError(t, err)
+	config.SetDiskBlockCache(cache)
+	bops := &countingBlockOps{BlockOps: config.BlockOps()}
+	config.SetBlockOps(bops)
+
+	kbfsOps := config.KBFSOps()
+	h := parseTlfHandleOrBust(t, config, "test_user", false)
+	rootNode, _, err := kbfsOps.GetOrCreateRootNode(ctx, h, MasterBranch)
+	require.NoError(t, err)
+	fb := rootNode.GetFolderBranch()
+
+	writeFile := func(dir Node, name string, data []byte) {
+		n, _, err := kbfsOps.CreateFile(ctx, dir, name, false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps.Write(ctx, n, data, 0)
+		require.NoError(t, err)
+		err = kbfsOps.Sync(ctx, n)
+		require.NoError(t, err)
+	}
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	for _, name := range []string{"b", "c", "d", "e"} {
+		writeFile(dirNode, name, []byte(name))
+	}
+	writeFile(rootNode, "f", []byte{1})
+
+	fbo := kbfsOps.(*KBFSOpsStandard).getOpsNoAdd(fb)
+	fp := fbo.pinner
+	pinnedBlocks := func() map[BlockID]bool {
+		fp.syncLock.Lock()
+		defer fp.syncLock.Unlock()
+		ids := make(map[BlockID]bool, len(fp.blockRefs))
+		for id := range fp.blockRefs {
+			ids[id] = true
+		}
+		return ids
+	}
+
+	// Pinning "a" fetches the root, "a" and its four files.
+	bops.takeGets()
+	err = kbfsOps.SetSyncPolicy(ctx, dirNode, true)
+	require.NoError(t, err)
+	require.Equal(t, 6, bops.takeGets())
+	oldPinned := pinnedBlocks()
+	require.Len(t, oldPinned, 6)
+	for id := range oldPinned {
+		require.True(t, isDiskBlockPinned(cache, fb.Tlf, id))
+	}
+
+	// A write outside of "a" only refetches the path to it.
+	writeFile(rootNode, "g", []byte{2})
+	bops.takeGets()
+	err = fp.sync(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, bops.takeGets())
+
+	// A new file in "a" only fetches "a" and the new file.
+	writeFile(dirNode, "h", []byte("h"))
+	bops.takeGets()
+	err = fp.sync(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 3, bops.takeGets())
+	newPinned := pinnedBlocks()
+	require.Len(t, newPinned, 7)
+	for id := range oldPinned {
+		// The old root and "a" blocks are replaced, but the four
+		// unchanged files stay pinned.
+		require.Equal(t, newPinned[id],
+			isDiskBlockPinned(cache, fb.Tlf, id))
+	}
+	for id := range newPinned {
+		require.True(t, isDiskBlockPinned(cache, fb.Tlf, id))
+	}
+
+	// Syncing again at the same revision is a no-op.
+	err = fp.sync(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, bops.takeGets())
+
+	// Unpinning releases everything.
+	err = kbfsOps.SetSyncPolicy(ctx, dirNode, false)
+	require.NoError(t, err)
+	require.Len(t, pinnedBlocks(), 0)
+	for id := range newPinned {
+		require.False(t, isDiskBlockPinned(cache, fb.Tlf, id))
+	}
+}
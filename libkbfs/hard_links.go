@@ -0,0 +1,823 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"golang.org/x/net/context"
+)
+
+// Hard links are implemented by giving each link its own directory
+// entry, with its own references to the same file blocks.  The
+// entries in a group are tied together by a group ID stored in each
+// entry (DirEntry.HardLink), which moves along with the entry when
+// it's renamed.  PrivateMetadata.HardLinks maps each group ID to the
+// paths of its links, which are used as hints to find the other
+// links without scanning the whole tree.  Renames and removals
+// update the hints in the same MD revision, but a hint can still go
+// stale (e.g., because of a rename resolved by conflict resolution),
+// so every hint is checked against the group ID of the entry it
+// names.  If any of them are wrong, the whole tree is scanned in the
+// background, without holding mdWriterLock, and the next write to
+// the group repairs the hints with what the scan found (see
+// folderBranchOps.findHardLinksLocked).
+//
+// Whenever one link is synced, or its attributes are changed, the
+// change is copied into every other link in its group, as part of
+// the same MD revision.  Unsynced writes to a group all go through
+// whichever of its links was dirtied first (see
+// folderBranchOps.hardLinkTarget), so that syncing one link never
+// overwrites the unsynced writes made through another.
+
+// hardLinkPath returns the path of p relative to the root directory,
+// in the form used by PrivateMetadata.HardLinks.
+func hardLinkPath(p path) string {
+	names := make([]string, 0, len(p.path))
+	for _, pn := range p.path[1:] {
+		names = append(names, pn.Name)
+	}
+	return strings.Join(names, "/")
+}
+
+// hardLinkCount returns the number of links in the given group, or
+// 0 if there is no such group.
+func (p PrivateMetadata) hardLinkCount(id string) uint32 {
+	if id == "" {
+		return 0
+	}
+	return uint32(len(p.HardLinks[id]))
+}
+
+// newHardLinkGroupID returns an ID for a new hard link group, based
+// on the given string, that isn't used by any existing group.
+func (p PrivateMetadata) newHardLinkGroupID(base string) string {
+	id := base
+	for i := 1; ; i++ {
+		if _, ok := p.HardLinks[id]; !ok {
+			return id
+		}
+		id = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// addHardLink adds the given path to the hard link group with the
+// given ID, creating the group if needed.
+func (p *PrivateMetadata) addHardLink(id string, linkPath string) {
+	if p.HardLinks == nil {
+		p.HardLinks = make(map[string][]string)
+	}
+	for _, lp := range p.HardLinks[id] {
+		if lp == linkPath {
+			return
+		}
+	}
+	// Never modify a path slice in place, since it may be shared
+	// with a previous revision.
+	paths := append([]string(nil), p.HardLinks[id]...)
+	p.HardLinks[id] = append(paths, linkPath)
+}
+
+// removeHardLink removes the given path from the hard link group
+// with the given ID, if it's there.  A group left with only one link
+// is removed completely.
+func (p *PrivateMetadata) removeHardLink(id string, linkPath string) {
+	paths, ok := p.HardLinks[id]
+	if !ok {
+		return
+	}
+	var newPaths []string
+	for _, lp := range paths {
+		if lp != linkPath {
+			newPaths = append(newPaths, lp)
+		}
+	}
+	if len(newPaths) < 2 {
+		delete(p.HardLinks, id)
+		return
+	}
+	p.HardLinks[id] = newPaths
+}
+
+// hasHardLink returns whether the given path is one of the hints
+// for the hard link group with the given ID.
+func (p PrivateMetadata) hasHardLink(id string, linkPath string) bool {
+	for _, lp := range p.HardLinks[id] {
+		if lp == linkPath {
+			return true
+		}
+	}
+	return false
+}
+
+// setHardLinks replaces the paths of the hard link group with the
+// given ID.  A group with fewer than two links is removed.
+func (p *PrivateMetadata) setHardLinks(id string, paths []string) {
+	if len(paths) < 2 {
+		delete(p.HardLinks, id)
+		return
+	}
+	if p.HardLinks == nil {
+		p.HardLinks = make(map[string][]string)
+	}
+	p.HardLinks[id] = paths
+}
+
+// renameHardLinks updates all the links at or under oldPath to be at
+// or under newPath instead.
+func (p *PrivateMetadata) renameHardLinks(oldPath, newPath string) {
+	for id, paths := range p.HardLinks {
+		var newPaths []string
+		for i, lp := range paths {
+			var renamed string
+			switch {
+			case lp == oldPath:
+				renamed = newPath
+			case strings.HasPrefix(lp, oldPath+"/"):
+				renamed = newPath + lp[len(oldPath):]
+			default:
+				continue
+			}
+			if newPaths == nil {
+				newPaths = append([]string(nil), paths...)
+			}
+			newPaths[i] = renamed
+		}
+		if newPaths != nil {
+			p.HardLinks[id] = newPaths
+		}
+	}
+}
+
+// mergeHardLinks does a three-way merge of the hard link groups from
+// the merged and unmerged branches of a TLF, given the groups as of
+// the branch point.  Links added or removed on the unmerged branch
+// are added to or removed from the merged groups.
+func mergeHardLinks(
+	base, merged, unmerged map[string][]string) map[string][]string {
+	inBase := func(id, lp string) bool {
+		for _, p := range base[id] {
+			if p == lp {
+				return true
+			}
+		}
+		return false
+	}
+
+	result := PrivateMetadata{}
+	for id, paths := range merged {
+		for _, lp := range paths {
+			result.addHardLink(id, lp)
+		}
+	}
+	ids := make(map[string]bool, len(base)+len(unmerged))
+	for id := range base {
+		ids[id] = true
+	}
+	for id := range unmerged {
+		ids[id] = true
+	}
+	for id := range ids {
+		unmergedPaths := make(map[string]bool, len(unmerged[id]))
+		for _, lp := range unmerged[id] {
+			unmergedPaths[lp] = true
+			if !inBase(id, lp) {
+				result.addHardLink(id, lp)
+			}
+		}
+		for _, lp := range base[id] {
+			if unmergedPaths[lp] {
+				continue
+			}
+			result.removeHardLink(id, lp)
+		}
+	}
+	for id, paths := range result.HardLinks {
+		if len(paths) < 2 {
+			delete(result.HardLinks, id)
+		}
+	}
+	return result.HardLinks
+}
+
+// copyHardLinkAttrs copies the attributes shared by all the links in
+// a hard link group from src into de.
+func (de *DirEntry) copyHardLinkAttrs(src DirEntry) {
+	de.Type = src.Type
+	de.Mtime = src.Mtime
+	de.Ctime = src.Ctime
+	// The map is never modified in place, so it can be shared.
+	de.Xattrs = src.Xattrs
+}
+
+// hardLinkLocation is where one of the links in a hard link group
+// lives.
+type hardLinkLocation struct {
+	parent path
+	name   string
+	de     DirEntry
+}
+
+func (hll hardLinkLocation) isAt(parent path, name string) bool {
+	return hll.parent.tailPointer() == parent.tailPointer() &&
+		hll.name == name
+}
+
+// getDirForHardLinksLocked returns the block for dir from lbc if it's
+// there, and otherwise from the cache or server.  Blocks fetched for
+// writing are added to lbc, so that later changes to them are synced
+// along with everything else in lbc.
+func (fbo *folderBranchOps) getDirForHardLinksLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, dir path, lbc localBcache,
+	rtype blockReqType) (*DirBlock, error) {
+	if dblock, ok := lbc[dir.tailPointer()]; ok {
+		return dblock, nil
+	}
+	dblock, err := fbo.blocks.GetDir(ctx, lState, md.ReadOnly(), dir, rtype)
+	if err != nil {
+		return nil, err
+	}
+	if rtype == blockWrite {
+		lbc[dir.tailPointer()] = dblock
+	}
+	return dblock, nil
+}
+
+func (fbo *folderBranchOps) hardLinkRootPath(md ReadOnlyRootMetadata) path {
+	return path{
+		FolderBranch: fbo.folderBranch,
+		path: []pathNode{{
+			BlockPointer: md.data.Dir.BlockPointer,
+			Name:         string(md.GetTlfHandle().GetCanonicalName()),
+		}},
+	}
+}
+
+// lookupHardLinkLocked returns the location of the entry named by
+// the given hint, or false if there's no such entry.
+func (fbo *folderBranchOps) lookupHardLinkLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, linkPath string,
+	lbc localBcache) (hardLinkLocation, bool, error) {
+	names := strings.Split(linkPath, "/")
+	parent := fbo.hardLinkRootPath(md.ReadOnly())
+	for i, name := range names {
+		dblock, err := fbo.getDirForHardLinksLocked(
+			ctx, lState, md, parent, lbc, blockRead)
+		if err != nil {
+			return hardLinkLocation{}, false, err
+		}
+		de, ok := dblock.Children[name]
+		if !ok {
+			return hardLinkLocation{}, false, nil
+		}
+		if i == len(names)-1 {
+			return hardLinkLocation{parent, name, de}, true, nil
+		}
+		if de.Type != Dir {
+			return hardLinkLocation{}, false, nil
+		}
+		parent = parent.ChildPath(name, de.BlockPointer)
+	}
+	return hardLinkLocation{}, false, nil
+}
+
+// scanForHardLinks returns the sorted paths of all the entries in the
+// hard link group with the given ID, as of the current head, by looking
+// at every directory in the TLF.  It doesn't hold mdWriterLock, so
+// the result must be checked again before it's used.
+func (fbo *folderBranchOps) scanForHardLinks(ctx context.Context,
+	lState *lockState, id string) ([]string, error) {
+	md, err := fbo.getMDForReadNoIdentify(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	dirs := []path{fbo.hardLinkRootPath(md.ReadOnly())}
+	for len(dirs) > 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+		dblock, err := fbo.blocks.GetDir(
+			ctx, lState, md.ReadOnly(), dir, blockRead)
+		if err != nil {
+			return nil, err
+		}
+		for name, de := range dblock.Children {
+			if de.Type == Dir {
+				dirs = append(dirs, dir.ChildPath(name, de.BlockPointer))
+			} else if de.HardLink == id {
+				paths = append(paths,
+					hardLinkPath(dir.ChildPathNoPtr(name)))
+			}
+		}
+	}
+	sort.Strings(paths)
+	fbo.log.CDebugf(ctx, "Found hard links %v for group %s", paths, id)
+	return paths, nil
+}
+
+// repairHardLinksInBackground starts a scan for the links of the hard
+// link group with the given ID, unless one has already been started,
+// and saves the result for findHardLinksLocked.
+func (fbo *folderBranchOps) repairHardLinksInBackground(id string) {
+	fbo.hardLinkRepairsLock.Lock()
+	defer fbo.hardLinkRepairsLock.Unlock()
+	if _, ok := fbo.hardLinkRepairs[id]; ok {
+		return
+	}
+	if fbo.hardLinkRepairs == nil {
+		fbo.hardLinkRepairs = make(map[string][]string)
+	}
+	fbo.hardLinkRepairs[id] = nil
+
+	go func() {
+		_ = fbo.runUnlessShutdown(func(ctx context.Context) error {
+			paths, err := fbo.scanForHardLinks(ctx, makeFBOLockState(), id)
+			fbo.hardLinkRepairsLock.Lock()
+			defer fbo.hardLinkRepairsLock.Unlock()
+			if err != nil {
+				fbo.log.CDebugf(ctx, "Couldn't scan for hard links in "+
+					"group %s: %v", id, err)
+				delete(fbo.hardLinkRepairs, id)
+				return err
+			}
+			fbo.hardLinkRepairs[id] = paths
+			return nil
+		})
+	}()
+}
+
+// takeHardLinkRepair returns the paths found by a finished
+// background scan for the hard link group with the given ID, if
+// there is one.
+func (fbo *folderBranchOps) takeHardLinkRepair(id string) ([]string, bool) {
+	fbo.hardLinkRepairsLock.Lock()
+	defer fbo.hardLinkRepairsLock.Unlock()
+	paths := fbo.hardLinkRepairs[id]
+	if paths == nil {
+		return nil, false
+	}
+	delete(fbo.hardLinkRepairs, id)
+	return paths, true
+}
+
+// findHardLinksLocked returns the locations of all the entries in
+// the hard link group with the given ID, as of md, using the hints
+// in md.  self is the path of the link being changed, which should
+// be one of them.  Directory blocks in lbc take precedence over
+// cached ones.  If any of the hints are stale, it only returns the
+// links that the valid hints lead to, and starts a background scan
+// of the whole TLF; a later call merges the links found by that scan
+// into the result, and repairs the hints in md.
+func (fbo *folderBranchOps) findHardLinksLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, id string, self string,
+	lbc localBcache) ([]hardLinkLocation, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	stale := !md.data.hasHardLink(id, self)
+	links := make([]hardLinkLocation, 0, len(md.data.HardLinks[id]))
+	paths := make([]string, 0, len(md.data.HardLinks[id]))
+	found := make(map[string]bool, len(md.data.HardLinks[id]))
+	addLinks := func(linkPaths []string) error {
+		for _, linkPath := range linkPaths {
+			if found[linkPath] {
+				continue
+			}
+			link, ok, err := fbo.lookupHardLinkLocked(
+				ctx, lState, md, linkPath, lbc)
+			if err != nil {
+				return err
+			}
+			if !ok || link.de.HardLink != id {
+				fbo.log.CDebugf(ctx, "Stale hard link %s in group %s",
+					linkPath, id)
+				stale = true
+				continue
+			}
+			found[linkPath] = true
+			links = append(links, link)
+			paths = append(paths, linkPath)
+		}
+		return nil
+	}
+	err := addLinks(md.data.HardLinks[id])
+	if err != nil {
+		return nil, err
+	}
+	if !stale {
+		return links, nil
+	}
+
+	if repaired, ok := fbo.takeHardLinkRepair(id); ok {
+		// The links found by the scan are checked again, since
+		// the tree may have changed since then.
+		err := addLinks(append(repaired, self))
+		if err != nil {
+			return nil, err
+		}
+		md.data.setHardLinks(id, paths)
+		return links, nil
+	}
+	fbo.repairHardLinksInBackground(id)
+	return links, nil
+}
+
+// removeHardLinkLocked removes the entry named name in dir, which
+// is about to be unlinked, from its hard link group, if any.
+func (fbo *folderBranchOps) removeHardLinkLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, dir path, name string,
+	de DirEntry) error {
+	if de.HardLink == "" {
+		return nil
+	}
+	linkPath := hardLinkPath(dir.ChildPathNoPtr(name))
+	if !md.data.hasHardLink(de.HardLink, linkPath) {
+		// The hints must be stale, so fix them up, if a scan has
+		// already found the right ones, before removing this link,
+		// to get the link count right.
+		_, err := fbo.findHardLinksLocked(
+			ctx, lState, md, de.HardLink, linkPath, nil)
+		if err != nil {
+			return err
+		}
+	}
+	md.data.removeHardLink(de.HardLink, linkPath)
+	return nil
+}
+
+// readyHardLinkDirsLocked readies the given directories, which must
+// already be in lbc, and all of their ancestors that aren't on keep,
+// deepest first, writing the new block info of each one into its
+// parent.  The updates are added to the last op in md.  The
+// directories on keep stay in lbc, for the caller to sync along with
+// the rest of keep using syncBlock.
+func (fbo *folderBranchOps) readyHardLinkDirsLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, uid keybase1.UID, keep path,
+	dirs []path, lbc localBcache, bps *blockPutState) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	onKeep := make(map[BlockPointer]bool, len(keep.path))
+	for _, pn := range keep.path {
+		onKeep[pn.BlockPointer] = true
+	}
+	toReady := make(map[BlockPointer]path)
+	maxDepth := 0
+	for _, dir := range dirs {
+		// The root is always on keep, so this always terminates.
+		for p := dir; !onKeep[p.tailPointer()]; p = *p.parentPath() {
+			toReady[p.tailPointer()] = p
+			if len(p.path) > maxDepth {
+				maxDepth = len(p.path)
+			}
+		}
+	}
+
+	for depth := maxDepth; depth > 1; depth-- {
+		for ptr, p := range toReady {
+			if len(p.path) != depth {
+				continue
+			}
+			dblock, ok := lbc[ptr]
+			if !ok {
+				return fmt.Errorf("No modified block for %v", p)
+			}
+			info, plainSize, err := fbo.readyBlockMultiple(
+				ctx, md.ReadOnly(), dblock, uid, bps)
+			if err != nil {
+				return err
+			}
+			pblock, err := fbo.getDirForHardLinksLocked(
+				ctx, lState, md, *p.parentPath(), lbc, blockWrite)
+			if err != nil {
+				return err
+			}
+			de, ok := pblock.Children[p.tailName()]
+			if !ok {
+				return NoSuchNameError{p.tailName()}
+			}
+			md.AddUpdate(de.BlockInfo, info)
+			de.BlockInfo = info
+			de.Size = uint64(plainSize)
+			pblock.Children[p.tailName()] = de
+			delete(lbc, ptr)
+		}
+	}
+	return nil
+}
+
+// syncHardLinksLocked copies the contents of file, which is being
+// synced as part of md with the given new top block and syncOp, into
+// all the other links in its hard link group.  Each other link gets
+// its own syncOp covering the whole file, and the file's syncOp is
+// moved after them, so the caller's syncBlock call attributes the
+// remaining updates to it.  The new blocks are added to bps, and new
+// references to them are added to refBps, which must only be put
+// once bps and fileBps have been.  It returns the block the caller
+// should pass to syncBlock for the file, which is already readied
+// into fileBps if the links share it, and true if the file is
+// hard-linked, in which case it has already set the times of the
+// file's entry (to match the other links), and syncBlock shouldn't
+// set them again.
+//
+// A link with unsynced writes of its own is left alone; its writes
+// are copied over this file when it is synced.  That only happens
+// for racing writes, since unsynced writes to the group normally
+// all go through the same link (see hardLinkTarget).
+func (fbo *folderBranchOps) syncHardLinksLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, uid keybase1.UID, file path,
+	fblock *FileBlock, so *syncOp, fileBps *blockPutState, lbc localBcache,
+	bps, refBps *blockPutState) (top Block, linked bool, err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	parentPath := *file.parentPath()
+	dblock, err := fbo.getDirForHardLinksLocked(
+		ctx, lState, md, parentPath, lbc, blockWrite)
+	if err != nil {
+		return nil, false, err
+	}
+	de, ok := dblock.Children[file.tailName()]
+	if !ok || de.HardLink == "" {
+		return fblock, false, nil
+	}
+	now := fbo.nowUnixNano()
+	de.Mtime = now
+	de.Ctime = now
+	dblock.Children[file.tailName()] = de
+
+	links, err := fbo.findHardLinksLocked(
+		ctx, lState, md, de.HardLink, hardLinkPath(file), lbc)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// A direct top block is readied once, for the file itself, and
+	// shared by all the other links with a new reference each, like
+	// the top block of a copied file (see copyFileBlocksLocked).  An
+	// indirect one needs new references to its children for each
+	// link, so it has to be readied for each of them.  If journaling
+	// is enabled, new references aren't supported, so even a direct
+	// block has to be readied for each link.  TODO: remove this when
+	// KBFS-1149 is fixed.
+	top = fblock
+	var shared *readiedBlock
+	shareTop := !fblock.IsInd && !TLFJournalEnabled(fbo.config, fbo.id())
+
+	// Child blocks that haven't been put yet can't get new
+	// references, so they'll have to be readied again.
+	newBlocks := make(map[BlockPointer]Block, len(fileBps.blockStates))
+	for _, bs := range fileBps.blockStates {
+		newBlocks[bs.blockPtr] = bs.block
+	}
+
+	var dirs []path
+	for _, link := range links {
+		if link.isAt(parentPath, file.tailName()) {
+			continue
+		}
+		linkPath := link.parent.ChildPath(link.name, link.de.BlockPointer)
+		if fbo.blocks.IsDirty(lState, linkPath) {
+			fbo.log.CDebugf(ctx, "Not syncing dirty hard link %v", linkPath)
+			continue
+		}
+
+		lso, err := newSyncOp(link.de.BlockPointer)
+		if err != nil {
+			return nil, false, err
+		}
+		lso.addTruncate(0)
+		lso.addWrite(0, de.Size)
+		md.AddOp(lso)
+
+		// The top block is unreferenced by the update below.
+		blockInfos, err := fbo.blocks.GetIndirectFileBlockInfos(
+			ctx, lState, md.ReadOnly(), linkPath)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, info := range blockInfos {
+			md.AddUnrefBlock(info)
+		}
+
+		var info BlockInfo
+		if shareTop {
+			if shared == nil {
+				info, plainSize, err := fbo.readyBlockMultiple(
+					ctx, md.ReadOnly(), fblock, uid, fileBps)
+				if err != nil {
+					return nil, false, err
+				}
+				shared = &readiedBlock{fblock, info, plainSize}
+				top = *shared
+			}
+			info = shared.info
+			info.RefNonce, err = fbo.config.Crypto().MakeBlockRefNonce()
+			if err != nil {
+				return nil, false, err
+			}
+			info.SetWriter(uid)
+			refBps.addNewBlock(info.BlockPointer, nil, ReadyBlockData{}, nil)
+		} else {
+			// The copy keeps the links' blocks separate from the
+			// file's own in the block cache.
+			lblock, err := fblock.DeepCopy(fbo.config.Codec())
+			if err != nil {
+				return nil, false, err
+			}
+			err = fbo.refFileChildBlocksLocked(
+				ctx, lState, md, uid, file, lblock, newBlocks, bps)
+			if err != nil {
+				return nil, false, err
+			}
+			info, _, err = fbo.readyBlockMultiple(
+				ctx, md.ReadOnly(), lblock, uid, bps)
+			if err != nil {
+				return nil, false, err
+			}
+		}
+		md.AddUpdate(link.de.BlockInfo, info)
+
+		pblock, err := fbo.getDirForHardLinksLocked(
+			ctx, lState, md, link.parent, lbc, blockWrite)
+		if err != nil {
+			return nil, false, err
+		}
+		lde := pblock.Children[link.name]
+		lde.BlockInfo = info
+		lde.Size = de.Size
+		lde.copyHardLinkAttrs(de)
+		pblock.Children[link.name] = lde
+		dirs = append(dirs, link.parent)
+	}
+	if len(dirs) == 0 {
+		return top, true, nil
+	}
+
+	ops := make(opsList, 0, len(md.data.Changes.Ops))
+	for _, o := range md.data.Changes.Ops {
+		if o != so {
+			ops = append(ops, o)
+		}
+	}
+	md.data.Changes.Ops = append(ops, so)
+
+	err = fbo.readyHardLinkDirsLocked(
+		ctx, lState, md, uid, parentPath, dirs, lbc, bps)
+	if err != nil {
+		return nil, false, err
+	}
+	return top, true, nil
+}
+
+// syncHardLinkAttrsLocked copies the attributes of the entry changed
+// by sao, de, into all the other links in its hard link group, and
+// then syncs dblock (the entry's parent directory block, which
+// already contains de) and finalizes md.  Each other link gets its
+// own setAttrOp, which follows sao in md; like the ops following a
+// resolutionOp made by conflict resolution, they just refer to the
+// new pointers of their directories, since sao carries all of the
+// updates.
+func (fbo *folderBranchOps) syncHardLinkAttrsLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, sao *setAttrOp, dir path,
+	dblock *DirBlock, de DirEntry) (err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	lbc := localBcache{dir.tailPointer(): dblock}
+	links, err := fbo.findHardLinksLocked(ctx, lState, md, de.HardLink,
+		hardLinkPath(dir.ChildPathNoPtr(sao.Name)), lbc)
+	if err != nil {
+		return err
+	}
+
+	bps := newBlockPutState(len(links))
+	var dirs []path
+	var linkOps []*setAttrOp
+	for _, link := range links {
+		if link.isAt(dir, sao.Name) {
+			continue
+		}
+		pblock, err := fbo.getDirForHardLinksLocked(
+			ctx, lState, md, link.parent, lbc, blockWrite)
+		if err != nil {
+			return err
+		}
+		lde := pblock.Children[link.name]
+		lde.copyHardLinkAttrs(de)
+		pblock.Children[link.name] = lde
+
+		lsao, err := newSetAttrOp(link.name, link.parent.tailPointer(),
+			sao.Attr, lde.BlockPointer)
+		if err != nil {
+			return err
+		}
+		lsao.XattrName = sao.XattrName
+		linkOps = append(linkOps, lsao)
+		dirs = append(dirs, link.parent)
+	}
+
+	err = fbo.readyHardLinkDirsLocked(
+		ctx, lState, md, uid, dir, dirs, lbc, bps)
+	if err != nil {
+		return err
+	}
+	_, _, syncBps, err := fbo.syncBlockLocked(
+		ctx, lState, uid, md, dblock, *dir.parentPath(), dir.tailName(),
+		Dir, false, false, zeroPtr, lbc)
+	if err != nil {
+		return err
+	}
+	bps.mergeOtherBps(syncBps)
+
+	defer func() {
+		if err != nil {
+			fbo.fbm.cleanUpBlockState(
+				md.ReadOnly(), bps, blockDeleteOnMDFail)
+		}
+	}()
+
+	updates := make(map[BlockPointer]BlockPointer)
+	for _, update := range sao.AllUpdates() {
+		updates[update.Unref] = update.Ref
+	}
+	for _, lsao := range linkOps {
+		newDir, ok := updates[lsao.Dir.Unref]
+		if !ok {
+			return fmt.Errorf("No update for hard link directory %v",
+				lsao.Dir.Unref)
+		}
+		lsao.Dir, err = makeBlockUpdate(newDir, newDir)
+		if err != nil {
+			return err
+		}
+		md.AddOp(lsao)
+	}
+
+	err = fbo.unembedBlockChangesIfNeeded(ctx, bps, md, uid)
+	if err != nil {
+		return err
+	}
+
+	_, err = doBlockPuts(ctx, fbo.config.BlockServer(),
+		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, md.TlfID(),
+		md.GetTlfHandle().GetCanonicalName(), *bps)
+	if err != nil {
+		return err
+	}
+	return fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl)
+}
+
+// hardLinkTarget returns the node that reads, writes and syncs of
+// file should go through: another link in the hard link group of
+// file that already has unsynced writes, if there is one, and
+// otherwise file itself.  This keeps all of a group's unsynced
+// writes on one link, so that syncing it copies all of them into the
+// other links, and none of them are lost.
+func (fbo *folderBranchOps) hardLinkTarget(
+	ctx context.Context, lState *lockState, file Node) (Node, error) {
+	head := fbo.getHead(lState)
+	if head == (ImmutableRootMetadata{}) || len(head.data.HardLinks) == 0 {
+		return file, nil
+	}
+	dirtyNodes := fbo.status.getDirtyNodes()
+	for _, n := range dirtyNodes {
+		if n.GetID() == file.GetID() {
+			return file, nil
+		}
+	}
+	if len(dirtyNodes) == 0 {
+		return file, nil
+	}
+
+	de, err := fbo.statEntry(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	if de.HardLink == "" {
+		return file, nil
+	}
+	for _, n := range dirtyNodes {
+		nde, err := fbo.statEntry(ctx, n)
+		if err != nil {
+			// The node may have been unlinked, in which case
+			// it's no longer part of the group.
+			fbo.log.CDebugf(ctx, "Couldn't stat dirty node %p: %v",
+				n.GetID(), err)
+			continue
+		}
+		if nde.HardLink == de.HardLink {
+			fbo.log.CDebugf(ctx, "Using dirty hard link %p for %p",
+				n.GetID(), file.GetID())
+			return n, nil
+		}
+	}
+	return file, nil
+}
@@ -0,0 +1,381 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestHardLinksAddRemove(t *testing.T) {
+	var pmd PrivateMetadata
+	pmd.addHardLink("g", "a/f")
+	pmd.addHardLink("g", "b/f")
+	pmd.addHardLink("g", "b/f")
+	require.Equal(t, uint32(2), pmd.hardLinkCount("g"))
+	require.Equal(t, uint32(0), pmd.hardLinkCount("h"))
+	require.Equal(t, uint32(0), pmd.hardLinkCount(""))
+
+	// The old path slice must not be modified in place.
+	old := pmd.HardLinks["g"]
+	pmd.addHardLink("g", "c")
+	require.Equal(t, []string{"a/f", "b/f"}, old)
+	require.Equal(t, uint32(3), pmd.hardLinkCount("g"))
+
+	pmd.removeHardLink("g", "b/f")
+	pmd.removeHardLink("h", "a/f")
+	require.Equal(t, []string{"a/f", "c"}, pmd.HardLinks["g"])
+
+	// A group with a single link left is removed.
+	pmd.removeHardLink("g", "c")
+	require.Equal(t, uint32(0), pmd.hardLinkCount("g"))
+	require.Len(t, pmd.HardLinks, 0)
+
+	require.Equal(t, "g", pmd.newHardLinkGroupID("g"))
+	pmd.addHardLink("g", "x")
+	require.Equal(t, "g-1", pmd.newHardLinkGroupID("g"))
+}
+
+func TestHardLinksRename(t *testing.T) {
+	var pmd PrivateMetadata
+	pmd.addHardLink("g", "a/f")
+	pmd.addHardLink("g", "ab/f")
+	pmd.addHardLink("g", "a")
+	old := pmd.HardLinks["g"]
+
+	pmd.renameHardLinks("a", "d/e")
+	require.Equal(t, []string{"d/e/f", "ab/f", "d/e"}, pmd.HardLinks["g"])
+	require.Equal(t, []string{"a/f", "ab/f", "a"}, old)
+}
+
+func TestHardLinksMerge(t *testing.T) {
+	base := map[string][]string{
+		"g1": {"a", "b", "c"},
+		"g2": {"x", "y"},
+	}
+	merged := map[string][]string{
+		"g1": {"a", "b", "c", "d"},
+		"g2": {"x", "y"},
+		"g3": {"m1", "m2"},
+	}
+	unmerged := map[string][]string{
+		"g1": {"a", "c", "e"},
+		"g4": {"u1", "u2"},
+	}
+	require.Equal(t, map[string][]string{
+		"g1": {"a", "c", "d", "e"},
+		"g3": {"m1", "m2"},
+		"g4": {"u1", "u2"},
+	}, mergeHardLinks(base, merged, unmerged))
+}
+
+func readHardLinkTestFile(
+	ctx context.Context, t *testing.T, kbfsOps KBFSOps, n Node,
+	size int) []byte {
+	buf := make([]byte, size)
+	nr, err := kbfsOps.Read(ctx, n, buf, 0)
+	require.NoError(t, err)
+	return buf[:nr]
+}
+
+func TestKBFSOpsCreateHardLink(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	// Use the smallest possible block size, so the file is indirect.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	rev := func() MetadataRevision {
+		return ops.getHead(lState).Revision()
+	}
+
+	dirA, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	dirB, _, err := kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+	fNode, _, err := kbfsOps.CreateFile(ctx, dirA, "f", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, fNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fNode)
+	require.NoError(t, err)
+
+	// Linking tags both entries in a single revision.
+	oldRev := rev()
+	gNode, ei, err := kbfsOps.CreateHardLink(ctx, dirB, "g", fNode)
+	require.NoError(t, err)
+	require.Equal(t, oldRev+1, rev())
+	require.Equal(t, uint32(2), ei.Nlink)
+	require.Equal(t, uint64(len(data)), ei.Size)
+	_, ei, err = kbfsOps.Lookup(ctx, dirA, "f")
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), ei.Nlink)
+	children, err := kbfsOps.GetDirChildren(ctx, dirB)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), children["g"].Nlink)
+	fEntry, err := ops.statEntry(ctx, fNode)
+	require.NoError(t, err)
+	gEntry, err := ops.statEntry(ctx, gNode)
+	require.NoError(t, err)
+	require.NotEqual(t, "", fEntry.HardLink)
+	require.Equal(t, fEntry.HardLink, gEntry.HardLink)
+	require.Equal(t, data, readHardLinkTestFile(ctx, t, kbfsOps, gNode, 200))
+
+	_, _, err = kbfsOps.CreateHardLink(ctx, dirB, "g", fNode)
+	require.IsType(t, NameExistsError{}, err)
+
+	// A write through one link shows up in the other, in the same
+	// revision.
+	err = kbfsOps.Write(ctx, gNode, []byte{255}, 0)
+	require.NoError(t, err)
+	oldRev = rev()
+	err = kbfsOps.Sync(ctx, gNode)
+	require.NoError(t, err)
+	require.Equal(t, oldRev+1, rev())
+	data[0] = 255
+	require.Equal(t, data, readHardLinkTestFile(ctx, t, kbfsOps, fNode, 200))
+	fEi, err := kbfsOps.Stat(ctx, fNode)
+	require.NoError(t, err)
+	gEi, err := kbfsOps.Stat(ctx, gNode)
+	require.NoError(t, err)
+	require.Equal(t, gEi.Mtime, fEi.Mtime)
+
+	// Renaming the parent of a link doesn't break the group.
+	err = kbfsOps.Rename(ctx, rootNode, "a", dirB, "c")
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fNode, []byte{254, 253}, 1)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fNode)
+	require.NoError(t, err)
+	data[1], data[2] = 254, 253
+	require.Equal(t, data, readHardLinkTestFile(ctx, t, kbfsOps, gNode, 200))
+	require.Equal(t, []string{"b/c/f", "b/g"},
+		ops.getHead(lState).data.HardLinks[fEntry.HardLink])
+
+	// Removing one link leaves the other one unlinked.
+	err = kbfsOps.RemoveEntry(ctx, dirB, "g")
+	require.NoError(t, err)
+	fEi, err = kbfsOps.Stat(ctx, fNode)
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), fEi.Nlink)
+	require.Len(t, ops.getHead(lState).data.HardLinks, 0)
+	require.Equal(t, data, readHardLinkTestFile(ctx, t, kbfsOps, fNode, 200))
+}
+
+func TestKBFSOpsHardLinkAttrs(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+
+	dirA, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	fNode, _, err := kbfsOps.CreateFile(ctx, dirA, "f", false, NoExcl)
+	require.NoError(t, err)
+	gNode, _, err := kbfsOps.CreateHardLink(ctx, rootNode, "g", fNode)
+	require.NoError(t, err)
+	hNode, _, err := kbfsOps.CreateHardLink(ctx, dirA, "h", gNode)
+	require.NoError(t, err)
+
+	checkAll := func(check func(n Node)) {
+		for _, n := range []Node{fNode, gNode, hNode} {
+			check(n)
+		}
+	}
+
+	oldRev := ops.getHead(lState).Revision()
+	err = kbfsOps.SetEx(ctx, gNode, true)
+	require.NoError(t, err)
+	require.Equal(t, oldRev+1, ops.getHead(lState).Revision())
+	checkAll(func(n Node) {
+		ei, err := kbfsOps.Stat(ctx, n)
+		require.NoError(t, err)
+		require.Equal(t, Exec, ei.Type)
+		require.Equal(t, uint32(3), ei.Nlink)
+	})
+
+	mtime := time.Unix(1234, 5678)
+	err = kbfsOps.SetMtime(ctx, fNode, &mtime)
+	require.NoError(t, err)
+	checkAll(func(n Node) {
+		ei, err := kbfsOps.Stat(ctx, n)
+		require.NoError(t, err)
+		require.Equal(t, mtime.UnixNano(), ei.Mtime)
+	})
+
+	err = kbfsOps.SetXattr(ctx, hNode, "user.x", []byte("x"))
+	require.NoError(t, err)
+	checkAll(func(n Node) {
+		value, err := kbfsOps.GetXattr(ctx, n, "user.x")
+		require.NoError(t, err)
+		require.Equal(t, []byte("x"), value)
+	})
+	err = kbfsOps.RemoveXattr(ctx, fNode, "user.x")
+	require.NoError(t, err)
+	checkAll(func(n Node) {
+		_, err := kbfsOps.GetXattr(ctx, n, "user.x")
+		require.IsType(t, NoSuchXattrError{}, err)
+	})
+}
+
+func TestKBFSOpsHardLinkDirtyLinks(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+
+	fNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fNode, []byte{1, 2, 3, 4}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fNode)
+	require.NoError(t, err)
+	gNode, _, err := kbfsOps.CreateHardLink(ctx, rootNode, "g", fNode)
+	require.NoError(t, err)
+
+	// Writing through g while f is dirty goes to f, so neither write
+	// is lost, and both links see both writes before any sync.
+	err = kbfsOps.Write(ctx, fNode, []byte{5}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, gNode, []byte{6}, 3)
+	require.NoError(t, err)
+	require.Equal(t, []byte{5, 2, 3, 6},
+		readHardLinkTestFile(ctx, t, kbfsOps, gNode, 10))
+	require.Equal(t, []byte{5, 2, 3, 6},
+		readHardLinkTestFile(ctx, t, kbfsOps, fNode, 10))
+	ei, err := kbfsOps.Stat(ctx, gNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), ei.Size)
+
+	err = kbfsOps.Sync(ctx, gNode)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fNode)
+	require.NoError(t, err)
+	for _, n := range []Node{fNode, gNode} {
+		require.Equal(t, []byte{5, 2, 3, 6},
+			readHardLinkTestFile(ctx, t, kbfsOps, n, 10))
+	}
+}
+
+func TestKBFSOpsHardLinkSharedDirectBlock(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+
+	fNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fNode)
+	require.NoError(t, err)
+	gNode, _, err := kbfsOps.CreateHardLink(ctx, rootNode, "g", fNode)
+	require.NoError(t, err)
+
+	// A synced write puts a single top block, and the other link
+	// gets a new reference to it.
+	err = kbfsOps.Write(ctx, fNode, []byte{4}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fNode)
+	require.NoError(t, err)
+	fEntry, err := ops.statEntry(ctx, fNode)
+	require.NoError(t, err)
+	gEntry, err := ops.statEntry(ctx, gNode)
+	require.NoError(t, err)
+	require.Equal(t, fEntry.ID, gEntry.ID)
+	require.NotEqual(t, fEntry.RefNonce, gEntry.RefNonce)
+	require.Equal(t, []byte{4, 2, 3},
+		readHardLinkTestFile(ctx, t, kbfsOps, gNode, 10))
+
+	// Removing one link leaves the shared block readable through
+	// the other.
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "f")
+	require.NoError(t, err)
+	require.Equal(t, []byte{4, 2, 3},
+		readHardLinkTestFile(ctx, t, kbfsOps, gNode, 10))
+}
+
+func TestKBFSOpsHardLinkStaleHints(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+
+	fNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fNode)
+	require.NoError(t, err)
+	gNode, _, err := kbfsOps.CreateHardLink(ctx, rootNode, "g", fNode)
+	require.NoError(t, err)
+	gEntry, err := ops.statEntry(ctx, gNode)
+	require.NoError(t, err)
+	id := gEntry.HardLink
+
+	// Drop g from the hints, as if they were stale.
+	func() {
+		ops.headLock.Lock(lState)
+		defer ops.headLock.Unlock(lState)
+		ops.head.data.HardLinks = map[string][]string{id: {"f"}}
+	}()
+
+	// A sync through g still updates f, using the valid hint, and
+	// starts a scan in the background.
+	err = kbfsOps.Write(ctx, gNode, []byte{4}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, gNode)
+	require.NoError(t, err)
+	require.Equal(t, []byte{4, 2, 3},
+		readHardLinkTestFile(ctx, t, kbfsOps, fNode, 10))
+	for {
+		ops.hardLinkRepairsLock.Lock()
+		paths, ok := ops.hardLinkRepairs[id]
+		ops.hardLinkRepairsLock.Unlock()
+		require.True(t, ok)
+		if paths != nil {
+			require.Equal(t, []string{"f", "g"}, paths)
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The next change to the group repairs the hints.
+	err = kbfsOps.Write(ctx, gNode, []byte{5}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, gNode)
+	require.NoError(t, err)
+	require.Equal(t, []string{"f", "g"},
+		ops.getHead(lState).data.HardLinks[id])
+	require.Equal(t, []byte{5, 2, 3},
+		readHardLinkTestFile(ctx, t, kbfsOps, fNode, 10))
+}
@@ -63,8 +63,66 @@ type InitParams struct {
 	// directory to put write journals in. If non-empty, enables
 	// write journaling to be turned on for TLFs.
 	WriteJournalRoot string
+	// JournalLimits bounds the unflushed data kept in the write
+	// journals.
+	JournalLimits JournalLimits
+	// JournalFlushLimit restricts how fast, and when, the write
+	// journals flush in the background.
+	JournalFlushLimit JournalFlushLimit
+	// JournalStorage controls how the write journals keep their
+	// files on the local disk.
+	JournalStorage JournalStorageOptions
+
+	// DiskCacheRoot is the local directory in which to cache
+	// encrypted blocks across restarts.
+	DiskCacheRoot string
+	// DiskCacheMaxBytes is the maximum number of bytes of block
+	// data to keep in the disk cache.  If zero, the disk cache is
+	// disabled.
+	DiskCacheMaxBytes int64
+
+	// ConflictHistoryRoot, if non-empty, is the local directory in
+	// which to record the conflict resolutions done for each TLF.
+	// It's empty by default, since the record is unencrypted.
+	ConflictHistoryRoot string
+	// ConflictHistoryMaxAge is how long to keep each recorded
+	// conflict resolution.  If zero, they're kept forever.
+	ConflictHistoryMaxAge time.Duration
+
+	// PrefetchDepth is the number of blocks of a file to fetch
+	// ahead of a sequential reader.  If zero, blocks are only
+	// fetched on demand.
+	PrefetchDepth int
+	// PrefetchWorkers is the maximum number of blocks to prefetch
+	// in parallel.
+	PrefetchWorkers int
+
+	// BlockSplitter names the algorithm used to split files into
+	// blocks; either BlockSplitterNameSimple or
+	// BlockSplitterNameCDC.
+	BlockSplitter string
+
+	// BlockCompression, if true, compresses new blocks before
+	// encrypting them.  Clients that don't understand
+	// EncryptionSecretboxWithSnappy can't read such blocks.
+	BlockCompression bool
+
+	// ConflictRenameTemplate, if non-empty, is the template used
+	// to name the conflicting copies of files kept by conflict
+	// resolution; see TemplateConflictRenamer.
+	ConflictRenameTemplate string
 }
 
+const (
+	// BlockSplitterNameSimple splits files into fixed-size blocks.
+	BlockSplitterNameSimple = "simple"
+	// BlockSplitterNameCDC splits files at content-defined
+	// boundaries, so that similar files share most of their
+	// blocks.  Files written this way can't be read by clients
+	// that predate ContentDefinedChunksDataVer.
+	BlockSplitterNameCDC = "cdc"
+)
+
 // GetDefaultBServer returns the default value for the -bserver flag.
 func GetDefaultBServer(ctx Context) string {
 	switch ctx.GetRunMode() {
@@ -100,6 +158,11 @@ func DefaultInitParams(ctx Context) InitParams {
 		BServerAddr:      GetDefaultBServer(ctx),
 		MDServerAddr:     GetDefaultMDServer(ctx),
 		TLFValidDuration: tlfValidDurationDefault,
+		PrefetchDepth:    defaultPrefetchDepth,
+		PrefetchWorkers:  defaultPrefetchWorkers,
+		BlockSplitter:    BlockSplitterNameSimple,
+
+		ConflictHistoryMaxAge: defaultConflictHistoryMaxAge,
 		LogFileConfig: logger.LogFileConfig{
 			MaxAge:       30 * 24 * time.Hour,
 			MaxSize:      128 * 1024 * 1024,
@@ -134,6 +197,23 @@ func AddFlags(flags *flag.FlagSet, ctx Context) *InitParams {
 	// The default is to *DELETE* old log files for kbfs.
 	flags.IntVar(&params.LogFileConfig.MaxKeepFiles, "log-file-max-keep-files", defaultParams.LogFileConfig.MaxKeepFiles, "Maximum number of log files for this service, older ones are deleted. 0 for infinite.")
 	flags.StringVar(&params.WriteJournalRoot, "write-journal-root", filepath.Join(ctx.GetDataDir(), "kbfs_journal"), "(EXPERIMENTAL) If non-empty, permits write journals to be turned on for TLFs which will be put in the given directory")
+	flags.Var(SizeFlag{&params.JournalLimits.TLFBytes}, "journal-tlf-max-bytes", "Maximum unflushed bytes in the write journal of any one TLF; 0 means no limit")
+	flags.Int64Var(&params.JournalLimits.TLFFiles, "journal-tlf-max-files", 0, "Maximum unflushed blocks in the write journal of any one TLF; 0 means no limit")
+	flags.Var(SizeFlag{&params.JournalLimits.TotalBytes}, "journal-max-bytes", "Maximum unflushed bytes in all write journals together; 0 means no limit")
+	flags.Int64Var(&params.JournalLimits.TotalFiles, "journal-max-files", 0, "Maximum unflushed blocks in all write journals together; 0 means no limit")
+	flags.Var(SizeFlag{&params.JournalFlushLimit.BytesPerSecond}, "journal-flush-rate", "Maximum bytes per second flushed by all write journals together in the background; 0 means no limit")
+	flags.Var(journalFlushWindowFlag{&params.JournalFlushLimit}, "journal-flush-window", fmt.Sprintf("Local times of day between which write journals flush in the background, as HH:MM-HH:MM, or %q", journalFlushWindowAlways))
+	flags.BoolVar(&params.JournalStorage.Encrypt, "journal-encrypt", false, "(EXPERIMENTAL) Encrypt all write journal files with a key that only this device can decrypt; existing journals are migrated when they're enabled")
+	flags.BoolVar(&params.JournalStorage.SecureWipe, "journal-secure-wipe", false, "(EXPERIMENTAL) Overwrite write journal files before removing them once they're flushed")
+	flags.StringVar(&params.DiskCacheRoot, "disk-cache-root", filepath.Join(ctx.GetDataDir(), "kbfs_block_cache"), "(EXPERIMENTAL) Directory in which to cache encrypted blocks on local disk")
+	flags.Var(SizeFlag{&params.DiskCacheMaxBytes}, "disk-cache-max-bytes", "(EXPERIMENTAL) Maximum size of the on-disk block cache; 0 disables it")
+	flags.StringVar(&params.ConflictHistoryRoot, "conflict-history-root", "", "If non-empty, the directory in which to record conflict resolutions (which include file names in the clear)")
+	flags.DurationVar(&params.ConflictHistoryMaxAge, "conflict-history-max-age", defaultParams.ConflictHistoryMaxAge, "How long to keep recorded conflict resolutions; 0 keeps them forever")
+	flags.IntVar(&params.PrefetchDepth, "prefetch-depth", defaultParams.PrefetchDepth, "Number of blocks to fetch ahead of sequential file reads; 0 disables prefetching")
+	flags.IntVar(&params.PrefetchWorkers, "prefetch-workers", defaultParams.PrefetchWorkers, "Maximum number of blocks to prefetch in parallel")
+	flags.StringVar(&params.BlockSplitter, "block-splitter", defaultParams.BlockSplitter, fmt.Sprintf("(EXPERIMENTAL) How to split files into blocks: %q for fixed-size blocks, or %q for content-defined chunks", BlockSplitterNameSimple, BlockSplitterNameCDC))
+	flags.BoolVar(&params.BlockCompression, "block-compression", false, "(EXPERIMENTAL) Compress new blocks before encrypting them")
+	flags.StringVar(&params.ConflictRenameTemplate, "conflict-rename-template", "", fmt.Sprintf("Go template for the names of conflicting copies of files, using the fields .Base, .Ext, .User, .Device, .Date, .Time and .Revision (e.g. %q)", DefaultConflictRenameTemplate))
 	return &params
 }
 
@@ -275,12 +355,33 @@ func Init(ctx Context, params InitParams, keybaseServiceCn KeybaseServiceCn, onI
 
 	config := NewConfigLocal()
 
-	bsplitter, err := NewBlockSplitterSimple(MaxBlockSizeBytesDefault, 8*1024,
-		config.Codec())
+	var bsplitter BlockSplitter
+	var err error
+	switch params.BlockSplitter {
+	case BlockSplitterNameSimple:
+		bsplitter, err = NewBlockSplitterSimple(
+			MaxBlockSizeBytesDefault, 8*1024, config.Codec())
+	case BlockSplitterNameCDC:
+		bsplitter, err = NewBlockSplitterCDC(cdcMinSizeDefault,
+			cdcAvgSizeDefault, MaxBlockSizeBytesDefault, 8*1024,
+			config.Codec())
+	default:
+		err = fmt.Errorf("Unknown block splitter %q", params.BlockSplitter)
+	}
 	if err != nil {
 		return nil, err
 	}
 	config.SetBlockSplitter(bsplitter)
+	config.SetDoBlockCompression(params.BlockCompression)
+
+	if len(params.ConflictRenameTemplate) > 0 {
+		renamer, err := NewTemplateConflictRenamer(
+			config, params.ConflictRenameTemplate)
+		if err != nil {
+			return nil, err
+		}
+		config.SetConflictRenamer(renamer)
+	}
 
 	if registry := config.MetricsRegistry(); registry != nil {
 		keyCache := config.KeyCache()
@@ -376,11 +477,42 @@ func Init(ctx Context, params InitParams, keybaseServiceCn KeybaseServiceCn, onI
 
 	config.SetBlockServer(bserv)
 
+	if params.DiskCacheMaxBytes > 0 && len(params.DiskCacheRoot) > 0 {
+		dbc, err := NewDiskBlockCacheStandard(config, params.DiskCacheRoot,
+			uint64(params.DiskCacheMaxBytes))
+		if err != nil {
+			// The cache is just an optimization, so keep going
+			// without it.
+			log.Warning("Could not open disk block cache at %s: %v",
+				params.DiskCacheRoot, err)
+		} else {
+			config.SetDiskBlockCache(dbc)
+		}
+	}
+
+	if len(params.ConflictHistoryRoot) > 0 {
+		config.SetConflictHistory(NewConflictHistoryDisk(
+			config, params.ConflictHistoryRoot,
+			params.ConflictHistoryMaxAge))
+	}
+
+	if params.PrefetchDepth > 0 {
+		config.SetPrefetcher(NewBlockPrefetcher(
+			config, params.PrefetchDepth, params.PrefetchWorkers))
+	}
+
 	// TODO: Don't turn on journaling if -server-in-memory is
 	// used.
 
 	if len(params.WriteJournalRoot) > 0 {
-		config.EnableJournaling(params.WriteJournalRoot)
+		config.EnableJournaling(
+			params.WriteJournalRoot, params.JournalStorage)
+		jServer, err := GetJournalServer(config)
+		if err != nil {
+			return nil, err
+		}
+		jServer.SetLimits(params.JournalLimits)
+		jServer.SetFlushLimit(params.JournalFlushLimit)
 	}
 
 	return config, nil
@@ -126,6 +126,24 @@ type KBFSOps interface {
 	GetRootNode(
 		ctx context.Context, h *TlfHandle, branch BranchName) (
 		node Node, ei EntryInfo, err error)
+	// GetArchivedRootNode returns a read-only root node for the
+	// given TLF handle, as of the given merged revision, if the
+	// logged-in user has read permissions to the top-level folder.
+	// All nodes reachable from the returned node reflect the state
+	// of the folder at that revision, and any attempt to modify
+	// them results in a WriteToReadonlyNodeError.  Blocks that have
+	// since been reclaimed by quota reclamation will not be
+	// readable.  This is a remote-access operation.
+	GetArchivedRootNode(
+		ctx context.Context, h *TlfHandle, rev MetadataRevision) (
+		node Node, ei EntryInfo, err error)
+	// GetRevisionForTime returns the most recent merged revision of
+	// the given TLF that was committed at or before the given time,
+	// according to the server.  The result can be passed to
+	// GetArchivedRootNode.  This is a remote-access operation.
+	GetRevisionForTime(
+		ctx context.Context, h *TlfHandle, t time.Time) (
+		MetadataRevision, error)
 	// GetDirChildren returns a map of children in the directory,
 	// mapped to their EntryInfo, if the logged-in user has read
 	// permission for the top-level folder.  This is a remote-access
@@ -162,6 +180,33 @@ type KBFSOps interface {
 	// is a remote-sync operation.
 	CreateLink(ctx context.Context, dir Node, fromName string, toPath string) (
 		EntryInfo, error)
+	// CopyFile creates a new file with the given name under dstDir
+	// with the same contents as the file represented by src, if the
+	// logged-in user has write permission to the top-level folder.
+	// Both nodes must be in the same top-level folder.  Instead of
+	// re-uploading the data, the new file shares the existing data
+	// blocks by adding new references to them.  Any dirty data in
+	// src is synced first.  Returns the new node and entry info for
+	// the copy.  This is a remote-sync operation.
+	CopyFile(ctx context.Context, src Node, dstDir Node, name string) (
+		Node, EntryInfo, error)
+	// CopyFileInto is like CopyFile, but replaces the contents of
+	// the existing, empty file represented by dst instead of
+	// creating a new one.  It returns the number of bytes copied,
+	// or a CopyIntoNonEmptyFileError if dst isn't empty.  This is a
+	// remote-sync operation.
+	CopyFileInto(ctx context.Context, src Node, dst Node) (uint64, error)
+	// CreateHardLink creates a new hard link with the given name
+	// under dir to the file represented by target, if the logged-in
+	// user has write permission to the top-level folder.  Both
+	// nodes must be in the same top-level folder.  Like CopyFile,
+	// the new link gets its own references to the existing data
+	// blocks, but any later writes to either link are copied to all
+	// the others when the written link is synced.  Returns the new
+	// node and entry info for the link.  This is a remote-sync
+	// operation.
+	CreateHardLink(ctx context.Context, dir Node, name string,
+		target Node) (Node, EntryInfo, error)
 	// RemoveDir removes the subdirectory represented by the given
 	// node, if the logged-in user has write permission to the
 	// top-level folder.  Will return an error if the subdirectory is
@@ -211,6 +256,21 @@ type KBFSOps interface {
 	// on whether or not the necessary blocks have been locally
 	// cached.  This is a remote-access operation.
 	Truncate(ctx context.Context, file Node, size uint64) error
+	// GetFileHoles returns the holes in the file at the given node,
+	// in order of offset.  A hole is a range of the file with no
+	// data blocks behind it, which reads back as zeros.  This is a
+	// remote-access operation.
+	GetFileHoles(ctx context.Context, file Node) ([]FileHole, error)
+	// PunchHole zeroes the given range of the file at the given
+	// node, if the logged-in user has write permission to the
+	// top-level folder, turning as much of it as possible into a
+	// hole so that its blocks no longer count against quota.  Only
+	// whole child blocks of an indirect file can become holes; a
+	// file with a single direct block just has zeros written over
+	// the range.  The file size doesn't change; the part of the
+	// range past the end of the file is ignored.  This is a
+	// remote-access operation.
+	PunchHole(ctx context.Context, file Node, off, length uint64) error
 	// SetEx turns on or off the executable bit on the file
 	// represented by a given node, if the logged-in user has write
 	// permissions to the top-level folder.  This is a remote-sync
@@ -221,12 +281,89 @@ type KBFSOps interface {
 	// the top-level folder.  If mtime is nil, it is a noop.  This is
 	// a remote-sync operation.
 	SetMtime(ctx context.Context, file Node, mtime *time.Time) error
+	// SetXattr sets the value of the named extended attribute on
+	// the file or directory represented by a given node, if the
+	// logged-in user has write permissions to the top-level folder.
+	// Extended attributes are stored encrypted in the parent
+	// directory's entry for the node, so they can't be set on the
+	// TLF root.  This is a remote-sync operation.
+	SetXattr(ctx context.Context, node Node, name string, value []byte) error
+	// GetXattr returns the value of the named extended attribute on
+	// the file or directory represented by a given node, or a
+	// NoSuchXattrError if it doesn't exist.  This is a remote-access
+	// operation.
+	GetXattr(ctx context.Context, node Node, name string) ([]byte, error)
+	// ListXattr returns the sorted names of all the extended
+	// attributes on the file or directory represented by a given
+	// node.  This is a remote-access operation.
+	ListXattr(ctx context.Context, node Node) ([]string, error)
+	// RemoveXattr removes the named extended attribute from the file
+	// or directory represented by a given node, if the logged-in
+	// user has write permissions to the top-level folder.  It
+	// returns a NoSuchXattrError if the attribute doesn't exist.
+	// This is a remote-sync operation.
+	RemoveXattr(ctx context.Context, node Node, name string) error
 	// Sync flushes all outstanding writes and truncates for the given
 	// file to the KBFS servers, if the logged-in user has write
 	// permissions to the top-level folder.  If done through a file
 	// system interface, this may include modifications done via
 	// multiple file handles.  This is a remote-sync operation.
 	Sync(ctx context.Context, file Node) error
+	// SetSyncPolicy pins or unpins the subtree rooted at the given
+	// node.  All blocks of a pinned subtree are eagerly fetched
+	// and kept in the disk block cache, exempt from eviction, so
+	// that they stay available offline; they're re-synced whenever
+	// a new revision of the folder arrives.  Pins persist across
+	// restarts.  Returns an error if the disk block cache is
+	// disabled.
+	SetSyncPolicy(ctx context.Context, node Node, pinned bool) error
+	// LockFile takes an advisory lock on the given file on behalf
+	// of the given owner, which identifies the lock holder on this
+	// device (e.g., a process or open file description).  A shared
+	// lock can be held by any number of owners at once, but an
+	// exclusive one can't be held alongside any other lock.  Locks
+	// are held as leases on the MD server, so they're visible to
+	// other devices, and are renewed in the background until
+	// they're released or the folder is shut down.  Calling it
+	// again for the same owner changes the lock type.  Returns
+	// FileLockConflictError if another owner, on this or another
+	// device, holds a conflicting lock, or FileLocksUnsupportedError
+	// if the MD server doesn't support lock leases.
+	LockFile(ctx context.Context, file Node, owner string,
+		exclusive bool) error
+	// UnlockFile releases the given owner's advisory lock on the
+	// given file, if it holds one.
+	UnlockFile(ctx context.Context, file Node, owner string) error
+	// Watch returns a channel of path-based events describing
+	// changes to the entries of the given directory, or of its
+	// whole subtree if recursive is true.  Both local and remote
+	// changes are reported, once they're part of a merged revision.
+	// Changes that arrive while the reader is behind are coalesced.
+	// If fromRev is not MetadataRevisionUninitialized, watching
+	// starts right after that revision rather than at the current
+	// one.  The channel is closed once ctx is canceled, or right
+	// after a ChangeEventError event if watching fails.  Squashing
+	// the unflushed revisions in the journal reuses their numbers,
+	// so it fails any watch that has delivered one of them, and
+	// any later Watch from one of them, with a
+	// RevisionsSquashedError.
+	Watch(ctx context.Context, dir Node, recursive bool,
+		fromRev MetadataRevision) (<-chan ChangeEvent, error)
+	// BeginBatch opens a batch for the given folder-branch.  Until
+	// the batch is committed or aborted, every write to the folder
+	// made with a context returned by the batch's Context method
+	// becomes part of it, and none of them are visible to other
+	// devices.  Writes from other callers on this device block
+	// until the batch is closed (or their contexts are canceled).
+	// Writes to files must still be synced to become part of the
+	// batch.  A batch that's still open after a few minutes is
+	// aborted automatically; after that, its Commit, Abort and
+	// writes fail with BatchExpiredError.  Returns
+	// BatchInProgressError if a batch is already open, or
+	// UnmergedError if the folder has unresolved conflicts.
+	BeginBatch(ctx context.Context, folderBranch FolderBranch) (
+		Batch, error)
+	// FolderStatus returns the status of a particular folder/branch, along
 	// FolderStatus returns the status of a particular folder/branch, along
 	// with a channel that will be closed when the status has been
 	// updated (to eliminate the need for polling this method).
@@ -265,6 +402,11 @@ type KBFSOps interface {
 	// for the folder.
 	GetEditHistory(ctx context.Context, folderBranch FolderBranch) (
 		edits TlfWriterEdits, err error)
+	// PreviewConflictResolution returns what conflict resolution
+	// would do to this device's unmerged changes to the given
+	// folder-branch, if any, without actually doing it.
+	PreviewConflictResolution(ctx context.Context,
+		folderBranch FolderBranch) (ConflictResolutionPreview, error)
 
 	// GetNodeMetadata gets metadata associated with a Node.
 	GetNodeMetadata(ctx context.Context, node Node) (NodeMetadata, error)
@@ -277,6 +419,35 @@ type KBFSOps interface {
 	PushConnectionStatusChange(service string, newStatus error)
 }
 
+// Batch is a set of writes to a single folder that are committed
+// together, as a single merged revision.  See KBFSOps.BeginBatch.
+type Batch interface {
+	// Context returns a child of ctx that writes into the batch.
+	// Only writes made with such a context become part of it.
+	Context(ctx context.Context) context.Context
+	// Commit makes all the writes in the batch visible to other
+	// devices, as one new merged revision whose ops list combines
+	// them all, so other devices' observers see them in a single
+	// BatchChanges call.  (Observers on this device are notified of
+	// each write as it's made.)  Writes to files that haven't been
+	// synced yet aren't part of the batch; they're synced
+	// separately afterwards.
+	//
+	// If other devices changed the folder after the batch began,
+	// the commit goes through conflict resolution like any other
+	// out-of-date writes: the batch's changes still land together
+	// in one revision, but entries that conflict with the other
+	// changes are renamed as conflict copies.  If that resolution
+	// fails, Commit returns BatchCommitError; the changes stay
+	// unmerged and private to this device until a later resolution
+	// succeeds, and Abort can still be used to discard them.
+	Commit(ctx context.Context) error
+	// Abort discards all the writes made during the batch.  It
+	// returns NotPermittedWhileDirtyError if any file in the folder
+	// has unsynced writes.
+	Abort(ctx context.Context) error
+}
+
 // KeybaseService is an interface for communicating with the keybase
 // service.
 type KeybaseService interface {
@@ -643,6 +814,79 @@ type BlockCache interface {
 	DeleteKnownPtr(tlf TlfID, block *FileBlock) error
 }
 
+// DiskBlockCache caches blocks on local disk in their encrypted,
+// server-side form, so that they survive a restart.  It acts as a
+// second-level cache behind BlockCache, consulted before fetching a
+// block from the BlockServer.
+type DiskBlockCache interface {
+	// Get gets the encoded, encrypted block data and server half
+	// for the given block ID.  Returns NoSuchBlockError if the
+	// block isn't in the cache.
+	Get(ctx context.Context, tlfID TlfID, blockID BlockID) (
+		[]byte, kbfscrypto.BlockCryptKeyServerHalf, error)
+	// Put stores the encoded, encrypted block data and server half
+	// for the given block ID, evicting least-recently-used blocks
+	// as necessary to stay within the cache's byte limit.
+	Put(ctx context.Context, tlfID TlfID, blockID BlockID, buf []byte,
+		serverHalf kbfscrypto.BlockCryptKeyServerHalf) error
+	// Delete removes the given blocks of the given TLF from the
+	// cache.  No error is returned for IDs that aren't in the cache.
+	Delete(ctx context.Context, tlfID TlfID, blockIDs []BlockID) error
+	// SetPinnedBlocks replaces the set of pinned blocks for the
+	// given TLF.  Pinned blocks are never evicted.  It returns the
+	// number of the given blocks that aren't in the cache, and so
+	// couldn't be pinned.
+	SetPinnedBlocks(ctx context.Context, tlfID TlfID,
+		blockIDs []BlockID) (numMissing int, err error)
+	// UpdatePinnedBlocks pins and unpins the given blocks of the
+	// given TLF, leaving the rest of its pinned blocks alone.  It
+	// returns the number of the blocks to pin that aren't in the
+	// cache, and so couldn't be pinned.
+	UpdatePinnedBlocks(ctx context.Context, tlfID TlfID,
+		pin, unpin []BlockID) (numMissing int, err error)
+	// GetPinnedPaths returns the paths, relative to the root of the
+	// given TLF, that should be kept available offline.
+	GetPinnedPaths(ctx context.Context, tlfID TlfID) ([]string, error)
+	// SetPinnedPaths persistently replaces the pinned paths for the
+	// given TLF.
+	SetPinnedPaths(ctx context.Context, tlfID TlfID, paths []string) error
+	// Shutdown cleanly shuts down the cache, after which it must
+	// not be used.
+	Shutdown(ctx context.Context)
+}
+
+// ConflictHistory keeps a record of the conflict resolutions done
+// for each TLF on this device, so users can find out afterwards what
+// happened to their conflicting changes.
+type ConflictHistory interface {
+	// Add records a completed conflict resolution for the given
+	// TLF.
+	Add(ctx context.Context, tlfID TlfID, entry ConflictHistoryEntry) error
+	// Get returns the recorded resolutions for the given TLF that
+	// haven't expired yet, oldest first.
+	Get(ctx context.Context, tlfID TlfID) ([]ConflictHistoryEntry, error)
+}
+
+// Prefetcher fetches blocks in the background, ahead of when they're
+// expected to be needed, and puts them in the BlockCache.
+type Prefetcher interface {
+	// PrefetchBlock asynchronously fetches the block for the given
+	// pointer into the given empty block, and puts it in the
+	// BlockCache, unless it's already cached or being fetched.
+	PrefetchBlock(block Block, ptr BlockPointer, kmd KeyMetadata)
+	// PrefetchAfterRead asynchronously fetches the child blocks of
+	// the given indirect file block that follow the one at index
+	// idx, up to the prefetcher's configured depth.  It should be
+	// called after a sequential read of that child block.
+	PrefetchAfterRead(parent *FileBlock, idx int, kmd KeyMetadata)
+	// PrefetchDirChildren asynchronously fetches the top blocks of
+	// all the subdirectories of the given directory block.
+	PrefetchDirChildren(dblock *DirBlock, kmd KeyMetadata)
+	// Shutdown cancels all outstanding prefetches, and waits for
+	// them to stop.
+	Shutdown()
+}
+
 // DirtyPermChan is a channel that gets closed when the holder has
 // permission to write.  We are forced to define it as a type due to a
 // bug in mockgen that can't handle return values with a chan
@@ -815,9 +1059,18 @@ type cryptoPure interface {
 	EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (
 		plainSize int, encryptedBlock EncryptedBlock, err error)
 
+	// EncryptBlockCompressed is like EncryptBlock, except that it
+	// first compresses the encoded block, if that makes it
+	// smaller.  plainSize is still the size of the uncompressed
+	// encoded block, so it may be bigger than len(encryptedBlock).
+	EncryptBlockCompressed(block Block, key kbfscrypto.BlockCryptKey) (
+		plainSize int, encryptedBlock EncryptedBlock, err error)
+
 	// DecryptBlock decrypts a block. Similar to EncryptBlock(),
 	// DecryptBlock() must guarantee that (size of the decrypted
-	// block) <= len(encryptedBlock).
+	// block) <= len(encryptedBlock), unless the block was
+	// encrypted with EncryptBlockCompressed, in which case the
+	// decrypted block may be bigger.
 	DecryptBlock(encryptedBlock EncryptedBlock,
 		key kbfscrypto.BlockCryptKey, block Block) error
 
@@ -1074,6 +1327,20 @@ type MDServer interface {
 	// released.
 	TruncateUnlock(ctx context.Context, id TlfID) (bool, error)
 
+	// LockFile takes, or renews, an advisory lease on the given
+	// lock ID within the given folder, on behalf of the given owner
+	// on the current device.  Any number of owners can share a
+	// non-exclusive lease, but an exclusive lease can only have one
+	// owner.  Returns how long the lease lasts unless it's renewed,
+	// as defined by the server, or FileLockConflictError if another
+	// owner holds a conflicting lease that hasn't expired.
+	LockFile(ctx context.Context, id TlfID, lockID string, owner string,
+		exclusive bool) (time.Duration, error)
+	// UnlockFile releases the given owner's lease on the given lock
+	// ID within the given folder, if it holds one.
+	UnlockFile(ctx context.Context, id TlfID, lockID string,
+		owner string) error
+
 	// DisableRekeyUpdatesForTesting disables processing rekey updates
 	// received from the mdserver while testing.
 	DisableRekeyUpdatesForTesting()
@@ -1228,6 +1495,10 @@ type BlockSplitter interface {
 	// ShouldEmbedBlockChanges decides whether we should keep the
 	// block changes embedded in the MD or not.
 	ShouldEmbedBlockChanges(bc *BlockChanges) bool
+
+	// DataVersion returns the lowest data version that files split
+	// by this splitter can be marked with.
+	DataVersion() DataVer
 }
 
 // KeyServer fetches/writes server-side key halves from/to the key server.
@@ -1310,6 +1581,48 @@ type ConflictRenamer interface {
 	ConflictRename(op op, original string) string
 }
 
+// ConflictChoice says how a conflict between changes made to the
+// same file on the unmerged and merged branches gets resolved.
+type ConflictChoice int
+
+const (
+	// ConflictKeepBoth keeps the merged file where it is, and moves
+	// the unmerged one to a new name chosen by the ConflictRenamer.
+	ConflictKeepBoth ConflictChoice = iota
+	// ConflictKeepMerged drops the unmerged change.
+	ConflictKeepMerged
+	// ConflictKeepUnmerged replaces the merged file with the
+	// unmerged one.
+	ConflictKeepUnmerged
+	// ConflictMergeText replaces the merged file with a merge of
+	// the lines of the two versions, as part of the resolution.  If
+	// they can't be merged, it keeps both like ConflictKeepBoth.
+	ConflictMergeText
+)
+
+// ConflictFileVersion describes one branch's version of a file that
+// was changed on both the unmerged and merged branches.
+type ConflictFileVersion struct {
+	// Mtime is the modification time of this version of the file.
+	Mtime time.Time
+	// Written is true if this branch changed the file's contents,
+	// rather than just its attributes.
+	Written bool
+}
+
+// ConflictPolicy decides how conflict resolution handles conflicting
+// changes to the same file.  Conflicts between directory entries
+// (e.g., two files created with the same name) always keep both.
+type ConflictPolicy interface {
+	// Name returns the name used to select this policy.
+	Name() string
+	// ChooseForFile returns how to resolve the conflicting changes
+	// made to a file, given its unmerged and merged versions.  It's
+	// called once per file, and the choice applies to all of the
+	// file's conflicting changes.
+	ChooseForFile(unmerged, merged ConflictFileVersion) ConflictChoice
+}
+
 // Config collects all the singleton instance instantiations needed to
 // run KBFS in one place.  The methods below are self-explanatory and
 // do not require comments.
@@ -1330,6 +1643,18 @@ type Config interface {
 	SetBlockCache(BlockCache)
 	DirtyBlockCache() DirtyBlockCache
 	SetDirtyBlockCache(DirtyBlockCache)
+	// DiskBlockCache may be nil, which means blocks are never
+	// cached on local disk.
+	DiskBlockCache() DiskBlockCache
+	SetDiskBlockCache(DiskBlockCache)
+	// ConflictHistory may be nil, which means conflict
+	// resolutions aren't recorded.
+	ConflictHistory() ConflictHistory
+	SetConflictHistory(ConflictHistory)
+	// Prefetcher may be nil, which means blocks are only fetched
+	// on demand.
+	Prefetcher() Prefetcher
+	SetPrefetcher(Prefetcher)
 	Crypto() Crypto
 	SetCrypto(Crypto)
 	Codec() kbfscodec.Codec
@@ -1377,6 +1702,10 @@ type Config interface {
 	// be true except for during some testing.
 	DoBackgroundFlushes() bool
 	SetDoBackgroundFlushes(bool)
+	// DoBlockCompression says whether new blocks should be
+	// compressed before they're encrypted.
+	DoBlockCompression() bool
+	SetDoBlockCompression(bool)
 	// RekeyWithPromptWaitTime indicates how long to wait, after
 	// setting the rekey bit, before prompting for a paper key.
 	RekeyWithPromptWaitTime() time.Duration
@@ -0,0 +1,601 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"golang.org/x/net/context"
+)
+
+// journalArchiveVersion is the current version of the journal
+// archive format.
+const journalArchiveVersion = 1
+
+// journalArchiveBlockEntry is a single block journal entry, along
+// with the block data and server half for puts.  Fields are exported
+// only for serialization.
+type journalArchiveBlockEntry struct {
+	Entry      blockJournalEntry
+	Data       []byte                             `codec:",omitempty"`
+	ServerHalf kbfscrypto.BlockCryptKeyServerHalf `codec:",omitempty"`
+}
+
+// journalArchiveMDEntry is a single signed MD from the MD journal.
+// Fields are exported only for serialization.
+type journalArchiveMDEntry struct {
+	Version MetadataVer
+	// RMDS is the encoded RootMetadataSigned.
+	RMDS []byte
+}
+
+// journalArchiveContents holds all the unflushed entries of a TLF
+// journal.  Fields are exported only for serialization.
+type journalArchiveContents struct {
+	Version      int
+	TlfID        TlfID
+	UID          keybase1.UID
+	VerifyingKey kbfscrypto.VerifyingKey
+	BranchID     BranchID
+	Blocks       []journalArchiveBlockEntry
+	MDs          []journalArchiveMDEntry
+}
+
+// journalArchiveSigned is the top-level object of an archive file:
+// the encoded contents, signed by the device that exported them.
+// Fields are exported only for serialization.
+type journalArchiveSigned struct {
+	Contents []byte
+	SigInfo  kbfscrypto.SignatureInfo
+}
+
+// journalArchive is a verified, decoded journal archive.
+type journalArchive struct {
+	contents journalArchiveContents
+	// rmdses holds the decoded MDs, in the same order as
+	// contents.MDs.
+	rmdses []*RootMetadataSigned
+}
+
+// exportEntries returns all the entries in the journal that haven't
+// been squashed away, along with the data for each put.
+func (j *blockJournal) exportEntries() ([]journalArchiveBlockEntry, error) {
+	first, err := j.j.readEarliestOrdinal()
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	last, err := j.j.readLatestOrdinal()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []journalArchiveBlockEntry
+	for ordinal := first; ordinal <= last; ordinal++ {
+		entry, err := j.readJournalEntry(ordinal)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Ignore {
+			continue
+		}
+		archiveEntry := journalArchiveBlockEntry{Entry: entry}
+		if entry.Op == blockPutOp {
+			id, _, err := entry.getSingleContext()
+			if err != nil {
+				return nil, err
+			}
+			archiveEntry.Data, archiveEntry.ServerHalf, err = j.getData(id)
+			if err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, archiveEntry)
+	}
+	return entries, nil
+}
+
+// exportEntries returns all the MDs in the journal, signed as they
+// would be for flushing.
+func (j mdJournal) exportEntries(ctx context.Context, signer cryptoSigner) (
+	[]journalArchiveMDEntry, error) {
+	length, err := j.length()
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, nil
+	}
+	start, err := j.readEarliestRevision()
+	if err != nil {
+		return nil, err
+	}
+	stop, err := j.readLatestRevision()
+	if err != nil {
+		return nil, err
+	}
+	irmds, err := j.getRange(start, stop)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]journalArchiveMDEntry, 0, len(irmds))
+	for _, rmd := range irmds {
+		mbrmd, ok := rmd.BareRootMetadata.(MutableBareRootMetadata)
+		if !ok {
+			return nil, MutableBareRootMetadataNoImplError{}
+		}
+		rmds := RootMetadataSigned{MD: mbrmd}
+		err = signMD(ctx, j.codec, signer, &rmds)
+		if err != nil {
+			return nil, err
+		}
+		buf, err := j.codec.Encode(&rmds)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, journalArchiveMDEntry{
+			Version: rmd.Version(),
+			RMDS:    buf,
+		})
+	}
+	return entries, nil
+}
+
+// importMD appends the given signed MD to the journal, which must
+// either be empty or have the previous revision as its head.
+func (j *mdJournal) importMD(
+	ctx context.Context, rmd BareRootMetadata) (err error) {
+	j.log.CDebugf(ctx, "Importing MD for TLF=%s with rev=%s bid=%s",
+		rmd.TlfID(), rmd.RevisionNumber(), rmd.BID())
+	defer func() {
+		if err != nil {
+			j.deferLog.CDebugf(ctx,
+				"Import MD for TLF=%s with rev=%s bid=%s failed with %v",
+				rmd.TlfID(), rmd.RevisionNumber(), rmd.BID(), err)
+		}
+	}()
+
+	length, err := j.length()
+	if err != nil {
+		return err
+	}
+	if length == 0 && j.branchID == NullBranchID {
+		j.branchID = rmd.BID()
+	}
+	if rmd.BID() != j.branchID {
+		return fmt.Errorf("Branch ID mismatch: expected %s, got %s",
+			j.branchID, rmd.BID())
+	}
+
+	_, err = j.putMD(rmd)
+	if err != nil {
+		return err
+	}
+	id, err := j.crypto.MakeMdID(rmd)
+	if err != nil {
+		return err
+	}
+	err = j.j.append(rmd.RevisionNumber(), mdIDJournalEntry{ID: id})
+	if err != nil {
+		return err
+	}
+
+	// Since the journal is now non-empty, clear lastMdID.
+	j.lastMdID = MdID{}
+	return nil
+}
+
+// exportArchive writes a signed archive of all the unflushed entries
+// in the journal to w.  The entries stay in the journal, which skips
+// any MDs that the archive has already flushed by the time it flushes
+// them itself.  If remove is true, the exported entries are instead
+// removed from the journal once the archive has been written, so that
+// only the archive flushes them.
+func (j *tlfJournal) exportArchive(
+	ctx context.Context, w io.Writer, remove bool) error {
+	// Hold flushLock throughout, so that nothing gets flushed or
+	// squashed between reading the entries and removing them.
+	j.flushLock.Lock()
+	defer j.flushLock.Unlock()
+
+	contents, blockEnd, mdEnd, err := func() (
+		journalArchiveContents, journalOrdinal, MetadataRevision, error) {
+		j.journalLock.RLock()
+		defer j.journalLock.RUnlock()
+		if err := j.checkEnabledLocked(); err != nil {
+			return journalArchiveContents{}, 0, 0, err
+		}
+
+		blockEnd, err := j.blockJournal.end()
+		if err != nil {
+			return journalArchiveContents{}, 0, 0, err
+		}
+		mdEnd, err := j.mdJournal.end()
+		if err != nil {
+			return journalArchiveContents{}, 0, 0, err
+		}
+		blocks, err := j.blockJournal.exportEntries()
+		if err != nil {
+			return journalArchiveContents{}, 0, 0, err
+		}
+		mds, err := j.mdJournal.exportEntries(ctx, j.config.Crypto())
+		if err != nil {
+			return journalArchiveContents{}, 0, 0, err
+		}
+		return journalArchiveContents{
+			Version:      journalArchiveVersion,
+			TlfID:        j.tlfID,
+			UID:          j.uid,
+			VerifyingKey: j.key,
+			BranchID:     j.mdJournal.getBranchID(),
+			Blocks:       blocks,
+			MDs:          mds,
+		}, blockEnd, mdEnd, nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	j.log.CDebugf(ctx, "Exporting %d block entries and %d MDs for %s",
+		len(contents.Blocks), len(contents.MDs), j.tlfID)
+	codec := j.config.Codec()
+	buf, err := codec.Encode(contents)
+	if err != nil {
+		return err
+	}
+	sigInfo, err := j.config.Crypto().Sign(ctx, buf)
+	if err != nil {
+		return err
+	}
+	buf, err = codec.Encode(journalArchiveSigned{
+		Contents: buf,
+		SigInfo:  sigInfo,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	if err != nil {
+		return err
+	}
+	if !remove {
+		return nil
+	}
+	// Make sure the archive is durable before the journal forgets
+	// about its entries.
+	if s, ok := w.(interface {
+		Sync() error
+	}); ok {
+		err = s.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	return j.removeExportedEntries(ctx, blockEnd, mdEnd)
+}
+
+// removeExportedEntries removes all the block entries before blockEnd
+// and all the MDs before mdEnd from the journal, without flushing
+// them.
+func (j *tlfJournal) removeExportedEntries(ctx context.Context,
+	blockEnd journalOrdinal, mdEnd MetadataRevision) error {
+	j.journalLock.Lock()
+	defer j.journalLock.Unlock()
+	if err := j.checkEnabledLocked(); err != nil {
+		return err
+	}
+
+	for {
+		first, err := j.blockJournal.j.readEarliestOrdinal()
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return err
+		}
+		if first >= blockEnd {
+			break
+		}
+		entries, _, err := j.blockJournal.getNextEntriesToFlush(
+			ctx, blockEnd, maxJournalBlockFlushBatchSize)
+		if err != nil {
+			return err
+		}
+		err = j.blockJournal.removeFlushedEntries(
+			ctx, entries, j.tlfID, j.config.Reporter())
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		rmd, err := j.mdJournal.getEarliest(true)
+		if err != nil {
+			return err
+		}
+		if rmd == (ImmutableBareRootMetadata{}) ||
+			rmd.RevisionNumber() >= mdEnd {
+			break
+		}
+		mbrmd, ok := rmd.BareRootMetadata.(MutableBareRootMetadata)
+		if !ok {
+			return MutableBareRootMetadataNoImplError{}
+		}
+		err = j.mdJournal.removeFlushedEntry(
+			ctx, rmd.mdID, &RootMetadataSigned{MD: mbrmd})
+		if err != nil {
+			return err
+		}
+	}
+
+	j.log.CDebugf(ctx, "Removed the exported entries for %s", j.tlfID)
+	return nil
+}
+
+// importArchive appends the entries in the given archive to the
+// journal, to be flushed along with any local entries.  The MD
+// journal must be empty, and the archive must have been exported by
+// this journal's user and device, since MDs are only accepted from
+// them.
+func (j *tlfJournal) importArchive(
+	ctx context.Context, archive journalArchive) error {
+	if archive.contents.TlfID != j.tlfID {
+		return fmt.Errorf("Archive is for %s, not %s",
+			archive.contents.TlfID, j.tlfID)
+	}
+	if archive.contents.UID != j.uid {
+		return fmt.Errorf("Archive is from user %s, not %s",
+			archive.contents.UID, j.uid)
+	}
+	if archive.contents.VerifyingKey != j.key {
+		return fmt.Errorf("Archive is from device %s, not %s",
+			archive.contents.VerifyingKey, j.key)
+	}
+
+	j.journalLock.Lock()
+	defer j.journalLock.Unlock()
+	if err := j.checkEnabledLocked(); err != nil {
+		return err
+	}
+
+	if len(archive.rmdses) > 0 {
+		length, err := j.mdJournal.length()
+		if err != nil {
+			return err
+		}
+		if length != 0 {
+			return fmt.Errorf("Can't import MDs into the non-empty "+
+				"journal for %s", j.tlfID)
+		}
+	}
+
+	for _, e := range archive.contents.Blocks {
+		var err error
+		switch e.Entry.Op {
+		case blockPutOp:
+			id, bctx, getErr := e.Entry.getSingleContext()
+			if getErr != nil {
+				return getErr
+			}
+			err = j.blockJournal.putData(ctx, id, bctx, e.Data, e.ServerHalf)
+		case addRefOp:
+			id, bctx, getErr := e.Entry.getSingleContext()
+			if getErr != nil {
+				return getErr
+			}
+			err = j.blockJournal.addReference(ctx, id, bctx)
+		case removeRefsOp:
+			_, err = j.blockJournal.removeReferences(ctx, e.Entry.Contexts)
+		case archiveRefsOp:
+			err = j.blockJournal.archiveReferences(ctx, e.Entry.Contexts)
+		case mdRevMarkerOp:
+			err = j.blockJournal.markMDRevision(ctx, e.Entry.Revision)
+		default:
+			err = fmt.Errorf("Unknown op %s", e.Entry.Op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, rmds := range archive.rmdses {
+		err := j.mdJournal.importMD(ctx, rmds.MD)
+		if err != nil {
+			return err
+		}
+	}
+
+	j.signalWork()
+	return nil
+}
+
+// readJournalArchive decodes the given archive, and checks its
+// signature and the integrity of everything in it.  The archive must
+// be signed by the same device that signed each of its MDs.
+func readJournalArchive(codec kbfscodec.Codec, crypto cryptoPure,
+	maxVer MetadataVer, buf []byte) (journalArchive, error) {
+	var signed journalArchiveSigned
+	err := codec.Decode(buf, &signed)
+	if err != nil {
+		return journalArchive{}, err
+	}
+	err = crypto.Verify(signed.Contents, signed.SigInfo)
+	if err != nil {
+		return journalArchive{}, fmt.Errorf(
+			"Could not verify journal archive: %v", err)
+	}
+
+	var contents journalArchiveContents
+	err = codec.Decode(signed.Contents, &contents)
+	if err != nil {
+		return journalArchive{}, err
+	}
+	if contents.Version != journalArchiveVersion {
+		return journalArchive{}, fmt.Errorf(
+			"Unsupported journal archive version %d", contents.Version)
+	}
+	if signed.SigInfo.VerifyingKey != contents.VerifyingKey {
+		return journalArchive{}, fmt.Errorf(
+			"Journal archive signed by %s, not %s",
+			signed.SigInfo.VerifyingKey, contents.VerifyingKey)
+	}
+
+	for _, e := range contents.Blocks {
+		if e.Entry.Op != blockPutOp {
+			continue
+		}
+		id, bctx, err := e.Entry.getSingleContext()
+		if err != nil {
+			return journalArchive{}, err
+		}
+		err = validateBlockServerPut(crypto, id, bctx, e.Data)
+		if err != nil {
+			return journalArchive{}, err
+		}
+	}
+
+	rmdses := make([]*RootMetadataSigned, 0, len(contents.MDs))
+	for i, e := range contents.MDs {
+		rmds, err := DecodeRootMetadataSigned(
+			codec, contents.TlfID, e.Version, maxVer, e.RMDS)
+		if err != nil {
+			return journalArchive{}, err
+		}
+		// MDv3 TODO: pass key bundles when needed
+		err = rmds.IsValidAndSigned(codec, crypto, nil)
+		if err != nil {
+			return journalArchive{}, err
+		}
+		err = rmds.IsLastModifiedBy(contents.UID, contents.VerifyingKey)
+		if err != nil {
+			return journalArchive{}, err
+		}
+		if rmds.MD.TlfID() != contents.TlfID {
+			return journalArchive{}, fmt.Errorf(
+				"MD is for %s, not %s", rmds.MD.TlfID(), contents.TlfID)
+		}
+		if rmds.MD.BID() != contents.BranchID {
+			return journalArchive{}, fmt.Errorf(
+				"Branch ID mismatch: expected %s, got %s",
+				contents.BranchID, rmds.MD.BID())
+		}
+		if i > 0 && rmds.MD.RevisionNumber() !=
+			rmdses[i-1].MD.RevisionNumber()+1 {
+			return journalArchive{}, fmt.Errorf(
+				"MD revision %s doesn't follow %s",
+				rmds.MD.RevisionNumber(), rmdses[i-1].MD.RevisionNumber())
+		}
+		rmdses = append(rmdses, rmds)
+	}
+
+	return journalArchive{contents, rmdses}, nil
+}
+
+// getTlfName returns the canonical name of the archived TLF, taken
+// from the handle of its last MD.  An archive without MDs has no
+// handle, so in that case the name is left empty.
+func (a journalArchive) getTlfName(ctx context.Context,
+	nug normalizedUsernameGetter) (CanonicalTlfName, error) {
+	if len(a.rmdses) == 0 {
+		return "", nil
+	}
+	// MDv3 TODO: pass key bundles when needed
+	bh, err := a.rmdses[len(a.rmdses)-1].MD.MakeBareTlfHandle(nil)
+	if err != nil {
+		return "", err
+	}
+	handle, err := MakeTlfHandle(ctx, bh, nug)
+	if err != nil {
+		return "", err
+	}
+	return handle.GetCanonicalName(), nil
+}
+
+// flush sends everything in the archive straight to the given
+// servers, blocks first.  MDs that the server already has are
+// skipped, so an interrupted flush can be retried.
+func (a journalArchive) flush(ctx context.Context, log logger.Logger,
+	bserver BlockServer, bcache BlockCache, reporter Reporter,
+	mdserver MDServer, crypto cryptoPure,
+	nug normalizedUsernameGetter) error {
+	tlfName, err := a.getTlfName(ctx, nug)
+	if err != nil {
+		return err
+	}
+
+	entries := blockEntriesToFlush{
+		puts: newBlockPutState(len(a.contents.Blocks)),
+		adds: newBlockPutState(len(a.contents.Blocks)),
+	}
+	for _, e := range a.contents.Blocks {
+		switch e.Entry.Op {
+		case blockPutOp:
+			id, bctx, err := e.Entry.getSingleContext()
+			if err != nil {
+				return err
+			}
+			entries.puts.addNewBlock(
+				BlockPointer{ID: id, BlockContext: bctx},
+				nil, /* only used by folderBranchOps */
+				ReadyBlockData{buf: e.Data, serverHalf: e.ServerHalf}, nil)
+		case addRefOp:
+			id, bctx, err := e.Entry.getSingleContext()
+			if err != nil {
+				return err
+			}
+			entries.adds.addNewBlock(
+				BlockPointer{ID: id, BlockContext: bctx},
+				nil, /* only used by folderBranchOps */
+				ReadyBlockData{}, nil)
+		default:
+			entries.other = append(entries.other, e.Entry)
+		}
+		entries.all = append(entries.all, e.Entry)
+	}
+
+	err = flushBlockEntries(ctx, log, bserver, bcache, reporter,
+		a.contents.TlfID, tlfName, entries)
+	if err != nil {
+		return err
+	}
+
+	for _, rmds := range a.rmdses {
+		log.CDebugf(ctx, "Flushing imported MD for TLF=%s with rev=%s, "+
+			"bid=%s", rmds.MD.TlfID(), rmds.MD.RevisionNumber(),
+			rmds.MD.BID())
+		// MDv3 TODO: pass actual key bundles
+		err := mdserver.Put(ctx, rmds, nil)
+		if !isRevisionConflict(err) {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// See if this MD was already flushed.
+		mdID, err := crypto.MakeMdID(rmds.MD)
+		if err != nil {
+			return err
+		}
+		onServer, err := isMDOnServer(ctx, mdserver, crypto, mdID, rmds)
+		if err != nil {
+			return err
+		}
+		if !onServer {
+			return errors.New("The archived MDs conflict with the " +
+				"server; import them into a journal instead")
+		}
+	}
+	return nil
+}
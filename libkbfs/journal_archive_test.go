@@ -0,0 +1,248 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestJournalArchiveExportAndFlush(t *testing.T) {
+	tempdir, config, ctx, cancel, tlfJournal, delegate :=
+		setupTLFJournalTest(t, TLFJournalBackgroundWorkPaused)
+	defer teardownTLFJournalTest(
+		tempdir, config, ctx, cancel, tlfJournal, delegate)
+
+	putBlock(ctx, t, config, tlfJournal, []byte{1, 2, 3, 4})
+	putBlock(ctx, t, config, tlfJournal, []byte{5, 6, 7, 8})
+
+	firstRevision := MetadataRevision(10)
+	firstPrevRoot := fakeMdID(1)
+	mdCount := 3
+	prevRoot := firstPrevRoot
+	for i := 0; i < mdCount; i++ {
+		revision := firstRevision + MetadataRevision(i)
+		md := config.makeMD(revision, prevRoot)
+		mdID, err := tlfJournal.putMD(ctx, md)
+		require.NoError(t, err)
+		prevRoot = mdID
+	}
+
+	var buf bytes.Buffer
+	err := tlfJournal.exportArchive(ctx, &buf, false)
+	require.NoError(t, err)
+
+	// Exporting leaves the entries in the journal.
+	requireJournalEntryCounts(t, tlfJournal, uint64(2+mdCount),
+		uint64(mdCount))
+
+	archive, err := readJournalArchive(
+		config.Codec(), config.Crypto(), InitialExtraMetadataVer, buf.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, config.tlfID, archive.contents.TlfID)
+	require.Equal(t, 2+mdCount, len(archive.contents.Blocks))
+	config.checkRange(
+		archive.rmdses, firstRevision, firstPrevRoot, Merged, NullBranchID)
+
+	// Flush the archive straight to the servers.
+	var mdserver shimMDServer
+	bserver := NewBlockServerMemory(config)
+	defer bserver.Shutdown()
+	nug := testNormalizedUsernameGetter{config.uid: "test_user"}
+	err = archive.flush(ctx, logger.NewTestLogger(t), bserver, nil,
+		config.Reporter(), &mdserver, config.Crypto(), nug)
+	require.NoError(t, err)
+	require.Equal(t, mdCount, len(mdserver.rmdses))
+	config.checkRange(
+		mdserver.rmdses, firstRevision, firstPrevRoot, Merged, NullBranchID)
+
+	id, bCtx, _ := config.makeBlock([]byte{1, 2, 3, 4})
+	data, _, err := bserver.Get(ctx, config.tlfID, id, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3, 4}, data)
+}
+
+// revisionMDServer keeps the MDs put to it by revision, and rejects
+// puts of revisions it already has, like a real server.
+type revisionMDServer struct {
+	MDServer
+	rmdses []*RootMetadataSigned
+}
+
+func (s *revisionMDServer) GetRange(
+	ctx context.Context, id TlfID, bid BranchID, mStatus MergeStatus,
+	start, stop MetadataRevision) ([]*RootMetadataSigned, error) {
+	var rmdses []*RootMetadataSigned
+	for _, rmds := range s.rmdses {
+		rev := rmds.MD.RevisionNumber()
+		if rev >= start && rev <= stop {
+			rmdses = append(rmdses, rmds)
+		}
+	}
+	return rmdses, nil
+}
+
+func (s *revisionMDServer) Put(
+	ctx context.Context, rmds *RootMetadataSigned, _ ExtraMetadata) error {
+	for _, existing := range s.rmdses {
+		if existing.MD.RevisionNumber() == rmds.MD.RevisionNumber() {
+			return MDServerErrorConflictRevision{
+				Expected: existing.MD.RevisionNumber() + 1,
+				Actual:   rmds.MD.RevisionNumber(),
+			}
+		}
+	}
+	s.rmdses = append(s.rmdses, rmds)
+	return nil
+}
+
+func (s *revisionMDServer) Shutdown() {
+}
+
+func TestJournalArchiveFlushBothWays(t *testing.T) {
+	tempdir, config, ctx, cancel, tlfJournal, delegate :=
+		setupTLFJournalTest(t, TLFJournalBackgroundWorkPaused)
+	defer teardownTLFJournalTest(
+		tempdir, config, ctx, cancel, tlfJournal, delegate)
+
+	putBlock(ctx, t, config, tlfJournal, []byte{1, 2, 3, 4})
+
+	firstRevision := MetadataRevision(10)
+	firstPrevRoot := fakeMdID(1)
+	mdCount := 3
+	prevRoot := firstPrevRoot
+	for i := 0; i < mdCount; i++ {
+		revision := firstRevision + MetadataRevision(i)
+		md := config.makeMD(revision, prevRoot)
+		mdID, err := tlfJournal.putMD(ctx, md)
+		require.NoError(t, err)
+		prevRoot = mdID
+	}
+
+	var buf bytes.Buffer
+	err := tlfJournal.exportArchive(ctx, &buf, false)
+	require.NoError(t, err)
+	archive, err := readJournalArchive(
+		config.Codec(), config.Crypto(), InitialExtraMetadataVer, buf.Bytes())
+	require.NoError(t, err)
+
+	// Flush only the first MD from the archive.
+	mdserver := &revisionMDServer{}
+	nug := testNormalizedUsernameGetter{config.uid: "test_user"}
+	partial := archive
+	partial.rmdses = archive.rmdses[:1]
+	err = partial.flush(ctx, logger.NewTestLogger(t), tlfJournal.delegateBlockServer, nil,
+		config.Reporter(), mdserver, config.Crypto(), nug)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(mdserver.rmdses))
+
+	// The journal skips the MD that the archive already flushed,
+	// and flushes the rest.
+	config.mdserver = mdserver
+	err = tlfJournal.flush(ctx)
+	require.NoError(t, err)
+	requireJournalEntryCounts(t, tlfJournal, 0, 0)
+	config.checkRange(
+		mdserver.rmdses, firstRevision, firstPrevRoot, Merged, NullBranchID)
+
+	// Flushing the whole archive afterwards is a no-op.
+	err = archive.flush(ctx, logger.NewTestLogger(t), tlfJournal.delegateBlockServer, nil,
+		config.Reporter(), mdserver, config.Crypto(), nug)
+	require.NoError(t, err)
+	require.Equal(t, mdCount, len(mdserver.rmdses))
+}
+
+func TestJournalArchiveExportAndRemove(t *testing.T) {
+	tempdir, config, ctx, cancel, tlfJournal, delegate :=
+		setupTLFJournalTest(t, TLFJournalBackgroundWorkPaused)
+	defer teardownTLFJournalTest(
+		tempdir, config, ctx, cancel, tlfJournal, delegate)
+
+	putBlock(ctx, t, config, tlfJournal, []byte{1, 2, 3, 4})
+	putOneMD(ctx, config, tlfJournal)
+
+	var buf bytes.Buffer
+	err := tlfJournal.exportArchive(ctx, &buf, true)
+	require.NoError(t, err)
+
+	// The exported entries are moved out of the journal, so it has
+	// nothing left to flush.
+	requireJournalEntryCounts(t, tlfJournal, 0, 0)
+	var journalMDServer shimMDServer
+	config.mdserver = &journalMDServer
+	err = tlfJournal.flush(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(journalMDServer.rmdses))
+}
+
+func TestJournalArchiveTampered(t *testing.T) {
+	tempdir, config, ctx, cancel, tlfJournal, delegate :=
+		setupTLFJournalTest(t, TLFJournalBackgroundWorkPaused)
+	defer teardownTLFJournalTest(
+		tempdir, config, ctx, cancel, tlfJournal, delegate)
+
+	putBlock(ctx, t, config, tlfJournal, []byte{1, 2, 3, 4})
+	putOneMD(ctx, config, tlfJournal)
+
+	var buf bytes.Buffer
+	err := tlfJournal.exportArchive(ctx, &buf, false)
+	require.NoError(t, err)
+
+	var signed journalArchiveSigned
+	err = config.Codec().Decode(buf.Bytes(), &signed)
+	require.NoError(t, err)
+	signed.Contents[len(signed.Contents)-1]++
+	tampered, err := config.Codec().Encode(signed)
+	require.NoError(t, err)
+
+	_, err = readJournalArchive(
+		config.Codec(), config.Crypto(), InitialExtraMetadataVer, tampered)
+	require.Error(t, err)
+}
+
+func TestJournalArchiveImport(t *testing.T) {
+	tempdir, config, ctx, cancel, tlfJournal, delegate :=
+		setupTLFJournalTest(t, TLFJournalBackgroundWorkPaused)
+	defer teardownTLFJournalTest(
+		tempdir, config, ctx, cancel, tlfJournal, delegate)
+
+	putBlock(ctx, t, config, tlfJournal, []byte{1, 2, 3, 4})
+	putOneMD(ctx, config, tlfJournal)
+
+	var buf bytes.Buffer
+	err := tlfJournal.exportArchive(ctx, &buf, true)
+	require.NoError(t, err)
+	requireJournalEntryCounts(t, tlfJournal, 0, 0)
+	archive, err := readJournalArchive(
+		config.Codec(), config.Crypto(), InitialExtraMetadataVer, buf.Bytes())
+	require.NoError(t, err)
+
+	// Archives from another user or device are rejected.
+	otherUser := archive
+	otherUser.contents.UID = keybase1.MakeTestUID(2)
+	err = tlfJournal.importArchive(ctx, otherUser)
+	require.Error(t, err)
+	otherDevice := archive
+	otherDevice.contents.VerifyingKey =
+		MakeFakeVerifyingKeyOrBust("other device")
+	err = tlfJournal.importArchive(ctx, otherDevice)
+	require.Error(t, err)
+	requireJournalEntryCounts(t, tlfJournal, 0, 0)
+
+	err = tlfJournal.importArchive(ctx, archive)
+	require.NoError(t, err)
+	requireJournalEntryCounts(t, tlfJournal, 2, 1)
+
+	// The MD journal isn't empty anymore, so the MDs can't be
+	// applied again.
+	err = tlfJournal.importArchive(ctx, archive)
+	require.Error(t, err)
+	requireJournalEntryCounts(t, tlfJournal, 2, 1)
+}
@@ -38,7 +38,7 @@ func setupJournalBlockServerTest(t *testing.T) (
 		}
 	}()
 
-	config.EnableJournaling(tempdir)
+	config.EnableJournaling(tempdir, JournalStorageOptions{})
 	jServer, err = GetJournalServer(config)
 	require.NoError(t, err)
 	blockServer := jServer.blockServer()
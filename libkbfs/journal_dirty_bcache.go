@@ -61,6 +61,12 @@ func (j journalDirtyBlockCache) IsAnyDirty(tlfID TlfID) bool {
 func (j journalDirtyBlockCache) RequestPermissionToDirty(ctx context.Context,
 	tlfID TlfID, estimatedDirtyBytes int64) (DirtyPermChan, error) {
 	if j.jServer.hasTLFJournal(tlfID) {
+		// Throttle writers as the journals fill up, before even
+		// asking the journal cache.
+		err := j.jServer.waitForLimits(ctx, tlfID, estimatedDirtyBytes)
+		if err != nil {
+			return nil, err
+		}
 		return j.journalCache.RequestPermissionToDirty(ctx, tlfID,
 			estimatedDirtyBytes)
 	}
@@ -0,0 +1,450 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/net/context"
+)
+
+// JournalStorageOptions controls how the write journals keep their
+// files on the local disk.  It is suitable for encoding directly as
+// JSON.
+type JournalStorageOptions struct {
+	// Encrypt, if true, encrypts every journal file with a random
+	// key, which is itself stored encrypted for the current
+	// device's crypt key.  Existing journals are migrated to (or,
+	// if false, back from) encryption when they're enabled.
+	Encrypt bool
+	// SecureWipe, if true, overwrites journal files before
+	// removing them, e.g. once their entries are flushed.  On
+	// disks that remap writes (like most SSDs), this is only
+	// best-effort.
+	SecureWipe bool
+}
+
+const (
+	// journalFileMagic starts every encrypted journal file, and
+	// is followed by a nonce and the sealed contents.
+	journalFileMagic = "KBFSJE1\n"
+	// journalFileOverhead is how much bigger an encrypted journal
+	// file is than its contents.
+	journalFileOverhead = len(journalFileMagic) + 24 + secretbox.Overhead
+	// Suffixes of the files written while migrating a journal
+	// file; see migrateFile.
+	journalMigrateTempSuffix = ".migrate-tmp"
+	journalMigrateNewSuffix  = ".migrate-new"
+)
+
+// journalFiles reads, writes, and removes the files of a TLF
+// journal.  The zero value keeps files in plaintext and removes them
+// normally.
+type journalFiles struct {
+	// key, if non-nil, is used to decrypt encrypted files.
+	key *[32]byte
+	// encrypt, if true, means that new files are encrypted with
+	// key.  If false, key may still be set so that files from
+	// before encryption was turned off can be read.
+	encrypt bool
+	// wipe, if true, means that files are overwritten before
+	// they're removed.
+	wipe bool
+}
+
+func isEncryptedJournalFile(buf []byte) bool {
+	return bytes.HasPrefix(buf, []byte(journalFileMagic))
+}
+
+func (f journalFiles) decode(path string, buf []byte) ([]byte, error) {
+	if !isEncryptedJournalFile(buf) {
+		return buf, nil
+	}
+	if f.key == nil {
+		return nil, fmt.Errorf("No key to decrypt journal file %s", path)
+	}
+	if len(buf) < journalFileOverhead {
+		return nil, fmt.Errorf(
+			"Encrypted journal file %s is truncated", path)
+	}
+	var nonce [24]byte
+	copy(nonce[:], buf[len(journalFileMagic):])
+	data, ok := secretbox.Open(
+		nil, buf[len(journalFileMagic)+len(nonce):], &nonce, f.key)
+	if !ok {
+		return nil, fmt.Errorf("Could not decrypt journal file %s", path)
+	}
+	return data, nil
+}
+
+func (f journalFiles) encode(data []byte) ([]byte, error) {
+	if !f.encrypt {
+		return data, nil
+	}
+	var nonce [24]byte
+	err := cryptoRandRead(nonce[:])
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, len(data)+journalFileOverhead)
+	buf = append(buf, journalFileMagic...)
+	buf = append(buf, nonce[:]...)
+	return secretbox.Seal(buf, data, &nonce, f.key), nil
+}
+
+// readFile reads the file at path, decrypting it if necessary.
+func (f journalFiles) readFile(path string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return f.decode(path, buf)
+}
+
+// writeFile writes data to the file at path, encrypting it if
+// necessary.
+func (f journalFiles) writeFile(path string, data []byte) error {
+	buf, err := f.encode(data)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf, 0600)
+}
+
+// dataSize returns the size of the decrypted contents of the file at
+// path, without reading all of it.
+func (f journalFiles) dataSize(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	header := make([]byte, len(journalFileMagic))
+	_, err = io.ReadFull(file, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fi.Size(), nil
+	} else if err != nil {
+		return 0, err
+	}
+	if !isEncryptedJournalFile(header) {
+		return fi.Size(), nil
+	}
+	return fi.Size() - int64(journalFileOverhead), nil
+}
+
+// wipeFile overwrites the regular file at path with zeroes.
+func wipeFile(path string) (err error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	zeroes := make([]byte, 32*1024)
+	for remaining := fi.Size(); remaining > 0; {
+		n := int64(len(zeroes))
+		if remaining < n {
+			n = remaining
+		}
+		_, err := file.Write(zeroes[:n])
+		if err != nil {
+			return err
+		}
+		remaining -= n
+	}
+	return file.Sync()
+}
+
+// remove removes the file at path, wiping it first if necessary.
+func (f journalFiles) remove(path string) error {
+	if f.wipe {
+		err := wipeFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Remove(path)
+}
+
+// removeAll is like os.RemoveAll, but wipes all the removed files
+// first if necessary.
+func (f journalFiles) removeAll(path string) error {
+	if f.wipe {
+		err := filepath.Walk(path,
+			func(p string, fi os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				return wipeFile(p)
+			})
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.RemoveAll(path)
+}
+
+// migrateFile rewrites the file at path in the form that f would
+// write it in, if it isn't already.  The new contents go to a temp
+// file, which is synced and renamed to path+journalMigrateNewSuffix
+// before the old file is touched, so a file with that suffix is
+// always complete; see recoverMigration.
+func (f journalFiles) migrateFile(path string) (bool, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	if isEncryptedJournalFile(buf) == f.encrypt {
+		return false, nil
+	}
+	data, err := f.decode(path, buf)
+	if err != nil {
+		return false, err
+	}
+	buf, err = f.encode(data)
+	if err != nil {
+		return false, err
+	}
+
+	tempPath := path + journalMigrateTempSuffix
+	file, err := os.OpenFile(
+		tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return false, err
+	}
+	_, err = file.Write(buf)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	newPath := path + journalMigrateNewSuffix
+	err = os.Rename(tempPath, newPath)
+	if err != nil {
+		return false, err
+	}
+
+	if f.wipe {
+		err = wipeFile(path)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, os.Rename(newPath, path)
+}
+
+// recoverMigration cleans up after a migration of dir that was
+// interrupted: incomplete temp files are removed, and complete new
+// files replace the files they were migrated from.
+func recoverMigration(dir string) error {
+	return filepath.Walk(dir,
+		func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			switch {
+			case strings.HasSuffix(path, journalMigrateTempSuffix):
+				return os.Remove(path)
+			case strings.HasSuffix(path, journalMigrateNewSuffix):
+				return os.Rename(path,
+					strings.TrimSuffix(path, journalMigrateNewSuffix))
+			}
+			return nil
+		})
+}
+
+// migrateDir rewrites every file under the given TLF journal
+// directory in the form that f would write it in, i.e. encrypts the
+// plaintext files if f.encrypt is true and decrypts the encrypted
+// ones otherwise.  It returns the number of files it rewrote.  If
+// it's interrupted, it can just be run again.
+func (f journalFiles) migrateDir(dir string) (int, error) {
+	err := recoverMigration(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	err = filepath.Walk(dir,
+		func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			ok, err := f.migrateFile(path)
+			if err != nil {
+				return err
+			}
+			if ok {
+				migrated++
+			}
+			return nil
+		})
+	if err != nil {
+		return 0, err
+	}
+	return migrated, nil
+}
+
+// journalKeyInfo is the on-disk form of a device's journal key.  The
+// key is stored like a TLF crypt key client half, i.e. encrypted for
+// the device's crypt key with an ephemeral key pair.
+type journalKeyInfo struct {
+	CryptKID            keybase1.KID
+	EPubKey             kbfscrypto.TLFEphemeralPublicKey
+	EncryptedClientHalf EncryptedTLFCryptKeyClientHalf
+}
+
+// getJournalKeyPath returns the path of the journal key for the
+// device with the given verifying key, under the given journal root
+// path (e.g., JournalServer.rootPath()).  Like the TLF journal
+// directories, it's named after a prefix of the verifying key.
+func getJournalKeyPath(
+	rootPath string, verifyingKey kbfscrypto.VerifyingKey) string {
+	return filepath.Join(rootPath, verifyingKey.String()[:36]+".key")
+}
+
+func readJournalKey(
+	ctx context.Context, config Config, path string) (*[32]byte, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var info journalKeyInfo
+	err = config.Codec().Decode(buf, &info)
+	if err != nil {
+		return nil, err
+	}
+	clientHalf, err := config.Crypto().DecryptTLFCryptKeyClientHalf(
+		ctx, info.EPubKey, info.EncryptedClientHalf)
+	if err != nil {
+		return nil, err
+	}
+	key := clientHalf.Data()
+	return &key, nil
+}
+
+// makeJournalKey makes a new journal key, encrypted for the current
+// device, and saves it to path.  It's written to a temp file that's
+// synced and then renamed to path, so a crash can't leave a partial
+// key behind, which would make the journals unreadable.
+func makeJournalKey(
+	ctx context.Context, config Config, path string) (
+	key *[32]byte, err error) {
+	cryptKey, err := config.KBPKI().GetCurrentCryptPublicKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	crypto := config.Crypto()
+	_, _, ePubKey, ePrivKey, randomKey, err := crypto.MakeRandomTLFKeys()
+	if err != nil {
+		return nil, err
+	}
+	keyData := randomKey.Data()
+	encryptedClientHalf, err := crypto.EncryptTLFCryptKeyClientHalf(
+		ePrivKey, cryptKey, kbfscrypto.MakeTLFCryptKeyClientHalf(keyData))
+	if err != nil {
+		return nil, err
+	}
+	buf, err := config.Codec().Encode(journalKeyInfo{
+		CryptKID:            cryptKey.KID(),
+		EPubKey:             ePubKey,
+		EncryptedClientHalf: encryptedClientHalf,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(file.Name())
+		}
+	}()
+	_, err = file.Write(buf)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return nil, err
+	}
+	return &keyData, nil
+}
+
+// loadJournalFiles returns the journalFiles for the current device
+// with the given options, reading its journal key from keyPath if it
+// exists, or making a new one if encryption is on.  The key is kept
+// even if encryption is turned off, so that older encrypted journals
+// can still be read and migrated.
+func loadJournalFiles(ctx context.Context, config Config, keyPath string,
+	opts JournalStorageOptions) (journalFiles, error) {
+	key, err := readJournalKey(ctx, config, keyPath)
+	switch {
+	case os.IsNotExist(err) && opts.Encrypt:
+		key, err = makeJournalKey(ctx, config, keyPath)
+		if err != nil {
+			return journalFiles{}, err
+		}
+	case os.IsNotExist(err):
+	case err != nil:
+		// Don't make a new key, since that would make any
+		// existing encrypted journals unreadable.
+		return journalFiles{}, fmt.Errorf(
+			"Could not read journal key %s: %v", keyPath, err)
+	}
+	return journalFiles{
+		key:     key,
+		encrypt: opts.Encrypt,
+		wipe:    opts.SecureWipe,
+	}, nil
+}
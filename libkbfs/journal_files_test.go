@@ -0,0 +1,238 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func makeTestJournalFiles(t *testing.T) journalFiles {
+	var key [32]byte
+	err := cryptoRandRead(key[:])
+	require.NoError(t, err)
+	return journalFiles{key: &key, encrypt: true}
+}
+
+func TestJournalFilesReadWrite(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "journal_files")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	files := makeTestJournalFiles(t)
+	path := filepath.Join(tempdir, "file")
+	data := []byte{1, 2, 3, 4}
+	err = files.writeFile(path, data)
+	require.NoError(t, err)
+
+	buf, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.True(t, isEncryptedJournalFile(buf))
+	require.Equal(t, len(data)+journalFileOverhead, len(buf))
+
+	read, err := files.readFile(path)
+	require.NoError(t, err)
+	require.Equal(t, data, read)
+	size, err := files.dataSize(path)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), size)
+
+	// Plaintext files can still be read.
+	plainPath := filepath.Join(tempdir, "plain")
+	err = journalFiles{}.writeFile(plainPath, data)
+	require.NoError(t, err)
+	read, err = files.readFile(plainPath)
+	require.NoError(t, err)
+	require.Equal(t, data, read)
+
+	// But encrypted ones need the right key.
+	_, err = journalFiles{}.readFile(path)
+	require.Error(t, err)
+	_, err = makeTestJournalFiles(t).readFile(path)
+	require.Error(t, err)
+}
+
+func TestJournalFilesMigrateDir(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "journal_files")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	plain := journalFiles{}
+	paths := []string{
+		filepath.Join(tempdir, "a"),
+		filepath.Join(tempdir, "sub", "b"),
+	}
+	err = os.MkdirAll(filepath.Join(tempdir, "sub"), 0700)
+	require.NoError(t, err)
+	for i, path := range paths {
+		err = plain.writeFile(path, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+
+	files := makeTestJournalFiles(t)
+	files.wipe = true
+	migrated, err := files.migrateDir(tempdir)
+	require.NoError(t, err)
+	require.Equal(t, len(paths), migrated)
+	for i, path := range paths {
+		buf, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		require.True(t, isEncryptedJournalFile(buf))
+		data, err := files.readFile(path)
+		require.NoError(t, err)
+		require.Equal(t, []byte{byte(i)}, data)
+	}
+
+	// Migrating again is a no-op.
+	migrated, err = files.migrateDir(tempdir)
+	require.NoError(t, err)
+	require.Equal(t, 0, migrated)
+
+	// Simulate a migration back to plaintext that was interrupted
+	// after the first file's new contents were complete, and
+	// while the second file's were being written.
+	err = plain.writeFile(paths[0]+journalMigrateNewSuffix, []byte{0})
+	require.NoError(t, err)
+	err = ioutil.WriteFile(
+		paths[1]+journalMigrateTempSuffix, []byte{0xff}, 0600)
+	require.NoError(t, err)
+
+	files.encrypt = false
+	migrated, err = files.migrateDir(tempdir)
+	require.NoError(t, err)
+	require.Equal(t, 1, migrated)
+	for i, path := range paths {
+		buf, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, []byte{byte(i)}, buf)
+		_, err = os.Stat(path + journalMigrateNewSuffix)
+		require.True(t, os.IsNotExist(err))
+		_, err = os.Stat(path + journalMigrateTempSuffix)
+		require.True(t, os.IsNotExist(err))
+	}
+
+	// A missing dir has nothing to migrate.
+	migrated, err = files.migrateDir(filepath.Join(tempdir, "missing"))
+	require.NoError(t, err)
+	require.Equal(t, 0, migrated)
+}
+
+func TestJournalFilesWipe(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "journal_files")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	path := filepath.Join(tempdir, "file")
+	data := []byte{1, 2, 3, 4}
+	err = ioutil.WriteFile(path, data, 0600)
+	require.NoError(t, err)
+	err = wipeFile(path)
+	require.NoError(t, err)
+	buf, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, len(data)), buf)
+
+	files := journalFiles{wipe: true}
+	err = files.remove(path)
+	require.NoError(t, err)
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+
+	dir := filepath.Join(tempdir, "dir")
+	err = os.MkdirAll(dir, 0700)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "file"), data, 0600)
+	require.NoError(t, err)
+	err = files.removeAll(dir)
+	require.NoError(t, err)
+	_, err = os.Stat(dir)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestJournalServerEncryptedRestart(t *testing.T) {
+	tempdir, config, jServer := setupJournalServerTest(t)
+	defer teardownJournalServerTest(t, tempdir, config)
+
+	ctx := context.Background()
+	uid, verifyingKey, err :=
+		getCurrentUIDAndVerifyingKey(ctx, config.KBPKI())
+	require.NoError(t, err)
+
+	restart := func(storage JournalStorageOptions) {
+		jServer.shutdown()
+		jServer = makeJournalServer(
+			config, jServer.log, tempdir, storage,
+			jServer.delegateBlockCache,
+			jServer.delegateDirtyBlockCache,
+			jServer.delegateBlockServer, jServer.delegateMDOps,
+			nil, nil, nil)
+		err := jServer.EnableExistingJournals(
+			ctx, uid, verifyingKey, TLFJournalBackgroundWorkPaused)
+		require.NoError(t, err)
+		config.SetBlockCache(jServer.blockCache())
+		config.SetBlockServer(jServer.blockServer())
+	}
+
+	restart(JournalStorageOptions{Encrypt: true})
+	require.True(t, jServer.Status().Storage.Encrypt)
+	keyPath := getJournalKeyPath(jServer.rootPath(), verifyingKey)
+	_, err = os.Stat(keyPath)
+	require.NoError(t, err)
+	// The key is renamed into place, so no temp file is left.
+	fileInfos, err := ioutil.ReadDir(jServer.rootPath())
+	require.NoError(t, err)
+	require.Len(t, fileInfos, 1)
+
+	tlfID := FakeTlfID(2, false)
+	err = jServer.Enable(ctx, tlfID, TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+
+	// Put a block, which is encrypted on disk.
+
+	blockServer := config.BlockServer()
+	crypto := config.Crypto()
+	bCtx := BlockContext{uid, "", zeroBlockRefNonce}
+	data := []byte{1, 2, 3, 4}
+	bID, err := crypto.MakePermanentBlockID(data)
+	require.NoError(t, err)
+	serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	err = blockServer.Put(ctx, tlfID, bID, bCtx, data, serverHalf)
+	require.NoError(t, err)
+
+	dataPath := jServer.tlfJournals[tlfID].blockJournal.blockDataPath(bID)
+	buf, err := ioutil.ReadFile(dataPath)
+	require.NoError(t, err)
+	require.True(t, isEncryptedJournalFile(buf))
+
+	// Turning encryption off migrates the journal back to
+	// plaintext, using the existing key.
+
+	restart(JournalStorageOptions{})
+	err = jServer.Enable(ctx, tlfID, TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+	buf, err = ioutil.ReadFile(dataPath)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+
+	buf, key, err := config.BlockServer().Get(ctx, tlfID, bID, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+	require.Equal(t, serverHalf, key)
+}
@@ -0,0 +1,359 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+// JournalFlushLimit restricts how fast, and when, the write journals
+// flush in the background.  Explicit flushes aren't restricted.
+type JournalFlushLimit struct {
+	// BytesPerSecond is the maximum average rate at which block
+	// data is flushed, shared by all journals; 0 means no limit.
+	BytesPerSecond int64
+	// If WindowStart and WindowEnd differ, the journals only flush
+	// between those times of day, given as offsets from local
+	// midnight.  A window that ends before it starts wraps past
+	// midnight.
+	WindowStart time.Duration
+	WindowEnd   time.Duration
+}
+
+const journalFlushWindowAlways = "always"
+
+func formatTimeOfDay(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d",
+		int(d/time.Hour), int(d%time.Hour/time.Minute))
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (l JournalFlushLimit) hasWindow() bool {
+	return l.WindowStart != l.WindowEnd
+}
+
+func (l JournalFlushLimit) rateString() string {
+	if l.BytesPerSecond <= 0 {
+		return "unlimited"
+	}
+	return SizeFlag{&l.BytesPerSecond}.String()
+}
+
+func (l JournalFlushLimit) windowString() string {
+	if !l.hasWindow() {
+		return journalFlushWindowAlways
+	}
+	return formatTimeOfDay(l.WindowStart) + "-" +
+		formatTimeOfDay(l.WindowEnd)
+}
+
+// String returns the limit in the format accepted by
+// ParseJournalFlushLimit, e.g. "rate=500k window=22:00-06:00".
+func (l JournalFlushLimit) String() string {
+	return fmt.Sprintf("rate=%s window=%s", l.rateString(), l.windowString())
+}
+
+func (l *JournalFlushLimit) setWindow(s string) error {
+	if s == journalFlushWindowAlways || s == "" {
+		l.WindowStart, l.WindowEnd = 0, 0
+		return nil
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return fmt.Errorf("Invalid window %q, expected HH:MM-HH:MM or %q",
+			s, journalFlushWindowAlways)
+	}
+	start, err := parseTimeOfDay(parts[0])
+	if err != nil {
+		return err
+	}
+	end, err := parseTimeOfDay(parts[1])
+	if err != nil {
+		return err
+	}
+	l.WindowStart, l.WindowEnd = start, end
+	return nil
+}
+
+// ParseJournalFlushLimit parses whitespace-separated settings of the
+// form "rate=<bytes per second>" (using the syntax of SizeFlag, or
+// "unlimited") and "window=HH:MM-HH:MM" (or "always"), and applies
+// them to prev.  Settings missing from s keep their values from
+// prev.
+func ParseJournalFlushLimit(s string, prev JournalFlushLimit) (
+	JournalFlushLimit, error) {
+	l := prev
+	for _, field := range strings.Fields(s) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return JournalFlushLimit{}, fmt.Errorf(
+				"Invalid setting %q, expected key=value", field)
+		}
+		switch kv[0] {
+		case "rate":
+			if kv[1] == "unlimited" {
+				l.BytesPerSecond = 0
+				continue
+			}
+			err := SizeFlag{&l.BytesPerSecond}.Set(kv[1])
+			if err != nil {
+				return JournalFlushLimit{}, err
+			}
+		case "window":
+			err := l.setWindow(kv[1])
+			if err != nil {
+				return JournalFlushLimit{}, err
+			}
+		default:
+			return JournalFlushLimit{}, fmt.Errorf(
+				"Unknown setting %q, expected rate or window", kv[0])
+		}
+	}
+	return l, nil
+}
+
+// journalFlushWindowFlag sets the window of a JournalFlushLimit from
+// the command line.
+type journalFlushWindowFlag struct {
+	l *JournalFlushLimit
+}
+
+// String for flag interface.
+func (f journalFlushWindowFlag) String() string {
+	if f.l == nil {
+		return journalFlushWindowAlways
+	}
+	return f.l.windowString()
+}
+
+// Set for flag interface.
+func (f journalFlushWindowFlag) Set(raw string) error {
+	return f.l.setWindow(raw)
+}
+
+// nextWindow returns the bounds of the flush window containing now,
+// or of the next one if now is outside a window.  It returns zero
+// times if there's no window, i.e. flushing is always allowed.
+func (l JournalFlushLimit) nextWindow(now time.Time) (start, end time.Time) {
+	if !l.hasWindow() {
+		return time.Time{}, time.Time{}
+	}
+	length := l.WindowEnd - l.WindowStart
+	if length < 0 {
+		length += 24 * time.Hour
+	}
+	// Start from yesterday's window, in case it wraps past
+	// midnight into today.
+	y, m, d := now.Date()
+	start = time.Date(y, m, d-1, 0, 0, 0, 0, now.Location()).Add(
+		l.WindowStart)
+	for !now.Before(start.Add(length)) {
+		start = start.AddDate(0, 0, 1)
+	}
+	return start, start.Add(length)
+}
+
+// JournalFlushStatus describes the restrictions on background
+// flushing for display in diagnostics.  It is suitable for encoding
+// directly as JSON.
+type JournalFlushStatus struct {
+	// Limit is the configured limit, in the format of the
+	// .kbfs_journal_flush_limit file.
+	Limit string
+	// EffectiveRate is the rate at which the journals may flush
+	// right now, in bytes per second: "unlimited", "paused" if
+	// outside the flush window, or a SizeFlag-style size.
+	EffectiveRate string
+	// NextWindowStart and NextWindowEnd bound the current flush
+	// window, or the next one if flushing is paused.  They are zero
+	// if there's no window.
+	NextWindowStart time.Time
+	NextWindowEnd   time.Time
+}
+
+// errJournalFlushWindowClosed is returned by a background flush when
+// it gets outside the flush window.
+var errJournalFlushWindowClosed = errors.New(
+	"Journal flush window is closed")
+
+// journalFlushLimiter enforces a JournalFlushLimit with a token
+// bucket that holds up to one second's worth of bytes.  It's shared
+// by all the tlfJournals of a JournalServer.
+type journalFlushLimiter struct {
+	clock Clock
+	log   logger.Logger
+
+	// Protects all fields below.
+	lock  sync.Mutex
+	limit JournalFlushLimit
+	// tokens is the number of bytes that can be flushed right
+	// away.  It goes negative when bytes are reserved ahead of
+	// time; the reserving flush then waits until it's paid off.
+	tokens   float64
+	lastFill time.Time
+	// changedCh is closed and replaced whenever the limit
+	// changes, to wake up waiting flushes.
+	changedCh chan struct{}
+}
+
+func newJournalFlushLimiter(
+	clock Clock, log logger.Logger) *journalFlushLimiter {
+	return &journalFlushLimiter{
+		clock:     clock,
+		log:       log,
+		changedCh: make(chan struct{}),
+	}
+}
+
+func (l *journalFlushLimiter) setLimit(limit JournalFlushLimit) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limit = limit
+	l.tokens = float64(limit.BytesPerSecond)
+	l.lastFill = l.clock.Now()
+	close(l.changedCh)
+	l.changedCh = make(chan struct{})
+}
+
+func (l *journalFlushLimiter) getLimit() JournalFlushLimit {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.limit
+}
+
+// reserveLocked takes the given number of bytes from the bucket, and
+// returns how long the caller must wait before flushing them.
+func (l *journalFlushLimiter) reserveLocked(
+	now time.Time, bytes int64) time.Duration {
+	rate := float64(l.limit.BytesPerSecond)
+	if rate <= 0 {
+		return 0
+	}
+	if now.After(l.lastFill) {
+		l.tokens += now.Sub(l.lastFill).Seconds() * rate
+		if l.tokens > rate {
+			l.tokens = rate
+		}
+		l.lastFill = now
+	}
+	l.tokens -= float64(bytes)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / rate * float64(time.Second))
+}
+
+// waitForWindow blocks until the flush window opens, or returns
+// right away if it's already open.
+func (l *journalFlushLimiter) waitForWindow(ctx context.Context) error {
+	for {
+		now, start, changedCh := func() (
+			time.Time, time.Time, <-chan struct{}) {
+			l.lock.Lock()
+			defer l.lock.Unlock()
+			now := l.clock.Now()
+			start, _ := l.limit.nextWindow(now)
+			return now, start, l.changedCh
+		}()
+		if !now.Before(start) {
+			return nil
+		}
+
+		l.log.CDebugf(ctx, "Waiting until %s for the flush window", start)
+		select {
+		case <-time.After(start.Sub(now)):
+		case <-changedCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// wait blocks until the given number of bytes may be flushed under
+// the rate limit.  If the flush window is closed, it instead returns
+// errJournalFlushWindowClosed right away, so that the caller can call
+// waitForWindow.  It must not be called while holding any journal
+// locks.
+func (l *journalFlushLimiter) wait(ctx context.Context, bytes int64) error {
+	for {
+		delay, changedCh, err := func() (
+			time.Duration, <-chan struct{}, error) {
+			l.lock.Lock()
+			defer l.lock.Unlock()
+			now := l.clock.Now()
+			start, _ := l.limit.nextWindow(now)
+			if now.Before(start) {
+				return 0, nil, errJournalFlushWindowClosed
+			}
+			return l.reserveLocked(now, bytes), l.changedCh, nil
+		}()
+		if err != nil || delay == 0 {
+			return err
+		}
+
+		l.log.CDebugf(ctx, "Delaying flush of %d bytes by %s", bytes, delay)
+		select {
+		case <-time.After(delay):
+			return nil
+		case <-changedCh:
+			// The new limit dropped the reservation, so make it
+			// again under the new limit.
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// reserve takes the given number of bytes from the bucket without
+// waiting, so that whichever flush waits next pays them off.
+func (l *journalFlushLimiter) reserve(bytes int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.reserveLocked(l.clock.Now(), bytes)
+}
+
+func (l *journalFlushLimiter) status() JournalFlushStatus {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.clock.Now()
+	start, end := l.limit.nextWindow(now)
+	rate := l.limit.rateString()
+	if now.Before(start) {
+		rate = "paused"
+	}
+	return JournalFlushStatus{
+		Limit:           l.limit.String(),
+		EffectiveRate:   rate,
+		NextWindowStart: start,
+		NextWindowEnd:   end,
+	}
+}
+
+// SetFlushLimit sets the limit on background flushing for all
+// journals.  It takes effect right away, including for flushes that
+// are already waiting on the old limit.
+func (j *JournalServer) SetFlushLimit(limit JournalFlushLimit) {
+	j.flushLimiter.setLimit(limit)
+}
+
+// FlushLimit returns the current limit on background flushing.
+func (j *JournalServer) FlushLimit() JournalFlushLimit {
+	return j.flushLimiter.getLimit()
+}
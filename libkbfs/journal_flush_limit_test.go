@@ -0,0 +1,164 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestJournalFlushLimitParse(t *testing.T) {
+	l, err := ParseJournalFlushLimit(
+		"rate=500k window=22:00-06:30\n", JournalFlushLimit{})
+	require.NoError(t, err)
+	require.Equal(t, JournalFlushLimit{
+		BytesPerSecond: 500 * 1000,
+		WindowStart:    22 * time.Hour,
+		WindowEnd:      6*time.Hour + 30*time.Minute,
+	}, l)
+	require.Equal(t, "rate=500k window=22:00-06:30", l.String())
+
+	// Missing settings are left alone.
+	l, err = ParseJournalFlushLimit("rate=unlimited", l)
+	require.NoError(t, err)
+	require.Equal(t, "rate=unlimited window=22:00-06:30", l.String())
+	l, err = ParseJournalFlushLimit("window=always", l)
+	require.NoError(t, err)
+	require.Equal(t, JournalFlushLimit{}, l)
+
+	for _, s := range []string{
+		"rate", "rate=fast", "window=22:00", "window=25:00-01:00", "burst=1",
+	} {
+		_, err = ParseJournalFlushLimit(s, l)
+		require.Error(t, err, s)
+	}
+}
+
+func TestJournalFlushLimitNextWindow(t *testing.T) {
+	day := func(h, m int) time.Time {
+		return time.Date(2016, 11, 2, h, m, 0, 0, time.UTC)
+	}
+
+	start, end := JournalFlushLimit{}.nextWindow(day(12, 0))
+	require.True(t, start.IsZero())
+	require.True(t, end.IsZero())
+
+	// A window within one day.
+	l := JournalFlushLimit{WindowStart: 9 * time.Hour, WindowEnd: 17 * time.Hour}
+	start, end = l.nextWindow(day(8, 0))
+	require.Equal(t, day(9, 0), start)
+	require.Equal(t, day(17, 0), end)
+	start, end = l.nextWindow(day(12, 0))
+	require.Equal(t, day(9, 0), start)
+	require.Equal(t, day(17, 0), end)
+	start, _ = l.nextWindow(day(17, 0))
+	require.Equal(t, day(9, 0).AddDate(0, 0, 1), start)
+
+	// A window that wraps past midnight.
+	l = JournalFlushLimit{WindowStart: 22 * time.Hour, WindowEnd: 6 * time.Hour}
+	start, end = l.nextWindow(day(3, 0))
+	require.Equal(t, day(22, 0).AddDate(0, 0, -1), start)
+	require.Equal(t, day(6, 0), end)
+	start, end = l.nextWindow(day(12, 0))
+	require.Equal(t, day(22, 0), start)
+	require.Equal(t, day(6, 0).AddDate(0, 0, 1), end)
+}
+
+func TestJournalFlushLimiter(t *testing.T) {
+	clock, now := newTestClockAndTimeNow()
+	limiter := newJournalFlushLimiter(clock, logger.NewTestLogger(t))
+	ctx := context.Background()
+
+	// No limit by default.
+	require.NoError(t, limiter.wait(ctx, 1<<30))
+
+	limiter.setLimit(JournalFlushLimit{BytesPerSecond: 1000})
+	limiter.lock.Lock()
+	// The bucket starts full, and allows debt.
+	require.Equal(t, time.Duration(0), limiter.reserveLocked(now, 1000))
+	require.Equal(t, 2*time.Second, limiter.reserveLocked(now, 2000))
+	// Paying off the debt takes time.
+	require.Equal(t, 500*time.Millisecond,
+		limiter.reserveLocked(now.Add(2*time.Second), 500))
+	// The bucket doesn't fill past one second's worth.
+	require.Equal(t, 1*time.Second,
+		limiter.reserveLocked(now.Add(time.Hour), 2000))
+	limiter.lock.Unlock()
+
+	// Outside the window, flushes stop.
+	start := now.Add(time.Hour)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0,
+		now.Location())
+	windowStart := start.Sub(midnight) % (24 * time.Hour)
+	limiter.setLimit(JournalFlushLimit{
+		WindowStart: windowStart,
+		WindowEnd:   (windowStart + time.Hour) % (24 * time.Hour),
+	})
+	require.Equal(t, errJournalFlushWindowClosed, limiter.wait(ctx, 0))
+	status := limiter.status()
+	require.Equal(t, "paused", status.EffectiveRate)
+
+	ctx2, cancel := context.WithCancel(ctx)
+	cancel()
+	require.Equal(t, context.Canceled, limiter.waitForWindow(ctx2))
+
+	clock.Set(start)
+	require.NoError(t, limiter.wait(ctx, 0))
+	require.NoError(t, limiter.waitForWindow(ctx))
+	status = limiter.status()
+	require.Equal(t, "unlimited", status.EffectiveRate)
+	require.True(t, status.NextWindowStart.Equal(start))
+}
+
+// waitForLimiterTokens waits until the limiter's bucket holds the
+// given number of tokens, i.e. until a waiting flush has reserved
+// its bytes.
+func waitForLimiterTokens(ctx context.Context, t *testing.T,
+	limiter *journalFlushLimiter, tokens float64) {
+	for {
+		limiter.lock.Lock()
+		current := limiter.tokens
+		limiter.lock.Unlock()
+		if current == tokens {
+			return
+		}
+		select {
+		case <-time.After(time.Millisecond):
+		case <-ctx.Done():
+			t.Fatalf("Tokens are %f, not %f: %v", current, tokens, ctx.Err())
+		}
+	}
+}
+
+func TestJournalFlushLimiterRereservesOnChange(t *testing.T) {
+	clock := newTestClockNow()
+	limiter := newJournalFlushLimiter(clock, logger.NewTestLogger(t))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	limiter.setLimit(JournalFlushLimit{BytesPerSecond: 1000})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- limiter.wait(ctx, 3000)
+	}()
+	waitForLimiterTokens(ctx, t, limiter, -2000)
+
+	// A new limit drops the old reservation, and the waiting
+	// flush reserves its bytes again under the new limit.
+	limiter.setLimit(JournalFlushLimit{BytesPerSecond: 100})
+	waitForLimiterTokens(ctx, t, limiter, -2900)
+	select {
+	case err := <-errCh:
+		t.Fatalf("wait returned early: %v", err)
+	default:
+	}
+
+	limiter.setLimit(JournalFlushLimit{})
+	require.NoError(t, <-errCh)
+}
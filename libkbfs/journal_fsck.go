@@ -0,0 +1,773 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"golang.org/x/net/context"
+)
+
+// JournalFsckResult describes the problems found by FsckJournals in
+// a single TLF journal.  It is suitable for encoding directly as
+// JSON.
+type JournalFsckResult struct {
+	Dir      string
+	TlfID    TlfID
+	Problems []string
+	// Repaired is true if the journal was truncated to its last
+	// consistent state, which fixes all of the problems except for
+	// unreferenced blocks.
+	Repaired bool
+	// Unrepairable is true if the journal has problems that can't
+	// be repaired without losing more than the bad entries.
+	Unrepairable bool
+}
+
+// FsckJournals checks every TLF journal under the given storage root
+// (i.e., the directory passed to EnableJournaling), which must not be
+// in use by any JournalServer.  It verifies the block data against
+// the block IDs, the MD chain, and the block references against the
+// references in the MDs.  If repair is true, each journal with
+// problems is truncated to the last entries that are consistent,
+// which discards any unflushed writes after that point.
+func FsckJournals(ctx context.Context, config Config, root string,
+	repair bool) ([]JournalFsckResult, error) {
+	rootPath := filepath.Join(root, "v1")
+	fileInfos, err := ioutil.ReadDir(rootPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	log := config.MakeLogger("")
+	files, err := getFsckJournalFiles(ctx, config, rootPath)
+	if err != nil {
+		return nil, err
+	}
+	var results []JournalFsckResult
+	for _, fi := range fileInfos {
+		// Squashed copies are cleaned up when the journal is
+		// next enabled.
+		if !fi.IsDir() || isTLFJournalSquashDir(fi.Name()) {
+			continue
+		}
+		f := journalFsck{
+			config:   config,
+			files:    files,
+			log:      log,
+			deferLog: log.CloneWithAddedDepth(1),
+			result: JournalFsckResult{
+				Dir: filepath.Join(rootPath, fi.Name()),
+			},
+		}
+		err := f.fsck(ctx, repair)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, f.result)
+	}
+	return results, nil
+}
+
+// getFsckJournalFiles returns the journalFiles for checking the
+// journals of the current device.  If the device has a journal key,
+// any repairs are encrypted with it, regardless of whether the
+// journal being repaired is; they're migrated along with the rest of
+// the journal when it's next enabled.
+func getFsckJournalFiles(ctx context.Context, config Config,
+	rootPath string) (journalFiles, error) {
+	_, verifyingKey, err := getCurrentUIDAndVerifyingKey(
+		ctx, config.KBPKI())
+	if err != nil {
+		// Without a current device, only plaintext journals
+		// can be checked.
+		return journalFiles{}, nil
+	}
+	key, err := readJournalKey(
+		ctx, config, getJournalKeyPath(rootPath, verifyingKey))
+	if os.IsNotExist(err) {
+		return journalFiles{}, nil
+	} else if err != nil {
+		return journalFiles{}, err
+	}
+	return journalFiles{key: key, encrypt: true}, nil
+}
+
+// fsckOrdinals checks the EARLIEST and LATEST files of the journal,
+// and finds any stray entry files outside of the range they give.
+// It returns exists == false if the journal has no valid range.
+func (j diskJournal) fsckOrdinals() (first, last journalOrdinal,
+	exists bool, problems []string, err error) {
+	first, earliestErr := j.readEarliestOrdinal()
+	last, latestErr := j.readLatestOrdinal()
+	switch {
+	case os.IsNotExist(earliestErr) && os.IsNotExist(latestErr):
+	case earliestErr != nil:
+		problems = append(problems,
+			fmt.Sprintf("Can't read the earliest ordinal of %s: %v",
+				j.dir, earliestErr))
+	case latestErr != nil:
+		problems = append(problems,
+			fmt.Sprintf("Can't read the latest ordinal of %s: %v",
+				j.dir, latestErr))
+	case first > last:
+		problems = append(problems,
+			fmt.Sprintf("The earliest ordinal %s of %s is after "+
+				"the latest ordinal %s", first, j.dir, last))
+	default:
+		exists = true
+	}
+
+	fileInfos, err := ioutil.ReadDir(j.dir)
+	if os.IsNotExist(err) {
+		return first, last, exists, problems, nil
+	} else if err != nil {
+		return 0, 0, false, nil, err
+	}
+	var strays []journalOrdinal
+	for _, fi := range fileInfos {
+		o, err := makeJournalOrdinal(fi.Name())
+		if err != nil {
+			// Not an entry file.
+			continue
+		}
+		if !exists || o < first || o > last {
+			strays = append(strays, o)
+		}
+	}
+	if exists && len(strays) > 0 {
+		problems = append(problems,
+			fmt.Sprintf("%s has %d entries outside of [%s, %s]",
+				j.dir, len(strays), first, last))
+	} else if len(strays) > 0 {
+		problems = append(problems,
+			fmt.Sprintf("%s has %d entries but no valid range",
+				j.dir, len(strays)))
+	}
+	return first, last, exists, problems, nil
+}
+
+// fsckTruncate makes the journal hold exactly the entries from first
+// to last, or no entries at all if empty is true, and removes the
+// files of all other entries.  Unlike the other functions that
+// remove entries, it tolerates missing and corrupt files.
+func (j diskJournal) fsckTruncate(
+	first, last journalOrdinal, empty bool) error {
+	fileInfos, err := ioutil.ReadDir(j.dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if empty {
+		for _, p := range []string{j.earliestPath(), j.latestPath()} {
+			err := j.files.remove(p)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	} else {
+		err := j.writeEarliestOrdinal(first)
+		if err != nil {
+			return err
+		}
+		err = j.writeLatestOrdinal(last)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, fi := range fileInfos {
+		o, err := makeJournalOrdinal(fi.Name())
+		if err != nil {
+			continue
+		}
+		if empty || o < first || o > last {
+			err := j.files.remove(j.journalEntryPath(o))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// journalFsckBlockEntry is a readable block journal entry, along with
+// its ordinal.
+type journalFsckBlockEntry struct {
+	ordinal journalOrdinal
+	entry   blockJournalEntry
+}
+
+// journalFsck checks, and optionally repairs, a single TLF journal.
+type journalFsck struct {
+	config   Config
+	files    journalFiles
+	log      logger.Logger
+	deferLog logger.Logger
+	result   JournalFsckResult
+
+	blockJournal *blockJournal
+	mdJournal    *mdJournal
+
+	// The range of readable, consistent block journal entries.
+	// blockKeep is the last ordinal to keep, unless blockEmpty is
+	// true.
+	blockFirst   journalOrdinal
+	blockKeep    journalOrdinal
+	blockEmpty   bool
+	blockEntries []journalFsckBlockEntry
+	// If hasBlockBad is true, blockBad is the ordinal of the first
+	// bad block journal entry, which was truncated along with
+	// everything after it.
+	hasBlockBad bool
+	blockBad    journalOrdinal
+
+	// The readable, consistent MDs, in revision order.
+	mdFirst MetadataRevision
+	mds     []ImmutableBareRootMetadata
+
+	// Whether anything needs to be truncated or appended.
+	needsRepair  bool
+	appendMarker bool
+}
+
+func (f *journalFsck) problemf(format string, args ...interface{}) {
+	f.result.Problems = append(f.result.Problems, fmt.Sprintf(format, args...))
+}
+
+func (f *journalFsck) fsck(ctx context.Context, repair bool) error {
+	dir := f.result.Dir
+	uid, key, tlfID, err := readTLFJournalInfoFile(dir, f.files)
+	if err != nil {
+		// Without the info file, the MDs can't be checked.
+		f.problemf("Can't read the journal info file: %v", err)
+		return nil
+	}
+	f.result.TlfID = tlfID
+	f.log.CDebugf(ctx, "Checking the journal for %s in %s", tlfID, dir)
+
+	codec := f.config.Codec()
+	crypto := f.config.Crypto()
+	f.blockJournal = &blockJournal{
+		codec:    codec,
+		crypto:   crypto,
+		dir:      dir,
+		files:    f.files,
+		log:      f.log,
+		deferLog: f.deferLog,
+		j: makeDiskJournal(codec, filepath.Join(dir, "block_journal"),
+			f.files, reflect.TypeOf(blockJournalEntry{})),
+	}
+	f.mdJournal = &mdJournal{
+		uid:      uid,
+		key:      key,
+		codec:    codec,
+		crypto:   crypto,
+		dir:      dir,
+		files:    f.files,
+		log:      f.log,
+		deferLog: f.deferLog,
+		j: makeMdIDJournal(
+			codec, filepath.Join(dir, "md_journal"), f.files),
+	}
+
+	err = f.checkBlockJournal(ctx)
+	if err != nil {
+		return err
+	}
+	err = f.checkMDJournal(tlfID)
+	if err != nil {
+		return err
+	}
+	f.checkMDPuts()
+	f.checkMarkers()
+	f.checkRefs(ctx)
+
+	if len(f.result.Problems) == 0 || !repair || !f.needsRepair ||
+		f.result.Unrepairable {
+		return nil
+	}
+	err = f.repair(ctx)
+	if err != nil {
+		return err
+	}
+	f.result.Repaired = true
+	return nil
+}
+
+// checkBlockData verifies the data and server half of a put block.
+func (f *journalFsck) checkBlockData(id BlockID) error {
+	data, err := f.files.readFile(f.blockJournal.blockDataPath(id))
+	if err != nil {
+		return err
+	}
+	err = f.config.Crypto().VerifyBlockID(data, id)
+	if err != nil {
+		return err
+	}
+	buf, err := f.files.readFile(f.blockJournal.keyServerHalfPath(id))
+	if err != nil {
+		return err
+	}
+	var serverHalf kbfscrypto.BlockCryptKeyServerHalf
+	return serverHalf.UnmarshalBinary(buf)
+}
+
+func (f *journalFsck) checkBlockJournal(ctx context.Context) error {
+	first, last, exists, problems, err :=
+		f.blockJournal.j.fsckOrdinals()
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		f.problemf("%s", p)
+	}
+	f.needsRepair = f.needsRepair || len(problems) > 0
+	f.blockFirst = first
+	f.blockEmpty = !exists
+	if !exists {
+		return nil
+	}
+	f.blockKeep = last
+
+	// The references are checked the same way as when the
+	// journal is loaded, but entry by entry, so that the first
+	// inconsistent one can be found.
+	refs := make(map[BlockID]blockRefMap)
+	checkedIDs := make(map[BlockID]bool)
+	for o := first; o <= last; o++ {
+		entry, err := f.blockJournal.readJournalEntry(o)
+		if err == nil && entry.Op == blockPutOp && !entry.Ignore {
+			var id BlockID
+			id, _, err = entry.getSingleContext()
+			if err == nil && !checkedIDs[id] {
+				err = f.checkBlockData(id)
+				checkedIDs[id] = true
+			}
+		}
+		if err == nil {
+			err = addJournalEntryRefs(refs, entry, o)
+		}
+		if err != nil {
+			f.problemf("Block journal entry %s is bad: %v", o, err)
+			f.hasBlockBad = true
+			f.blockBad = o
+			f.truncateBlocksBefore(o)
+			return nil
+		}
+		f.blockEntries = append(
+			f.blockEntries, journalFsckBlockEntry{o, entry})
+	}
+	return nil
+}
+
+// truncateBlocksBefore marks all block journal entries starting at
+// the given ordinal for removal.
+func (f *journalFsck) truncateBlocksBefore(o journalOrdinal) {
+	f.needsRepair = true
+	if o <= f.blockFirst {
+		f.blockEmpty = true
+		f.blockEntries = nil
+		return
+	}
+	f.blockKeep = o - 1
+	for i, e := range f.blockEntries {
+		if e.ordinal >= o {
+			f.blockEntries = f.blockEntries[:i]
+			break
+		}
+	}
+}
+
+func (f *journalFsck) checkMDJournal(tlfID TlfID) error {
+	first, last, exists, problems, err :=
+		f.mdJournal.j.j.fsckOrdinals()
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		f.problemf("%s", p)
+	}
+	f.needsRepair = f.needsRepair || len(problems) > 0
+	if !exists {
+		return nil
+	}
+	f.mdFirst, err = ordinalToRevision(first)
+	if err != nil {
+		f.problemf("%v", err)
+		f.needsRepair = true
+		return nil
+	}
+	lastRev, err := ordinalToRevision(last)
+	if err != nil {
+		f.problemf("%v", err)
+		f.needsRepair = true
+		return nil
+	}
+
+	for rev := f.mdFirst; rev <= lastRev; rev++ {
+		err := f.checkMD(tlfID, rev)
+		if err != nil {
+			f.problemf("MD journal entry for revision %s is bad: %v",
+				rev, err)
+			f.needsRepair = true
+			return nil
+		}
+	}
+	return nil
+}
+
+// checkMD checks the MD for the given revision, and its continuity
+// with the previous one.
+func (f *journalFsck) checkMD(tlfID TlfID, rev MetadataRevision) error {
+	entry, err := f.mdJournal.j.readJournalEntry(rev)
+	if err != nil {
+		return err
+	}
+	// This checks the ID, the writer, and the signature.
+	brmd, ts, err := f.mdJournal.getMD(entry.ID, false)
+	if err != nil {
+		return err
+	}
+	if brmd.RevisionNumber() != rev {
+		return fmt.Errorf("Unexpected revision %s", brmd.RevisionNumber())
+	}
+	if brmd.TlfID() != tlfID {
+		return fmt.Errorf("Unexpected TLF ID %s", brmd.TlfID())
+	}
+	if len(f.mds) > 0 {
+		if bid := f.mds[0].BID(); brmd.BID() != bid {
+			return fmt.Errorf("Branch ID %s doesn't match the "+
+				"earliest branch ID %s", brmd.BID(), bid)
+		}
+		prev := f.mds[len(f.mds)-1]
+		err := prev.CheckValidSuccessor(prev.mdID, brmd)
+		if err != nil {
+			return err
+		}
+	}
+	f.mds = append(f.mds, MakeImmutableBareRootMetadata(brmd, entry.ID, ts))
+	return nil
+}
+
+// checkMDPuts drops the MDs that reference block journal entries
+// that were dropped by checkBlockJournal.  Since the block entries
+// for an MD are appended before its revision marker, every MD from
+// the revision of the first marker after the bad entry onwards may
+// reference dropped entries, and so do the MDs after the last
+// remaining marker.
+func (f *journalFsck) checkMDPuts() {
+	if !f.hasBlockBad || len(f.mds) == 0 {
+		return
+	}
+
+	keepRev, found := MetadataRevisionUninitialized, false
+	for _, e := range f.blockEntries {
+		if e.entry.Op == mdRevMarkerOp {
+			keepRev, found = e.entry.Revision, true
+		}
+	}
+	last, err := f.blockJournal.j.readLatestOrdinal()
+	if err != nil {
+		last = f.blockBad
+	}
+	for o := f.blockBad; o <= last; o++ {
+		entry, err := f.blockJournal.readJournalEntry(o)
+		if err == nil && entry.Op == mdRevMarkerOp {
+			keepRev, found = entry.Revision-1, true
+			break
+		}
+	}
+	if !found {
+		// The revision markers before the bad entry may have
+		// been flushed already, in which case there's no telling
+		// which of the MDs reference the dropped entries.
+		f.problemf("Can't tell which MD revisions reference the "+
+			"bad block journal entry %s", f.blockBad)
+		f.result.Unrepairable = true
+		return
+	}
+
+	for i, brmd := range f.mds {
+		if brmd.RevisionNumber() > keepRev {
+			f.problemf("MD revision %s and after reference dropped "+
+				"block journal entries", brmd.RevisionNumber())
+			f.mds = f.mds[:i]
+			break
+		}
+	}
+}
+
+// checkMarkers cross-checks the MD revision markers in the block
+// journal against the MDs.  Since a marker is appended just after its
+// MD is put, the last marker must always be for the latest MD.  The
+// block entries before a marker belong to its MD (the markers and
+// entries of earlier MDs may already have been flushed, though).
+func (f *journalFsck) checkMarkers() {
+	lastRev := MetadataRevisionUninitialized
+	if len(f.mds) > 0 {
+		lastRev = f.mds[len(f.mds)-1].RevisionNumber()
+	}
+
+	// Any blocks for MDs past the latest one have to go.  Earlier
+	// markers for revisions that aren't in the MD journal are
+	// expected after the journal is cleared for conflict
+	// resolution, though.
+	if lastRev != MetadataRevisionUninitialized {
+		lastMarker, lastGoodMarker := -1, -1
+		for i, e := range f.blockEntries {
+			if e.entry.Op != mdRevMarkerOp {
+				continue
+			}
+			lastMarker = i
+			if e.entry.Revision <= lastRev {
+				lastGoodMarker = i
+			}
+		}
+		if lastMarker >= 0 &&
+			f.blockEntries[lastMarker].entry.Revision > lastRev {
+			f.problemf("Block journal entry %s marks revision %s, "+
+				"which is after the latest MD revision %s",
+				f.blockEntries[lastMarker].ordinal,
+				f.blockEntries[lastMarker].entry.Revision, lastRev)
+			if lastGoodMarker >= 0 {
+				f.truncateBlocksBefore(
+					f.blockEntries[lastGoodMarker].ordinal + 1)
+			} else {
+				f.truncateBlocksBefore(f.blockFirst)
+			}
+		}
+	}
+
+	// Any block puts after the last marker were either done for
+	// an MD put whose marker never got appended, or for a sync
+	// that never finished.
+	trailing := 0
+	lastMarker := -1
+	for i, e := range f.blockEntries {
+		switch e.entry.Op {
+		case mdRevMarkerOp:
+			trailing = 0
+			lastMarker = i
+		case blockPutOp, addRefOp:
+			if !e.entry.Ignore {
+				trailing++
+			}
+		}
+	}
+	if trailing == 0 {
+		return
+	}
+	if lastRev != MetadataRevisionUninitialized &&
+		(lastMarker < 0 ||
+			f.blockEntries[lastMarker].entry.Revision != lastRev) {
+		f.problemf("MD revision %s has no marker in the block journal",
+			lastRev)
+		f.needsRepair = true
+		f.appendMarker = true
+		return
+	}
+	f.problemf("%d block journal entries after the last MD revision "+
+		"marker are from an unfinished sync", trailing)
+	if lastMarker >= 0 {
+		f.truncateBlocksBefore(f.blockEntries[lastMarker].ordinal + 1)
+	} else {
+		f.truncateBlocksBefore(f.blockFirst)
+	}
+}
+
+// getMDRefs adds the block references made by the given MD to refs.
+func (f *journalFsck) getMDRefs(ctx context.Context,
+	brmd ImmutableBareRootMetadata,
+	refs map[BlockID]map[BlockRefNonce]bool) error {
+	// MDv3 TODO: pass key bundles when needed
+	bh, err := brmd.MakeBareTlfHandle(nil)
+	if err != nil {
+		return err
+	}
+	handle, err := MakeTlfHandle(ctx, bh, f.config.KBPKI())
+	if err != nil {
+		return err
+	}
+	mbrmd, ok := brmd.BareRootMetadata.(MutableBareRootMetadata)
+	if !ok {
+		return MutableBareRootMetadataNoImplError{}
+	}
+	rmd := RootMetadata{
+		bareMd:    mbrmd,
+		tlfHandle: handle,
+	}
+	err = decryptMDPrivateData(ctx, f.config, &rmd, rmd.ReadOnly())
+	if err != nil {
+		return err
+	}
+
+	addRef := func(ptr BlockPointer) {
+		if ptr == zeroPtr {
+			return
+		}
+		if refs[ptr.ID] == nil {
+			refs[ptr.ID] = make(map[BlockRefNonce]bool)
+		}
+		refs[ptr.ID][ptr.GetRefNonce()] = true
+	}
+	addRef(rmd.data.Dir.BlockPointer)
+	for _, op := range rmd.data.Changes.Ops {
+		for _, ptr := range op.Refs() {
+			addRef(ptr)
+		}
+		for _, update := range op.AllUpdates() {
+			addRef(update.Ref)
+		}
+	}
+	return nil
+}
+
+// checkRefs makes sure every block put or reference added in the
+// block journal is referenced by some MD in the MD journal.  This
+// doesn't lead to any repairs, since the worst effect of an
+// unreferenced block is some wasted space on the server.
+func (f *journalFsck) checkRefs(ctx context.Context) {
+	if len(f.mds) == 0 {
+		return
+	}
+	refs := make(map[BlockID]map[BlockRefNonce]bool)
+	for _, brmd := range f.mds {
+		err := f.getMDRefs(ctx, brmd, refs)
+		if err != nil {
+			// Not a problem with the journal; the MD might not
+			// be readable by this user.
+			f.log.CDebugf(ctx, "Not checking block references, since "+
+				"MD revision %s can't be read: %v",
+				brmd.RevisionNumber(), err)
+			return
+		}
+	}
+
+	// Only the entries up to the last marker belong to MDs in the
+	// journal.
+	lastMarker := -1
+	for i, e := range f.blockEntries {
+		if e.entry.Op == mdRevMarkerOp {
+			lastMarker = i
+		}
+	}
+	if f.appendMarker {
+		lastMarker = len(f.blockEntries) - 1
+	}
+	for _, e := range f.blockEntries[:lastMarker+1] {
+		if e.entry.Ignore ||
+			(e.entry.Op != blockPutOp && e.entry.Op != addRefOp) {
+			continue
+		}
+		id, context, err := e.entry.getSingleContext()
+		if err != nil {
+			continue
+		}
+		if !refs[id][context.GetRefNonce()] {
+			f.problemf("Block %s (ref nonce %s) in block journal "+
+				"entry %s isn't referenced by any MD in the journal",
+				id, context.GetRefNonce(), e.ordinal)
+		}
+	}
+}
+
+// repair truncates the block and MD journals to the consistent
+// entries found by the checks, and removes the data of any blocks
+// and MDs that are no longer in the journals.
+func (f *journalFsck) repair(ctx context.Context) error {
+	f.log.CDebugf(ctx, "Repairing the journal in %s", f.result.Dir)
+
+	// Remember the puts that are about to be removed.
+	var removedIDs []BlockID
+	_, last, exists, _, err := f.blockJournal.j.fsckOrdinals()
+	if err != nil {
+		return err
+	}
+	if exists && (f.blockEmpty || last > f.blockKeep) {
+		start := f.blockFirst
+		if !f.blockEmpty {
+			start = f.blockKeep + 1
+		}
+		for o := start; o <= last; o++ {
+			entry, err := f.blockJournal.readJournalEntry(o)
+			if err != nil || entry.Op != blockPutOp {
+				continue
+			}
+			if id, _, err := entry.getSingleContext(); err == nil {
+				removedIDs = append(removedIDs, id)
+			}
+		}
+	}
+	err = f.blockJournal.j.fsckTruncate(
+		f.blockFirst, f.blockKeep, f.blockEmpty)
+	if err != nil {
+		return err
+	}
+
+	// Remove the MDs after the last good one.
+	mdFirst, mdLast, mdExists, _, err := f.mdJournal.j.j.fsckOrdinals()
+	if err != nil {
+		return err
+	}
+	if mdExists {
+		for o := mdFirst + journalOrdinal(len(f.mds)); o <= mdLast; o++ {
+			rev, err := ordinalToRevision(o)
+			if err != nil {
+				continue
+			}
+			entry, err := f.mdJournal.j.readJournalEntry(rev)
+			if err != nil {
+				continue
+			}
+			err = f.mdJournal.removeMD(entry.ID)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	mdKeep := journalOrdinal(f.mdFirst) + journalOrdinal(len(f.mds)) - 1
+	err = f.mdJournal.j.j.fsckTruncate(
+		journalOrdinal(f.mdFirst), mdKeep, len(f.mds) == 0)
+	if err != nil {
+		return err
+	}
+
+	// Now make sure the journals load cleanly.
+	blockJournal, err := makeBlockJournal(ctx, f.config.Codec(),
+		f.config.Crypto(), f.result.Dir, f.files, f.log)
+	if err != nil {
+		return err
+	}
+	if f.appendMarker {
+		err := blockJournal.markMDRevision(
+			ctx, f.mds[len(f.mds)-1].RevisionNumber())
+		if err != nil {
+			return err
+		}
+	}
+	for _, id := range removedIDs {
+		if blockJournal.hasRef(id) {
+			continue
+		}
+		err := blockJournal.removeBlockData(id)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = makeMDJournal(f.mdJournal.uid, f.mdJournal.key,
+		f.config.Codec(), f.config.Crypto(), f.result.Dir, f.files, f.log)
+	return err
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestJournalFsck(t *testing.T) {
+	tempdir, config, jServer := setupJournalServerTest(t)
+	defer teardownJournalServerTest(t, tempdir, config)
+
+	// Use a shutdown-only BlockServer so that it errors if the
+	// journal tries to access it.
+	jServer.delegateBlockServer = shutdownOnlyBlockServer{}
+
+	ctx := context.Background()
+
+	tlfID := FakeTlfID(2, false)
+	err := jServer.Enable(ctx, tlfID, TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+
+	blockServer := config.BlockServer()
+	mdOps := config.MDOps()
+	crypto := config.Crypto()
+
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "test_user1", false)
+	require.NoError(t, err)
+	uid := h.ResolvedWriters()[0]
+
+	bh, err := h.ToBareHandle()
+	require.NoError(t, err)
+
+	// Put a block.
+
+	bCtx := BlockContext{uid, "", zeroBlockRefNonce}
+	data := []byte{1, 2, 3, 4}
+	bID, err := crypto.MakePermanentBlockID(data)
+	require.NoError(t, err)
+	serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	err = blockServer.Put(ctx, tlfID, bID, bCtx, data, serverHalf)
+	require.NoError(t, err)
+
+	// Put an MD that references it.
+
+	rmd := NewRootMetadata()
+	err = rmd.Update(tlfID, bh)
+	require.NoError(t, err)
+	rmd.tlfHandle = h
+	rmd.SetRevision(MetadataRevision(1))
+	ptr := BlockPointer{ID: bID, BlockContext: bCtx}
+	so, err := newSyncOp(BlockPointer{ID: fakeBlockID(1), BlockContext: bCtx})
+	require.NoError(t, err)
+	err = so.File.setRef(ptr)
+	require.NoError(t, err)
+	rmd.AddOp(so)
+	rekeyDone, _, err := config.KeyManager().Rekey(ctx, rmd, false)
+	require.NoError(t, err)
+	require.True(t, rekeyDone)
+
+	_, err = mdOps.Put(ctx, rmd)
+	require.NoError(t, err)
+
+	// Shut down the journal, since it can't be in use while it's
+	// checked.
+	tlfJournal, ok := jServer.getTLFJournal(tlfID)
+	require.True(t, ok)
+	blockJournal := tlfJournal.blockJournal
+	mdJournal := tlfJournal.mdJournal
+	tlfJournal.shutdown()
+
+	// The journal is consistent.
+
+	results, err := FsckJournals(ctx, config, tempdir, false)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Equal(t, tlfID, results[0].TlfID)
+	require.Empty(t, results[0].Problems)
+
+	// Corrupt the block data, which can only be fixed by dropping
+	// the block journal entries, along with the MD that references
+	// them.
+
+	err = ioutil.WriteFile(
+		blockJournal.blockDataPath(bID), []byte{5, 6}, 0600)
+	require.NoError(t, err)
+
+	// Without the revision marker after the put, there's no
+	// telling which MD references it.
+	first, err := blockJournal.j.readEarliestOrdinal()
+	require.NoError(t, err)
+	err = blockJournal.j.fsckTruncate(first, first, false)
+	require.NoError(t, err)
+
+	results, err = FsckJournals(ctx, config, tempdir, true)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Len(t, results[0].Problems, 2)
+	require.True(t, results[0].Unrepairable)
+	require.False(t, results[0].Repaired)
+
+	err = blockJournal.markMDRevision(ctx, MetadataRevision(1))
+	require.NoError(t, err)
+
+	results, err = FsckJournals(ctx, config, tempdir, false)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Len(t, results[0].Problems, 2)
+	require.False(t, results[0].Unrepairable)
+	require.False(t, results[0].Repaired)
+
+	results, err = FsckJournals(ctx, config, tempdir, true)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.True(t, results[0].Repaired)
+
+	results, err = FsckJournals(ctx, config, tempdir, false)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Empty(t, results[0].Problems)
+
+	length, err := blockJournal.length()
+	require.NoError(t, err)
+	require.Zero(t, length)
+	length, err = mdJournal.length()
+	require.NoError(t, err)
+	require.Zero(t, length)
+}
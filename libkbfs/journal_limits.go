@@ -0,0 +1,185 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// JournalLimits bounds how much unflushed data the write journals
+// may keep on the local disk.  A limit of zero is not enforced.  The
+// file limits count unflushed blocks, each of which is stored in its
+// own set of files.  It is suitable for encoding directly as JSON.
+type JournalLimits struct {
+	// TLFBytes and TLFFiles apply to each TLF's journal separately.
+	TLFBytes int64
+	TLFFiles int64
+	// TotalBytes and TotalFiles apply to all journals together.
+	TotalBytes int64
+	TotalFiles int64
+}
+
+// journalSoftLimitFrac is the fraction of each limit past which
+// writes get throttled.  Writers are delayed more and more as the
+// usage approaches the limit itself (i.e., the hard limit), past
+// which they fail with a JournalFullError.
+const journalSoftLimitFrac = 0.75
+
+// journalMaxLimitDelay caps how long a single write may be delayed
+// for being past a soft limit, so that one write() call never
+// stalls for long.
+const journalMaxLimitDelay = 1 * time.Second
+
+// ctxJournalNoNewDataKeyType is the type of ctxJournalNoNewDataKey.
+type ctxJournalNoNewDataKeyType int
+
+// ctxJournalNoNewDataKey tags the contexts of operations, like
+// truncating a file or punching a hole in it, whose dirty byte
+// estimates don't correspond to new data for the journal.  They are
+// still throttled past the soft limits, but never rejected for
+// exceeding a hard limit.
+const ctxJournalNoNewDataKey ctxJournalNoNewDataKeyType = iota
+
+// journalNoNewDataContext returns a context marking that the
+// operation doing the dirtying won't add new data to the journal.
+func journalNoNewDataContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxJournalNoNewDataKey, true)
+}
+
+// journalLimitFrac returns how far past the soft limit the given
+// usage is, as a fraction of the distance between the soft and hard
+// limits.  It returns 0 if the usage is below the soft limit or the
+// limit is disabled, and something greater than 1 if the usage is
+// over the hard limit.
+func journalLimitFrac(usage, limit int64) float64 {
+	if limit <= 0 {
+		return 0
+	}
+	softLimit := int64(float64(limit) * journalSoftLimitFrac)
+	if usage <= softLimit {
+		return 0
+	}
+	return float64(usage-softLimit) / float64(limit-softLimit)
+}
+
+// SetLimits sets the limits on the unflushed data in the journals.
+// It applies only to writes that start after it's called.
+func (j *JournalServer) SetLimits(limits JournalLimits) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.limits = limits
+}
+
+// getUnflushedUsage returns the unflushed bytes and files for the
+// given TLF, and for all TLFs together, along with the current
+// limits.
+func (j *JournalServer) getUnflushedUsage(tlfID TlfID) (
+	tlfBytes, tlfFiles, totalBytes, totalFiles int64,
+	limits JournalLimits) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	for id, tlfJournal := range j.tlfJournals {
+		bytes, files := tlfJournal.getUnflushedUsage()
+		if id == tlfID {
+			tlfBytes, tlfFiles = bytes, files
+		}
+		totalBytes += bytes
+		totalFiles += files
+	}
+	return tlfBytes, tlfFiles, totalBytes, totalFiles, j.limits
+}
+
+// checkLimits returns a JournalFullError if writing newBytes more
+// bytes to the journal for the given TLF would exceed any hard
+// limit.  Otherwise, it returns how far the journals are between the
+// soft and hard limits, as a fraction between 0 and 1 (using
+// whichever limit is closest to being reached).
+func (j *JournalServer) checkLimits(tlfID TlfID, newBytes int64) (
+	float64, error) {
+	tlfBytes, tlfFiles, totalBytes, totalFiles, limits :=
+		j.getUnflushedUsage(tlfID)
+	// A write dirties at least one block, which will become at
+	// least one more file in the journal.
+	checks := []struct {
+		desc  string
+		usage int64
+		limit int64
+	}{
+		{"TLF bytes", tlfBytes + newBytes, limits.TLFBytes},
+		{"TLF files", tlfFiles + 1, limits.TLFFiles},
+		{"total bytes", totalBytes + newBytes, limits.TotalBytes},
+		{"total files", totalFiles + 1, limits.TotalFiles},
+	}
+	var maxFrac float64
+	for _, c := range checks {
+		frac := journalLimitFrac(c.usage, c.limit)
+		if frac > 1 {
+			return 0, JournalFullError{tlfID, c.desc, c.usage, c.limit}
+		}
+		if frac > maxFrac {
+			maxFrac = frac
+		}
+	}
+	return maxFrac, nil
+}
+
+// waitForLimits blocks writers to the given TLF for a time
+// proportional to how far the journals are past their soft limits,
+// to give the journals a chance to flush, and returns a
+// JournalFullError if the write would exceed a hard limit.  The delay
+// is at most journalMaxLimitDelay, and never gets close to the
+// context's deadline.  Writes with a context from
+// journalNoNewDataContext are delayed but never rejected.
+func (j *JournalServer) waitForLimits(ctx context.Context, tlfID TlfID,
+	newBytes int64) error {
+	noNewData, _ := ctx.Value(ctxJournalNoNewDataKey).(bool)
+	if noNewData {
+		newBytes = 0
+	}
+	frac, err := j.checkLimits(tlfID, newBytes)
+	if _, isFull := err.(JournalFullError); isFull && noNewData {
+		frac, err = 1, nil
+	}
+	if err != nil {
+		j.log.CDebugf(ctx, "Rejecting write: %v", err)
+		return err
+	}
+	if frac == 0 {
+		return nil
+	}
+
+	now := j.config.Clock().Now()
+	deadline, ok := ctx.Deadline()
+	defaultDeadline := now.Add(backgroundTaskTimeout / 2)
+	if !ok || deadline.After(defaultDeadline) {
+		deadline = defaultDeadline
+	}
+	totalReqTime := deadline.Sub(now) - backpressureSlack
+	if totalReqTime <= 0 {
+		return nil
+	}
+	if totalReqTime > journalMaxLimitDelay {
+		totalReqTime = journalMaxLimitDelay
+	}
+	delay := time.Duration(float64(totalReqTime) * frac)
+	j.log.CDebugf(ctx, "Journal for %s is past its soft limit (%f); "+
+		"delaying write by %s", tlfID, frac, delay)
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if noNewData {
+		return nil
+	}
+
+	// Check the hard limits again, in case other writes got in
+	// while we were waiting.
+	_, err = j.checkLimits(tlfID, newBytes)
+	return err
+}
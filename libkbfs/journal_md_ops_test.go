@@ -41,7 +41,7 @@ func setupJournalMDOpsTest(t *testing.T) (
 	}()
 
 	oldMDOps = config.MDOps()
-	config.EnableJournaling(tempdir)
+	config.EnableJournaling(tempdir, JournalStorageOptions{})
 	jServer, err = GetJournalServer(config)
 	// Turn off listeners to avoid background MD pushes for CR.
 	jServer.onBranchChange = nil
@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -29,6 +30,10 @@ type JournalServerStatus struct {
 	CurrentVerifyingKey kbfscrypto.VerifyingKey
 	JournalCount        int
 	UnflushedBytes      int64 // (signed because os.FileInfo.Size() is signed)
+	UnflushedFiles      int64
+	Limits              JournalLimits
+	Flush               JournalFlushStatus
+	Storage             JournalStorageOptions
 }
 
 // branchChangeListener describes a caller that will get updates via
@@ -50,6 +55,15 @@ type mdFlushListener interface {
 	onMDFlush(TlfID, BranchID, MetadataRevision)
 }
 
+// mdSquashListener describes a caller that will get requests via the
+// onMDSquash method to squash the unflushed MDs in the journal for
+// the given TlfID, and which must close the given channel once it's
+// done, whether or not anything was squashed.  The implementer must
+// do its work from another goroutine to avoid deadlocks.
+type mdSquashListener interface {
+	onMDSquash(TlfID, chan<- struct{})
+}
+
 // TODO: JournalServer isn't really a server, although it can create
 // objects that act as servers. Rename to JournalManager.
 
@@ -71,7 +85,8 @@ type JournalServer struct {
 	log      logger.Logger
 	deferLog logger.Logger
 
-	dir string
+	dir     string
+	storage JournalStorageOptions
 
 	delegateBlockCache      BlockCache
 	delegateDirtyBlockCache DirtyBlockCache
@@ -79,32 +94,42 @@ type JournalServer struct {
 	delegateMDOps           MDOps
 	onBranchChange          branchChangeListener
 	onMDFlush               mdFlushListener
+	onMDSquash              mdSquashListener
+	flushLimiter            *journalFlushLimiter
 
 	// Protects all fields below.
 	lock                sync.RWMutex
 	currentUID          keybase1.UID
 	currentVerifyingKey kbfscrypto.VerifyingKey
 	tlfJournals         map[TlfID]*tlfJournal
+	limits              JournalLimits
 	dirtyOps            uint
 	dirtyOpsDone        *sync.Cond
+	// files is set along with currentVerifyingKey, since it
+	// holds the journal key of the current device.
+	files journalFiles
 }
 
 func makeJournalServer(
 	config Config, log logger.Logger, dir string,
-	bcache BlockCache, dirtyBcache DirtyBlockCache, bserver BlockServer,
+	storage JournalStorageOptions, bcache BlockCache,
+	dirtyBcache DirtyBlockCache, bserver BlockServer,
 	mdOps MDOps, onBranchChange branchChangeListener,
-	onMDFlush mdFlushListener) *JournalServer {
+	onMDFlush mdFlushListener, onMDSquash mdSquashListener) *JournalServer {
 	jServer := JournalServer{
 		config:                  config,
 		log:                     log,
 		deferLog:                log.CloneWithAddedDepth(1),
 		dir:                     dir,
+		storage:                 storage,
 		delegateBlockCache:      bcache,
 		delegateDirtyBlockCache: dirtyBcache,
 		delegateBlockServer:     bserver,
 		delegateMDOps:           mdOps,
 		onBranchChange:          onBranchChange,
 		onMDFlush:               onMDFlush,
+		onMDSquash:              onMDSquash,
+		flushLimiter:            newJournalFlushLimiter(config.Clock(), log),
 		tlfJournals:             make(map[TlfID]*tlfJournal),
 	}
 	jServer.dirtyOpsDone = sync.NewCond(&jServer.lock)
@@ -151,6 +176,37 @@ func (j *JournalServer) getTLFJournal(tlfID TlfID) (*tlfJournal, bool) {
 	return tlfJournal, ok
 }
 
+// getTlfIDForHandle returns the ID of the TLF whose journal head has
+// the given handle, if any, so that the TLF can be found without
+// asking the mdserver.
+func (j *JournalServer) getTlfIDForHandle(
+	ctx context.Context, handle *TlfHandle) (TlfID, bool) {
+	j.lock.RLock()
+	tlfIDs := make([]TlfID, 0, len(j.tlfJournals))
+	for tlfID := range j.tlfJournals {
+		tlfIDs = append(tlfIDs, tlfID)
+	}
+	j.lock.RUnlock()
+
+	fav := handle.ToFavorite()
+	for _, tlfID := range tlfIDs {
+		for _, mStatus := range []MergeStatus{Merged, Unmerged} {
+			head, err := j.mdOps().getHeadFromJournal(
+				ctx, tlfID, NullBranchID, mStatus, nil)
+			if err != nil {
+				j.log.CDebugf(ctx, "Couldn't get the journal head "+
+					"for %s: %v", tlfID, err)
+				break
+			}
+			if head != (ImmutableRootMetadata{}) &&
+				head.GetTlfHandle().ToFavorite() == fav {
+				return tlfID, true
+			}
+		}
+	}
+	return TlfID{}, false
+}
+
 func (j *JournalServer) hasTLFJournal(tlfID TlfID) bool {
 	j.lock.RLock()
 	defer j.lock.RUnlock()
@@ -212,6 +268,19 @@ func (j *JournalServer) EnableExistingJournals(
 		}
 	}()
 
+	j.files, err = loadJournalFiles(ctx, j.config,
+		getJournalKeyPath(j.rootPath(), currentVerifyingKey), j.storage)
+	if err != nil {
+		return err
+	}
+
+	// Do this first, since a TLF journal dir might only exist as
+	// a squashed copy.
+	err = recoverTLFJournalSquashes(j.rootPath(), j.files)
+	if err != nil {
+		return err
+	}
+
 	fileInfos, err := ioutil.ReadDir(j.rootPath())
 	if os.IsNotExist(err) {
 		enableSucceeded = true
@@ -228,7 +297,7 @@ func (j *JournalServer) EnableExistingJournals(
 		}
 
 		dir := filepath.Join(j.rootPath(), name)
-		uid, key, tlfID, err := readTLFJournalInfoFile(dir)
+		uid, key, tlfID, err := readTLFJournalInfoFile(dir, j.files)
 		if err != nil {
 			j.log.CDebugf(
 				ctx, "Skipping non-TLF dir %q: %v", name, err)
@@ -317,10 +386,25 @@ func (j *JournalServer) enableLocked(
 	}
 
 	tlfDir := j.tlfJournalPathLocked(tlfID)
+	// This must be done before migrating, since a squashed copy
+	// shares files with the journal it was copied from.
+	err = recoverTLFJournalSquash(tlfDir, j.files)
+	if err != nil {
+		return err
+	}
+	migrated, err := j.files.migrateDir(tlfDir)
+	if err != nil {
+		return err
+	}
+	if migrated > 0 {
+		j.log.CDebugf(ctx, "Migrated %d files in %s (encrypt=%t)",
+			migrated, tlfDir, j.files.encrypt)
+	}
+
 	tlfJournal, err := makeTLFJournal(
-		ctx, j.currentUID, j.currentVerifyingKey, tlfDir,
+		ctx, j.currentUID, j.currentVerifyingKey, tlfDir, j.files,
 		tlfID, tlfJournalConfigAdapter{j.config}, j.delegateBlockServer,
-		bws, nil, j.onBranchChange, j.onMDFlush)
+		j.flushLimiter, bws, nil, j.onBranchChange, j.onMDFlush, j.onMDSquash)
 	if err != nil {
 		return err
 	}
@@ -408,6 +492,72 @@ func (j *JournalServer) Wait(ctx context.Context, tlfID TlfID) (err error) {
 	return nil
 }
 
+// ExportJournal writes a signed archive of all the unflushed block
+// and MD entries in the journal for the given TLF to w.  The archive
+// can be carried to another machine and passed to ImportJournal
+// there.  The entries are kept in the journal, which can still flush
+// them safely after the archive has been flushed; if remove is true,
+// they're removed from the journal instead, so that only the archive
+// flushes them.
+func (j *JournalServer) ExportJournal(
+	ctx context.Context, tlfID TlfID, w io.Writer, remove bool) (err error) {
+	j.log.CDebugf(ctx, "Exporting journal for %s (remove=%t)", tlfID, remove)
+	defer func() {
+		if err != nil {
+			j.deferLog.CDebugf(ctx,
+				"Error when exporting journal for %s: %v", tlfID, err)
+		}
+	}()
+
+	tlfJournal, ok := j.getTLFJournal(tlfID)
+	if !ok {
+		return fmt.Errorf("Journal not enabled for %s", tlfID)
+	}
+
+	return tlfJournal.exportArchive(ctx, w, remove)
+}
+
+// ImportJournal reads an archive written by ExportJournal from r, and
+// checks its signatures and the integrity of its blocks and MDs.  If
+// apply is false, the archived entries are then flushed straight to
+// the servers.  Otherwise, they're appended to the local journal for
+// the archived TLF, which must already be enabled and have no
+// unflushed MDs; this only works when the archive came from the
+// current device.  It returns the ID of the archived TLF.
+func (j *JournalServer) ImportJournal(
+	ctx context.Context, r io.Reader, apply bool) (tlfID TlfID, err error) {
+	j.log.CDebugf(ctx, "Importing journal archive (apply=%t)", apply)
+	defer func() {
+		if err != nil {
+			j.deferLog.CDebugf(ctx,
+				"Error when importing journal archive: %v", err)
+		}
+	}()
+
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return TlfID{}, err
+	}
+	archive, err := readJournalArchive(j.config.Codec(),
+		j.config.Crypto(), j.config.MetadataVersion(), buf)
+	if err != nil {
+		return TlfID{}, err
+	}
+	tlfID = archive.contents.TlfID
+
+	if !apply {
+		return tlfID, archive.flush(ctx, j.log, j.delegateBlockServer,
+			j.delegateBlockCache, j.config.Reporter(), j.config.MDServer(),
+			j.config.Crypto(), j.config.KBPKI())
+	}
+
+	tlfJournal, ok := j.getTLFJournal(tlfID)
+	if !ok {
+		return TlfID{}, fmt.Errorf("Journal not enabled for %s", tlfID)
+	}
+	return tlfID, tlfJournal.importArchive(ctx, archive)
+}
+
 // Disable turns off the write journal for the given TLF.
 func (j *JournalServer) Disable(ctx context.Context, tlfID TlfID) (
 	wasEnabled bool, err error) {
@@ -472,16 +622,20 @@ func (j *JournalServer) mdOps() journalMDOps {
 // Status returns a JournalServerStatus object suitable for
 // diagnostics.
 func (j *JournalServer) Status() JournalServerStatus {
-	journalCount, unflushedBytes, currentUID, currentVerifyingKey :=
-		func() (int, int64, keybase1.UID, kbfscrypto.VerifyingKey) {
+	journalCount, unflushedBytes, unflushedFiles, limits,
+		currentUID, currentVerifyingKey :=
+		func() (int, int64, int64, JournalLimits, keybase1.UID,
+			kbfscrypto.VerifyingKey) {
 			j.lock.RLock()
 			defer j.lock.RUnlock()
-			var unflushedBytes int64
+			var unflushedBytes, unflushedFiles int64
 			for _, tlfJournal := range j.tlfJournals {
-				unflushedBytes += tlfJournal.getUnflushedBytes()
+				bytes, files := tlfJournal.getUnflushedUsage()
+				unflushedBytes += bytes
+				unflushedFiles += files
 			}
-			return len(j.tlfJournals), unflushedBytes,
-				j.currentUID, j.currentVerifyingKey
+			return len(j.tlfJournals), unflushedBytes, unflushedFiles,
+				j.limits, j.currentUID, j.currentVerifyingKey
 		}()
 	return JournalServerStatus{
 		RootDir:             j.rootPath(),
@@ -490,6 +644,10 @@ func (j *JournalServer) Status() JournalServerStatus {
 		CurrentVerifyingKey: currentVerifyingKey,
 		JournalCount:        journalCount,
 		UnflushedBytes:      unflushedBytes,
+		UnflushedFiles:      unflushedFiles,
+		Limits:              limits,
+		Flush:               j.flushLimiter.status(),
+		Storage:             j.storage,
 	}
 }
 
@@ -618,6 +776,7 @@ func (j *JournalServer) shutdownExistingJournalsLocked(ctx context.Context) {
 	j.tlfJournals = make(map[TlfID]*tlfJournal)
 	j.currentUID = keybase1.UID("")
 	j.currentVerifyingKey = kbfscrypto.VerifyingKey{}
+	j.files = journalFiles{}
 }
 
 // shutdownExistingJournals shuts down all write journals, sets the
@@ -5,9 +5,11 @@
 package libkbfs
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -37,7 +39,7 @@ func setupJournalServerTest(t *testing.T) (
 		}
 	}()
 
-	config.EnableJournaling(tempdir)
+	config.EnableJournaling(tempdir, JournalStorageOptions{})
 	jServer, err = GetJournalServer(config)
 	require.NoError(t, err)
 
@@ -105,9 +107,10 @@ func TestJournalServerRestart(t *testing.T) {
 	// Simulate a restart.
 
 	jServer = makeJournalServer(
-		config, jServer.log, tempdir, jServer.delegateBlockCache,
+		config, jServer.log, tempdir, jServer.storage,
+		jServer.delegateBlockCache,
 		jServer.delegateDirtyBlockCache,
-		jServer.delegateBlockServer, jServer.delegateMDOps, nil, nil)
+		jServer.delegateBlockServer, jServer.delegateMDOps, nil, nil, nil)
 	uid, verifyingKey, err :=
 		getCurrentUIDAndVerifyingKey(ctx, config.KBPKI())
 	require.NoError(t, err)
@@ -409,3 +412,194 @@ func TestJournalServerMultiUser(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, uid2, head.LastModifyingWriter())
 }
+
+func TestJournalServerLimits(t *testing.T) {
+	tempdir, config, jServer := setupJournalServerTest(t)
+	defer teardownJournalServerTest(t, tempdir, config)
+
+	// Use a shutdown-only BlockServer so that it errors if the
+	// journal tries to access it.
+	jServer.delegateBlockServer = shutdownOnlyBlockServer{}
+
+	ctx := context.Background()
+
+	tlfID := FakeTlfID(2, false)
+	err := jServer.Enable(ctx, tlfID, TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+
+	blockServer := config.BlockServer()
+	crypto := config.Crypto()
+
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "test_user1", false)
+	require.NoError(t, err)
+	uid := h.ResolvedWriters()[0]
+
+	// Put a block.
+
+	bCtx := BlockContext{uid, "", zeroBlockRefNonce}
+	data := []byte{1, 2, 3, 4}
+	bID, err := crypto.MakePermanentBlockID(data)
+	require.NoError(t, err)
+	serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	err = blockServer.Put(ctx, tlfID, bID, bCtx, data, serverHalf)
+	require.NoError(t, err)
+
+	// Without limits, nothing is throttled.
+
+	frac, err := jServer.checkLimits(tlfID, 100)
+	require.NoError(t, err)
+	require.Zero(t, frac)
+
+	// Past the soft byte limit.
+
+	limits := JournalLimits{TLFBytes: 8, TotalFiles: 10}
+	jServer.SetLimits(limits)
+	frac, err = jServer.checkLimits(tlfID, 3)
+	require.NoError(t, err)
+	require.Equal(t, 0.5, frac)
+
+	status := jServer.Status()
+	require.Equal(t, int64(4), status.UnflushedBytes)
+	require.Equal(t, int64(1), status.UnflushedFiles)
+	require.Equal(t, limits, status.Limits)
+
+	// Past the hard byte limit, but only for this TLF.
+
+	_, err = jServer.checkLimits(tlfID, 5)
+	require.IsType(t, JournalFullError{}, err)
+	_, err = jServer.checkLimits(FakeTlfID(3, false), 5)
+	require.NoError(t, err)
+
+	// Past the hard file limit.
+
+	jServer.SetLimits(JournalLimits{TotalFiles: 1})
+	err = jServer.waitForLimits(ctx, tlfID, 1)
+	require.IsType(t, JournalFullError{}, err)
+
+	// Truncates and holes are throttled, but not rejected.  (Use a
+	// short deadline to skip the delay.)
+	noDataCtx, cancel := context.WithTimeout(
+		journalNoNewDataContext(ctx), backpressureSlack/2)
+	defer cancel()
+	err = jServer.waitForLimits(noDataCtx, tlfID, 1<<30)
+	require.NoError(t, err)
+}
+
+// noUpdatesMDServer never sends any updates, and doesn't register
+// with the underlying server, so that more than one folderBranchOps
+// per TLF can use it.
+type noUpdatesMDServer struct {
+	MDServer
+}
+
+func (md noUpdatesMDServer) RegisterForUpdate(ctx context.Context, id TlfID,
+	currHead MetadataRevision) (<-chan error, error) {
+	return make(chan error), nil
+}
+
+func TestJournalServerOfflineRootNode(t *testing.T) {
+	tempdir, config, jServer := setupJournalServerTest(t)
+	defer teardownJournalServerTest(t, tempdir, config)
+
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+	config.SetMDServer(noUpdatesMDServer{config.MDServer()})
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "test_user1", false)
+	require.NoError(t, err)
+	kbfsOps := config.KBFSOps()
+	rootNode, _, err := kbfsOps.GetOrCreateRootNode(ctx, h, MasterBranch)
+	require.NoError(t, err)
+	err = jServer.Enable(ctx, rootNode.GetFolderBranch().Tlf,
+		TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+
+	// Leave a file in the journal.
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	// While offline, a loaded folder serves its current head.
+	offlineErr := errors.New("offline")
+	kbfsOps.PushConnectionStatusChange(MDServiceName, offlineErr)
+	node, _, err := kbfsOps.GetOrCreateRootNode(ctx, h, MasterBranch)
+	require.NoError(t, err)
+	require.Equal(t, rootNode, node)
+
+	// A folder that isn't loaded yet is found through its
+	// journal, and served from the journal's head.
+	fs := kbfsOps.(*KBFSOpsStandard)
+	fb := rootNode.GetFolderBranch()
+	oldOps := fs.getOpsNoAdd(fb)
+	fs.opsLock.Lock()
+	delete(fs.ops, fb)
+	delete(fs.opsByFav, h.ToFavorite())
+	fs.opsLock.Unlock()
+	err = oldOps.Shutdown()
+	require.NoError(t, err)
+	node, _, err = kbfsOps.GetOrCreateRootNode(ctx, h, MasterBranch)
+	require.NoError(t, err)
+	require.NotEqual(t, rootNode, node)
+	fileNode, ei, err := kbfsOps.Lookup(ctx, node, "a")
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), ei.Size)
+	buf := make([]byte, 3)
+	_, err = kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, buf)
+
+	// Coming back online flushes the journal.
+	kbfsOps.PushConnectionStatusChange(MDServiceName, nil)
+	err = jServer.Flush(ctx, fb.Tlf)
+	require.NoError(t, err)
+	status, err := jServer.JournalStatus(fb.Tlf)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevisionUninitialized, status.RevisionStart)
+}
+
+func TestJournalServerOfflineJournalTurnedOff(t *testing.T) {
+	tempdir, config, jServer := setupJournalServerTest(t)
+	defer teardownJournalServerTest(t, tempdir, config)
+
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "test_user1", false)
+	require.NoError(t, err)
+	kbfsOps := config.KBFSOps()
+	rootNode, _, err := kbfsOps.GetOrCreateRootNode(ctx, h, MasterBranch)
+	require.NoError(t, err)
+	tlfID := rootNode.GetFolderBranch().Tlf
+	_, err = jServer.JournalStatus(tlfID)
+	require.Error(t, err)
+
+	// Going offline turns on the journal, to hold the writes.
+	kbfsOps.PushConnectionStatusChange(MDServiceName, errDisconnected{})
+	_, err = jServer.JournalStatus(tlfID)
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	// Once back online, the journal flushes and is turned off again.
+	kbfsOps.PushConnectionStatusChange(MDServiceName, nil)
+	for {
+		if _, err := jServer.JournalStatus(tlfID); err != nil {
+			break
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+	}
+	ops := getOps(config, tlfID)
+	ops.offlineLock.Lock()
+	defer ops.offlineLock.Unlock()
+	require.False(t, ops.enabledJournalForOffline)
+}
@@ -0,0 +1,994 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/kbfscodec"
+	"golang.org/x/net/context"
+)
+
+// Squashing replaces a run of unflushed MD revisions at the end of
+// the MD journal with a single revision containing all of their ops,
+// so that only one MD has to be flushed for all of them.  Any block
+// that was both referenced and unreferenced within the run, and that
+// was only ever put (or referenced) by the block journal, is dropped
+// from both the new MD and the block journal, so it's never
+// uploaded.
+//
+// The journal can't build the new MD by itself, since it needs the
+// decrypted ops, so it asks its mdSquashListener (i.e., the
+// folderBranchOps for the TLF) to do it, which in turn calls back
+// into tlfJournal.squashMDs.
+
+// squashIfNeeded asks the squash listener, if there is one, to squash
+// the unflushed MDs if enough of them have built up since the last
+// request, and waits a limited time for it to finish.  It must not be
+// called with flushLock held.
+func (j *tlfJournal) squashIfNeeded(ctx context.Context) {
+	if j.onMDSquash == nil {
+		return
+	}
+
+	needSquash, err := func() (bool, error) {
+		j.journalLock.Lock()
+		defer j.journalLock.Unlock()
+		if err := j.checkEnabledLocked(); err != nil {
+			return false, err
+		}
+
+		// Branches get resolved, not flushed as-is, so there's no
+		// point in squashing them.
+		if j.mdJournal.getBranchID() != NullBranchID {
+			return false, nil
+		}
+
+		length, err := j.mdJournal.length()
+		if err != nil {
+			return false, err
+		}
+		if length < journalSquashThreshold {
+			return false, nil
+		}
+
+		latest, err := j.mdJournal.readLatestRevision()
+		if err != nil {
+			return false, err
+		}
+		if j.lastSquashRevision != MetadataRevisionUninitialized &&
+			latest < j.lastSquashRevision+journalSquashThreshold {
+			return false, nil
+		}
+		j.lastSquashRevision = latest
+		return true, nil
+	}()
+	if err != nil {
+		j.log.CDebugf(ctx, "Couldn't check whether to squash: %v", err)
+		return
+	}
+	if !needSquash {
+		return
+	}
+
+	j.log.CDebugf(ctx, "Requesting a squash of the MDs for %s", j.tlfID)
+	doneCh := make(chan struct{})
+	j.onMDSquash.onMDSquash(j.tlfID, doneCh)
+	select {
+	case <-doneCh:
+	case <-ctx.Done():
+	case <-time.After(journalSquashTimeout):
+		j.log.CDebugf(ctx, "Timed out waiting for the MDs for %s to be "+
+			"squashed; flushing them anyway", j.tlfID)
+	}
+}
+
+// squashMDs replaces the unflushed MDs from revision start onwards,
+// the latest of which must have the ID headID, with the MD returned
+// by build.  Before build is called, the block journal entries for
+// the given candidate pointers are checked, and those for pointers
+// that can be dropped (along with the size of their data, if it was
+// put by the journal) are passed to build, which must remove them
+// from the MD.  Those entries are then removed from the block
+// journal.  build may also return new blocks for the MD, like its
+// unembedded block changes, which are put in the block journal ahead
+// of the MD's revision marker.
+//
+// The squashed journals are built in a copy of the journal
+// directory, which is then swapped in, so that a crash leaves either
+// the old journals or the new ones; see recoverTLFJournalSquash.
+func (j *tlfJournal) squashMDs(ctx context.Context, start MetadataRevision,
+	headID MdID, candidates map[BlockPointer]bool,
+	build func(dropped map[BlockPointer]int64) (
+		*RootMetadata, *blockPutState, error)) (MdID, error) {
+	// Keep flushes out while the journals are being rewritten.
+	j.flushLock.Lock()
+	defer j.flushLock.Unlock()
+	j.journalLock.Lock()
+	defer j.journalLock.Unlock()
+	if err := j.checkEnabledLocked(); err != nil {
+		return MdID{}, err
+	}
+
+	head, err := j.mdJournal.getHead()
+	if err != nil {
+		return MdID{}, err
+	}
+	if head.mdID != headID {
+		return MdID{}, fmt.Errorf(
+			"Journal head %s doesn't match the expected head %s",
+			head.mdID, headID)
+	}
+	earliest, err := j.mdJournal.readEarliestRevision()
+	if err != nil {
+		return MdID{}, err
+	}
+	if start < earliest || start >= head.RevisionNumber() {
+		return MdID{}, fmt.Errorf(
+			"Can't squash from revision %d with journal revisions %d to %d",
+			start, earliest, head.RevisionNumber())
+	}
+
+	dropped, err := j.blockJournal.getDroppablePtrs(candidates)
+	if err != nil {
+		return MdID{}, err
+	}
+
+	rmd, bps, err := build(dropped)
+	if err != nil {
+		return MdID{}, err
+	}
+
+	newDir := j.dir + tlfJournalSquashNewSuffix
+	mdID, err := j.writeSquashedJournalDir(
+		ctx, newDir, start, rmd, bps, dropped)
+	if err != nil {
+		if removeErr := removeTLFJournalDirCopy(
+			newDir, j.dir, j.blockJournal.files); removeErr != nil {
+			j.log.CDebugf(ctx, "Couldn't remove %s: %v", newDir, removeErr)
+		}
+		return MdID{}, err
+	}
+
+	err = j.swapInSquashedJournalDirLocked(ctx, newDir)
+	if err != nil {
+		return MdID{}, err
+	}
+
+	j.lastSquashRevision = start
+	return mdID, nil
+}
+
+const (
+	// The squashed copy of a TLF journal directory is built in
+	// the directory with this suffix.
+	tlfJournalSquashNewSuffix = ".squash"
+	// The old TLF journal directory is moved to the directory
+	// with this suffix once the squashed copy is complete.
+	tlfJournalSquashOldSuffix = ".squashed"
+)
+
+// writeSquashedJournalDir makes a copy of the TLF journal directory
+// in newDir, and squashes the journals in the copy.  Block data and
+// MDs are never changed once written, so they're hard-linked into
+// the copy instead of being copied, and so the copy's files must
+// never be wiped.  The blocks in bps, if any, are put along with rmd.
+func (j *tlfJournal) writeSquashedJournalDir(ctx context.Context,
+	newDir string, start MetadataRevision, rmd *RootMetadata,
+	bps *blockPutState, dropped map[BlockPointer]int64) (MdID, error) {
+	files := j.blockJournal.files
+	// Throw away anything left over from an earlier failed squash.
+	err := removeTLFJournalDirCopy(newDir, j.dir, files)
+	if err != nil {
+		return MdID{}, err
+	}
+	err = copyTLFJournalDir(j.dir, newDir)
+	if err != nil {
+		return MdID{}, err
+	}
+
+	files.wipe = false
+	blockJournal, err := makeBlockJournal(ctx, j.config.Codec(),
+		j.config.Crypto(), newDir, files, j.log)
+	if err != nil {
+		return MdID{}, err
+	}
+	mdJournal, err := makeMDJournal(j.uid, j.key, j.config.Codec(),
+		j.config.Crypto(), newDir, files, j.log)
+	if err != nil {
+		return MdID{}, err
+	}
+
+	mdID, err := mdJournal.squash(ctx, j.config.Crypto(),
+		j.config.encryptionKeyGetter(), j.config.BlockSplitter(), start, rmd)
+	if err != nil {
+		return MdID{}, err
+	}
+
+	if bps != nil {
+		for _, bs := range bps.blockStates {
+			err = blockJournal.putData(ctx, bs.blockPtr.ID,
+				bs.blockPtr.BlockContext, bs.readyBlockData.buf,
+				bs.readyBlockData.serverHalf)
+			if err != nil {
+				return MdID{}, err
+			}
+		}
+	}
+
+	err = blockJournal.squashMDRevMarkers(ctx, start)
+	if err != nil {
+		return MdID{}, err
+	}
+
+	err = blockJournal.dropPtrs(ctx, dropped)
+	if err != nil {
+		return MdID{}, err
+	}
+
+	err = syncTLFJournalDir(newDir)
+	if err != nil {
+		return MdID{}, err
+	}
+	return mdID, nil
+}
+
+// swapInSquashedJournalDirLocked replaces the TLF journal directory
+// with the squashed copy in newDir, and reopens the journals.
+func (j *tlfJournal) swapInSquashedJournalDirLocked(
+	ctx context.Context, newDir string) error {
+	files := j.blockJournal.files
+	oldDir := j.dir + tlfJournalSquashOldSuffix
+	// Moving the old directory aside commits the squash.
+	err := os.Rename(j.dir, oldDir)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(newDir, j.dir)
+	if err == nil {
+		j.blockJournal, j.mdJournal, err = j.reopenJournals(ctx, files)
+	}
+	if err != nil {
+		// The old journals are gone, so make further accesses
+		// error out until the squash is recovered on the next
+		// enable.
+		j.blockJournal = nil
+		j.mdJournal = nil
+		return err
+	}
+
+	err = removeTLFJournalDirCopy(oldDir, j.dir, files)
+	if err != nil {
+		// It'll be removed on the next enable.
+		j.log.CDebugf(ctx, "Couldn't remove %s: %v", oldDir, err)
+	}
+	return nil
+}
+
+func (j *tlfJournal) reopenJournals(
+	ctx context.Context, files journalFiles) (
+	*blockJournal, *mdJournal, error) {
+	blockJournal, err := makeBlockJournal(ctx, j.config.Codec(),
+		j.config.Crypto(), j.dir, files, j.log)
+	if err != nil {
+		return nil, nil, err
+	}
+	mdJournal, err := makeMDJournal(j.uid, j.key, j.config.Codec(),
+		j.config.Crypto(), j.dir, files, j.log)
+	if err != nil {
+		return nil, nil, err
+	}
+	return blockJournal, mdJournal, nil
+}
+
+// recoverTLFJournalSquash finishes or rolls back a squash of the TLF
+// journal in dir that was interrupted by a crash.  If the squashed
+// copy exists but the old directory hadn't been moved aside yet, the
+// squash never happened, so the copy is removed.  If the old
+// directory had been moved aside, the squash was committed, so the
+// copy is moved into place.
+func recoverTLFJournalSquash(dir string, files journalFiles) error {
+	newDir := dir + tlfJournalSquashNewSuffix
+	oldDir := dir + tlfJournalSquashOldSuffix
+	_, err := os.Stat(newDir)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		_, err := os.Stat(dir)
+		if os.IsNotExist(err) {
+			err = os.Rename(newDir, dir)
+			if err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else {
+			err = removeTLFJournalDirCopy(newDir, dir, files)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return removeTLFJournalDirCopy(oldDir, dir, files)
+}
+
+// recoverTLFJournalSquashes calls recoverTLFJournalSquash for every
+// TLF journal under rootPath that was being squashed.
+func recoverTLFJournalSquashes(rootPath string, files journalFiles) error {
+	fileInfos, err := ioutil.ReadDir(rootPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	recovered := make(map[string]bool)
+	for _, fi := range fileInfos {
+		name := fi.Name()
+		dir := strings.TrimSuffix(name, tlfJournalSquashNewSuffix)
+		dir = strings.TrimSuffix(dir, tlfJournalSquashOldSuffix)
+		if !fi.IsDir() || dir == name || recovered[dir] {
+			continue
+		}
+		err := recoverTLFJournalSquash(filepath.Join(rootPath, dir), files)
+		if err != nil {
+			return err
+		}
+		recovered[dir] = true
+	}
+	return nil
+}
+
+// isTLFJournalSquashDir returns whether the given directory name is
+// that of a copy made while squashing a TLF journal.
+func isTLFJournalSquashDir(name string) bool {
+	return strings.HasSuffix(name, tlfJournalSquashNewSuffix) ||
+		strings.HasSuffix(name, tlfJournalSquashOldSuffix)
+}
+
+// copyTLFJournalDir copies the TLF journal directory dir to newDir,
+// hard-linking the block data and MD files (falling back to copying
+// them if that fails), and copying everything else.
+func copyTLFJournalDir(dir, newDir string) error {
+	return filepath.Walk(dir,
+		func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			newPath := filepath.Join(newDir, rel)
+			if fi.IsDir() {
+				return os.MkdirAll(newPath, 0700)
+			}
+			top := strings.SplitN(rel, string(filepath.Separator), 2)[0]
+			if top == "blocks" || top == "mds" {
+				if os.Link(path, newPath) == nil {
+					return nil
+				}
+			}
+			buf, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(newPath, buf, 0600)
+		})
+}
+
+// syncTLFJournalDir syncs every file in dir to disk.
+func syncTLFJournalDir(dir string) error {
+	return filepath.Walk(dir,
+		func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			file, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				return err
+			}
+			err = file.Sync()
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			return err
+		})
+}
+
+// removeTLFJournalDirCopy removes dir, which is a copy of the TLF
+// journal directory otherDir, or the other way around.  Files that
+// are hard-linked between the two are just unlinked, since wiping
+// them would wipe them from otherDir too; everything else is removed
+// through files.
+func removeTLFJournalDirCopy(
+	dir, otherDir string, files journalFiles) error {
+	err := filepath.Walk(dir,
+		func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			otherFI, err := os.Lstat(filepath.Join(otherDir, rel))
+			if err == nil && os.SameFile(fi, otherFI) {
+				return os.Remove(path)
+			} else if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return files.remove(path)
+		})
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// getDroppablePtrs returns the subset of the given pointers whose
+// references were all made by entries in the journal, so that the
+// entries can be dropped without the server ever knowing about
+// them.  A put is only droppable if every reference to its block is
+// droppable.  The returned map holds the size of the data for each
+// dropped put, and 0 for each dropped reference add.
+func (j *blockJournal) getDroppablePtrs(
+	candidates map[BlockPointer]bool) (map[BlockPointer]int64, error) {
+	dropped := make(map[BlockPointer]int64)
+	if len(candidates) == 0 {
+		return dropped, nil
+	}
+
+	first, err := j.j.readEarliestOrdinal()
+	if os.IsNotExist(err) {
+		return dropped, nil
+	} else if err != nil {
+		return nil, err
+	}
+	last, err := j.j.readLatestOrdinal()
+	if err != nil {
+		return nil, err
+	}
+
+	// Block contexts don't include everything in a pointer, so
+	// look the candidates up by ID and nonce.
+	byRef := make(map[BlockID]map[BlockRefNonce]BlockPointer)
+	for ptr := range candidates {
+		if byRef[ptr.ID] == nil {
+			byRef[ptr.ID] = make(map[BlockRefNonce]BlockPointer)
+		}
+		byRef[ptr.ID][ptr.GetRefNonce()] = ptr
+	}
+
+	puts := make(map[BlockID]BlockPointer)
+	for i := first; i <= last; i++ {
+		entry, err := j.readJournalEntry(i)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Ignore ||
+			(entry.Op != blockPutOp && entry.Op != addRefOp) {
+			continue
+		}
+
+		id, context, err := entry.getSingleContext()
+		if err != nil {
+			return nil, err
+		}
+		ptr, ok := byRef[id][context.GetRefNonce()]
+		if !ok {
+			continue
+		}
+
+		if entry.Op == blockPutOp {
+			puts[id] = ptr
+		} else {
+			dropped[ptr] = 0
+		}
+	}
+
+	for id, ptr := range puts {
+		allDropped := true
+		for refNonce := range j.refs[id] {
+			if refNonce == ptr.GetRefNonce() {
+				continue
+			}
+			if _, ok := dropped[byRef[id][refNonce]]; !ok {
+				allDropped = false
+				break
+			}
+		}
+		if !allDropped {
+			continue
+		}
+		size, err := j.getDataSize(id)
+		if err != nil {
+			return nil, err
+		}
+		dropped[ptr] = size
+	}
+	return dropped, nil
+}
+
+// squashMDRevMarkers makes the latest MD revision marker at or after
+// the given revision refer to that revision instead, and ignores the
+// others, to match an MD journal that has been squashed down to that
+// revision.  If blocks have been put since the latest marker, like
+// the unembedded block changes of the squashed MD, it's ignored too,
+// and a new marker is added after them, so they're flushed before
+// the MD.
+func (j *blockJournal) squashMDRevMarkers(
+	ctx context.Context, start MetadataRevision) error {
+	first, err := j.j.readEarliestOrdinal()
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	last, err := j.j.readLatestOrdinal()
+	if err != nil {
+		return err
+	}
+
+	var markers []journalOrdinal
+	for i := first; i <= last; i++ {
+		entry, err := j.readJournalEntry(i)
+		if err != nil {
+			return err
+		}
+		if !entry.Ignore && entry.Op == mdRevMarkerOp &&
+			entry.Revision >= start {
+			markers = append(markers, i)
+		}
+	}
+	if len(markers) == 0 {
+		return nil
+	}
+
+	j.log.CDebugf(ctx, "Squashing %d MD revision markers into "+
+		"revision %d", len(markers), start)
+	moveLatest := markers[len(markers)-1] != last
+	for n, i := range markers {
+		entry, err := j.readJournalEntry(i)
+		if err != nil {
+			return err
+		}
+		if n == len(markers)-1 && !moveLatest {
+			entry.Revision = start
+		} else {
+			entry.Ignore = true
+		}
+		err = j.j.writeJournalEntry(i, entry)
+		if err != nil {
+			return err
+		}
+	}
+	if moveLatest {
+		return j.markMDRevision(ctx, start)
+	}
+	return nil
+}
+
+// dropPtrs ignores the block journal entries for the given pointers,
+// which must have come from getDroppablePtrs, and removes their
+// references and any data that is no longer referenced.
+func (j *blockJournal) dropPtrs(
+	ctx context.Context, dropped map[BlockPointer]int64) error {
+	if len(dropped) == 0 {
+		return nil
+	}
+
+	first, err := j.j.readEarliestOrdinal()
+	if err != nil {
+		return err
+	}
+	last, err := j.j.readLatestOrdinal()
+	if err != nil {
+		return err
+	}
+
+	droppedRefs := make(map[BlockID]map[BlockRefNonce]bool)
+	for ptr := range dropped {
+		if droppedRefs[ptr.ID] == nil {
+			droppedRefs[ptr.ID] = make(map[BlockRefNonce]bool)
+		}
+		droppedRefs[ptr.ID][ptr.GetRefNonce()] = true
+	}
+
+	j.log.CDebugf(ctx, "Dropping %d squashed block pointers", len(dropped))
+	for i := first; i <= last; i++ {
+		entry, err := j.readJournalEntry(i)
+		if err != nil {
+			return err
+		}
+		if entry.Ignore || entry.Op == mdRevMarkerOp {
+			continue
+		}
+
+		changed := false
+		for id, idContexts := range entry.Contexts {
+			var kept []BlockContext
+			for _, context := range idContexts {
+				if droppedRefs[id][context.GetRefNonce()] {
+					changed = true
+				} else {
+					kept = append(kept, context)
+				}
+			}
+			if len(kept) == 0 {
+				delete(entry.Contexts, id)
+			} else {
+				entry.Contexts[id] = kept
+			}
+		}
+		if !changed {
+			continue
+		}
+		if len(entry.Contexts) == 0 {
+			entry.Ignore = true
+			if entry.Op == blockPutOp {
+				j.unflushedFiles--
+			}
+		}
+		err = j.j.writeJournalEntry(i, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	for ptr, size := range dropped {
+		j.unflushedBytes -= size
+		refs := j.refs[ptr.ID]
+		if refs == nil {
+			continue
+		}
+		err := refs.remove(ptr.BlockContext, nil)
+		if err != nil {
+			return err
+		}
+		if len(refs) == 0 {
+			delete(j.refs, ptr.ID)
+			err = j.removeBlockData(ptr.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// squash replaces the entries from revision start onwards with the
+// given MD, which must have that revision and must be a valid
+// successor of the entry before it, if there is one.  Only the master
+// branch can be squashed.
+func (j *mdJournal) squash(
+	ctx context.Context, signer cryptoSigner, ekg encryptionKeyGetter,
+	bsplit BlockSplitter, start MetadataRevision, rmd *RootMetadata) (
+	mdID MdID, err error) {
+	j.log.CDebugf(ctx, "Squashing MDs for TLF=%s from rev=%s",
+		rmd.TlfID(), start)
+	defer func() {
+		if err != nil {
+			j.deferLog.CDebugf(ctx,
+				"Squashing MDs for TLF=%s from rev=%s failed with %v",
+				rmd.TlfID(), start, err)
+		}
+	}()
+
+	if j.branchID != NullBranchID || rmd.MergedStatus() != Merged {
+		return MdID{}, errors.New("Only the master branch can be squashed")
+	}
+	if rmd.Revision() != start {
+		return MdID{}, fmt.Errorf("Squashed MD has revision %d, not %d",
+			rmd.Revision(), start)
+	}
+
+	earliest, err := j.readEarliestRevision()
+	if err != nil {
+		return MdID{}, err
+	}
+	latest, err := j.readLatestRevision()
+	if err != nil {
+		return MdID{}, err
+	}
+	if start < earliest || start > latest {
+		return MdID{}, fmt.Errorf(
+			"Revision %d is not in the journal", start)
+	}
+	_, oldEntries, err := j.j.getEntryRange(start, latest)
+	if err != nil {
+		return MdID{}, err
+	}
+
+	if start > earliest {
+		_, prevEntries, err := j.j.getEntryRange(start-1, start-1)
+		if err != nil {
+			return MdID{}, err
+		}
+		prevID := prevEntries[0].ID
+		prev, _, err := j.getMD(prevID, true)
+		if err != nil {
+			return MdID{}, err
+		}
+		err = prev.CheckValidSuccessorForServer(prevID, rmd.bareMd)
+		if err != nil {
+			return MdID{}, err
+		}
+	}
+
+	if rmd.data.Changes.Info.BlockPointer == zeroPtr &&
+		!bsplit.ShouldEmbedBlockChanges(&rmd.data.Changes) {
+		return MdID{},
+			errors.New("MD has embedded block changes, but shouldn't")
+	}
+
+	brmd, err := encryptMDPrivateData(
+		ctx, j.codec, j.crypto, signer, ekg, j.uid, rmd.ReadOnly())
+	if err != nil {
+		return MdID{}, err
+	}
+
+	id, err := j.putMD(brmd)
+	if err != nil {
+		return MdID{}, err
+	}
+	if id == (MdID{}) {
+		return MdID{}, errors.New("Squashed MD is already in the journal")
+	}
+
+	err = j.j.replaceRange(start, mdIDJournalEntry{ID: id})
+	if err != nil {
+		return MdID{}, err
+	}
+
+	// Garbage-collect the old entries.  TODO: we'll eventually need
+	// a sweeper to clean up entries left behind if we crash here.
+	for _, entry := range oldEntries {
+		err := j.removeMD(entry.ID)
+		if err != nil {
+			return MdID{}, err
+		}
+	}
+	return id, nil
+}
+
+// getSquashableOpParts returns the common part of the given op and
+// pointers to any other block updates in it, if it's a kind of op
+// that can be squashed together with others.
+func getSquashableOpParts(o op) (
+	oc *OpCommon, updates []*blockUpdate, ok bool) {
+	switch realOp := o.(type) {
+	case *createOp:
+		return &realOp.OpCommon, []*blockUpdate{&realOp.Dir}, true
+	case *rmOp:
+		return &realOp.OpCommon, []*blockUpdate{&realOp.Dir}, true
+	case *renameOp:
+		return &realOp.OpCommon,
+			[]*blockUpdate{&realOp.OldDir, &realOp.NewDir}, true
+	case *syncOp:
+		return &realOp.OpCommon, []*blockUpdate{&realOp.File}, true
+	case *setAttrOp:
+		return &realOp.OpCommon, []*blockUpdate{&realOp.Dir}, true
+	default:
+		return nil, nil, false
+	}
+}
+
+// isSquashableMD returns whether the given MD only holds ordinary
+// changes that can be squashed together with those of other MDs of
+// the given key generation.
+func isSquashableMD(md ImmutableRootMetadata, keyGen KeyGen) bool {
+	if md.Revision() <= MetadataRevisionInitial ||
+		md.MergedStatus() != Merged || md.IsFinal() || md.IsRekeySet() ||
+		md.IsWriterMetadataCopiedSet() ||
+		md.LatestKeyGeneration() != keyGen ||
+		md.data.Changes.Info.BlockPointer != zeroPtr ||
+		md.data.ChangesBlockInfo().BlockPointer != zeroPtr ||
+		len(md.data.Changes.Ops) == 0 {
+		return false
+	}
+	for _, o := range md.data.Changes.Ops {
+		if _, _, ok := getSquashableOpParts(o); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// mdSquash holds a run of consecutive MDs to be squashed together,
+// and works out how the block pointers in their ops relate to each
+// other.
+type mdSquash struct {
+	mds []ImmutableRootMetadata
+	// For every pointer that was replaced by a block update, next
+	// maps it to the pointer that replaced it, and prev maps that
+	// pointer back to it.
+	next map[BlockPointer]BlockPointer
+	prev map[BlockPointer]BlockPointer
+	// Pointers that were both referenced and unreferenced within the
+	// run, and that could be dropped from it.
+	candidates map[BlockPointer]bool
+}
+
+func makeMDSquash(mds []ImmutableRootMetadata) mdSquash {
+	s := mdSquash{
+		mds:        mds,
+		next:       make(map[BlockPointer]BlockPointer),
+		prev:       make(map[BlockPointer]BlockPointer),
+		candidates: make(map[BlockPointer]bool),
+	}
+
+	refs := make(map[BlockPointer]bool)
+	unrefs := make(map[BlockPointer]bool)
+	// Pointers that were updated in more than one way can't be
+	// followed safely.
+	ambiguous := make(map[BlockPointer]bool)
+	for _, md := range mds {
+		for _, o := range md.data.Changes.Ops {
+			for _, ptr := range o.Refs() {
+				refs[ptr] = true
+			}
+			for _, ptr := range o.Unrefs() {
+				unrefs[ptr] = true
+			}
+			for _, update := range o.AllUpdates() {
+				if update.Unref == zeroPtr || update.Ref == zeroPtr ||
+					update.Unref == update.Ref {
+					continue
+				}
+				refs[update.Ref] = true
+				unrefs[update.Unref] = true
+				if next, ok := s.next[update.Unref]; ok &&
+					next != update.Ref {
+					ambiguous[update.Unref] = true
+				}
+				if prev, ok := s.prev[update.Ref]; ok &&
+					prev != update.Unref {
+					ambiguous[update.Ref] = true
+				}
+				s.next[update.Unref] = update.Ref
+				s.prev[update.Ref] = update.Unref
+			}
+		}
+	}
+
+	for ptr := range refs {
+		if !unrefs[ptr] || ambiguous[ptr] {
+			continue
+		}
+		// A pointer in the middle of a chain of updates can be
+		// dropped by joining its neighbors, but one at either end
+		// of a chain has nothing to be replaced with.
+		_, hasPrev := s.prev[ptr]
+		_, hasNext := s.next[ptr]
+		if hasPrev != hasNext {
+			continue
+		}
+		s.candidates[ptr] = true
+	}
+	return s
+}
+
+// follow returns the first pointer that isn't dropped, starting from
+// the given pointer and following the given links.
+func (s mdSquash) follow(ptr BlockPointer,
+	links map[BlockPointer]BlockPointer,
+	dropped map[BlockPointer]int64) (BlockPointer, error) {
+	for i := 0; i <= len(dropped); i++ {
+		if _, ok := dropped[ptr]; !ok {
+			return ptr, nil
+		}
+		next, ok := links[ptr]
+		if !ok {
+			return zeroPtr, fmt.Errorf(
+				"No replacement for dropped pointer %v", ptr)
+		}
+		ptr = next
+	}
+	return zeroPtr, fmt.Errorf("Cycle of dropped pointers at %v", ptr)
+}
+
+func removeDroppedPtrs(ptrs []BlockPointer,
+	dropped map[BlockPointer]int64) []BlockPointer {
+	var kept []BlockPointer
+	for _, ptr := range ptrs {
+		if _, ok := dropped[ptr]; !ok {
+			kept = append(kept, ptr)
+		}
+	}
+	return kept
+}
+
+// makeMD returns a new MD that takes the place of the whole run: it
+// has the revision and previous root of the first MD, the state of
+// the last one, and the ops of all of them, with the given dropped
+// pointers removed.  Block updates through dropped pointers are
+// joined up, so that every update of the same block goes from its
+// pointer before the run to its pointer after it.
+func (s mdSquash) makeMD(codec kbfscodec.Codec,
+	dropped map[BlockPointer]int64) (*RootMetadata, error) {
+	first, last := s.mds[0], s.mds[len(s.mds)-1]
+	newMD, err := last.deepCopy(codec, true)
+	if err != nil {
+		return nil, err
+	}
+	newMD.SetRevision(first.Revision())
+	newMD.SetPrevRoot(first.PrevRoot())
+
+	var ops opsList
+	var refBytes, unrefBytes, droppedBytes uint64
+	for _, md := range s.mds {
+		var changes BlockChanges
+		err := kbfscodec.Update(codec, &changes, md.data.Changes)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, changes.Ops...)
+		refBytes += md.RefBytes()
+		unrefBytes += md.UnrefBytes()
+	}
+
+	for _, o := range ops {
+		oc, updates, ok := getSquashableOpParts(o)
+		if !ok {
+			return nil, fmt.Errorf("Can't squash op %s", o)
+		}
+		oc.RefBlocks = removeDroppedPtrs(oc.RefBlocks, dropped)
+		oc.UnrefBlocks = removeDroppedPtrs(oc.UnrefBlocks, dropped)
+		for i := range oc.Updates {
+			updates = append(updates, &oc.Updates[i])
+		}
+		for _, update := range updates {
+			if *update == (blockUpdate{}) {
+				continue
+			}
+			update.Unref, err = s.follow(update.Unref, s.prev, dropped)
+			if err != nil {
+				return nil, err
+			}
+			update.Ref, err = s.follow(update.Ref, s.next, dropped)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Dropped blocks were counted once when they were referenced,
+	// and once more when they were unreferenced.
+	for _, size := range dropped {
+		droppedBytes += uint64(size)
+	}
+	if refBytes > droppedBytes {
+		refBytes -= droppedBytes
+	} else {
+		refBytes = 0
+	}
+	if unrefBytes > droppedBytes {
+		unrefBytes -= droppedBytes
+	} else {
+		unrefBytes = 0
+	}
+	newMD.SetRefBytes(refBytes)
+	newMD.SetUnrefBytes(unrefBytes)
+	newMD.data.Changes = BlockChanges{Ops: ops}
+	return newMD, nil
+}
@@ -0,0 +1,252 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLFJournalSquashMDs(t *testing.T) {
+	tempdir, config, ctx, cancel, tlfJournal, delegate :=
+		setupTLFJournalTest(t, TLFJournalBackgroundWorkPaused)
+	defer teardownTLFJournalTest(
+		tempdir, config, ctx, cancel, tlfJournal, delegate)
+
+	firstRevision := MetadataRevision(10)
+	firstPrevRoot := fakeMdID(1)
+	var mdIDs []MdID
+	var ptrs []BlockPointer
+	prevRoot := firstPrevRoot
+	for i := 0; i < 3; i++ {
+		data := []byte{byte(i), 2, 3, 4}
+		id, bCtx, _ := config.makeBlock(data)
+		putBlock(ctx, t, config, tlfJournal, data)
+		ptrs = append(ptrs, BlockPointer{ID: id, BlockContext: bCtx})
+
+		md := config.makeMD(firstRevision+MetadataRevision(i), prevRoot)
+		mdID, err := tlfJournal.putMD(ctx, md)
+		require.NoError(t, err)
+		mdIDs = append(mdIDs, mdID)
+		prevRoot = mdID
+	}
+
+	// Squash the last two revisions, dropping the second block.
+	candidates := map[BlockPointer]bool{ptrs[1]: true}
+	var dropped map[BlockPointer]int64
+	_, err := tlfJournal.squashMDs(ctx, firstRevision+1, mdIDs[2],
+		candidates, func(d map[BlockPointer]int64) (
+			*RootMetadata, *blockPutState, error) {
+			dropped = d
+			return config.makeMD(firstRevision+1, mdIDs[0]), nil, nil
+		})
+	require.NoError(t, err)
+	require.Equal(t, map[BlockPointer]int64{ptrs[1]: 4}, dropped)
+
+	// The squashed copy was swapped in and nothing was left behind.
+	_, err = os.Stat(tlfJournal.dir + tlfJournalSquashNewSuffix)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(tlfJournal.dir + tlfJournalSquashOldSuffix)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(tlfJournal.blockJournal.blockDataPath(ptrs[1].ID))
+	require.True(t, os.IsNotExist(err))
+
+	// The ignored entries stay in the block journal until they're
+	// flushed.
+	requireJournalEntryCounts(t, tlfJournal, 6, 2)
+	require.Equal(t, int64(8), tlfJournal.getUnflushedBytes())
+	require.NoError(t, tlfJournal.blockJournal.checkInSync(ctx))
+
+	// A squash that doesn't start from the current head fails.
+	_, err = tlfJournal.squashMDs(ctx, firstRevision, mdIDs[2], nil,
+		func(map[BlockPointer]int64) (
+			*RootMetadata, *blockPutState, error) {
+			return config.makeMD(firstRevision, firstPrevRoot), nil, nil
+		})
+	require.Error(t, err)
+
+	var mdserver shimMDServer
+	config.mdserver = &mdserver
+	err = tlfJournal.flush(ctx)
+	require.NoError(t, err)
+	requireJournalEntryCounts(t, tlfJournal, 0, 0)
+	testMDJournalGCd(t, tlfJournal.mdJournal)
+	config.checkRange(
+		mdserver.rmdses, firstRevision, firstPrevRoot, Merged, NullBranchID)
+	require.Equal(t, 2, len(mdserver.rmdses))
+
+	// The dropped block was never uploaded.
+	bserver := tlfJournal.delegateBlockServer
+	_, _, err = bserver.Get(
+		ctx, config.tlfID, ptrs[0].ID, ptrs[0].BlockContext)
+	require.NoError(t, err)
+	_, _, err = bserver.Get(
+		ctx, config.tlfID, ptrs[1].ID, ptrs[1].BlockContext)
+	require.Error(t, err)
+}
+
+func TestTLFJournalSquashMDsWithNewBlock(t *testing.T) {
+	tempdir, config, ctx, cancel, tlfJournal, delegate :=
+		setupTLFJournalTest(t, TLFJournalBackgroundWorkPaused)
+	defer teardownTLFJournalTest(
+		tempdir, config, ctx, cancel, tlfJournal, delegate)
+
+	firstRevision := MetadataRevision(10)
+	firstPrevRoot := fakeMdID(1)
+	var mdIDs []MdID
+	prevRoot := firstPrevRoot
+	for i := 0; i < 2; i++ {
+		putBlock(ctx, t, config, tlfJournal, []byte{byte(i), 2, 3, 4})
+		md := config.makeMD(firstRevision+MetadataRevision(i), prevRoot)
+		mdID, err := tlfJournal.putMD(ctx, md)
+		require.NoError(t, err)
+		mdIDs = append(mdIDs, mdID)
+		prevRoot = mdID
+	}
+
+	// The squashed MD comes with a new block, like its unembedded
+	// block changes, which is put before its revision marker.
+	data := []byte{5, 6, 7}
+	id, bCtx, serverHalf := config.makeBlock(data)
+	bps := newBlockPutState(1)
+	bps.addNewBlock(BlockPointer{ID: id, BlockContext: bCtx}, nil,
+		ReadyBlockData{buf: data, serverHalf: serverHalf}, nil)
+	_, err := tlfJournal.squashMDs(ctx, firstRevision, mdIDs[1], nil,
+		func(map[BlockPointer]int64) (
+			*RootMetadata, *blockPutState, error) {
+			return config.makeMD(firstRevision, firstPrevRoot), bps, nil
+		})
+	require.NoError(t, err)
+	requireJournalEntryCounts(t, tlfJournal, 6, 1)
+	require.NoError(t, tlfJournal.blockJournal.checkInSync(ctx))
+
+	var mdserver shimMDServer
+	config.mdserver = &mdserver
+	err = tlfJournal.flush(ctx)
+	require.NoError(t, err)
+	requireJournalEntryCounts(t, tlfJournal, 0, 0)
+	require.Equal(t, 1, len(mdserver.rmdses))
+	buf, key, err := tlfJournal.delegateBlockServer.Get(
+		ctx, config.tlfID, id, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+	require.Equal(t, serverHalf, key)
+}
+
+func makeSquashTestMD(t *testing.T, revision MetadataRevision,
+	ops ...op) ImmutableRootMetadata {
+	md := makeMDForTest(t, FakeTlfID(1, false), revision,
+		keybase1.MakeTestUID(1), fakeMdID(byte(revision-1)))
+	md.tlfHandle = &TlfHandle{name: "fake"}
+	md.SetRefBytes(10)
+	md.SetUnrefBytes(10)
+	for _, o := range ops {
+		md.AddOp(o)
+	}
+	return MakeImmutableRootMetadata(md, fakeMdID(byte(revision)),
+		time.Now())
+}
+
+func TestMDSquashJoinsUpdates(t *testing.T) {
+	codec := kbfscodec.NewMsgpack()
+	RegisterOps(codec)
+
+	var ptrs []BlockPointer
+	for i := 0; i < 5; i++ {
+		ptrs = append(ptrs, BlockPointer{ID: fakeBlockID(byte(i + 1))})
+	}
+
+	// Each revision syncs the same file; the last one also removes
+	// a block that was added by the first one.
+	var mds []ImmutableRootMetadata
+	for i := 0; i < 3; i++ {
+		so, err := newSyncOp(ptrs[i])
+		require.NoError(t, err)
+		so.AddUpdate(ptrs[i], ptrs[i+1])
+		if i == 0 {
+			so.AddRefBlock(ptrs[4])
+		} else if i == 2 {
+			so.AddUnrefBlock(ptrs[4])
+		}
+		mds = append(mds, makeSquashTestMD(t, MetadataRevision(i+2), so))
+	}
+
+	s := makeMDSquash(mds)
+	require.Equal(t, map[BlockPointer]bool{
+		ptrs[1]: true,
+		ptrs[2]: true,
+		ptrs[4]: true,
+	}, s.candidates)
+
+	dropped := map[BlockPointer]int64{ptrs[1]: 1, ptrs[2]: 2, ptrs[4]: 3}
+	newMD, err := s.makeMD(codec, dropped)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(2), newMD.Revision())
+	require.Equal(t, mds[0].PrevRoot(), newMD.PrevRoot())
+	require.Equal(t, uint64(24), newMD.RefBytes())
+	require.Equal(t, uint64(24), newMD.UnrefBytes())
+	require.Len(t, newMD.data.Changes.Ops, 3)
+	for _, o := range newMD.data.Changes.Ops {
+		so := o.(*syncOp)
+		require.Equal(t, blockUpdate{Unref: ptrs[0], Ref: ptrs[3]}, so.File)
+		require.Empty(t, so.Refs())
+		require.Empty(t, so.Unrefs())
+	}
+}
+
+func TestTLFJournalSquashRecovery(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "tlf_journal_squash")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	files := journalFiles{wipe: true}
+
+	makeDir := func(dir string, data []byte) string {
+		path := filepath.Join(dir, "blocks", "data")
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, ioutil.WriteFile(path, data, 0600))
+		return path
+	}
+	requireData := func(path string, data []byte) {
+		buf, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, data, buf)
+	}
+	requireGone := func(path string) {
+		_, err := os.Stat(path)
+		require.True(t, os.IsNotExist(err))
+	}
+
+	// A squash that crashed before the old directory was moved
+	// aside is thrown away, without wiping the shared files.
+	dir := filepath.Join(tempdir, "uncommitted")
+	path := makeDir(dir, []byte{1, 2, 3})
+	newDir := dir + tlfJournalSquashNewSuffix
+	require.NoError(t, copyTLFJournalDir(dir, newDir))
+	require.NoError(t, recoverTLFJournalSquash(dir, files))
+	requireData(path, []byte{1, 2, 3})
+	requireGone(newDir)
+
+	// A squash that crashed after the old directory was moved aside
+	// is moved into place.
+	dir = filepath.Join(tempdir, "committed")
+	oldDir := dir + tlfJournalSquashOldSuffix
+	makeDir(oldDir, []byte{4, 5, 6})
+	newDir = dir + tlfJournalSquashNewSuffix
+	makeDir(newDir, []byte{7, 8, 9})
+	require.NoError(t, recoverTLFJournalSquashes(tempdir, files))
+	requireData(filepath.Join(dir, "blocks", "data"), []byte{7, 8, 9})
+	requireGone(oldDir)
+	requireGone(newDir)
+}
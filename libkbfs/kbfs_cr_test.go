@@ -822,6 +822,162 @@ func TestBasicCRFileConflict(t *testing.T) {
 	}
 }
 
+// Tests that under the merge-text policy, conflicting writes to
+// different lines of a text file get merged within the single MD
+// revision of the resolution.
+func TestBasicCRFileConflictMergeText(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 sets the policy and creates a text file in a shared dir
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+
+	kbfsOps1 := config1.KBFSOps()
+	policyFile, _, err := kbfsOps1.CreateFile(
+		ctx, rootNode1, ConflictPolicyFileName, false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	err = kbfsOps1.Write(ctx, policyFile, []byte("merge-text"), 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, dirA1, "b", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	err = kbfsOps1.Write(ctx, fileB1, []byte("1\n2\n3\n4\n5\n"), 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	err = kbfsOps1.Sync(ctx, fileB1)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	err = kbfsOps1.Sync(ctx, policyFile)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+
+	kbfsOps2 := config2.KBFSOps()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't lookup dir: %v", err)
+	}
+	fileB2, _, err := kbfsOps2.Lookup(ctx, dirA2, "b")
+	if err != nil {
+		t.Fatalf("Couldn't lookup file: %v", err)
+	}
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+
+	// User 1 changes the first line
+	err = kbfsOps1.Write(ctx, fileB1, []byte("A"), 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	err = kbfsOps1.Sync(ctx, fileB1)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	ops1 := getOps(config1, rootNode1.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	mergedRev := ops1.getCurrMDRevision(lState)
+
+	// User 2 changes the last line
+	err = kbfsOps2.Write(ctx, fileB2, []byte("E"), 8)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	err = kbfsOps2.Sync(ctx, fileB2)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2,
+		rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	// The merge is part of the resolution itself.
+	head := ops1.getHead(lState)
+	if g, e := head.Revision(), mergedRev+1; g != e {
+		t.Errorf("Unexpected head revision: %d vs %d", g, e)
+	}
+	autoMerged := false
+	for _, op := range head.data.Changes.Ops {
+		if so, ok := op.(*syncOp); ok && so.AutoMerged {
+			autoMerged = true
+		}
+	}
+	if !autoMerged {
+		t.Errorf("No auto-merged sync in %v", head.data.Changes.Ops)
+	}
+
+	expectedData := []byte("A\n2\n3\n4\nE\n")
+	for _, kbfsOps := range []KBFSOps{kbfsOps1, kbfsOps2} {
+		dir := dirA1
+		if kbfsOps == kbfsOps2 {
+			dir = dirA2
+		}
+		children, err := kbfsOps.GetDirChildren(ctx, dir)
+		if err != nil {
+			t.Fatalf("Couldn't get children: %v", err)
+		}
+		if len(children) != 1 {
+			t.Errorf("Unexpected children: %v", children)
+		}
+		fileB, _, err := kbfsOps.Lookup(ctx, dir, "b")
+		if err != nil {
+			t.Fatalf("Couldn't lookup file: %v", err)
+		}
+		buf := make([]byte, 2*len(expectedData))
+		n, err := kbfsOps.Read(ctx, fileB, buf, 0)
+		if err != nil {
+			t.Fatalf("Couldn't read file: %v", err)
+		}
+		if g, e := buf[:n], expectedData; !reflect.DeepEqual(g, e) {
+			t.Errorf("Unexpected contents: %q vs %q", g, e)
+		}
+	}
+}
+
 // Tests that two users can create the same file simultaneously, and
 // the unmerged user can write to it, and they will be merged into a
 // single file.
@@ -2072,3 +2228,105 @@ func TestUnmergedPutAfterCanceledUnmergedPut(t *testing.T) {
 		}
 	}
 }
+
+// Tests that xattr changes made by two users while forked are merged
+// per-key by conflict resolution.
+func TestBasicCRXattrMerge(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileA1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	err = kbfsOps1.SetXattr(ctx, fileA1, "user.shared", []byte("orig"))
+	if err != nil {
+		t.Fatalf("Couldn't set xattr: %v", err)
+	}
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't lookup file: %v", err)
+	}
+
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+
+	// User 1 sets one key and changes the shared one.
+	err = kbfsOps1.SetXattr(ctx, fileA1, "user.one", []byte("1"))
+	if err != nil {
+		t.Fatalf("Couldn't set xattr: %v", err)
+	}
+	err = kbfsOps1.SetXattr(ctx, fileA1, "user.shared", []byte("merged"))
+	if err != nil {
+		t.Fatalf("Couldn't set xattr: %v", err)
+	}
+
+	// User 2 sets a different key and also changes the shared one.
+	err = kbfsOps2.SetXattr(ctx, fileA2, "user.two", []byte("2"))
+	if err != nil {
+		t.Fatalf("Couldn't set xattr: %v", err)
+	}
+	err = kbfsOps2.SetXattr(ctx, fileA2, "user.shared", []byte("unmerged"))
+	if err != nil {
+		t.Fatalf("Couldn't set xattr: %v", err)
+	}
+
+	c <- struct{}{}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	// Both keys survive, and the unmerged value of the shared key
+	// wins; no conflict copy is made.
+	expected := map[string]string{
+		"user.one":    "1",
+		"user.two":    "2",
+		"user.shared": "unmerged",
+	}
+	check := func(kbfsOps KBFSOps, rootNode, fileNode Node) {
+		names, err := kbfsOps.ListXattr(ctx, fileNode)
+		if err != nil {
+			t.Fatalf("Couldn't list xattrs: %v", err)
+		}
+		if len(names) != len(expected) {
+			t.Fatalf("Unexpected xattrs: %v", names)
+		}
+		for k, v := range expected {
+			value, err := kbfsOps.GetXattr(ctx, fileNode, k)
+			if err != nil {
+				t.Fatalf("Couldn't get xattr %s: %v", k, err)
+			}
+			if string(value) != v {
+				t.Errorf("Unexpected value for %s: %s vs %s", k, value, v)
+			}
+		}
+		children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+		if err != nil {
+			t.Fatalf("Couldn't get children: %v", err)
+		}
+		if len(children) != 1 {
+			t.Errorf("Unexpected children: %v", children)
+		}
+	}
+	check(kbfsOps1, rootNode1, fileA1)
+	check(kbfsOps2, rootNode2, fileA2)
+}
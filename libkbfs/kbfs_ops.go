@@ -26,6 +26,16 @@ type KBFSOpsStandard struct {
 	ops      map[FolderBranch]*folderBranchOps
 	opsByFav map[Favorite]*folderBranchOps
 	opsLock  sync.RWMutex
+	// offline is set, while holding opsLock, when the mdserver
+	// connection is down, so that new folder-branches start out
+	// offline.  offlineLock serializes switches in and out of
+	// offline mode.
+	offline     bool
+	offlineLock sync.Mutex
+	// archivedLock serializes the creation of archived views with
+	// the shutdown of idle ones, so that a view isn't shut down
+	// between being created and handing out its root node.
+	archivedLock sync.Mutex
 	// reIdentifyControlChan controls reidentification.
 	// Sending a value to this channel forces all fbos
 	// to be marked for revalidation.
@@ -71,6 +81,9 @@ func (fs *KBFSOpsStandard) markForReIdentifyIfNeededLoop() {
 		// Normal case: feed the current time from config and mark fbos needing validation.
 		case <-ticker.C:
 			now = fs.config.Clock().Now()
+			// Piggyback on the ticker to reclaim any archived
+			// views that are no longer in use.
+			fs.shutdownIdleArchivedOps(context.Background())
 		// Mark everything for reidentification via now being the empty value or quit.
 		case _, ok := <-fs.reIdentifyControlChan:
 			if !ok {
@@ -99,7 +112,17 @@ func (fs *KBFSOpsStandard) Shutdown() error {
 	if err := fs.favs.Shutdown(); err != nil {
 		errors = append(errors, err)
 	}
-	for _, ops := range fs.ops {
+	// Idle archived views may be shut down concurrently by the
+	// reidentification loop, so copy the ops under the lock.
+	var allOps []*folderBranchOps
+	func() {
+		fs.opsLock.RLock()
+		defer fs.opsLock.RUnlock()
+		for _, ops := range fs.ops {
+			allOps = append(allOps, ops)
+		}
+	}()
+	for _, ops := range allOps {
 		if err := ops.Shutdown(); err != nil {
 			errors = append(errors, err)
 			// Continue on and try to shut down the other FBOs.
@@ -114,9 +137,42 @@ func (fs *KBFSOpsStandard) Shutdown() error {
 	return nil
 }
 
+// setOffline tells every folder-branch whether the mdserver is
+// reachable.
+func (fs *KBFSOpsStandard) setOffline(offline bool) {
+	fs.offlineLock.Lock()
+	defer fs.offlineLock.Unlock()
+
+	fs.opsLock.Lock()
+	fs.offline = offline
+	ops := make([]*folderBranchOps, 0, len(fs.ops))
+	for _, op := range fs.ops {
+		ops = append(ops, op)
+	}
+	fs.opsLock.Unlock()
+
+	for _, op := range ops {
+		ctx := op.ctxWithFBOID(context.Background())
+		op.setOffline(ctx, offline)
+	}
+}
+
+// isOffline returns whether the mdserver connection is down.
+func (fs *KBFSOpsStandard) isOffline() bool {
+	fs.opsLock.RLock()
+	defer fs.opsLock.RUnlock()
+	return fs.offline
+}
+
 // PushConnectionStatusChange pushes human readable connection status changes.
 func (fs *KBFSOpsStandard) PushConnectionStatusChange(service string, newStatus error) {
 	fs.currentStatus.PushConnectionStatusChange(service, newStatus)
+
+	// Failed commands don't mean that the mdserver is unreachable.
+	if _, isCommandErr := newStatus.(mdServerCommandError); !isCommandErr &&
+		service == MDServiceName {
+		fs.setOffline(newStatus != nil)
+	}
 }
 
 // GetFavorites implements the KBFSOps interface for
@@ -203,9 +259,17 @@ func (fs *KBFSOpsStandard) getOpsNoAdd(fb FolderBranch) *folderBranchOps {
 	ops, ok := fs.ops[fb]
 	if !ok {
 		// TODO: add some interface for specifying the type of the
-		// branch; for now assume online and read-write.
-		ops = newFolderBranchOps(fs.config, fb, standard)
+		// branch; for now assume online, and read-write unless the
+		// branch name pins a past revision.
+		bType := standard
+		if fb.Branch.IsArchived() {
+			bType = archive
+		}
+		ops = newFolderBranchOps(fs.config, fb, bType)
 		fs.ops[fb] = ops
+		if fs.offline {
+			ops.setOffline(ops.ctxWithFBOID(context.Background()), true)
+		}
 	}
 	return ops
 }
@@ -306,6 +370,42 @@ func (fs *KBFSOpsStandard) getOrInitializeNewMDMaster(
 
 }
 
+// getOfflineRootNode returns the root node of the folder for the
+// given handle, without contacting the mdserver, if the folder is
+// already loaded or has a journal on this device.  It returns false
+// if there's no such folder.
+func (fs *KBFSOpsStandard) getOfflineRootNode(
+	ctx context.Context, h *TlfHandle, branch BranchName) (
+	node Node, ei EntryInfo, ok bool, err error) {
+	fs.opsLock.RLock()
+	ops, ok := fs.opsByFav[h.ToFavorite()]
+	fs.opsLock.RUnlock()
+	if !ok && branch == MasterBranch {
+		// Looking up the TLF ID would need the mdserver, so see
+		// if any journal has a head with this handle.
+		jServer, err := GetJournalServer(fs.config)
+		if err != nil {
+			return nil, EntryInfo{}, false, nil
+		}
+		id, ok := jServer.getTlfIDForHandle(ctx, h)
+		if !ok {
+			return nil, EntryInfo{}, false, nil
+		}
+		ops = fs.getOpsByHandle(
+			ctx, h, FolderBranch{Tlf: id, Branch: MasterBranch})
+	} else if !ok || ops.folderBranch.Branch != branch {
+		return nil, EntryInfo{}, false, nil
+	}
+
+	fs.log.CDebugf(ctx, "Offline; serving the last known head of %s",
+		h.GetCanonicalPath())
+	node, ei, _, err = ops.getRootNode(ctx)
+	if err != nil {
+		return nil, EntryInfo{}, true, err
+	}
+	return node, ei, true, nil
+}
+
 // getMaybeCreateRootNode is called for GetOrCreateRootNode and GetRootNode.
 func (fs *KBFSOpsStandard) getMaybeCreateRootNode(
 	ctx context.Context, h *TlfHandle, branch BranchName, create bool) (
@@ -314,6 +414,15 @@ func (fs *KBFSOpsStandard) getMaybeCreateRootNode(
 		h.GetCanonicalPath(), branch, create)
 	defer func() { fs.deferLog.CDebugf(ctx, "Done: %#v", err) }()
 
+	if fs.isOffline() {
+		// The mdserver is unreachable, so serve the last known
+		// head of this folder, if we have one.
+		node, ei, ok, err := fs.getOfflineRootNode(ctx, h, branch)
+		if ok || err != nil {
+			return node, ei, err
+		}
+	}
+
 	// Do GetForHandle() unlocked -- no cache lookups, should be fine
 	mdops := fs.config.MDOps()
 	// TODO: only do this the first time, cache the folder ID after that
@@ -417,6 +526,108 @@ func (fs *KBFSOpsStandard) GetRootNode(
 	return fs.getMaybeCreateRootNode(ctx, h, branch, false)
 }
 
+// GetArchivedRootNode implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) GetArchivedRootNode(
+	ctx context.Context, h *TlfHandle, rev MetadataRevision) (
+	node Node, ei EntryInfo, err error) {
+	fs.log.CDebugf(ctx, "GetArchivedRootNode(%s, %d)",
+		h.GetCanonicalPath(), rev)
+	defer func() { fs.deferLog.CDebugf(ctx, "Done: %#v", err) }()
+
+	id, head, err := fs.config.MDOps().GetForHandle(ctx, h, Merged)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	if head == (ImmutableRootMetadata{}) {
+		return nil, EntryInfo{}, NoSuchMDError{id, rev, NullBranchID}
+	}
+	if rev < MetadataRevisionInitial || rev > head.Revision() {
+		return nil, EntryInfo{}, NoSuchMDError{id, rev, NullBranchID}
+	}
+
+	md := head
+	if rev != head.Revision() {
+		md, err = getSingleMD(ctx, fs.config, id, NullBranchID, rev, Merged)
+		if err != nil {
+			return nil, EntryInfo{}, err
+		}
+	}
+
+	if err := isReadableOrError(ctx, fs.config, md.ReadOnly()); err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	// Each view keeps its own goroutines and caches, so shut down
+	// the ones nobody is using anymore before making another.
+	fs.shutdownIdleArchivedOps(ctx)
+
+	fs.archivedLock.Lock()
+	defer fs.archivedLock.Unlock()
+	// Archived views are never added to the favorites list, so
+	// don't use getOpsByHandle.
+	ops := fs.getOpsNoAdd(FolderBranch{Tlf: id, Branch: MakeRevBranchName(rev)})
+	err = ops.SetInitialHeadFromServer(ctx, md)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	node, ei, _, err = ops.getRootNode(ctx)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return node, ei, nil
+}
+
+// shutdownIdleArchivedOps shuts down and forgets every archived view
+// whose nodes have all been released by the caller.  A later
+// GetArchivedRootNode call for the same revision makes a new view.
+func (fs *KBFSOpsStandard) shutdownIdleArchivedOps(ctx context.Context) {
+	fs.archivedLock.Lock()
+	defer fs.archivedLock.Unlock()
+
+	var idle []*folderBranchOps
+	func() {
+		fs.opsLock.Lock()
+		defer fs.opsLock.Unlock()
+		for fb, ops := range fs.ops {
+			if ops.isArchived() && ops.isIdle() {
+				idle = append(idle, ops)
+				delete(fs.ops, fb)
+			}
+		}
+	}()
+
+	for _, ops := range idle {
+		fs.log.CDebugf(ctx, "Shutting down idle archived view %s",
+			ops.folderBranch)
+		if err := ops.Shutdown(); err != nil {
+			fs.log.CDebugf(ctx, "Couldn't shut down archived view %s: %v",
+				ops.folderBranch, err)
+		}
+	}
+}
+
+// GetRevisionForTime implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) GetRevisionForTime(
+	ctx context.Context, h *TlfHandle, t time.Time) (
+	rev MetadataRevision, err error) {
+	fs.log.CDebugf(ctx, "GetRevisionForTime(%s, %s)",
+		h.GetCanonicalPath(), t)
+	defer func() { fs.deferLog.CDebugf(ctx, "Done: %d %v", rev, err) }()
+
+	id, head, err := fs.config.MDOps().GetForHandle(ctx, h, Merged)
+	if err != nil {
+		return MetadataRevisionUninitialized, err
+	}
+	if head == (ImmutableRootMetadata{}) {
+		return MetadataRevisionUninitialized,
+			NoSuchMDError{id, MetadataRevisionInitial, NullBranchID}
+	}
+	return getMDRevisionForTime(ctx, fs.config, head, t)
+}
+
 // GetDirChildren implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) GetDirChildren(ctx context.Context, dir Node) (
 	map[string]EntryInfo, error) {
@@ -461,6 +672,43 @@ func (fs *KBFSOpsStandard) CreateLink(
 	return ops.CreateLink(ctx, dir, fromName, toPath)
 }
 
+// CopyFile implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) CopyFile(
+	ctx context.Context, src Node, dstDir Node, name string) (
+	Node, EntryInfo, error) {
+	// blocks can only be shared within the same TLF
+	if src.GetFolderBranch() != dstDir.GetFolderBranch() {
+		return nil, EntryInfo{}, CopyAcrossTlfsError{}
+	}
+
+	ops := fs.getOpsByNode(ctx, dstDir)
+	return ops.CopyFile(ctx, src, dstDir, name)
+}
+
+// CopyFileInto implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) CopyFileInto(
+	ctx context.Context, src Node, dst Node) (uint64, error) {
+	// blocks can only be shared within the same TLF
+	if src.GetFolderBranch() != dst.GetFolderBranch() {
+		return 0, CopyAcrossTlfsError{}
+	}
+
+	ops := fs.getOpsByNode(ctx, dst)
+	return ops.CopyFileInto(ctx, src, dst)
+}
+
+// CreateHardLink implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) CreateHardLink(
+	ctx context.Context, dir Node, name string, target Node) (
+	Node, EntryInfo, error) {
+	if target.GetFolderBranch() != dir.GetFolderBranch() {
+		return nil, EntryInfo{}, HardLinkAcrossTlfsError{}
+	}
+
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.CreateHardLink(ctx, dir, name, target)
+}
+
 // RemoveDir implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) RemoveDir(
 	ctx context.Context, dir Node, name string) error {
@@ -513,6 +761,20 @@ func (fs *KBFSOpsStandard) Truncate(
 	return ops.Truncate(ctx, file, size)
 }
 
+// GetFileHoles implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetFileHoles(
+	ctx context.Context, file Node) ([]FileHole, error) {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.GetFileHoles(ctx, file)
+}
+
+// PunchHole implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) PunchHole(
+	ctx context.Context, file Node, off, length uint64) error {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.PunchHole(ctx, file, off, length)
+}
+
 // SetEx implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) SetEx(
 	ctx context.Context, file Node, ex bool) error {
@@ -527,12 +789,75 @@ func (fs *KBFSOpsStandard) SetMtime(
 	return ops.SetMtime(ctx, file, mtime)
 }
 
+// SetXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetXattr(
+	ctx context.Context, node Node, name string, value []byte) error {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.SetXattr(ctx, node, name, value)
+}
+
+// GetXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetXattr(
+	ctx context.Context, node Node, name string) ([]byte, error) {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.GetXattr(ctx, node, name)
+}
+
+// ListXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) ListXattr(
+	ctx context.Context, node Node) ([]string, error) {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.ListXattr(ctx, node)
+}
+
+// RemoveXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) RemoveXattr(
+	ctx context.Context, node Node, name string) error {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.RemoveXattr(ctx, node, name)
+}
+
 // Sync implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Sync(ctx context.Context, file Node) error {
 	ops := fs.getOpsByNode(ctx, file)
 	return ops.Sync(ctx, file)
 }
 
+// SetSyncPolicy implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetSyncPolicy(
+	ctx context.Context, node Node, pinned bool) error {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.SetSyncPolicy(ctx, node, pinned)
+}
+
+// LockFile implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) LockFile(
+	ctx context.Context, file Node, owner string, exclusive bool) error {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.LockFile(ctx, file, owner, exclusive)
+}
+
+// UnlockFile implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) UnlockFile(
+	ctx context.Context, file Node, owner string) error {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.UnlockFile(ctx, file, owner)
+}
+
+// BeginBatch implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) BeginBatch(
+	ctx context.Context, folderBranch FolderBranch) (Batch, error) {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.BeginBatch(ctx, folderBranch)
+}
+
+// Watch implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) Watch(ctx context.Context, dir Node,
+	recursive bool, fromRev MetadataRevision) (<-chan ChangeEvent, error) {
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.Watch(ctx, dir, recursive, fromRev)
+}
+
 // FolderStatus implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) FolderStatus(
 	ctx context.Context, folderBranch FolderBranch) (
@@ -615,6 +940,14 @@ func (fs *KBFSOpsStandard) GetEditHistory(ctx context.Context,
 	return ops.GetEditHistory(ctx, folderBranch)
 }
 
+// PreviewConflictResolution implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) PreviewConflictResolution(ctx context.Context,
+	folderBranch FolderBranch) (ConflictResolutionPreview, error) {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.PreviewConflictResolution(ctx, folderBranch)
+}
+
 // GetNodeMetadata implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) GetNodeMetadata(ctx context.Context, node Node) (
 	NodeMetadata, error) {
@@ -657,3 +990,42 @@ func (fs *KBFSOpsStandard) onMDFlush(tlfID TlfID, bid BranchID,
 	ops := fs.getOpsNoAdd(FolderBranch{Tlf: tlfID, Branch: MasterBranch})
 	ops.onMDFlush(bid, rev) // folderBranchOps makes a goroutine
 }
+
+func (fs *KBFSOpsStandard) onMDSquash(tlfID TlfID, doneCh chan<- struct{}) {
+	ops := fs.getOpsNoAdd(FolderBranch{Tlf: tlfID, Branch: MasterBranch})
+	// folderBranchOps makes a goroutine
+	ops.onMDSquash(doneCh, func(start MetadataRevision) {
+		fs.shutdownSquashedArchivedOps(ops.ctxWithFBOID(
+			context.Background()), tlfID, start)
+	})
+}
+
+// shutdownSquashedArchivedOps shuts down and forgets the archived
+// views of the given TLF pinned at revision start or later, since
+// those revisions were just squashed away, and their numbers will be
+// reused.  Any later request for one of them gets a new view.
+func (fs *KBFSOpsStandard) shutdownSquashedArchivedOps(
+	ctx context.Context, tlfID TlfID, start MetadataRevision) {
+	var squashedOps []*folderBranchOps
+	func() {
+		fs.opsLock.Lock()
+		defer fs.opsLock.Unlock()
+		for fb, ops := range fs.ops {
+			rev, ok := fb.Branch.RevisionIfSpecified()
+			if fb.Tlf != tlfID || !ok || rev < start {
+				continue
+			}
+			delete(fs.ops, fb)
+			squashedOps = append(squashedOps, ops)
+		}
+	}()
+
+	for _, ops := range squashedOps {
+		fs.log.CDebugf(ctx, "Shutting down squashed archived view %s",
+			ops.branch())
+		if err := ops.Shutdown(); err != nil {
+			fs.log.CDebugf(ctx, "Couldn't shut down %s: %v",
+				ops.branch(), err)
+		}
+	}
+}
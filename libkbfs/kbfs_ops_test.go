@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"runtime"
 	"testing"
 	"time"
 
@@ -3799,6 +3800,149 @@ func TestKBFSOpsTruncateRemovesABlock(t *testing.T) {
 		})
 }
 
+func TestKBFSOpsPunchHoleRemovesABlock(t *testing.T) {
+	mockCtrl, config, ctx := kbfsOpsInit(t, true)
+	defer kbfsTestShutdown(mockCtrl, config)
+
+	uid, id, rmd := injectNewRMD(t, config)
+
+	rootID := fakeBlockID(42)
+	fileID := fakeBlockID(43)
+	id1 := fakeBlockID(44)
+	id2 := fakeBlockID(45)
+	id3 := fakeBlockID(46)
+	rootBlock := NewDirBlock().(*DirBlock)
+	fileInfo := makeBIFromID(fileID, uid)
+	rootBlock.Children["f"] = DirEntry{
+		BlockInfo: fileInfo,
+		EntryInfo: EntryInfo{
+			Size: 15,
+		},
+	}
+	fileBlock := NewFileBlock().(*FileBlock)
+	fileBlock.IsInd = true
+	fileBlock.IPtrs = []IndirectFilePtr{
+		makeIFP(id1, rmd, config, uid, 5, 0),
+		makeIFP(id2, rmd, config, uid, 6, 5),
+		makeIFP(id3, rmd, config, uid, 7, 10),
+	}
+	block1 := NewFileBlock().(*FileBlock)
+	block1.Contents = []byte{5, 4, 3, 2, 1}
+	block2 := NewFileBlock().(*FileBlock)
+	block2.Contents = []byte{10, 9, 8, 7, 6}
+	node := pathNode{makeBP(rootID, rmd, config, uid), "p"}
+	fileNode := pathNode{makeBP(fileID, rmd, config, uid), "f"}
+	p := path{FolderBranch{Tlf: id}, []pathNode{node, fileNode}}
+	ops := getOps(config, id)
+	n := nodeFromPath(t, ops, p)
+	so, err := newSyncOp(fileInfo.BlockPointer)
+	require.NoError(t, err)
+	rmd.AddOp(so)
+
+	testPutBlockInCache(t, config, node.BlockPointer, id, rootBlock)
+	testPutBlockInCache(t, config, fileNode.BlockPointer, id, fileBlock)
+	testPutBlockInCache(t, config, fileBlock.IPtrs[0].BlockPointer, id, block1)
+	testPutBlockInCache(t, config, fileBlock.IPtrs[1].BlockPointer, id, block2)
+
+	// The third block doesn't overlap the range, so it's never
+	// fetched.
+	err = config.KBFSOps().PunchHole(ctx, n, 3, 7)
+	require.NoError(t, err)
+
+	newPBlock := getFileBlockFromCache(t, config, id, fileNode.BlockPointer,
+		p.Branch)
+	newBlock1 := getFileBlockFromCache(t, config, id,
+		fileBlock.IPtrs[0].BlockPointer, p.Branch)
+	require.Equal(t, []byte{5, 4, 3}, newBlock1.Contents)
+	require.Len(t, newPBlock.IPtrs, 2)
+	require.Equal(t, int64(10), newPBlock.IPtrs[1].Off)
+	require.Equal(t, DataVer(FilesWithHolesDataVer), newPBlock.DataVersion())
+
+	holes, err := config.KBFSOps().GetFileHoles(ctx, n)
+	require.NoError(t, err)
+	require.Equal(t, []FileHole{{Off: 3, Len: 7}}, holes)
+
+	lState := makeFBOLockState()
+
+	// merge unref changes so we can easily check the block changes
+	checkSyncOpInCache(t, config.Codec(), ops, fileNode.BlockPointer,
+		[]WriteRange{{Off: 3, Len: 7}})
+	mergeUnrefCache(ops, lState, p, rmd)
+	// The first block was modified, and the second one removed.
+	require.Equal(t, uint64(0+5+6), rmd.UnrefBytes())
+}
+
+func TestKBFSOpsPunchHoleDirtyBlocks(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	// Use the smallest possible block size, so the files are
+	// indirect.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	dbc := config.DirtyBlockCache().(*DirtyBlockCacheStandard)
+	numDirty := func() int {
+		dbc.lock.RLock()
+		defer dbc.lock.RUnlock()
+		return len(dbc.cache)
+	}
+	unsyncedBytes := func() int64 {
+		dbc.lock.RLock()
+		defer dbc.lock.RUnlock()
+		return dbc.waitBufBytes
+	}
+
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	expected := append([]byte(nil), data...)
+	for i := 10; i < 70; i++ {
+		expected[i] = 0
+	}
+
+	// "a" has been synced once, so its dirty blocks have old
+	// versions to unref; "b" has never been synced at all.
+	a, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, a, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, a)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, a, data, 0)
+	require.NoError(t, err)
+	b, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, b, data, 0)
+	require.NoError(t, err)
+
+	for _, n := range []Node{a, b} {
+		dirty := numDirty()
+		err = kbfsOps.PunchHole(ctx, n, 10, 60)
+		require.NoError(t, err)
+		// The dropped blocks are no longer dirty.
+		require.True(t, numDirty() < dirty)
+		holes, err := kbfsOps.GetFileHoles(ctx, n)
+		require.NoError(t, err)
+		require.NotEmpty(t, holes)
+		buf := make([]byte, len(data))
+		nr, err := kbfsOps.Read(ctx, n, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, expected, buf[:nr])
+		err = kbfsOps.Sync(ctx, n)
+		require.NoError(t, err)
+		nr, err = kbfsOps.Read(ctx, n, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, expected, buf[:nr])
+	}
+	require.Equal(t, int64(0), unsyncedBytes())
+}
+
 func TestKBFSOpsTruncateBiggerSuccess(t *testing.T) {
 	mockCtrl, config, ctx := kbfsOpsInit(t, true)
 	defer kbfsTestShutdown(mockCtrl, config)
@@ -5508,3 +5652,433 @@ func TestKBFSOpsMaliciousMDServerRange(t *testing.T) {
 	// have MDOps do the handle check, that'll trigger first.
 	require.IsType(t, MDPrevRootMismatch{}, err)
 }
+
+// Test that an archived root node reflects the state of the TLF at a
+// past revision, and can't be modified.
+func TestKBFSOpsArchivedRevision(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	clock, t0 := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "test_user", false)
+	require.NoError(t, err)
+	oldRev, err := kbfsOps.GetRevisionForTime(ctx, h, clock.Now())
+	require.NoError(t, err)
+
+	clock.Add(1 * time.Minute)
+	err = kbfsOps.Write(ctx, fileNode, []byte{2}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	// Times before the TLF existed don't resolve to anything.
+	_, err = kbfsOps.GetRevisionForTime(ctx, h, t0.Add(-1*time.Minute))
+	require.IsType(t, NoSuchMDError{}, err)
+
+	// The time between the two syncs resolves to the first one.
+	rev, err := kbfsOps.GetRevisionForTime(
+		ctx, h, clock.Now().Add(-30*time.Second))
+	require.NoError(t, err)
+	require.Equal(t, oldRev, rev)
+
+	archivedRoot, _, err := kbfsOps.GetArchivedRootNode(ctx, h, oldRev)
+	require.NoError(t, err)
+	require.Equal(t, MakeRevBranchName(oldRev),
+		archivedRoot.GetFolderBranch().Branch)
+	archivedFile, _, err := kbfsOps.Lookup(ctx, archivedRoot, "a")
+	require.NoError(t, err)
+
+	buf := make([]byte, 1)
+	_, err = kbfsOps.Read(ctx, archivedFile, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, buf)
+
+	_, err = kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{2}, buf)
+
+	err = kbfsOps.Write(ctx, archivedFile, []byte{3}, 0)
+	require.IsType(t, WriteToReadonlyNodeError{}, err)
+	_, _, err = kbfsOps.CreateFile(ctx, archivedRoot, "b", false, NoExcl)
+	require.IsType(t, WriteToReadonlyNodeError{}, err)
+
+	// Revisions beyond the head don't exist.
+	_, _, err = kbfsOps.GetArchivedRootNode(ctx, h, oldRev+100)
+	require.IsType(t, NoSuchMDError{}, err)
+}
+
+// Test that archived views are shut down once their nodes are no
+// longer in use.
+func TestKBFSOpsArchivedRevisionShutdownIdle(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps().(*KBFSOpsStandard)
+	_, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "test_user", false)
+	require.NoError(t, err)
+	// The create made the revision after the initial one.
+	rev := MetadataRevisionInitial + 1
+	archivedRoot, _, err := kbfsOps.GetArchivedRootNode(ctx, h, rev)
+	require.NoError(t, err)
+	fb := archivedRoot.GetFolderBranch()
+
+	hasOps := func() bool {
+		kbfsOps.opsLock.RLock()
+		defer kbfsOps.opsLock.RUnlock()
+		_, ok := kbfsOps.ops[fb]
+		return ok
+	}
+
+	// The view is kept while its root node is in use.
+	kbfsOps.shutdownIdleArchivedOps(ctx)
+	require.True(t, hasOps())
+	runtime.KeepAlive(archivedRoot)
+
+	// Once the node is collected, the view goes away.
+	archivedRoot = nil
+	for i := 0; i < 100 && hasOps(); i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+		kbfsOps.shutdownIdleArchivedOps(ctx)
+	}
+	require.False(t, hasOps())
+
+	// And it can be made again.
+	archivedRoot, _, err = kbfsOps.GetArchivedRootNode(ctx, h, rev)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.Lookup(ctx, archivedRoot, "a")
+	require.NoError(t, err)
+}
+
+func TestKBFSOpsXattrs(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+
+	names, err := kbfsOps.ListXattr(ctx, fileNode)
+	require.NoError(t, err)
+	require.Len(t, names, 0)
+	_, err = kbfsOps.GetXattr(ctx, fileNode, "user.x")
+	require.IsType(t, NoSuchXattrError{}, err)
+
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.y", []byte("y1"))
+	require.NoError(t, err)
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.x", []byte("x1"))
+	require.NoError(t, err)
+	err = kbfsOps.SetXattr(ctx, dirNode, "user.x", []byte("dir"))
+	require.NoError(t, err)
+
+	names, err = kbfsOps.ListXattr(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, []string{"user.x", "user.y"}, names)
+	value, err := kbfsOps.GetXattr(ctx, fileNode, "user.x")
+	require.NoError(t, err)
+	require.Equal(t, []byte("x1"), value)
+	value, err = kbfsOps.GetXattr(ctx, dirNode, "user.x")
+	require.NoError(t, err)
+	require.Equal(t, []byte("dir"), value)
+
+	err = kbfsOps.RemoveXattr(ctx, fileNode, "user.y")
+	require.NoError(t, err)
+	err = kbfsOps.RemoveXattr(ctx, fileNode, "user.y")
+	require.IsType(t, NoSuchXattrError{}, err)
+	names, err = kbfsOps.ListXattr(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, []string{"user.x"}, names)
+
+	// The TLF root has no parent entry to hold xattrs.
+	err = kbfsOps.SetXattr(ctx, rootNode, "user.x", []byte("root"))
+	require.IsType(t, InvalidParentPathError{}, err)
+
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.big",
+		make([]byte, maxXattrValueBytes+1))
+	require.IsType(t, XattrTooBigError{}, err)
+}
+
+func TestKBFSOpsCopyFileSharesBlocks(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	// Use the smallest possible block size, so the file is indirect.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+
+	srcNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	// Leave the write unsynced; CopyFile should sync it.
+	err = kbfsOps.Write(ctx, srcNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SetXattr(ctx, srcNode, "user.x", []byte("x"))
+	require.NoError(t, err)
+
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+	dstNode, ei, err := kbfsOps.CopyFile(ctx, srcNode, dirNode, "c")
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), ei.Size)
+
+	_, _, err = kbfsOps.CopyFile(ctx, srcNode, dirNode, "c")
+	require.IsType(t, NameExistsError{}, err)
+	_, _, err = kbfsOps.CopyFile(ctx, dirNode, rootNode, "d")
+	require.IsType(t, NotFileError{}, err)
+
+	buf := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, dstNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+	value, err := kbfsOps.GetXattr(ctx, dstNode, "user.x")
+	require.NoError(t, err)
+	require.Equal(t, []byte("x"), value)
+
+	// The children of the copy should be new references to the
+	// same blocks.
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	head := ops.getHead(lState)
+	srcInfos, err := ops.blocks.GetIndirectFileBlockInfos(
+		ctx, lState, head, ops.nodeCache.PathFromNode(srcNode))
+	require.NoError(t, err)
+	dstInfos, err := ops.blocks.GetIndirectFileBlockInfos(
+		ctx, lState, head, ops.nodeCache.PathFromNode(dstNode))
+	require.NoError(t, err)
+	require.True(t, len(srcInfos) > 1)
+	require.Equal(t, len(srcInfos), len(dstInfos))
+	for i := range srcInfos {
+		require.Equal(t, srcInfos[i].ID, dstInfos[i].ID)
+		require.NotEqual(t, srcInfos[i].RefNonce, dstInfos[i].RefNonce)
+	}
+
+	// Writing to the copy doesn't affect the source.
+	err = kbfsOps.Write(ctx, dstNode, []byte{255}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, dstNode)
+	require.NoError(t, err)
+	_, err = kbfsOps.Read(ctx, srcNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+}
+
+func TestKBFSOpsCopyFileSharesDirectBlock(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+
+	srcNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3, 4}
+	err = kbfsOps.Write(ctx, srcNode, data, 0)
+	require.NoError(t, err)
+	dstNode, _, err := kbfsOps.CopyFile(ctx, srcNode, rootNode, "b")
+	require.NoError(t, err)
+
+	// The copy's top block is a new reference to the same block.
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	srcPtr := ops.nodeCache.PathFromNode(srcNode).tailPointer()
+	dstPtr := ops.nodeCache.PathFromNode(dstNode).tailPointer()
+	require.Equal(t, srcPtr.ID, dstPtr.ID)
+	require.NotEqual(t, srcPtr.RefNonce, dstPtr.RefNonce)
+
+	// The copy survives the removal of the source.
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "a")
+	require.NoError(t, err)
+	config.ResetCaches()
+	rootNode = GetRootNodeOrBust(t, config, "test_user", false)
+	dstNode, _, err = kbfsOps.Lookup(ctx, rootNode, "b")
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, dstNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+}
+
+func TestKBFSOpsCopyFileIntoSharesBlocks(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+
+	srcNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, srcNode, data, 0)
+	require.NoError(t, err)
+
+	dstNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	size, err := kbfsOps.CopyFileInto(ctx, srcNode, dstNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), size)
+
+	buf := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, dstNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+	ei, err := kbfsOps.Stat(ctx, dstNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), ei.Size)
+
+	// The destination is no longer empty.
+	_, err = kbfsOps.CopyFileInto(ctx, srcNode, dstNode)
+	require.IsType(t, CopyIntoNonEmptyFileError{}, err)
+}
+
+func TestKBFSOpsCompressedBlocks(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+	config.SetDoBlockCompression(true)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := bytes.Repeat([]byte("kbfs"), 1000)
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	// Only blocks that were actually compressed are marked as such.
+	randNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	randData := make([]byte, 1000)
+	err = cryptoRandRead(randData)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, randNode, randData, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, randNode)
+	require.NoError(t, err)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	require.Equal(t, DataVer(CompressedBlocksDataVer),
+		ops.nodeCache.PathFromNode(fileNode).tailPointer().DataVer)
+	require.Equal(t, DataVer(FirstValidDataVer),
+		ops.nodeCache.PathFromNode(randNode).tailPointer().DataVer)
+
+	// Read it back from the server, rather than the cache.
+	config.ResetCaches()
+	buf := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+}
+
+func TestKBFSOpsOfflineOnlyOnConnectionErrors(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	fs := config.KBFSOps().(*KBFSOpsStandard)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+
+	// A failed command leaves the folder online.
+	fs.PushConnectionStatusChange(
+		MDServiceName, mdServerCommandError{errors.New("bad request")})
+	require.False(t, fs.isOffline())
+	require.False(t, ops.isOffline())
+
+	fs.PushConnectionStatusChange(MDServiceName, errDisconnected{})
+	require.True(t, fs.isOffline())
+	require.True(t, ops.isOffline())
+
+	fs.PushConnectionStatusChange(MDServiceName, nil)
+	require.False(t, fs.isOffline())
+	require.False(t, ops.isOffline())
+}
+
+func TestKBFSOpsOfflineMDCacheFallback(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+	config.SetMDServer(noUpdatesMDServer{config.MDServer()})
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	fs := config.KBFSOps().(*KBFSOpsStandard)
+	lState := makeFBOLockState()
+	head := getOps(config, fb.Tlf).getHead(lState)
+
+	// Replace the folder-branch with a new one, which has heard of
+	// the latest merged revision but doesn't have a head yet.
+	fs.PushConnectionStatusChange(MDServiceName, errDisconnected{})
+	oldOps := fs.getOpsNoAdd(fb)
+	fs.opsLock.Lock()
+	delete(fs.ops, fb)
+	fs.opsLock.Unlock()
+	err := oldOps.Shutdown()
+	require.NoError(t, err)
+	ops := fs.getOpsNoAdd(fb)
+	require.True(t, ops.isOffline())
+	ops.headLock.Lock(lState)
+	ops.latestMergedRevision = head.Revision()
+	ops.headLock.Unlock(lState)
+
+	// Without a cached copy, there's nothing to fall back on.
+	config.MDCache().Delete(fb.Tlf, head.Revision(), NullBranchID)
+	ops.mdWriterLock.Lock(lState)
+	_, err = ops.getMDLocked(ctx, lState, mdWrite)
+	ops.mdWriterLock.Unlock(lState)
+	require.IsType(t, OfflineUnavailableError{}, err)
+
+	// Without a journal, the offline folder-branch falls back to
+	// the cached copy of the latest merged revision.
+	err = config.MDCache().Put(head)
+	require.NoError(t, err)
+	ops.mdWriterLock.Lock(lState)
+	md, err := ops.getMDLocked(ctx, lState, mdWrite)
+	ops.mdWriterLock.Unlock(lState)
+	require.NoError(t, err)
+	require.Equal(t, head.mdID, md.mdID)
+}
@@ -545,7 +545,7 @@ func (k *KeybaseServiceBase) FSEditListRequest(ctx context.Context,
 			switch edit.Type {
 			case FileCreated:
 				nType = keybase1.FSNotificationType_FILE_CREATED
-			case FileModified:
+			case FileModified, FileAutoMerged:
 				nType = keybase1.FSNotificationType_FILE_MODIFIED
 			default:
 				k.log.CDebugf(ctx, "Bad notification type in edit history: %v",
@@ -34,8 +34,10 @@ type mdIDJournalEntry struct {
 	codec.UnknownFieldSetHandler
 }
 
-func makeMdIDJournal(codec kbfscodec.Codec, dir string) mdIDJournal {
-	j := makeDiskJournal(codec, dir, reflect.TypeOf(mdIDJournalEntry{}))
+func makeMdIDJournal(
+	codec kbfscodec.Codec, dir string, files journalFiles) mdIDJournal {
+	j := makeDiskJournal(
+		codec, dir, files, reflect.TypeOf(mdIDJournalEntry{}))
 	return mdIDJournal{j}
 }
 
@@ -204,6 +206,21 @@ func (j mdIDJournal) replaceHead(entry mdIDJournalEntry) error {
 	return j.j.writeJournalEntry(o, entry)
 }
 
+// replaceRange replaces the entries from the given revision onwards
+// with the given entry, which becomes the new head.
+func (j mdIDJournal) replaceRange(
+	r MetadataRevision, entry mdIDJournalEntry) error {
+	o, err := revisionToOrdinal(r)
+	if err != nil {
+		return err
+	}
+	err = j.j.removeLatestAfter(o)
+	if err != nil {
+		return err
+	}
+	return j.j.writeJournalEntry(o, entry)
+}
+
 func (j mdIDJournal) append(r MetadataRevision, entry mdIDJournalEntry) error {
 	o, err := revisionToOrdinal(r)
 	if err != nil {
@@ -106,6 +106,7 @@ type mdJournal struct {
 	codec  kbfscodec.Codec
 	crypto cryptoPure
 	dir    string
+	files  journalFiles
 
 	log      logger.Logger
 	deferLog logger.Logger
@@ -125,7 +126,8 @@ type mdJournal struct {
 
 func makeMDJournal(
 	uid keybase1.UID, key kbfscrypto.VerifyingKey, codec kbfscodec.Codec,
-	crypto cryptoPure, dir string, log logger.Logger) (*mdJournal, error) {
+	crypto cryptoPure, dir string, files journalFiles, log logger.Logger) (
+	*mdJournal, error) {
 	if uid == keybase1.UID("") {
 		return nil, errors.New("Empty user")
 	}
@@ -142,9 +144,10 @@ func makeMDJournal(
 		codec:    codec,
 		crypto:   crypto,
 		dir:      dir,
+		files:    files,
 		log:      log,
 		deferLog: deferLog,
-		j:        makeMdIDJournal(codec, journalDir),
+		j:        makeMdIDJournal(codec, journalDir, files),
 	}
 
 	earliest, err := journal.getEarliest(false)
@@ -207,7 +210,7 @@ func (j mdJournal) getMD(id MdID, verifyBranchID bool) (
 	BareRootMetadata, time.Time, error) {
 	// Read data.
 
-	data, err := ioutil.ReadFile(j.mdDataPath(id))
+	data, err := j.files.readFile(j.mdDataPath(id))
 	if err != nil {
 		return nil, time.Time{}, err
 	}
@@ -299,7 +302,7 @@ func (j mdJournal) putMD(rmd BareRootMetadata) (MdID, error) {
 
 	// TODO: Write version info.
 
-	err = ioutil.WriteFile(j.mdDataPath(id), buf, 0600)
+	err = j.files.writeFile(j.mdDataPath(id), buf)
 	if err != nil {
 		return MdID{}, err
 	}
@@ -310,7 +313,7 @@ func (j mdJournal) putMD(rmd BareRootMetadata) (MdID, error) {
 // removeMD removes the metadata (which must exist) with the given ID.
 func (j *mdJournal) removeMD(id MdID) error {
 	path := j.mdPath(id)
-	err := os.RemoveAll(path)
+	err := j.files.removeAll(path)
 	if err != nil {
 		return err
 	}
@@ -430,7 +433,7 @@ func (j *mdJournal) convertToBranch(
 	defer func() {
 		j.log.CDebugf(ctx, "Removing temp dir %s and %d old MDs",
 			journalTempDir, len(mdsToRemove))
-		removeErr := os.RemoveAll(journalTempDir)
+		removeErr := j.files.removeAll(journalTempDir)
 		if removeErr != nil {
 			j.log.CWarningf(ctx,
 				"Error when removing temp dir %s: %v",
@@ -448,7 +451,7 @@ func (j *mdJournal) convertToBranch(
 		}
 	}()
 
-	tempJournal := makeMdIDJournal(j.codec, journalTempDir)
+	tempJournal := makeMdIDJournal(j.codec, journalTempDir, j.files)
 
 	var prevID MdID
 
@@ -659,6 +662,20 @@ func getMdID(ctx context.Context, mdserver MDServer, crypto cryptoPure,
 	return crypto.MakeMdID(rmdses[0].MD)
 }
 
+// isMDOnServer returns whether the server already has the given MD,
+// with the given ID, at its revision.  It's meant to be called after
+// a put of the MD fails with a revision conflict, to tell a previous
+// flush of the same MD apart from a real conflict.
+func isMDOnServer(ctx context.Context, mdserver MDServer, crypto cryptoPure,
+	mdID MdID, rmds *RootMetadataSigned) (bool, error) {
+	headMdID, err := getMdID(ctx, mdserver, crypto, rmds.MD.TlfID(),
+		rmds.MD.BID(), rmds.MD.MergedStatus(), rmds.MD.RevisionNumber())
+	if err != nil {
+		return false, err
+	}
+	return headMdID != (MdID{}) && headMdID == mdID, nil
+}
+
 // All functions below are public functions.
 
 func (j mdJournal) readEarliestRevision() (MetadataRevision, error) {
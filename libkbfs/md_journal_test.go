@@ -65,7 +65,8 @@ func setupMDJournalTest(t *testing.T) (
 	}()
 
 	log := logger.NewTestLogger(t)
-	j, err = makeMDJournal(uid, verifyingKey, codec, crypto, tempdir, log)
+	j, err = makeMDJournal(
+		uid, verifyingKey, codec, crypto, tempdir, journalFiles{}, log)
 	require.NoError(t, err)
 
 	bsplit = &BlockSplitterSimple{64 * 1024, 8 * 1024}
@@ -696,7 +697,7 @@ func TestMDJournalRestart(t *testing.T) {
 		firstRevision, firstPrevRoot, mdCount, j)
 
 	// Restart journal.
-	j, err := makeMDJournal(j.uid, j.key, codec, crypto, j.dir, j.log)
+	j, err := makeMDJournal(j.uid, j.key, codec, crypto, j.dir, j.files, j.log)
 	require.NoError(t, err)
 
 	require.Equal(t, mdCount, getMDJournalLength(t, j))
@@ -735,7 +736,7 @@ func TestMDJournalRestartAfterBranchConversion(t *testing.T) {
 
 	// Restart journal.
 
-	j, err = makeMDJournal(j.uid, j.key, codec, crypto, j.dir, j.log)
+	j, err = makeMDJournal(j.uid, j.key, codec, crypto, j.dir, j.files, j.log)
 	require.NoError(t, err)
 
 	require.Equal(t, mdCount, getMDJournalLength(t, j))
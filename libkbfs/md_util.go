@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
@@ -175,6 +176,42 @@ func getSingleMD(ctx context.Context, config Config, id TlfID, bid BranchID,
 	return rmds[0], nil
 }
 
+// getMDRevisionForTime returns the most recent merged revision of the
+// given TLF, no newer than `head`, that was applied at the server at
+// or before the given time.  It does a binary search over the merged
+// history, so it fetches O(log n) MD objects via MDOps.GetRange.  If
+// the TLF didn't exist yet at the given time, it returns a
+// NoSuchMDError.
+func getMDRevisionForTime(ctx context.Context, config Config,
+	head ImmutableRootMetadata, t time.Time) (MetadataRevision, error) {
+	id := head.TlfID()
+	if !head.localTimestamp.After(t) {
+		return head.Revision(), nil
+	}
+
+	// Invariant: the revision at `lo` (if not uninitialized) is at
+	// or before `t`, and the revision at `hi` is after `t`.
+	lo := MetadataRevisionUninitialized
+	hi := head.Revision()
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		rmd, err := getSingleMD(ctx, config, id, NullBranchID, mid, Merged)
+		if err != nil {
+			return MetadataRevisionUninitialized, err
+		}
+		if rmd.localTimestamp.After(t) {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+
+	if lo < MetadataRevisionInitial {
+		return MetadataRevisionUninitialized, NoSuchMDError{id, lo, NullBranchID}
+	}
+	return lo, nil
+}
+
 // getMergedMDUpdates returns a slice of all the merged MDs for a TLF,
 // starting from the given startRev.  The returned MDs are the same
 // instances that are stored in the MD cache, so they should be
@@ -23,9 +23,10 @@ import (
 type mdServerDiskShared struct {
 	dirPath string
 
-	// Protects handleDb, branchDb, tlfStorage, and
-	// truncateLockManager. After Shutdown() is called, handleDb,
-	// branchDb, tlfStorage, and truncateLockManager are nil.
+	// Protects handleDb, branchDb, tlfStorage, truncateLockManager,
+	// and fileLockManager. After Shutdown() is called, handleDb,
+	// branchDb, tlfStorage, truncateLockManager, and fileLockManager
+	// are nil.
 	lock sync.RWMutex
 	// Bare TLF handle -> TLF ID
 	handleDb *leveldb.DB
@@ -35,6 +36,7 @@ type mdServerDiskShared struct {
 	// Always use memory for the lock storage, so it gets wiped
 	// after a restart.
 	truncateLockManager *mdServerLocalTruncateLockManager
+	fileLockManager     *mdServerLocalFileLockManager
 
 	updateManager *mdServerLocalUpdateManager
 
@@ -67,12 +69,14 @@ func newMDServerDisk(config mdServerLocalConfig, dirPath string,
 	}
 	log := config.MakeLogger("MDSD")
 	truncateLockManager := newMDServerLocalTruncatedLockManager()
+	fileLockManager := newMDServerLocalFileLockManager()
 	shared := mdServerDiskShared{
 		dirPath:             dirPath,
 		handleDb:            handleDb,
 		branchDb:            branchDb,
 		tlfStorage:          make(map[TlfID]*mdServerTlfStorage),
 		truncateLockManager: &truncateLockManager,
+		fileLockManager:     &fileLockManager,
 		updateManager:       newMDServerLocalUpdateManager(),
 		shutdownFunc:        shutdownFunc,
 	}
@@ -478,6 +482,42 @@ func (md *MDServerDisk) TruncateUnlock(ctx context.Context, id TlfID) (
 	return md.truncateLockManager.truncateUnlock(key.KID(), id)
 }
 
+// LockFile implements the MDServer interface for MDServerDisk.
+func (md *MDServerDisk) LockFile(ctx context.Context, id TlfID,
+	lockID string, owner string, exclusive bool) (time.Duration, error) {
+	key, err := md.config.currentInfoGetter().GetCurrentCryptPublicKey(ctx)
+	if err != nil {
+		return 0, MDServerError{err}
+	}
+
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	if md.fileLockManager == nil {
+		return 0, errMDServerDiskShutdown
+	}
+
+	return md.fileLockManager.lockFile(md.config.Clock().Now(), key.KID(),
+		id, lockID, owner, exclusive)
+}
+
+// UnlockFile implements the MDServer interface for MDServerDisk.
+func (md *MDServerDisk) UnlockFile(ctx context.Context, id TlfID,
+	lockID string, owner string) error {
+	key, err := md.config.currentInfoGetter().GetCurrentCryptPublicKey(ctx)
+	if err != nil {
+		return MDServerError{err}
+	}
+
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	if md.fileLockManager == nil {
+		return errMDServerDiskShutdown
+	}
+
+	md.fileLockManager.unlockFile(key.KID(), id, lockID, owner)
+	return nil
+}
+
 // Shutdown implements the MDServer interface for MDServerDisk.
 func (md *MDServerDisk) Shutdown() {
 	md.lock.Lock()
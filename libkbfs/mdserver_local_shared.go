@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfscodec"
@@ -95,6 +96,84 @@ func (m mdServerLocalTruncateLockManager) truncateUnlock(
 	return false, MDServerErrorLocked{}
 }
 
+// mdServerLocalFileLockTTL is how long a file lock lease lasts in
+// the local MD servers, unless it's renewed.
+const mdServerLocalFileLockTTL = 30 * time.Second
+
+type mdServerLocalFileLockKey struct {
+	tlfID  TlfID
+	lockID string
+}
+
+type mdServerLocalFileLockOwner struct {
+	deviceKID keybase1.KID
+	owner     string
+}
+
+type mdServerLocalFileLock struct {
+	exclusive bool
+	// Owner -> lease expiration time.
+	holders map[mdServerLocalFileLockOwner]time.Time
+}
+
+// mdServerLocalFileLockManager manages the advisory file lock leases
+// for a set of TLFs.  Note that it is not goroutine-safe.
+type mdServerLocalFileLockManager struct {
+	locksDb map[mdServerLocalFileLockKey]*mdServerLocalFileLock
+}
+
+func newMDServerLocalFileLockManager() mdServerLocalFileLockManager {
+	return mdServerLocalFileLockManager{
+		locksDb: make(
+			map[mdServerLocalFileLockKey]*mdServerLocalFileLock),
+	}
+}
+
+func (m mdServerLocalFileLockManager) lockFile(now time.Time,
+	deviceKID keybase1.KID, id TlfID, lockID string, owner string,
+	exclusive bool) (time.Duration, error) {
+	key := mdServerLocalFileLockKey{id, lockID}
+	lockOwner := mdServerLocalFileLockOwner{deviceKID, owner}
+	fl, ok := m.locksDb[key]
+	if !ok {
+		fl = &mdServerLocalFileLock{
+			holders: make(map[mdServerLocalFileLockOwner]time.Time),
+		}
+		m.locksDb[key] = fl
+	}
+
+	// Drop any expired leases first.
+	for o, expiry := range fl.holders {
+		if !now.Before(expiry) {
+			delete(fl.holders, o)
+		}
+	}
+
+	for o := range fl.holders {
+		if o != lockOwner && (exclusive || fl.exclusive) {
+			return 0, FileLockConflictError{lockID}
+		}
+	}
+
+	fl.exclusive = exclusive
+	fl.holders[lockOwner] = now.Add(mdServerLocalFileLockTTL)
+	return mdServerLocalFileLockTTL, nil
+}
+
+func (m mdServerLocalFileLockManager) unlockFile(
+	deviceKID keybase1.KID, id TlfID, lockID string, owner string) {
+	key := mdServerLocalFileLockKey{id, lockID}
+	fl, ok := m.locksDb[key]
+	if !ok {
+		// Already unlocked.
+		return
+	}
+	delete(fl.holders, mdServerLocalFileLockOwner{deviceKID, owner})
+	if len(fl.holders) == 0 {
+		delete(m.locksDb, key)
+	}
+}
+
 // mdServerLocalUpdateManager manages the observers for a set of TLFs
 // referenced by multiple mdServerLocal instances sharing the same
 // data. It is goroutine-safe.
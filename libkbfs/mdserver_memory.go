@@ -43,9 +43,9 @@ type mdBlockMemList struct {
 }
 
 type mdServerMemShared struct {
-	// Protects all *db variables and truncateLockManager. After
-	// Shutdown() is called, all *db variables and
-	// truncateLockManager are nil.
+	// Protects all *db variables, truncateLockManager, and
+	// fileLockManager. After Shutdown() is called, all *db
+	// variables, truncateLockManager, and fileLockManager are nil.
 	lock sync.RWMutex
 	// Bare TLF handle -> TLF ID
 	handleDb map[mdHandleKey]TlfID
@@ -60,6 +60,7 @@ type mdServerMemShared struct {
 	// (TLF ID, device KID) -> branch ID
 	branchDb            map[mdBranchKey]BranchID
 	truncateLockManager *mdServerLocalTruncateLockManager
+	fileLockManager     *mdServerLocalFileLockManager
 
 	updateManager *mdServerLocalUpdateManager
 }
@@ -85,6 +86,7 @@ func NewMDServerMemory(config mdServerLocalConfig) (*MDServerMemory, error) {
 	readerKeyBundleDb := make(map[TLFReaderKeyBundleID]*TLFReaderKeyBundleV3)
 	log := config.MakeLogger("MDSM")
 	truncateLockManager := newMDServerLocalTruncatedLockManager()
+	fileLockManager := newMDServerLocalFileLockManager()
 	shared := mdServerMemShared{
 		handleDb:            handleDb,
 		latestHandleDb:      latestHandleDb,
@@ -93,6 +95,7 @@ func NewMDServerMemory(config mdServerLocalConfig) (*MDServerMemory, error) {
 		writerKeyBundleDb:   writerKeyBundleDb,
 		readerKeyBundleDb:   readerKeyBundleDb,
 		truncateLockManager: &truncateLockManager,
+		fileLockManager:     &fileLockManager,
 		updateManager:       newMDServerLocalUpdateManager(),
 	}
 	mdserv := &MDServerMemory{config, log, &shared}
@@ -611,6 +614,42 @@ func (md *MDServerMemory) TruncateUnlock(ctx context.Context, id TlfID) (
 	return md.truncateLockManager.truncateUnlock(myKID, id)
 }
 
+// LockFile implements the MDServer interface for MDServerMemory.
+func (md *MDServerMemory) LockFile(ctx context.Context, id TlfID,
+	lockID string, owner string, exclusive bool) (time.Duration, error) {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	if md.fileLockManager == nil {
+		return 0, errMDServerMemoryShutdown
+	}
+
+	myKID, err := md.getCurrentDeviceKID(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return md.fileLockManager.lockFile(md.config.Clock().Now(), myKID, id,
+		lockID, owner, exclusive)
+}
+
+// UnlockFile implements the MDServer interface for MDServerMemory.
+func (md *MDServerMemory) UnlockFile(ctx context.Context, id TlfID,
+	lockID string, owner string) error {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	if md.fileLockManager == nil {
+		return errMDServerMemoryShutdown
+	}
+
+	myKID, err := md.getCurrentDeviceKID(ctx)
+	if err != nil {
+		return err
+	}
+
+	md.fileLockManager.unlockFile(myKID, id, lockID, owner)
+	return nil
+}
+
 // Shutdown implements the MDServer interface for MDServerMemory.
 func (md *MDServerMemory) Shutdown() {
 	md.lock.Lock()
@@ -619,6 +658,7 @@ func (md *MDServerMemory) Shutdown() {
 	md.latestHandleDb = nil
 	md.branchDb = nil
 	md.truncateLockManager = nil
+	md.fileLockManager = nil
 }
 
 // IsConnected implements the MDServer interface for MDServerMemory.
@@ -316,13 +316,21 @@ func (md *MDServerRemote) OnConnectError(err error, wait time.Duration) {
 	md.config.KBFSOps().PushConnectionStatusChange(MDServiceName, err)
 }
 
+// mdServerCommandError wraps an error from a single mdserver command
+// that's pushed as a connection status change, to tell it apart from
+// the connection itself going down.
+type mdServerCommandError struct {
+	error
+}
+
 // OnDoCommandError implements the ConnectionHandler interface.
 func (md *MDServerRemote) OnDoCommandError(err error, wait time.Duration) {
 	md.log.Warning("MDServerRemote: DoCommand error: %q; retrying in %s",
 		err, wait)
 	// Only push errors that should not be retried as connection status changes.
 	if !md.ShouldRetry("", err) {
-		md.config.KBFSOps().PushConnectionStatusChange(MDServiceName, err)
+		md.config.KBFSOps().PushConnectionStatusChange(
+			MDServiceName, mdServerCommandError{err})
 	}
 }
 
@@ -620,6 +628,19 @@ func (md *MDServerRemote) TruncateUnlock(ctx context.Context, id TlfID) (
 	return md.client.TruncateUnlock(ctx, id.String())
 }
 
+// LockFile implements the MDServer interface for MDServerRemote.
+// The mdserver protocol doesn't have file lock leases yet.
+func (md *MDServerRemote) LockFile(ctx context.Context, id TlfID,
+	lockID string, owner string, exclusive bool) (time.Duration, error) {
+	return 0, FileLocksUnsupportedError{}
+}
+
+// UnlockFile implements the MDServer interface for MDServerRemote.
+func (md *MDServerRemote) UnlockFile(ctx context.Context, id TlfID,
+	lockID string, owner string) error {
+	return FileLocksUnsupportedError{}
+}
+
 // GetLatestHandleForTLF implements the MDServer interface for MDServerRemote.
 func (md *MDServerRemote) GetLatestHandleForTLF(ctx context.Context, id TlfID) (
 	BareTlfHandle, error) {
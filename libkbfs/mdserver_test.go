@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"testing"
+	"time"
 
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfscodec"
@@ -194,3 +195,47 @@ func TestMDServerRegisterForUpdate(t *testing.T) {
 	_, err = mdServer.RegisterForUpdate(ctx, id2, MetadataRevisionInitial)
 	require.NoError(t, err)
 }
+
+func TestMDServerLocalFileLocks(t *testing.T) {
+	m := newMDServerLocalFileLockManager()
+	id := FakeTlfID(1, false)
+	kid1 := keybase1.KID("kid1")
+	kid2 := keybase1.KID("kid2")
+	now := time.Now()
+
+	// Shared locks from different devices don't conflict.
+	ttl, err := m.lockFile(now, kid1, id, "a", "o1", false)
+	require.NoError(t, err)
+	require.Equal(t, mdServerLocalFileLockTTL, ttl)
+	_, err = m.lockFile(now, kid2, id, "a", "o1", false)
+	require.NoError(t, err)
+
+	// But an exclusive one does, even for the same owner name on
+	// another device.
+	_, err = m.lockFile(now, kid1, id, "a", "o1", true)
+	require.Equal(t, FileLockConflictError{"a"}, err)
+
+	// Once the other device unlocks, the lock can be upgraded.
+	m.unlockFile(kid2, id, "a", "o1")
+	_, err = m.lockFile(now, kid1, id, "a", "o1", true)
+	require.NoError(t, err)
+	_, err = m.lockFile(now, kid1, id, "a", "o2", false)
+	require.Equal(t, FileLockConflictError{"a"}, err)
+
+	// Other lock IDs and TLFs are independent.
+	_, err = m.lockFile(now, kid2, id, "b", "o1", true)
+	require.NoError(t, err)
+	_, err = m.lockFile(now, kid2, FakeTlfID(2, false), "a", "o1", true)
+	require.NoError(t, err)
+
+	// An expired lease no longer conflicts.
+	later := now.Add(mdServerLocalFileLockTTL)
+	_, err = m.lockFile(later, kid2, id, "a", "o1", true)
+	require.NoError(t, err)
+	_, err = m.lockFile(later, kid1, id, "a", "o1", false)
+	require.Equal(t, FileLockConflictError{"a"}, err)
+
+	m.unlockFile(kid2, id, "a", "o1")
+	_, ok := m.locksDb[mdServerLocalFileLockKey{id, "a"}]
+	require.False(t, ok)
+}
@@ -177,7 +177,7 @@ func (s *mdServerTlfStorage) getOrCreateBranchJournalLocked(
 		return mdIDJournal{}, err
 	}
 
-	j = makeMdIDJournal(s.codec, dir)
+	j = makeMdIDJournal(s.codec, dir, journalFiles{})
 	s.branchJournals[bid] = j
 	return j, nil
 }
@@ -253,6 +253,29 @@ func (_mr *_MockKBFSOpsRecorder) GetRootNode(arg0, arg1, arg2 interface{}) *gomo
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetRootNode", arg0, arg1, arg2)
 }
 
+func (_m *MockKBFSOps) GetArchivedRootNode(ctx context.Context, h *TlfHandle, rev MetadataRevision) (Node, EntryInfo, error) {
+	ret := _m.ctrl.Call(_m, "GetArchivedRootNode", ctx, h, rev)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetArchivedRootNode(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetArchivedRootNode", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) GetRevisionForTime(ctx context.Context, h *TlfHandle, t time.Time) (MetadataRevision, error) {
+	ret := _m.ctrl.Call(_m, "GetRevisionForTime", ctx, h, t)
+	ret0, _ := ret[0].(MetadataRevision)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetRevisionForTime(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetRevisionForTime", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) GetDirChildren(ctx context.Context, dir Node) (map[string]EntryInfo, error) {
 	ret := _m.ctrl.Call(_m, "GetDirChildren", ctx, dir)
 	ret0, _ := ret[0].(map[string]EntryInfo)
@@ -322,6 +345,41 @@ func (_mr *_MockKBFSOpsRecorder) CreateLink(arg0, arg1, arg2, arg3 interface{})
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateLink", arg0, arg1, arg2, arg3)
 }
 
+func (_m *MockKBFSOps) CopyFile(ctx context.Context, src Node, dstDir Node, name string) (Node, EntryInfo, error) {
+	ret := _m.ctrl.Call(_m, "CopyFile", ctx, src, dstDir, name)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKBFSOpsRecorder) CopyFile(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CopyFile", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKBFSOps) CopyFileInto(ctx context.Context, src Node, dst Node) (uint64, error) {
+	ret := _m.ctrl.Call(_m, "CopyFileInto", ctx, src, dst)
+	ret0, _ := ret[0].(uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) CopyFileInto(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CopyFileInto", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) CreateHardLink(ctx context.Context, dir Node, name string, target Node) (Node, EntryInfo, error) {
+	ret := _m.ctrl.Call(_m, "CreateHardLink", ctx, dir, name, target)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKBFSOpsRecorder) CreateHardLink(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateHardLink", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockKBFSOps) RemoveDir(ctx context.Context, dir Node, dirName string) error {
 	ret := _m.ctrl.Call(_m, "RemoveDir", ctx, dir, dirName)
 	ret0, _ := ret[0].(error)
@@ -383,6 +441,27 @@ func (_mr *_MockKBFSOpsRecorder) Truncate(arg0, arg1, arg2 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Truncate", arg0, arg1, arg2)
 }
 
+func (_m *MockKBFSOps) GetFileHoles(ctx context.Context, file Node) ([]FileHole, error) {
+	ret := _m.ctrl.Call(_m, "GetFileHoles", ctx, file)
+	ret0, _ := ret[0].([]FileHole)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetFileHoles(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetFileHoles", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) PunchHole(ctx context.Context, file Node, off uint64, length uint64) error {
+	ret := _m.ctrl.Call(_m, "PunchHole", ctx, file, off, length)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) PunchHole(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PunchHole", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockKBFSOps) SetEx(ctx context.Context, file Node, ex bool) error {
 	ret := _m.ctrl.Call(_m, "SetEx", ctx, file, ex)
 	ret0, _ := ret[0].(error)
@@ -403,6 +482,48 @@ func (_mr *_MockKBFSOpsRecorder) SetMtime(arg0, arg1, arg2 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMtime", arg0, arg1, arg2)
 }
 
+func (_m *MockKBFSOps) SetXattr(ctx context.Context, node Node, name string, value []byte) error {
+	ret := _m.ctrl.Call(_m, "SetXattr", ctx, node, name, value)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetXattr(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetXattr", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKBFSOps) GetXattr(ctx context.Context, node Node, name string) ([]byte, error) {
+	ret := _m.ctrl.Call(_m, "GetXattr", ctx, node, name)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetXattr(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetXattr", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) ListXattr(ctx context.Context, node Node) ([]string, error) {
+	ret := _m.ctrl.Call(_m, "ListXattr", ctx, node)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) ListXattr(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ListXattr", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) RemoveXattr(ctx context.Context, node Node, name string) error {
+	ret := _m.ctrl.Call(_m, "RemoveXattr", ctx, node, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) RemoveXattr(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RemoveXattr", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) Sync(ctx context.Context, file Node) error {
 	ret := _m.ctrl.Call(_m, "Sync", ctx, file)
 	ret0, _ := ret[0].(error)
@@ -413,6 +534,58 @@ func (_mr *_MockKBFSOpsRecorder) Sync(arg0, arg1 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Sync", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) SetSyncPolicy(ctx context.Context, node Node, pinned bool) error {
+	ret := _m.ctrl.Call(_m, "SetSyncPolicy", ctx, node, pinned)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetSyncPolicy(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetSyncPolicy", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) LockFile(ctx context.Context, file Node, owner string, exclusive bool) error {
+	ret := _m.ctrl.Call(_m, "LockFile", ctx, file, owner, exclusive)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) LockFile(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "LockFile", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKBFSOps) UnlockFile(ctx context.Context, file Node, owner string) error {
+	ret := _m.ctrl.Call(_m, "UnlockFile", ctx, file, owner)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) UnlockFile(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UnlockFile", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) Watch(ctx context.Context, dir Node, recursive bool, fromRev MetadataRevision) (<-chan ChangeEvent, error) {
+	ret := _m.ctrl.Call(_m, "Watch", ctx, dir, recursive, fromRev)
+	ret0, _ := ret[0].(<-chan ChangeEvent)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) Watch(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Watch", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKBFSOps) BeginBatch(ctx context.Context, folderBranch FolderBranch) (Batch, error) {
+	ret := _m.ctrl.Call(_m, "BeginBatch", ctx, folderBranch)
+	ret0, _ := ret[0].(Batch)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) BeginBatch(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BeginBatch", arg0, arg1)
+}
+
 func (_m *MockKBFSOps) FolderStatus(ctx context.Context, folderBranch FolderBranch) (FolderBranchStatus, <-chan StatusUpdate, error) {
 	ret := _m.ctrl.Call(_m, "FolderStatus", ctx, folderBranch)
 	ret0, _ := ret[0].(FolderBranchStatus)
@@ -489,6 +662,17 @@ func (_mr *_MockKBFSOpsRecorder) GetEditHistory(arg0, arg1 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetEditHistory", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) PreviewConflictResolution(ctx context.Context, folderBranch FolderBranch) (ConflictResolutionPreview, error) {
+	ret := _m.ctrl.Call(_m, "PreviewConflictResolution", ctx, folderBranch)
+	ret0, _ := ret[0].(ConflictResolutionPreview)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) PreviewConflictResolution(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PreviewConflictResolution", arg0, arg1)
+}
+
 func (_m *MockKBFSOps) GetNodeMetadata(ctx context.Context, node Node) (NodeMetadata, error) {
 	ret := _m.ctrl.Call(_m, "GetNodeMetadata", ctx, node)
 	ret0, _ := ret[0].(NodeMetadata)
@@ -518,7 +702,58 @@ func (_mr *_MockKBFSOpsRecorder) PushConnectionStatusChange(arg0, arg1 interface
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "PushConnectionStatusChange", arg0, arg1)
 }
 
+// Mock of Batch interface
+type MockBatch struct {
+	ctrl     *gomock.Controller
+	recorder *_MockBatchRecorder
+}
+
+// Recorder for MockBatch (not exported)
+type _MockBatchRecorder struct {
+	mock *MockBatch
+}
+
+func NewMockBatch(ctrl *gomock.Controller) *MockBatch {
+	mock := &MockBatch{ctrl: ctrl}
+	mock.recorder = &_MockBatchRecorder{mock}
+	return mock
+}
+
+func (_m *MockBatch) EXPECT() *_MockBatchRecorder {
+	return _m.recorder
+}
+
+func (_m *MockBatch) Context(ctx context.Context) context.Context {
+	ret := _m.ctrl.Call(_m, "Context", ctx)
+	ret0, _ := ret[0].(context.Context)
+	return ret0
+}
+
+func (_mr *_MockBatchRecorder) Context(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Context", arg0)
+}
+
 // Mock of KeybaseService interface
+func (_m *MockBatch) Commit(ctx context.Context) error {
+	ret := _m.ctrl.Call(_m, "Commit", ctx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockBatchRecorder) Commit(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Commit", arg0)
+}
+
+func (_m *MockBatch) Abort(ctx context.Context) error {
+	ret := _m.ctrl.Call(_m, "Abort", ctx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockBatchRecorder) Abort(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Abort", arg0)
+}
+
 type MockKeybaseService struct {
 	ctrl     *gomock.Controller
 	recorder *_MockKeybaseServiceRecorder
@@ -1501,6 +1736,205 @@ func (_mr *_MockBlockCacheRecorder) DeleteKnownPtr(arg0, arg1 interface{}) *gomo
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DeleteKnownPtr", arg0, arg1)
 }
 
+// Mock of DiskBlockCache interface
+type MockDiskBlockCache struct {
+	ctrl     *gomock.Controller
+	recorder *_MockDiskBlockCacheRecorder
+}
+
+// Recorder for MockDiskBlockCache (not exported)
+type _MockDiskBlockCacheRecorder struct {
+	mock *MockDiskBlockCache
+}
+
+func NewMockDiskBlockCache(ctrl *gomock.Controller) *MockDiskBlockCache {
+	mock := &MockDiskBlockCache{ctrl: ctrl}
+	mock.recorder = &_MockDiskBlockCacheRecorder{mock}
+	return mock
+}
+
+func (_m *MockDiskBlockCache) EXPECT() *_MockDiskBlockCacheRecorder {
+	return _m.recorder
+}
+
+func (_m *MockDiskBlockCache) Get(ctx context.Context, tlfID TlfID, blockID BlockID) ([]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
+	ret := _m.ctrl.Call(_m, "Get", ctx, tlfID, blockID)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(kbfscrypto.BlockCryptKeyServerHalf)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockDiskBlockCacheRecorder) Get(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Get", arg0, arg1, arg2)
+}
+
+func (_m *MockDiskBlockCache) Put(ctx context.Context, tlfID TlfID, blockID BlockID, buf []byte, serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
+	ret := _m.ctrl.Call(_m, "Put", ctx, tlfID, blockID, buf, serverHalf)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDiskBlockCacheRecorder) Put(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Put", arg0, arg1, arg2, arg3, arg4)
+}
+
+func (_m *MockDiskBlockCache) Delete(ctx context.Context, tlfID TlfID, blockIDs []BlockID) error {
+	ret := _m.ctrl.Call(_m, "Delete", ctx, tlfID, blockIDs)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDiskBlockCacheRecorder) Delete(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Delete", arg0, arg1, arg2)
+}
+
+func (_m *MockDiskBlockCache) SetPinnedBlocks(ctx context.Context, tlfID TlfID, blockIDs []BlockID) (int, error) {
+	ret := _m.ctrl.Call(_m, "SetPinnedBlocks", ctx, tlfID, blockIDs)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDiskBlockCacheRecorder) SetPinnedBlocks(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetPinnedBlocks", arg0, arg1, arg2)
+}
+
+func (_m *MockDiskBlockCache) UpdatePinnedBlocks(ctx context.Context, tlfID TlfID, pin []BlockID, unpin []BlockID) (int, error) {
+	ret := _m.ctrl.Call(_m, "UpdatePinnedBlocks", ctx, tlfID, pin, unpin)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDiskBlockCacheRecorder) UpdatePinnedBlocks(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UpdatePinnedBlocks", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockDiskBlockCache) GetPinnedPaths(ctx context.Context, tlfID TlfID) ([]string, error) {
+	ret := _m.ctrl.Call(_m, "GetPinnedPaths", ctx, tlfID)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDiskBlockCacheRecorder) GetPinnedPaths(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetPinnedPaths", arg0, arg1)
+}
+
+func (_m *MockDiskBlockCache) SetPinnedPaths(ctx context.Context, tlfID TlfID, paths []string) error {
+	ret := _m.ctrl.Call(_m, "SetPinnedPaths", ctx, tlfID, paths)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDiskBlockCacheRecorder) SetPinnedPaths(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetPinnedPaths", arg0, arg1, arg2)
+}
+
+func (_m *MockDiskBlockCache) Shutdown(ctx context.Context) {
+	_m.ctrl.Call(_m, "Shutdown", ctx)
+}
+
+func (_mr *_MockDiskBlockCacheRecorder) Shutdown(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Shutdown", arg0)
+}
+
+// Mock of ConflictHistory interface
+type MockConflictHistory struct {
+	ctrl     *gomock.Controller
+	recorder *_MockConflictHistoryRecorder
+}
+
+// Recorder for MockConflictHistory (not exported)
+type _MockConflictHistoryRecorder struct {
+	mock *MockConflictHistory
+}
+
+func NewMockConflictHistory(ctrl *gomock.Controller) *MockConflictHistory {
+	mock := &MockConflictHistory{ctrl: ctrl}
+	mock.recorder = &_MockConflictHistoryRecorder{mock}
+	return mock
+}
+
+func (_m *MockConflictHistory) EXPECT() *_MockConflictHistoryRecorder {
+	return _m.recorder
+}
+
+func (_m *MockConflictHistory) Add(ctx context.Context, tlfID TlfID, entry ConflictHistoryEntry) error {
+	ret := _m.ctrl.Call(_m, "Add", ctx, tlfID, entry)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockConflictHistoryRecorder) Add(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Add", arg0, arg1, arg2)
+}
+
+func (_m *MockConflictHistory) Get(ctx context.Context, tlfID TlfID) ([]ConflictHistoryEntry, error) {
+	ret := _m.ctrl.Call(_m, "Get", ctx, tlfID)
+	ret0, _ := ret[0].([]ConflictHistoryEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockConflictHistoryRecorder) Get(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Get", arg0, arg1)
+}
+
+// Mock of Prefetcher interface
+type MockPrefetcher struct {
+	ctrl     *gomock.Controller
+	recorder *_MockPrefetcherRecorder
+}
+
+// Recorder for MockPrefetcher (not exported)
+type _MockPrefetcherRecorder struct {
+	mock *MockPrefetcher
+}
+
+func NewMockPrefetcher(ctrl *gomock.Controller) *MockPrefetcher {
+	mock := &MockPrefetcher{ctrl: ctrl}
+	mock.recorder = &_MockPrefetcherRecorder{mock}
+	return mock
+}
+
+func (_m *MockPrefetcher) EXPECT() *_MockPrefetcherRecorder {
+	return _m.recorder
+}
+
+func (_m *MockPrefetcher) PrefetchBlock(block Block, ptr BlockPointer, kmd KeyMetadata) {
+	_m.ctrl.Call(_m, "PrefetchBlock", block, ptr, kmd)
+}
+
+func (_mr *_MockPrefetcherRecorder) PrefetchBlock(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PrefetchBlock", arg0, arg1, arg2)
+}
+
+func (_m *MockPrefetcher) PrefetchAfterRead(parent *FileBlock, idx int, kmd KeyMetadata) {
+	_m.ctrl.Call(_m, "PrefetchAfterRead", parent, idx, kmd)
+}
+
+func (_mr *_MockPrefetcherRecorder) PrefetchAfterRead(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PrefetchAfterRead", arg0, arg1, arg2)
+}
+
+func (_m *MockPrefetcher) PrefetchDirChildren(dblock *DirBlock, kmd KeyMetadata) {
+	_m.ctrl.Call(_m, "PrefetchDirChildren", dblock, kmd)
+}
+
+func (_mr *_MockPrefetcherRecorder) PrefetchDirChildren(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PrefetchDirChildren", arg0, arg1)
+}
+
+func (_m *MockPrefetcher) Shutdown() {
+	_m.ctrl.Call(_m, "Shutdown")
+}
+
+func (_mr *_MockPrefetcherRecorder) Shutdown() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Shutdown")
+}
+
 // Mock of DirtyBlockCache interface
 type MockDirtyBlockCache struct {
 	ctrl     *gomock.Controller
@@ -1869,6 +2303,18 @@ func (_mr *_MockcryptoPureRecorder) EncryptBlock(arg0, arg1 interface{}) *gomock
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlock", arg0, arg1)
 }
 
+func (_m *MockcryptoPure) EncryptBlockCompressed(block Block, key kbfscrypto.BlockCryptKey) (int, EncryptedBlock, error) {
+	ret := _m.ctrl.Call(_m, "EncryptBlockCompressed", block, key)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(EncryptedBlock)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockcryptoPureRecorder) EncryptBlockCompressed(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlockCompressed", arg0, arg1)
+}
+
 func (_m *MockcryptoPure) DecryptBlock(encryptedBlock EncryptedBlock, key kbfscrypto.BlockCryptKey, block Block) error {
 	ret := _m.ctrl.Call(_m, "DecryptBlock", encryptedBlock, key, block)
 	ret0, _ := ret[0].(error)
@@ -2242,6 +2688,18 @@ func (_mr *_MockCryptoRecorder) EncryptBlock(arg0, arg1 interface{}) *gomock.Cal
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlock", arg0, arg1)
 }
 
+func (_m *MockCrypto) EncryptBlockCompressed(block Block, key kbfscrypto.BlockCryptKey) (int, EncryptedBlock, error) {
+	ret := _m.ctrl.Call(_m, "EncryptBlockCompressed", block, key)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(EncryptedBlock)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockCryptoRecorder) EncryptBlockCompressed(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlockCompressed", arg0, arg1)
+}
+
 func (_m *MockCrypto) DecryptBlock(encryptedBlock EncryptedBlock, key kbfscrypto.BlockCryptKey, block Block) error {
 	ret := _m.ctrl.Call(_m, "DecryptBlock", encryptedBlock, key, block)
 	ret0, _ := ret[0].(error)
@@ -2784,6 +3242,27 @@ func (_mr *_MockMDServerRecorder) TruncateUnlock(arg0, arg1 interface{}) *gomock
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "TruncateUnlock", arg0, arg1)
 }
 
+func (_m *MockMDServer) LockFile(ctx context.Context, id TlfID, lockID string, owner string, exclusive bool) (time.Duration, error) {
+	ret := _m.ctrl.Call(_m, "LockFile", ctx, id, lockID, owner, exclusive)
+	ret0, _ := ret[0].(time.Duration)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockMDServerRecorder) LockFile(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "LockFile", arg0, arg1, arg2, arg3, arg4)
+}
+
+func (_m *MockMDServer) UnlockFile(ctx context.Context, id TlfID, lockID string, owner string) error {
+	ret := _m.ctrl.Call(_m, "UnlockFile", ctx, id, lockID, owner)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockMDServerRecorder) UnlockFile(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UnlockFile", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockMDServer) DisableRekeyUpdatesForTesting() {
 	_m.ctrl.Call(_m, "DisableRekeyUpdatesForTesting")
 }
@@ -2970,6 +3449,27 @@ func (_mr *_MockmdServerLocalRecorder) TruncateUnlock(arg0, arg1 interface{}) *g
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "TruncateUnlock", arg0, arg1)
 }
 
+func (_m *MockmdServerLocal) LockFile(ctx context.Context, id TlfID, lockID string, owner string, exclusive bool) (time.Duration, error) {
+	ret := _m.ctrl.Call(_m, "LockFile", ctx, id, lockID, owner, exclusive)
+	ret0, _ := ret[0].(time.Duration)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockmdServerLocalRecorder) LockFile(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "LockFile", arg0, arg1, arg2, arg3, arg4)
+}
+
+func (_m *MockmdServerLocal) UnlockFile(ctx context.Context, id TlfID, lockID string, owner string) error {
+	ret := _m.ctrl.Call(_m, "UnlockFile", ctx, id, lockID, owner)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockmdServerLocalRecorder) UnlockFile(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UnlockFile", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockmdServerLocal) DisableRekeyUpdatesForTesting() {
 	_m.ctrl.Call(_m, "DisableRekeyUpdatesForTesting")
 }
@@ -3335,6 +3835,16 @@ func (_mr *_MockBlockSplitterRecorder) ShouldEmbedBlockChanges(arg0 interface{})
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "ShouldEmbedBlockChanges", arg0)
 }
 
+func (_m *MockBlockSplitter) DataVersion() DataVer {
+	ret := _m.ctrl.Call(_m, "DataVersion")
+	ret0, _ := ret[0].(DataVer)
+	return ret0
+}
+
+func (_mr *_MockBlockSplitterRecorder) DataVersion() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DataVersion")
+}
+
 // Mock of KeyServer interface
 type MockKeyServer struct {
 	ctrl     *gomock.Controller
@@ -3708,6 +4218,60 @@ func (_mr *_MockConfigRecorder) SetDirtyBlockCache(arg0 interface{}) *gomock.Cal
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDirtyBlockCache", arg0)
 }
 
+func (_m *MockConfig) DiskBlockCache() DiskBlockCache {
+	ret := _m.ctrl.Call(_m, "DiskBlockCache")
+	ret0, _ := ret[0].(DiskBlockCache)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) DiskBlockCache() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DiskBlockCache")
+}
+
+func (_m *MockConfig) SetDiskBlockCache(_param0 DiskBlockCache) {
+	_m.ctrl.Call(_m, "SetDiskBlockCache", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetDiskBlockCache(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDiskBlockCache", arg0)
+}
+
+func (_m *MockConfig) ConflictHistory() ConflictHistory {
+	ret := _m.ctrl.Call(_m, "ConflictHistory")
+	ret0, _ := ret[0].(ConflictHistory)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) ConflictHistory() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ConflictHistory")
+}
+
+func (_m *MockConfig) SetConflictHistory(_param0 ConflictHistory) {
+	_m.ctrl.Call(_m, "SetConflictHistory", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetConflictHistory(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetConflictHistory", arg0)
+}
+
+func (_m *MockConfig) Prefetcher() Prefetcher {
+	ret := _m.ctrl.Call(_m, "Prefetcher")
+	ret0, _ := ret[0].(Prefetcher)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) Prefetcher() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Prefetcher")
+}
+
+func (_m *MockConfig) SetPrefetcher(_param0 Prefetcher) {
+	_m.ctrl.Call(_m, "SetPrefetcher", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetPrefetcher(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetPrefetcher", arg0)
+}
+
 func (_m *MockConfig) Crypto() Crypto {
 	ret := _m.ctrl.Call(_m, "Crypto")
 	ret0, _ := ret[0].(Crypto)
@@ -4038,6 +4602,24 @@ func (_mr *_MockConfigRecorder) SetDoBackgroundFlushes(arg0 interface{}) *gomock
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDoBackgroundFlushes", arg0)
 }
 
+func (_m *MockConfig) DoBlockCompression() bool {
+	ret := _m.ctrl.Call(_m, "DoBlockCompression")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) DoBlockCompression() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DoBlockCompression")
+}
+
+func (_m *MockConfig) SetDoBlockCompression(_param0 bool) {
+	_m.ctrl.Call(_m, "SetDoBlockCompression", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetDoBlockCompression(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDoBlockCompression", arg0)
+}
+
 func (_m *MockConfig) RekeyWithPromptWaitTime() time.Duration {
 	ret := _m.ctrl.Call(_m, "RekeyWithPromptWaitTime")
 	ret0, _ := ret[0].(time.Duration)
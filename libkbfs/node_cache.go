@@ -237,6 +237,14 @@ func (ncs *nodeCacheStandard) Unlink(ref blockRef, oldPath path) {
 	return
 }
 
+// isEmpty returns true if none of the Nodes made by this cache are
+// still in use.
+func (ncs *nodeCacheStandard) isEmpty() bool {
+	ncs.lock.RLock()
+	defer ncs.lock.RUnlock()
+	return len(ncs.nodes) == 0
+}
+
 // PathFromNode implements the NodeCache interface for nodeCacheStandard.
 func (ncs *nodeCacheStandard) PathFromNode(node Node) (p path) {
 	ncs.lock.RLock()
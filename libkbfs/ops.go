@@ -600,6 +600,9 @@ type syncOp struct {
 	OpCommon
 	File   blockUpdate  `codec:"f"`
 	Writes []WriteRange `codec:"w"`
+	// AutoMerged is set when this sync wrote the result of an
+	// automatic text merge made by conflict resolution.
+	AutoMerged bool `codec:"am,omitempty"`
 }
 
 func newSyncOp(oldFile BlockPointer) (*syncOp, error) {
@@ -819,6 +822,7 @@ const (
 	exAttr attrChange = iota
 	mtimeAttr
 	sizeAttr // only used during conflict resolution
+	xattrAttr
 )
 
 func (ac attrChange) String() string {
@@ -829,6 +833,8 @@ func (ac attrChange) String() string {
 		return "mtime"
 	case sizeAttr:
 		return "size"
+	case xattrAttr:
+		return "xattr"
 	}
 	return "<invalid attrChange>"
 }
@@ -841,6 +847,11 @@ type setAttrOp struct {
 	Dir  blockUpdate  `codec:"d"`
 	Attr attrChange   `codec:"a"`
 	File BlockPointer `codec:"f"`
+
+	// XattrName is the name of the extended attribute that was set
+	// or removed, if Attr is xattrAttr.  The value itself lives only
+	// in the (encrypted) directory entry.
+	XattrName string `codec:"x,omitempty"`
 }
 
 func newSetAttrOp(name string, oldDir BlockPointer,
@@ -869,7 +880,7 @@ func (sao *setAttrOp) AddUpdate(oldPtr BlockPointer, newPtr BlockPointer) {
 }
 
 func (sao *setAttrOp) SizeExceptUpdates() uint64 {
-	return uint64(len(sao.Name))
+	return uint64(len(sao.Name) + len(sao.XattrName))
 }
 
 func (sao *setAttrOp) AllUpdates() []blockUpdate {
@@ -887,6 +898,10 @@ func (sao *setAttrOp) checkValid() error {
 }
 
 func (sao *setAttrOp) String() string {
+	if sao.Attr == xattrAttr {
+		return fmt.Sprintf("setAttr %s (%s %s)",
+			sao.Name, sao.Attr, sao.XattrName)
+	}
 	return fmt.Sprintf("setAttr %s (%s)", sao.Name, sao.Attr)
 }
 
@@ -894,6 +909,12 @@ func (sao *setAttrOp) CheckConflict(renamer ConflictRenamer, mergedOp op,
 	isFile bool) (crAction, error) {
 	switch realMergedOp := mergedOp.(type) {
 	case *setAttrOp:
+		if sao.Attr == xattrAttr {
+			// Extended attributes are merged per-key, with the
+			// unmerged value winning if both branches touched the
+			// same key, so there is never a conflict.
+			return nil, nil
+		}
 		if realMergedOp.Attr == sao.Attr {
 			var symPath string
 			var causedByAttr attrChange
@@ -924,11 +945,15 @@ func (sao *setAttrOp) CheckConflict(renamer ConflictRenamer, mergedOp op,
 }
 
 func (sao *setAttrOp) GetDefaultAction(mergedPath path) crAction {
-	return &copyUnmergedAttrAction{
+	action := &copyUnmergedAttrAction{
 		fromName: sao.getFinalPath().tailName(),
 		toName:   mergedPath.tailName(),
 		attr:     []attrChange{sao.Attr},
 	}
+	if sao.Attr == xattrAttr {
+		action.xattr = []string{sao.XattrName}
+	}
+	return action
 }
 
 // resolutionOp is an op that represents the block changes that took
@@ -1088,10 +1113,12 @@ func invertOpForLocalNotifications(oldOp op) (newOp op, err error) {
 		copy(so.Writes, op.Writes)
 		newOp = so
 	case *setAttrOp:
-		newOp, err = newSetAttrOp(op.Name, op.Dir.Ref, op.Attr, op.File)
+		sao, err := newSetAttrOp(op.Name, op.Dir.Ref, op.Attr, op.File)
 		if err != nil {
 			return nil, err
 		}
+		sao.XattrName = op.XattrName
+		newOp = sao
 	case *gcOp:
 		newOp = op
 	}
@@ -0,0 +1,201 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	// defaultPrefetchDepth is the default number of child blocks
+	// of an indirect file to fetch ahead of a sequential reader.
+	defaultPrefetchDepth = 8
+	// defaultPrefetchWorkers is the default number of blocks
+	// that can be fetched in parallel.
+	defaultPrefetchWorkers = 10
+)
+
+// CtxPrefetchTagKey is the type used for unique context tags within
+// the prefetcher.
+type CtxPrefetchTagKey int
+
+const (
+	// CtxPrefetchIDKey is the type of the tag for unique operation
+	// IDs within the prefetcher.
+	CtxPrefetchIDKey CtxPrefetchTagKey = iota
+)
+
+// CtxPrefetchID is the display name for the unique operation
+// prefetcher ID tag.
+const CtxPrefetchID = "PFID"
+
+type prefetchRequest struct {
+	block Block
+	ptr   BlockPointer
+	kmd   KeyMetadata
+}
+
+// blockPrefetcher implements the Prefetcher interface with a fixed
+// pool of workers fed by a bounded queue.  Prefetching is only ever
+// an optimization, so requests that don't fit in the queue are
+// dropped rather than blocking the caller.
+type blockPrefetcher struct {
+	config Config
+	log    logger.Logger
+	depth  int
+
+	requestCh  chan prefetchRequest
+	shutdownCh chan struct{}
+	doneCh     chan struct{}
+	cancel     context.CancelFunc
+
+	// inFlightLock protects inFlight.
+	inFlightLock sync.Mutex
+	inFlight     map[BlockID]bool
+	shutdownOnce sync.Once
+}
+
+var _ Prefetcher = (*blockPrefetcher)(nil)
+
+// NewBlockPrefetcher returns a Prefetcher that fetches up to depth
+// blocks ahead of a sequential reader, using the given number of
+// parallel workers.
+func NewBlockPrefetcher(config Config, depth, workers int) Prefetcher {
+	if workers <= 0 {
+		workers = 1
+	}
+	log := config.MakeLogger("PRE")
+	ctx, cancel := context.WithCancel(ctxWithRandomIDReplayable(
+		context.Background(), CtxPrefetchIDKey, CtxPrefetchID, log))
+	p := &blockPrefetcher{
+		config: config,
+		log:    log,
+		depth:  depth,
+		// Leave enough room to queue a full read-ahead window for
+		// a few files at once.
+		requestCh:  make(chan prefetchRequest, depth*workers+workers),
+		shutdownCh: make(chan struct{}),
+		doneCh:     make(chan struct{}),
+		cancel:     cancel,
+		inFlight:   make(map[BlockID]bool),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			p.run(ctx)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(p.doneCh)
+	}()
+	return p
+}
+
+func (p *blockPrefetcher) run(ctx context.Context) {
+	for {
+		select {
+		case req := <-p.requestCh:
+			p.fetch(ctx, req)
+		case <-p.shutdownCh:
+			return
+		}
+	}
+}
+
+func (p *blockPrefetcher) fetch(ctx context.Context, req prefetchRequest) {
+	defer func() {
+		p.inFlightLock.Lock()
+		defer p.inFlightLock.Unlock()
+		delete(p.inFlight, req.ptr.ID)
+	}()
+
+	if _, err := p.config.BlockCache().Get(req.ptr); err == nil {
+		return
+	}
+
+	err := p.config.BlockOps().Get(ctx, req.kmd, req.ptr, req.block)
+	if err != nil {
+		if ctx.Err() == nil {
+			p.log.CDebugf(ctx, "Couldn't prefetch block %v: %v",
+				req.ptr, err)
+		}
+		return
+	}
+
+	err = p.config.BlockCache().Put(
+		req.ptr, req.kmd.TlfID(), req.block, TransientEntry)
+	if err != nil {
+		p.log.CDebugf(ctx, "Couldn't cache prefetched block %v: %v",
+			req.ptr, err)
+	}
+}
+
+// PrefetchBlock implements the Prefetcher interface for
+// blockPrefetcher.
+func (p *blockPrefetcher) PrefetchBlock(
+	block Block, ptr BlockPointer, kmd KeyMetadata) {
+	select {
+	case <-p.shutdownCh:
+		return
+	default:
+	}
+
+	if _, err := p.config.BlockCache().Get(ptr); err == nil {
+		return
+	}
+
+	p.inFlightLock.Lock()
+	defer p.inFlightLock.Unlock()
+	if p.inFlight[ptr.ID] {
+		return
+	}
+	select {
+	case p.requestCh <- prefetchRequest{block, ptr, kmd}:
+		p.inFlight[ptr.ID] = true
+	default:
+		// The queue is full; just drop the request.
+	}
+}
+
+// PrefetchAfterRead implements the Prefetcher interface for
+// blockPrefetcher.
+func (p *blockPrefetcher) PrefetchAfterRead(
+	parent *FileBlock, idx int, kmd KeyMetadata) {
+	end := idx + 1 + p.depth
+	if end > len(parent.IPtrs) {
+		end = len(parent.IPtrs)
+	}
+	for i := idx + 1; i < end; i++ {
+		p.PrefetchBlock(NewFileBlock(), parent.IPtrs[i].BlockPointer, kmd)
+	}
+}
+
+// PrefetchDirChildren implements the Prefetcher interface for
+// blockPrefetcher.
+func (p *blockPrefetcher) PrefetchDirChildren(
+	dblock *DirBlock, kmd KeyMetadata) {
+	for _, de := range dblock.Children {
+		if de.Type != Dir || !de.BlockPointer.IsValid() {
+			continue
+		}
+		p.PrefetchBlock(NewDirBlock(), de.BlockPointer, kmd)
+	}
+}
+
+// Shutdown implements the Prefetcher interface for blockPrefetcher.
+func (p *blockPrefetcher) Shutdown() {
+	p.shutdownOnce.Do(func() {
+		close(p.shutdownCh)
+		p.cancel()
+	})
+	<-p.doneCh
+}
@@ -0,0 +1,108 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func prefetcherInit(t *testing.T) (mockCtrl *gomock.Controller,
+	config *ConfigMock) {
+	ctr := NewSafeTestReporter(t)
+	mockCtrl = gomock.NewController(ctr)
+	config = NewConfigMock(mockCtrl, ctr)
+	config.SetBlockCache(NewBlockCacheStandard(10, 1<<20))
+	return mockCtrl, config
+}
+
+func prefetcherShutdown(mockCtrl *gomock.Controller, config *ConfigMock) {
+	config.ctr.CheckForFailures()
+	mockCtrl.Finish()
+}
+
+// expectPrefetch expects a single fetch of the given pointer, and
+// sends the pointer on fetchedCh once it happens.
+func expectPrefetch(config *ConfigMock, kmd KeyMetadata, ptr BlockPointer,
+	fetchedCh chan<- BlockPointer) {
+	config.mockBops.EXPECT().Get(gomock.Any(), kmd, ptr, gomock.Any()).
+		Do(func(ctx context.Context, kmd KeyMetadata, ptr BlockPointer,
+			block Block) {
+			fetchedCh <- ptr
+		}).Return(nil)
+}
+
+func TestPrefetcherAfterRead(t *testing.T) {
+	mockCtrl, config := prefetcherInit(t)
+	defer prefetcherShutdown(mockCtrl, config)
+
+	kmd := makeKMD()
+	parent := NewFileBlock().(*FileBlock)
+	parent.IsInd = true
+	for i := byte(1); i <= 5; i++ {
+		parent.IPtrs = append(parent.IPtrs, IndirectFilePtr{
+			BlockInfo: BlockInfo{
+				BlockPointer: BlockPointer{ID: fakeBlockID(i)},
+			},
+			Off: int64(i-1) * 10,
+		})
+	}
+
+	// Block 3 is already cached, so only block 4 should be fetched
+	// out of the two following block 2.
+	cachedPtr := parent.IPtrs[2].BlockPointer
+	err := config.BlockCache().Put(
+		cachedPtr, kmd.TlfID(), NewFileBlock(), TransientEntry)
+	require.NoError(t, err)
+
+	fetchedCh := make(chan BlockPointer, 2)
+	expectPrefetch(config, kmd, parent.IPtrs[3].BlockPointer, fetchedCh)
+
+	p := NewBlockPrefetcher(config, 2, 1)
+	p.PrefetchAfterRead(parent, 1, kmd)
+	require.Equal(t, parent.IPtrs[3].BlockPointer, <-fetchedCh)
+	p.Shutdown()
+
+	_, err = config.BlockCache().Get(parent.IPtrs[3].BlockPointer)
+	require.NoError(t, err)
+	_, err = config.BlockCache().Get(parent.IPtrs[4].BlockPointer)
+	require.Equal(t, NoSuchBlockError{parent.IPtrs[4].ID}, err)
+}
+
+func TestPrefetcherDirChildren(t *testing.T) {
+	mockCtrl, config := prefetcherInit(t)
+	defer prefetcherShutdown(mockCtrl, config)
+
+	kmd := makeKMD()
+	dirPtr := BlockPointer{ID: fakeBlockID(1)}
+	filePtr := BlockPointer{ID: fakeBlockID(2)}
+	dblock := NewDirBlock().(*DirBlock)
+	dblock.Children["d"] = DirEntry{
+		BlockInfo: BlockInfo{BlockPointer: dirPtr},
+		EntryInfo: EntryInfo{Type: Dir},
+	}
+	dblock.Children["f"] = DirEntry{
+		BlockInfo: BlockInfo{BlockPointer: filePtr},
+		EntryInfo: EntryInfo{Type: File},
+	}
+
+	fetchedCh := make(chan BlockPointer, 1)
+	expectPrefetch(config, kmd, dirPtr, fetchedCh)
+
+	p := NewBlockPrefetcher(config, 2, 2)
+	p.PrefetchDirChildren(dblock, kmd)
+	require.Equal(t, dirPtr, <-fetchedCh)
+	p.Shutdown()
+
+	block, err := config.BlockCache().Get(dirPtr)
+	require.NoError(t, err)
+	require.IsType(t, &DirBlock{}, block)
+
+	// Nothing more can be fetched after shutdown.
+	p.PrefetchDirChildren(dblock, kmd)
+}
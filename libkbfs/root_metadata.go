@@ -68,6 +68,10 @@ type PrivateMetadata struct {
 	TLFPrivateKey kbfscrypto.TLFPrivateKey
 	// The block changes done as part of the update that created this MD
 	Changes BlockChanges
+	// HardLinks maps the ID of each group of hard-linked files to
+	// the paths of the links in that group, relative to the root
+	// directory.
+	HardLinks map[string][]string `codec:",omitempty"`
 
 	codec.UnknownFieldSetHandler
 
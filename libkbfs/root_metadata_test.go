@@ -72,6 +72,7 @@ func makeFakePrivateMetadataFuture(t *testing.T) privateMetadataFuture {
 				},
 				0,
 			},
+			map[string][]string{"fake link": {"a", "b/c"}},
 			codec.UnknownFieldSetHandler{},
 			BlockChanges{},
 		},
@@ -25,6 +25,10 @@ const (
 	FileCreated TlfEditNotificationType = iota
 	// FileModified indicates an existing file that was written to.
 	FileModified
+	// FileAutoMerged indicates an existing file that conflict
+	// resolution wrote to, after merging the text of two conflicting
+	// versions of it.
+	FileAutoMerged
 )
 
 // TlfEdit represents an individual update about a file edit within a
@@ -200,6 +204,14 @@ func (teh *TlfEditHistory) Wait(ctx context.Context) error {
 	return nil
 }
 
+// reset forgets the cached edit history, so that it's recalculated
+// from scratch the next time it's needed.
+func (teh *TlfEditHistory) reset() {
+	teh.lock.Lock()
+	defer teh.lock.Unlock()
+	teh.edits = nil
+}
+
 func (teh *TlfEditHistory) getEditsCopyLocked() TlfWriterEdits {
 	if teh.edits == nil {
 		return nil
@@ -312,6 +324,8 @@ outer:
 				t := FileModified
 				if chains.isCreated(ptr) {
 					t = FileCreated
+				} else if lastOp.(*syncOp).AutoMerged {
+					t = FileAutoMerged
 				}
 				edits[writer] = append(edits[writer], TlfEdit{
 					Filepath:  lastOp.getFinalPath().String(),
@@ -572,7 +586,7 @@ func (teh *TlfEditHistory) updateHistory(ctx context.Context,
 				n = fileCreateNotification(
 					cop.getFinalPath().ChildPathNoPtr(cop.NewName), writer,
 					edit.LocalTime)
-			case FileModified:
+			case FileModified, FileAutoMerged:
 				n = fileModifyNotification(
 					edit.cachedOp.getFinalPath(), writer, edit.LocalTime)
 			default:
@@ -8,10 +8,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
@@ -47,9 +47,16 @@ func (ca tlfJournalConfigAdapter) encryptionKeyGetter() encryptionKeyGetter {
 
 const (
 	// Maximum number of blocks that can be flushed in a single batch
-	// by the journal.  TODO: make this configurable, so that users
-	// can choose how much bandwidth is used by the journal.
+	// by the journal.  The bandwidth used by background flushes is
+	// limited separately, by JournalFlushLimit.
 	maxJournalBlockFlushBatchSize = 25
+	// Number of unflushed MD revisions that need to build up in the
+	// journal before a flush asks for them to be squashed.  TODO:
+	// make this configurable.
+	journalSquashThreshold = 100
+	// How long a flush waits for a requested squash before going
+	// ahead without it.
+	journalSquashTimeout = 30 * time.Second
 )
 
 // TLFJournalStatus represents the status of a TLF's journal for
@@ -62,6 +69,7 @@ type TLFJournalStatus struct {
 	BranchID       string
 	BlockOpCount   uint64
 	UnflushedBytes int64 // (signed because os.FileInfo.Size() is signed)
+	UnflushedFiles int64
 	UnflushedPaths []string
 }
 
@@ -136,10 +144,12 @@ type tlfJournal struct {
 	dir                 string
 	config              tlfJournalConfig
 	delegateBlockServer BlockServer
+	flushLimiter        *journalFlushLimiter
 	log                 logger.Logger
 	deferLog            logger.Logger
 	onBranchChange      branchChangeListener
 	onMDFlush           mdFlushListener
+	onMDSquash          mdSquashListener
 
 	// All the channels below are used as simple on/off
 	// signals. They're buffered for one object, and all sends are
@@ -168,6 +178,10 @@ type tlfJournal struct {
 	blockJournal *blockJournal
 	mdJournal    *mdJournal
 	disabled     bool
+	// The latest MD revision when a squash was last requested, so
+	// that a squash that can't be done isn't requested on every
+	// flush.
+	lastSquashRevision MetadataRevision
 
 	bwDelegate tlfJournalBWDelegate
 }
@@ -182,9 +196,9 @@ type tlfJournalInfo struct {
 	TlfID        TlfID
 }
 
-func readTLFJournalInfoFile(dir string) (
+func readTLFJournalInfoFile(dir string, files journalFiles) (
 	keybase1.UID, kbfscrypto.VerifyingKey, TlfID, error) {
-	infoJSON, err := ioutil.ReadFile(getTLFJournalInfoFilePath(dir))
+	infoJSON, err := files.readFile(getTLFJournalInfoFilePath(dir))
 	if err != nil {
 		return keybase1.UID(""), kbfscrypto.VerifyingKey{}, TlfID{}, err
 	}
@@ -198,8 +212,8 @@ func readTLFJournalInfoFile(dir string) (
 	return info.UID, info.VerifyingKey, info.TlfID, nil
 }
 
-func writeTLFJournalInfoFile(dir string, uid keybase1.UID,
-	key kbfscrypto.VerifyingKey, tlfID TlfID) error {
+func writeTLFJournalInfoFile(dir string, files journalFiles,
+	uid keybase1.UID, key kbfscrypto.VerifyingKey, tlfID TlfID) error {
 	info := tlfJournalInfo{uid, key, tlfID}
 	infoJSON, err := json.Marshal(info)
 	if err != nil {
@@ -211,15 +225,17 @@ func writeTLFJournalInfoFile(dir string, uid keybase1.UID,
 		return err
 	}
 
-	return ioutil.WriteFile(getTLFJournalInfoFilePath(dir), infoJSON, 0600)
+	return files.writeFile(getTLFJournalInfoFilePath(dir), infoJSON)
 }
 
 func makeTLFJournal(
 	ctx context.Context, uid keybase1.UID, key kbfscrypto.VerifyingKey,
-	dir string, tlfID TlfID, config tlfJournalConfig,
-	delegateBlockServer BlockServer, bws TLFJournalBackgroundWorkStatus,
-	bwDelegate tlfJournalBWDelegate, onBranchChange branchChangeListener,
-	onMDFlush mdFlushListener) (*tlfJournal, error) {
+	dir string, files journalFiles, tlfID TlfID, config tlfJournalConfig,
+	delegateBlockServer BlockServer, flushLimiter *journalFlushLimiter,
+	bws TLFJournalBackgroundWorkStatus, bwDelegate tlfJournalBWDelegate,
+	onBranchChange branchChangeListener, onMDFlush mdFlushListener,
+	onMDSquash mdSquashListener) (
+	*tlfJournal, error) {
 	if uid == keybase1.UID("") {
 		return nil, errors.New("Empty user")
 	}
@@ -230,11 +246,11 @@ func makeTLFJournal(
 		return nil, errors.New("Empty TlfID")
 	}
 
-	readUID, readKey, readTlfID, err := readTLFJournalInfoFile(dir)
+	readUID, readKey, readTlfID, err := readTLFJournalInfoFile(dir, files)
 	switch {
 	case os.IsNotExist(err):
 		// Info file doesn't exist, so write it.
-		err := writeTLFJournalInfoFile(dir, uid, key, tlfID)
+		err := writeTLFJournalInfoFile(dir, files, uid, key, tlfID)
 		if err != nil {
 			return nil, err
 		}
@@ -265,26 +281,30 @@ func makeTLFJournal(
 	log := config.MakeLogger("TLFJ")
 
 	blockJournal, err := makeBlockJournal(
-		ctx, config.Codec(), config.Crypto(), dir, log)
+		ctx, config.Codec(), config.Crypto(), dir, files, log)
 	if err != nil {
 		return nil, err
 	}
 
 	mdJournal, err := makeMDJournal(
-		uid, key, config.Codec(), config.Crypto(), dir, log)
+		uid, key, config.Codec(), config.Crypto(), dir, files, log)
 	if err != nil {
 		return nil, err
 	}
 
 	j := &tlfJournal{
+		uid:                  uid,
+		key:                  key,
 		tlfID:                tlfID,
 		dir:                  dir,
 		config:               config,
 		delegateBlockServer:  delegateBlockServer,
+		flushLimiter:         flushLimiter,
 		log:                  log,
 		deferLog:             log.CloneWithAddedDepth(1),
 		onBranchChange:       onBranchChange,
 		onMDFlush:            onMDFlush,
+		onMDSquash:           onMDSquash,
 		hasWorkCh:            make(chan struct{}, 1),
 		needPauseCh:          make(chan struct{}, 1),
 		needResumeCh:         make(chan struct{}, 1),
@@ -481,11 +501,30 @@ func (j *tlfJournal) doBackgroundWork(ctx context.Context) <-chan error {
 	// TODO: Handle panics.
 	go func() {
 		defer j.wg.Done()
-		errCh <- j.flush(ctx)
+		errCh <- j.flushInBackground(ctx)
 	}()
 	return errCh
 }
 
+// flushInBackground is like flush, but obeys the flush limit. It
+// waits for the flush window outside of flushLock, so that explicit
+// flushes aren't held up by it.
+func (j *tlfJournal) flushInBackground(ctx context.Context) error {
+	if j.flushLimiter == nil {
+		return j.flush(ctx)
+	}
+	for {
+		err := j.flushLimiter.waitForWindow(ctx)
+		if err != nil {
+			return err
+		}
+		err = j.flushLimited(ctx, j.flushLimiter)
+		if err != errJournalFlushWindowClosed {
+			return err
+		}
+	}
+}
+
 // We don't guarantee that pause/resume requests will be processed in
 // strict FIFO order. In particular, multiple pause requests are
 // collapsed into one (also multiple resume requests), so it's
@@ -527,9 +566,19 @@ func (j *tlfJournal) getJournalEnds(ctx context.Context) (
 	return blockEnd, mdEnd, nil
 }
 
-func (j *tlfJournal) flush(ctx context.Context) (err error) {
-	j.flushLock.Lock()
-	defer j.flushLock.Unlock()
+func (j *tlfJournal) flush(ctx context.Context) error {
+	return j.flushLimited(ctx, nil)
+}
+
+// flushLimited flushes the journal one batch of block entries at a
+// time.  If limiter is non-nil, the bytes of each batch are reserved
+// and waited for before taking flushLock, so that explicit flushes
+// aren't held up by the wait.
+func (j *tlfJournal) flushLimited(
+	ctx context.Context, limiter *journalFlushLimiter) (err error) {
+	// This must be done before taking flushLock, since squashing
+	// needs it.
+	j.squashIfNeeded(ctx)
 
 	flushedBlockEntries := 0
 	flushedMDEntries := 0
@@ -547,49 +596,112 @@ func (j *tlfJournal) flush(ctx context.Context) (err error) {
 	// block ops. See KBFS-1502.
 
 	for {
-		blockEnd, mdEnd, err := j.getJournalEnds(ctx)
+		var reserved int64
+		if limiter != nil {
+			reserved, err = j.waitForNextBlockEntries(ctx, limiter)
+			if err != nil {
+				return err
+			}
+		}
+
+		numBlocks, numMDs, done, err := j.flushOneBatch(
+			ctx, limiter, reserved)
+		flushedBlockEntries += numBlocks
+		flushedMDEntries += numMDs
 		if err != nil {
 			return err
 		}
-
-		if blockEnd == 0 && mdEnd == MetadataRevisionUninitialized {
-			j.log.CDebugf(ctx, "Nothing else to flush")
+		if done {
 			break
 		}
+	}
 
-		j.log.CDebugf(ctx, "Flushing up to blockEnd=%d and mdEnd=%d",
-			blockEnd, mdEnd)
+	j.log.CDebugf(ctx, "Flushed %d block entries and %d MD entries for %s",
+		flushedBlockEntries, flushedMDEntries, j.tlfID)
+	return nil
+}
 
-		// Flush the block journal ops in parallel.
-		numFlushed, maxMDRevToFlush, err := j.flushBlockEntries(ctx, blockEnd)
+// waitForNextBlockEntries reserves the bytes of the next batch of
+// block entries to flush on the given limiter, and waits until they
+// may be flushed.  It returns the number of bytes reserved.
+func (j *tlfJournal) waitForNextBlockEntries(
+	ctx context.Context, limiter *journalFlushLimiter) (int64, error) {
+	bytes, err := func() (int64, error) {
+		j.journalLock.RLock()
+		defer j.journalLock.RUnlock()
+		if err := j.checkEnabledLocked(); err != nil {
+			return 0, err
+		}
+		end, err := j.blockJournal.end()
 		if err != nil {
-			return err
+			return 0, err
 		}
-		flushedBlockEntries += numFlushed
+		return j.blockJournal.getNextEntriesToFlushBytes(
+			end, maxJournalBlockFlushBatchSize)
+	}()
+	if err != nil {
+		return 0, err
+	}
 
-		if numFlushed == 0 {
-			// There were no blocks to flush, so we can flush all of
-			// the remaining MDs.
-			maxMDRevToFlush = mdEnd
-		}
+	// Even with no blocks to flush, this keeps the MDs from being
+	// flushed outside the flush window.
+	err = limiter.wait(ctx, bytes)
+	if err != nil {
+		return 0, err
+	}
+	return bytes, nil
+}
 
-		// TODO: Flush MDs in batch.
+// flushOneBatch flushes the next batch of block entries, and then the
+// MDs that they allow to be flushed.  Any bytes in the batch beyond
+// the given number already reserved on limiter (if non-nil) are
+// reserved without waiting, which delays the next batch instead.  It
+// returns done == true if there was nothing left to flush.
+func (j *tlfJournal) flushOneBatch(ctx context.Context,
+	limiter *journalFlushLimiter, reserved int64) (
+	numBlocks, numMDs int, done bool, err error) {
+	j.flushLock.Lock()
+	defer j.flushLock.Unlock()
 
-		for {
-			flushed, err := j.flushOneMDOp(ctx, mdEnd, maxMDRevToFlush)
-			if err != nil {
-				return err
-			}
-			if !flushed {
-				break
-			}
-			flushedMDEntries++
-		}
+	blockEnd, mdEnd, err := j.getJournalEnds(ctx)
+	if err != nil {
+		return 0, 0, false, err
 	}
 
-	j.log.CDebugf(ctx, "Flushed %d block entries and %d MD entries for %s",
-		flushedBlockEntries, flushedMDEntries, j.tlfID)
-	return nil
+	if blockEnd == 0 && mdEnd == MetadataRevisionUninitialized {
+		j.log.CDebugf(ctx, "Nothing else to flush")
+		return 0, 0, true, nil
+	}
+
+	j.log.CDebugf(ctx, "Flushing up to blockEnd=%d and mdEnd=%d",
+		blockEnd, mdEnd)
+
+	// Flush the block journal ops in parallel.
+	numBlocks, maxMDRevToFlush, err := j.flushBlockEntries(
+		ctx, blockEnd, limiter, reserved)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	if numBlocks == 0 {
+		// There were no blocks to flush, so we can flush all of
+		// the remaining MDs.
+		maxMDRevToFlush = mdEnd
+	}
+
+	// TODO: Flush MDs in batch.
+
+	for {
+		flushed, err := j.flushOneMDOp(ctx, mdEnd, maxMDRevToFlush)
+		if err != nil {
+			return numBlocks, numMDs, false, err
+		}
+		if !flushed {
+			break
+		}
+		numMDs++
+	}
+	return numBlocks, numMDs, false, nil
 }
 
 var errTLFJournalShutdown = errors.New("tlfJournal is shutdown")
@@ -632,12 +744,19 @@ func (j *tlfJournal) removeFlushedBlockEntries(ctx context.Context,
 }
 
 func (j *tlfJournal) flushBlockEntries(
-	ctx context.Context, end journalOrdinal) (int, MetadataRevision, error) {
+	ctx context.Context, end journalOrdinal,
+	limiter *journalFlushLimiter, reserved int64) (
+	int, MetadataRevision, error) {
 	entries, maxMDRevToFlush, err := j.getNextBlockEntriesToFlush(ctx, end)
 	if err != nil {
 		return 0, MetadataRevisionUninitialized, err
 	}
 
+	// The batch may have grown since its bytes were reserved.
+	if bytes := entries.putBytes(); limiter != nil && bytes > reserved {
+		limiter.reserve(bytes - reserved)
+	}
+
 	if entries.length() == 0 {
 		return 0, maxMDRevToFlush, nil
 	}
@@ -739,18 +858,21 @@ func (j *tlfJournal) flushOneMDOp(
 	// MDv3 TODO: pass actual key bundles
 	pushErr := mdServer.Put(ctx, rmds, nil)
 	if isRevisionConflict(pushErr) {
-		headMdID, err := getMdID(ctx, mdServer, j.mdJournal.crypto,
-			rmds.MD.TlfID(), rmds.MD.BID(), rmds.MD.MergedStatus(),
-			rmds.MD.RevisionNumber())
+		// The server may already have this MD, e.g. if it was
+		// flushed before but not removed from the journal, or if
+		// it was flushed from an exported archive.
+		onServer, err := isMDOnServer(
+			ctx, mdServer, j.mdJournal.crypto, mdID, rmds)
 		if err != nil {
 			j.log.CWarningf(ctx,
 				"getMdID failed for TLF %s, BID %s, and revision %d: %v",
 				rmds.MD.TlfID(), rmds.MD.BID(), rmds.MD.RevisionNumber(), err)
-		} else if headMdID == mdID {
-			if headMdID == (MdID{}) {
-				panic("nil earliestID and revision conflict error returned by pushEarliestToServer")
-			}
+		} else if onServer {
 			// We must have already flushed this MD, so continue.
+			j.log.CDebugf(ctx, "Skipping MD for TLF=%s with id=%s, "+
+				"rev=%s, bid=%s, since the server already has it",
+				rmds.MD.TlfID(), mdID, rmds.MD.RevisionNumber(),
+				rmds.MD.BID())
 			pushErr = nil
 		} else if rmds.MD.MergedStatus() == Merged {
 			j.log.CDebugf(ctx, "Conflict detected %v", pushErr)
@@ -833,6 +955,7 @@ func (j *tlfJournal) getJournalStatus() (TLFJournalStatus, error) {
 		RevisionEnd:    latestRevision,
 		BlockOpCount:   blockEntryCount,
 		UnflushedBytes: j.blockJournal.unflushedBytes,
+		UnflushedFiles: j.blockJournal.unflushedFiles,
 	}, nil
 }
 
@@ -842,6 +965,14 @@ func (j *tlfJournal) getUnflushedBytes() int64 {
 	return j.blockJournal.unflushedBytes
 }
 
+// getUnflushedUsage returns the number of block bytes and block
+// files that still need to be flushed.
+func (j *tlfJournal) getUnflushedUsage() (bytes, files int64) {
+	j.journalLock.RLock()
+	defer j.journalLock.RUnlock()
+	return j.blockJournal.unflushedBytes, j.blockJournal.unflushedFiles
+}
+
 func (j *tlfJournal) shutdown() {
 	select {
 	case j.needShutdownCh <- struct{}{}:
@@ -224,8 +224,8 @@ func setupTLFJournalTest(
 	delegateBlockServer := NewBlockServerMemory(config)
 
 	tlfJournal, err = makeTLFJournal(ctx, uid, verifyingKey,
-		tempdir, config.tlfID, config, delegateBlockServer,
-		bwStatus, delegate, nil, nil)
+		tempdir, journalFiles{}, config.tlfID, config, delegateBlockServer,
+		nil, bwStatus, delegate, nil, nil, nil)
 	require.NoError(t, err)
 
 	switch bwStatus {
@@ -363,6 +363,39 @@ func putBlock(ctx context.Context,
 	require.NoError(t, err)
 }
 
+func TestTLFJournalFlushLimitDoesNotBlockFlush(t *testing.T) {
+	tempdir, config, ctx, cancel, tlfJournal, delegate :=
+		setupTLFJournalTest(t, TLFJournalBackgroundWorkPaused)
+	defer teardownTLFJournalTest(
+		tempdir, config, ctx, cancel, tlfJournal, delegate)
+
+	// Put the limiter deep into debt, so that the background flush
+	// has to wait.
+	limiter := newJournalFlushLimiter(
+		newTestClockNow(), logger.NewTestLogger(t))
+	limiter.setLimit(JournalFlushLimit{BytesPerSecond: 1})
+	limiter.reserve(1000)
+	tlfJournal.flushLimiter = limiter
+
+	putBlock(ctx, t, config, tlfJournal, []byte{1, 2, 3, 4})
+
+	bgCtx, bgCancel := context.WithCancel(ctx)
+	defer bgCancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- tlfJournal.flushInBackground(bgCtx)
+	}()
+	waitForLimiterTokens(ctx, t, limiter, 1-1000-4)
+
+	// An explicit flush doesn't wait for the background one.
+	err := tlfJournal.flush(ctx)
+	require.NoError(t, err)
+	requireJournalEntryCounts(t, tlfJournal, 0, 0)
+
+	bgCancel()
+	require.Equal(t, context.Canceled, <-errCh)
+}
+
 func TestTLFJournalBlockOpBasic(t *testing.T) {
 	tempdir, config, ctx, cancel, tlfJournal, delegate :=
 		setupTLFJournalTest(t, TLFJournalBackgroundWorkPaused)
@@ -370,7 +403,7 @@ func TestTLFJournalBlockOpBasic(t *testing.T) {
 		tempdir, config, ctx, cancel, tlfJournal, delegate)
 
 	putBlock(ctx, t, config, tlfJournal, []byte{1, 2, 3, 4})
-	numFlushed, rev, err := tlfJournal.flushBlockEntries(ctx, 1)
+	numFlushed, rev, err := tlfJournal.flushBlockEntries(ctx, 1, nil, 0)
 	require.NoError(t, err)
 	require.Equal(t, 1, numFlushed)
 	require.Equal(t, rev, MetadataRevisionUninitialized)
@@ -0,0 +1,215 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// These tests check that the conflict policy selected by a TLF is
+// used when resolving conflicting writes to the same file.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// bob and alice both write to the same file, and the merged write wins.
+func TestCrConflictPolicyMergedWins(t *testing.T) {
+	test(t,
+		users("alice", "bob"),
+		as(alice,
+			mkfile(libkbfs.ConflictPolicyFileName, "merged-wins"),
+			mkfile("a/b", "hello"),
+		),
+		as(bob,
+			disableUpdates(),
+		),
+		as(alice,
+			write("a/b", "world"),
+		),
+		as(bob, noSync(),
+			write("a/b", "uh oh"),
+			reenableUpdates(),
+			lsdir("a/", m{"b$": "FILE"}),
+			read("a/b", "world"),
+		),
+		as(alice,
+			lsdir("a/", m{"b$": "FILE"}),
+			read("a/b", "world"),
+		),
+	)
+}
+
+// bob and alice both write to the same file, and the unmerged write
+// wins.
+func TestCrConflictPolicyUnmergedWins(t *testing.T) {
+	test(t,
+		users("alice", "bob"),
+		as(alice,
+			mkfile(libkbfs.ConflictPolicyFileName, "unmerged-wins\n"),
+			mkfile("a/b", "hello"),
+		),
+		as(bob,
+			disableUpdates(),
+		),
+		as(alice,
+			write("a/b", "world"),
+		),
+		as(bob, noSync(),
+			write("a/b", "uh oh"),
+			reenableUpdates(),
+			lsdir("a/", m{"b$": "FILE"}),
+			read("a/b", "uh oh"),
+		),
+		as(alice,
+			lsdir("a/", m{"b$": "FILE"}),
+			read("a/b", "uh oh"),
+		),
+	)
+}
+
+// bob writes to a file after alice does, so bob's unmerged write wins.
+func TestCrConflictPolicyNewestMtimeWinsUnmerged(t *testing.T) {
+	test(t,
+		users("alice", "bob"),
+		as(alice,
+			mkfile(libkbfs.ConflictPolicyFileName, "newest-mtime-wins"),
+			mkfile("a/b", "hello"),
+		),
+		as(bob,
+			disableUpdates(),
+		),
+		as(alice,
+			write("a/b", "world"),
+		),
+		as(bob, noSync(),
+			addTime(1*time.Minute),
+			write("a/b", "uh oh"),
+			reenableUpdates(),
+			lsdir("a/", m{"b$": "FILE"}),
+			read("a/b", "uh oh"),
+		),
+		as(alice,
+			lsdir("a/", m{"b$": "FILE"}),
+			read("a/b", "uh oh"),
+		),
+	)
+}
+
+// alice writes to a file after bob does, so alice's merged write wins.
+func TestCrConflictPolicyNewestMtimeWinsMerged(t *testing.T) {
+	test(t,
+		users("alice", "bob"),
+		as(alice,
+			mkfile(libkbfs.ConflictPolicyFileName, "newest-mtime-wins"),
+			mkfile("a/b", "hello"),
+		),
+		as(bob,
+			disableUpdates(),
+		),
+		as(bob, noSync(),
+			write("a/b", "uh oh"),
+		),
+		as(alice,
+			addTime(1*time.Minute),
+			write("a/b", "world"),
+		),
+		as(bob, noSync(),
+			reenableUpdates(),
+			lsdir("a/", m{"b$": "FILE"}),
+			read("a/b", "world"),
+		),
+		as(alice,
+			lsdir("a/", m{"b$": "FILE"}),
+			read("a/b", "world"),
+		),
+	)
+}
+
+// An unknown policy name falls back to keeping both versions.
+func TestCrConflictPolicyUnknownKeepsBoth(t *testing.T) {
+	test(t,
+		users("alice", "bob"),
+		as(alice,
+			mkfile(libkbfs.ConflictPolicyFileName, "no-such-policy"),
+			mkfile("a/b", "hello"),
+		),
+		as(bob,
+			disableUpdates(),
+		),
+		as(alice,
+			write("a/b", "world"),
+		),
+		as(bob, noSync(),
+			write("a/b", "uh oh"),
+			reenableUpdates(),
+			lsdir("a/", m{"b$": "FILE", crnameEsc("b", bob): "FILE"}),
+			read("a/b", "world"),
+			read(crname("a/b", bob), "uh oh"),
+		),
+		as(alice,
+			lsdir("a/", m{"b$": "FILE", crnameEsc("b", bob): "FILE"}),
+			read("a/b", "world"),
+			read(crname("a/b", bob), "uh oh"),
+		),
+	)
+}
+
+// bob and alice write to different lines of the same text file, and
+// the two versions get merged.
+func TestCrConflictPolicyMergeText(t *testing.T) {
+	test(t,
+		users("alice", "bob"),
+		as(alice,
+			mkfile(libkbfs.ConflictPolicyFileName, "merge-text"),
+			mkfile("a/b", "1\n2\n3\n4\n5\n"),
+		),
+		as(bob,
+			disableUpdates(),
+		),
+		as(alice,
+			write("a/b", "A\n2\n3\n4\n5\n"),
+		),
+		as(bob, noSync(),
+			write("a/b", "1\n2\n3\n4\nE\n"),
+			reenableUpdates(),
+			lsdir("a/", m{"b$": "FILE"}),
+			read("a/b", "A\n2\n3\n4\nE\n"),
+		),
+		as(alice,
+			lsdir("a/", m{"b$": "FILE"}),
+			read("a/b", "A\n2\n3\n4\nE\n"),
+		),
+	)
+}
+
+// bob and alice write to the same line of a text file, so both
+// versions are kept.
+func TestCrConflictPolicyMergeTextOverlap(t *testing.T) {
+	test(t,
+		users("alice", "bob"),
+		as(alice,
+			mkfile(libkbfs.ConflictPolicyFileName, "merge-text"),
+			mkfile("a/b", "1\n2\n3\n4\n5\n"),
+		),
+		as(bob,
+			disableUpdates(),
+		),
+		as(alice,
+			write("a/b", "1\n2\nC\n4\n5\n"),
+		),
+		as(bob, noSync(),
+			write("a/b", "1\n2\nX\n4\n5\n"),
+			reenableUpdates(),
+			lsdir("a/", m{"b$": "FILE", crnameEsc("b", bob): "FILE"}),
+			read("a/b", "1\n2\nC\n4\n5\n"),
+			read(crname("a/b", bob), "1\n2\nX\n4\n5\n"),
+		),
+		as(alice,
+			lsdir("a/", m{"b$": "FILE", crnameEsc("b", bob): "FILE"}),
+			read("a/b", "1\n2\nC\n4\n5\n"),
+			read(crname("a/b", bob), "1\n2\nX\n4\n5\n"),
+		),
+	)
+}